@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"infinirewards/models"
+	"infinirewards/nats"
+	"infinirewards/utils"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	router := setupNATSTest(t)
+	ctx := context.Background()
+
+	admin := createTestAdminWithAuth(t, router)
+	token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+	// Creating an API key and using it are audited
+	reqBody, _ := json.Marshal(models.CreateAPIKeyRequest{Name: "Audited Key"})
+	req := httptest.NewRequest("POST", "/user/api-keys", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeader(req, token.AccessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if !assert.Equal(t, http.StatusCreated, w.Code, "Response body: %s", w.Body.String()) {
+		return
+	}
+	var apiKey models.APIKey
+	json.Unmarshal(w.Body.Bytes(), &apiKey)
+
+	updateBody, _ := json.Marshal(models.UpdateUserRequest{Name: "Audited Name"})
+	req = httptest.NewRequest("PUT", "/user", bytes.NewBuffer(updateBody))
+	req.Header.Set("Content-Type", "application/json")
+	assert.NoError(t, utils.SignRequest(req, apiKey.ID, apiKey.Secret))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+	t.Run("Admin Query", func(t *testing.T) {
+		var page models.Page[models.AuditEvent]
+		w := getPage(t, router, admin.Token.AccessToken, "/admin/audit?actor="+token.User, &page)
+		if !assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) || !assert.Len(t, page.Items, 2) {
+			return
+		}
+
+		created, updated := page.Items[0], page.Items[1]
+		assert.Equal(t, "POST /user/api-keys", created.Route)
+		assert.Equal(t, models.AuthMethodBearer, created.AuthMethod)
+		assert.Equal(t, http.StatusCreated, created.Status)
+		assert.Equal(t, models.AuditOutcomeSuccess, created.Outcome)
+		// The body is hashed whole although the handler streams it
+		expected := sha256.Sum256(append([]byte("POST /user/api-keys\n"), reqBody...))
+		assert.Equal(t, hex.EncodeToString(expected[:]), created.RequestHash)
+		assert.NotEmpty(t, created.IP)
+		assert.Empty(t, created.Merchant)
+
+		assert.Equal(t, "PUT /user", updated.Route)
+		assert.Equal(t, models.AuthMethodAPIKey, updated.AuthMethod)
+		assert.Equal(t, apiKey.ID, updated.APIKeyID)
+		assert.Greater(t, updated.Sequence, created.Sequence)
+		assert.NotEqual(t, created.RequestHash, updated.RequestHash)
+
+		// Reads are not audited
+		w = getPage(t, router, admin.Token.AccessToken, "/admin/audit?actor="+admin.User.ID, &page)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			for _, event := range page.Items {
+				assert.NotContains(t, event.Route, "GET ")
+			}
+		}
+	})
+
+	t.Run("Merchant Query", func(t *testing.T) {
+		merchant := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		user := &models.User{}
+		assert.NoError(t, user.GetUser(ctx, merchant.User))
+		grantTestRole(t, user, models.RoleMerchant)
+		merchant = refreshTestToken(t, router, merchant)
+
+		// A rejected mint is audited as a failure of the merchant
+		req := httptest.NewRequest("POST", "/points/mint", bytes.NewBufferString("{"))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, merchant.AccessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		var page models.Page[models.AuditEvent]
+		w = getPage(t, router, merchant.AccessToken, "/merchant/audit", &page)
+		if assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) && assert.Len(t, page.Items, 1) {
+			assert.Equal(t, "POST /points/mint", page.Items[0].Route)
+			assert.Equal(t, merchant.User, page.Items[0].Merchant)
+			assert.Equal(t, models.AuditOutcomeFailure, page.Items[0].Outcome)
+			assert.Equal(t, http.StatusBadRequest, page.Items[0].Status)
+		}
+
+		w = getPage(t, router, admin.Token.AccessToken, "/admin/audit?merchant="+merchant.User, &page)
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			assert.Len(t, page.Items, 1)
+		}
+
+		// Users without the permissions cannot read the audit log
+		for _, path := range []string{"/merchant/audit", "/admin/audit", "/admin/audit/verify"} {
+			w = getPage(t, router, token.AccessToken, path, nil)
+			assert.Equal(t, http.StatusForbidden, w.Code, path)
+		}
+	})
+
+	t.Run("Concurrent Appends", func(t *testing.T) {
+		// More appends than conflict retries run at once, and none is lost
+		const appends = 20
+		var wg sync.WaitGroup
+		errs := make([]error, appends)
+		events := make([]*models.AuditEvent, appends)
+		for i := range events {
+			events[i] = &models.AuditEvent{Actor: token.User, Route: "PUT /user", Status: http.StatusOK}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = models.RecordAuditEvent(ctx, events[i])
+			}(i)
+		}
+		wg.Wait()
+
+		sequences := map[uint64]bool{}
+		for i, event := range events {
+			assert.NoError(t, errs[i])
+			sequences[event.Sequence] = true
+		}
+		assert.Len(t, sequences, appends, "Every event should have its own sequence")
+	})
+
+	t.Run("Hash Chain", func(t *testing.T) {
+		var result models.AuditVerification
+		w := getPage(t, router, admin.Token.AccessToken, "/admin/audit/verify", &result)
+		if assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			assert.True(t, result.Valid, result.Reason)
+			assert.GreaterOrEqual(t, result.Checked, 3)
+		}
+
+		// An event written around the chain is detected
+		forged := models.AuditEvent{Sequence: result.LastSequence + 1, Actor: token.User, Route: "POST /points/burn", Status: http.StatusOK}
+		msg := natsgo.NewMsg(nats.AuditSubject("", token.User))
+		msg.Data, _ = json.Marshal(forged)
+		_, err := nats.PublishStream(ctx, msg)
+		assert.NoError(t, err)
+
+		w = getPage(t, router, admin.Token.AccessToken, "/admin/audit/verify", &result)
+		if assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			assert.False(t, result.Valid)
+			assert.Equal(t, forged.Sequence, result.BrokenAt)
+		}
+	})
+}
@@ -9,13 +9,11 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-	"time"
 
 	"infinirewards/models"
 	"infinirewards/nats"
+	"infinirewards/utils"
 
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,7 +24,7 @@ type TestUser struct {
 }
 
 // createTestUserWithAuth creates a test user following the proper auth flow
-func createTestUserWithAuth(t *testing.T, router *http.ServeMux) *TestUser {
+func createTestUserWithAuth(t *testing.T, router http.Handler) *TestUser {
 	testLogger.Printf("Starting test user creation flow")
 
 	// Generate test phone number
@@ -66,7 +64,7 @@ func createTestUserWithAuth(t *testing.T, router *http.ServeMux) *TestUser {
 }
 
 // requestOTPAndAuthenticate handles the OTP request and authentication flow
-func requestOTPAndAuthenticate(t *testing.T, router *http.ServeMux, phoneNumber string) *models.Token {
+func requestOTPAndAuthenticate(t *testing.T, router http.Handler, phoneNumber string) *models.Token {
 	// Request OTP
 	otpReq := models.RequestOTPRequest{
 		PhoneNumber: phoneNumber,
@@ -75,6 +73,9 @@ func requestOTPAndAuthenticate(t *testing.T, router *http.ServeMux, phoneNumber
 
 	req := httptest.NewRequest("POST", "/auth/request-otp", bytes.NewBuffer(reqBody))
 	req.Header.Set("Content-Type", "application/json")
+	// Each sign in comes from its own address, so the per IP limit, which
+	// the NATS store keeps across test runs, is not used up
+	req.RemoteAddr = generateTestRemoteAddr()
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
@@ -86,22 +87,7 @@ func requestOTPAndAuthenticate(t *testing.T, router *http.ServeMux, phoneNumber
 	assert.NoError(t, err, "Failed to unmarshal OTP response")
 	assert.NotEmpty(t, otpResp.ID, "OTP ID should not be empty")
 
-	// Get verification from NATS
-	entry, err := nats.GetKV(context.Background(), "phoneVerification", otpResp.ID)
-	assert.NoError(t, err, "Failed to get verification from NATS")
-
-	var verification models.PhoneNumberVerification
-	err = json.Unmarshal(entry.Value(), &verification)
-	assert.NoError(t, err, "Failed to unmarshal verification")
-
-	// Generate valid OTP using the secret
-	otp, err := totp.GenerateCodeCustom(verification.Secret, time.Now(), totp.ValidateOpts{
-		Period:    300,
-		Skew:      1,
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA512,
-	})
-	assert.NoError(t, err, "Failed to generate OTP")
+	otp := readTestOTP(t, otpResp.ID)
 
 	// Authenticate with valid OTP
 	authReq := models.AuthenticateRequest{
@@ -128,35 +114,151 @@ func requestOTPAndAuthenticate(t *testing.T, router *http.ServeMux, phoneNumber
 	return &authResp.Token
 }
 
+// readTestOTP returns the code sent for a verification from the file message sink
+func readTestOTP(t *testing.T, verificationID string) string {
+	return readTestMessage(t, verificationID).Code
+}
+
+// readTestMessage returns the last message sent for a verification from the file message sink
+func readTestMessage(t *testing.T, verificationID string) utils.FileSinkMessage {
+	messages, err := utils.ReadFileSink(testMessageSinkPath)
+	assert.NoError(t, err, "Failed to read message sink")
+
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Reference == verificationID {
+			return messages[i]
+		}
+	}
+
+	t.Errorf("No message sent for verification %s", verificationID)
+	return utils.FileSinkMessage{}
+}
+
+// startTestPhoneChange starts a phone number change and returns the stored change
+func startTestPhoneChange(t *testing.T, router http.Handler, path string, accessToken string, newPhoneNumber string) *models.PhoneChange {
+	reqBody, _ := json.Marshal(models.PhoneChangeRequest{NewPhoneNumber: newPhoneNumber})
+	req := httptest.NewRequest("POST", path, bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeader(req, accessToken)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Failed to start phone change. Response: %s", w.Body.String())
+
+	var changeResp models.PhoneChangeResponse
+	err := json.Unmarshal(w.Body.Bytes(), &changeResp)
+	assert.NoError(t, err, "Failed to unmarshal phone change response")
+
+	entry, err := nats.GetKV(context.Background(), "phoneChanges", changeResp.ID)
+	assert.NoError(t, err, "Failed to get phone change from NATS")
+
+	var change models.PhoneChange
+	err = json.Unmarshal(entry.Value(), &change)
+	assert.NoError(t, err, "Failed to unmarshal phone change")
+
+	return &change
+}
+
+// verifyTestPhoneChange submits the OTPs of a phone number change
+func verifyTestPhoneChange(router http.Handler, verifyReq models.VerifyPhoneChangeRequest) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(verifyReq)
+	req := httptest.NewRequest("POST", "/auth/phone-change/verify", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
 // createTestMerchantWithAuth creates a test merchant following the proper auth flow
-func createTestMerchantWithAuth(t *testing.T, router *http.ServeMux) *TestUser {
+func createTestMerchantWithAuth(t *testing.T, router http.Handler) *TestUser {
 	testLogger.Printf("Creating test merchant")
 
 	// First create a user with auth
 	testUser := createTestUserWithAuth(t, router)
 
+	// Merchants are created by an admin on behalf of the user
+	admin := createTestAdminWithAuth(t, router)
+
 	// Create merchant contract
 	merchantReq := models.CreateMerchantRequest{
 		Name:     testUser.User.Name,
 		Symbol:   "TST",
 		Decimals: 18,
+		UserID:   testUser.User.ID,
 	}
 	reqBody, _ := json.Marshal(merchantReq)
 
 	req := httptest.NewRequest("POST", "/merchant", bytes.NewBuffer(reqBody))
 	req.Header.Set("Content-Type", "application/json")
-	addAuthHeader(req, testUser.Token.AccessToken)
+	addAuthHeader(req, admin.Token.AccessToken)
 
 	w := httptest.NewRecorder()
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, http.StatusCreated, w.Code, "Failed to create merchant. Response: %s", w.Body.String())
 
+	// Pick up the merchant role
+	testUser.Token = refreshTestToken(t, router, testUser.Token)
+
 	testLogger.Printf("Created merchant for user ID: %s", testUser.User.ID)
 	return testUser
 }
 
+// createTestAdminWithAuth creates a user with the admin role and a token carrying it
+func createTestAdminWithAuth(t *testing.T, router http.Handler) *TestUser {
+	phoneNumber := generateTestPhoneNumber()
+	token := requestOTPAndAuthenticate(t, router, phoneNumber)
+
+	user := &models.User{}
+	err := user.GetUser(context.Background(), token.User)
+	assert.NoError(t, err, "Failed to get admin user")
+
+	grantTestRole(t, user, models.RoleAdmin)
+
+	return &TestUser{
+		User:  user,
+		Token: refreshTestToken(t, router, token),
+	}
+}
+
+// grantTestRole grants a role to a user directly in NATS KV
+func grantTestRole(t *testing.T, user *models.User, role models.Role) {
+	user.AddRole(role)
+	err := user.UpdateUser(context.Background())
+	assert.NoError(t, err, "Failed to grant role %s", role)
+}
+
+// refreshTestToken exchanges a token for a new one carrying the user's current roles
+func refreshTestToken(t *testing.T, router http.Handler, token *models.Token) *models.Token {
+	reqBody, _ := json.Marshal(models.RefreshTokenRequest{
+		RefreshToken: token.ID,
+	})
+
+	req := httptest.NewRequest("POST", "/auth/refresh-token", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeader(req, token.AccessToken)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code, "Failed to refresh token. Response: %s", w.Body.String())
+
+	var refreshResp models.RefreshTokenResponse
+	err := json.Unmarshal(w.Body.Bytes(), &refreshResp)
+	assert.NoError(t, err, "Failed to unmarshal refresh response")
+
+	return &refreshResp.Token
+}
+
 // generateTestPhoneNumber generates a phone number for testing
 func generateTestPhoneNumber() string {
 	return fmt.Sprintf("+TEST%07d", rand.Intn(10000000))
 }
+
+// generateTestRemoteAddr returns a random client address in 10.0.0.0/8
+func generateTestRemoteAddr() string {
+	return fmt.Sprintf("10.%d.%d.%d:1234", rand.Intn(256), rand.Intn(256), rand.Intn(256))
+}
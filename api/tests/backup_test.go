@@ -0,0 +1,231 @@
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"infinirewards/commands"
+	"infinirewards/models"
+	"infinirewards/nats"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupRestore(t *testing.T) {
+	setupNATSTest(t)
+	ctx := context.Background()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	commands.BackupEncryptionKey = base64.StdEncoding.EncodeToString(key)
+	defer func() { commands.BackupEncryptionKey = "" }()
+
+	user := &models.User{
+		PhoneNumber: generateTestPhoneNumber(),
+		Name:        "Backup User",
+		PrivateKey:  "0xbackupprivatekey",
+	}
+	assert.NoError(t, user.CreateUser(ctx))
+	apiKey, err := models.CreateAPIKey(ctx, user.ID, "Backup Key")
+	assert.NoError(t, err)
+
+	// The token bucket is keyed by refresh token
+	refreshToken := "backuprefreshtoken"
+	tokenData, _ := json.Marshal(models.Token{ID: refreshToken, User: user.ID, AccessToken: "backupaccesstoken"})
+	assert.NoError(t, nats.PutKV(ctx, "token", refreshToken, tokenData))
+
+	msg := natsgo.NewMsg("dlq.webhooks.backup.test")
+	msg.Data = []byte(`{"backup":true}`)
+	msg.Header.Set("Dead-Letter-Reason", "backup test")
+	_, err = nats.PublishStream(ctx, msg)
+	assert.NoError(t, err)
+
+	var archive bytes.Buffer
+	manifest, err := commands.Backup(ctx, &archive, commands.BackupOptions{
+		Buckets: []string{"users", "apikeys", "token"},
+		Streams: []string{nats.WebhooksDLQStream},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, commands.BackupFormatVersion, manifest.FormatVersion)
+	assert.Len(t, manifest.Buckets, 3)
+	assert.Len(t, manifest.Streams, 1)
+
+	t.Run("Secrets Are Encrypted", func(t *testing.T) {
+		contents := archiveContents(t, archive.Bytes())
+		assert.Contains(t, contents, "manifest.json")
+		for name, data := range contents {
+			assert.NotContains(t, string(data), "0xbackupprivatekey", "%s should not hold the private key", name)
+			assert.NotContains(t, string(data), apiKey.Secret, "%s should not hold the API key secret", name)
+			assert.NotContains(t, string(data), refreshToken, "%s should not hold the refresh token", name)
+			assert.NotContains(t, string(data), "backupaccesstoken", "%s should not hold the access token", name)
+		}
+
+		read, err := commands.ReadBackup(bytes.NewReader(archive.Bytes()))
+		if assert.NoError(t, err) {
+			found := false
+			for _, record := range read.Records["users"] {
+				if record.Key == user.ID {
+					found = true
+					assert.Contains(t, string(record.Value), "0xbackupprivatekey", "Reading should decrypt secrets")
+				}
+			}
+			assert.True(t, found, "User should be in the archive")
+
+			found = false
+			for _, record := range read.Records["token"] {
+				if record.Key == refreshToken {
+					found = true
+					assert.Contains(t, string(record.Value), `"id":"`+refreshToken+`"`, "Reading should decrypt the token ID")
+				}
+			}
+			assert.True(t, found, "Reading should decrypt the token keys")
+		}
+	})
+
+	t.Run("Verification", func(t *testing.T) {
+		// A changed file fails its checksum
+		contents := archiveContents(t, archive.Bytes())
+		contents["kv/users.jsonl"] = append(contents["kv/users.jsonl"], []byte("{}\n")...)
+		_, err := commands.ReadBackup(bytes.NewReader(writeArchive(t, contents)))
+		assert.ErrorContains(t, err, "checksum")
+
+		// Secrets cannot be read with another key
+		other := make([]byte, 32)
+		rand.Read(other)
+		commands.BackupEncryptionKey = base64.StdEncoding.EncodeToString(other)
+		_, err = commands.ReadBackup(bytes.NewReader(archive.Bytes()))
+		assert.ErrorContains(t, err, "decrypt")
+		commands.BackupEncryptionKey = base64.StdEncoding.EncodeToString(key)
+	})
+
+	t.Run("Dry Run", func(t *testing.T) {
+		_, err := models.ModifyUser(ctx, user.ID, func(user *models.User) error {
+			user.Name = "Changed After Backup"
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.NoError(t, models.DeleteAPIKey(ctx, apiKey.ID))
+
+		results, err := commands.Restore(ctx, bytes.NewReader(archive.Bytes()), commands.RestoreOptions{DryRun: true})
+		if assert.NoError(t, err) {
+			byName := restoreResults(results)
+			assert.Positive(t, byName["users"].Changed)
+			assert.Positive(t, byName["apikeys"].Added)
+			assert.True(t, byName[nats.WebhooksDLQStream].Skipped, "A stream with messages should not be restored")
+		}
+
+		stored := &models.User{}
+		assert.NoError(t, stored.GetUser(ctx, user.ID))
+		assert.Equal(t, "Changed After Backup", stored.Name, "A dry run should not write")
+	})
+
+	t.Run("Bucket Filter", func(t *testing.T) {
+		results, err := commands.Restore(ctx, bytes.NewReader(archive.Bytes()), commands.RestoreOptions{Buckets: []string{"users"}, Streams: []string{nats.WebhooksDLQStream}})
+		if assert.NoError(t, err) {
+			assert.Len(t, results, 2)
+		}
+
+		stored := &models.User{}
+		if assert.NoError(t, stored.GetUser(ctx, user.ID)) {
+			assert.Equal(t, "Backup User", stored.Name)
+			assert.Equal(t, "0xbackupprivatekey", stored.PrivateKey)
+		}
+		_, err = models.GetAPIKey(ctx, apiKey.ID)
+		assert.Error(t, err, "Filtered out buckets should not be restored")
+
+		_, err = commands.Restore(ctx, bytes.NewReader(archive.Bytes()), commands.RestoreOptions{Buckets: []string{"merchants"}})
+		assert.ErrorContains(t, err, "not in the archive")
+	})
+
+	t.Run("Round Trip", func(t *testing.T) {
+		// Empty the stream so its messages are restored
+		for _, file := range manifest.Streams {
+			for seq := uint64(1); seq <= file.Sequence; seq++ {
+				nats.DeleteStreamMsg(ctx, file.Name, seq)
+			}
+		}
+
+		results, err := commands.Restore(ctx, bytes.NewReader(archive.Bytes()), commands.RestoreOptions{})
+		if assert.NoError(t, err) {
+			byName := restoreResults(results)
+			assert.Equal(t, manifest.Streams[0].Records, byName[nats.WebhooksDLQStream].Added)
+		}
+
+		restored, err := models.GetAPIKey(ctx, apiKey.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, apiKey.Secret, restored.Secret)
+		}
+		state, err := nats.StreamState(ctx, nats.WebhooksDLQStream)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(manifest.Streams[0].Records), state.Msgs)
+		}
+
+		// Restoring again changes nothing
+		results, err = commands.Restore(ctx, bytes.NewReader(archive.Bytes()), commands.RestoreOptions{Buckets: []string{"users", "apikeys"}, Streams: []string{nats.WebhooksDLQStream}, DryRun: true})
+		if assert.NoError(t, err) {
+			for _, result := range results {
+				assert.Zero(t, result.Added, result.Name)
+				assert.Zero(t, result.Changed, result.Name)
+			}
+		}
+	})
+}
+
+func restoreResults(results []*commands.RestoreResult) map[string]*commands.RestoreResult {
+	byName := map[string]*commands.RestoreResult{}
+	for _, result := range results {
+		byName[result.Name] = result
+	}
+	return byName
+}
+
+// archiveContents returns the files of a gzipped tar by name
+func archiveContents(t *testing.T, data []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	contents := map[string][]byte{}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		contents[header.Name], _ = io.ReadAll(archive)
+	}
+	return contents
+}
+
+// writeArchive writes files to a gzipped tar, manifest first
+func writeArchive(t *testing.T, contents map[string][]byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(gz)
+	names := []string{"manifest.json"}
+	for name := range contents {
+		if name != "manifest.json" {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		assert.NoError(t, archive.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(contents[name]))}))
+		archive.Write(contents[name])
+	}
+	assert.NoError(t, archive.Close())
+	assert.NoError(t, gz.Close())
+	return buf.Bytes()
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"infinirewards/bot"
+	"infinirewards/models"
+	"infinirewards/utils"
+	"infinirewards/worker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBotFlow(t *testing.T) {
+	router := setupNATSTest(t)
+
+	err := worker.Start()
+	assert.NoError(t, err, "Failed to start webhook worker")
+	defer worker.Stop()
+
+	phoneNumber := generateTestPhoneNumber()
+	requestOTPAndAuthenticate(t, router, phoneNumber)
+
+	t.Run("Unregistered Number", func(t *testing.T) {
+		message := botTestMessage(generateTestPhoneNumber(), "balance")
+		w := postWhatsAppTestWebhook(router, whatsAppTestMessagePayload(message))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		reply := waitForBotReply(t, message.ID)
+		assert.Contains(t, reply.Body, "not registered")
+		assert.Equal(t, utils.ChannelWhatsApp, reply.Channel)
+	})
+
+	t.Run("Help", func(t *testing.T) {
+		message := botTestMessage(phoneNumber, "hello there")
+		w := postWhatsAppTestWebhook(router, whatsAppTestMessagePayload(message))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		reply := waitForBotReply(t, message.ID)
+		assert.Equal(t, phoneNumber, reply.To)
+		if assert.NotNil(t, reply.Interactive, "Help should offer buttons") {
+			assert.Equal(t, "button", reply.Interactive.Type)
+			ids := []string{}
+			for _, button := range reply.Interactive.Action.Buttons {
+				ids = append(ids, button.Reply.ID)
+			}
+			assert.Equal(t, []string{"balance", "rewards"}, ids)
+		}
+	})
+
+	t.Run("Button Reply", func(t *testing.T) {
+		// Buttons send the command in their ID
+		message := botTestMessage(phoneNumber, "")
+		message.Type = "interactive"
+		message.Interactive = models.MessageInteractive{
+			Type:        "button_reply",
+			ButtonReply: models.InteractiveReply{ID: "balance", Title: "Balance"},
+		}
+		w := postWhatsAppTestWebhook(router, whatsAppTestMessagePayload(message))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		// The user signed up without an account in tests
+		reply := waitForBotReply(t, message.ID)
+		assert.Contains(t, reply.Body, "still being set up")
+	})
+
+	t.Run("No Merchant", func(t *testing.T) {
+		message := botTestMessage(phoneNumber, "REWARDS")
+		w := postWhatsAppTestWebhook(router, whatsAppTestMessagePayload(message))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		reply := waitForBotReply(t, message.ID)
+		assert.Contains(t, reply.Body, "not available")
+	})
+
+	t.Run("Redelivered Message", func(t *testing.T) {
+		runs := 0
+		bot.HandleCommand("count", func(ctx context.Context, request *bot.Request) (utils.Message, error) {
+			runs++
+			return utils.Message{Body: "Counted"}, nil
+		})
+
+		// A webhook redelivered after a later message failed runs the
+		// command once
+		message := botTestMessage(phoneNumber, "count")
+		assert.NoError(t, bot.HandleMessage(context.Background(), message))
+		assert.NoError(t, bot.HandleMessage(context.Background(), message))
+		assert.Equal(t, 1, runs)
+	})
+}
+
+// botTestMessage returns an inbound text message from a phone number
+func botTestMessage(phoneNumber string, text string) models.Message {
+	return models.Message{
+		From:      strings.TrimPrefix(phoneNumber, "+"),
+		ID:        fmt.Sprintf("wamid.%d", time.Now().UnixNano()),
+		Timestamp: fmt.Sprint(time.Now().Unix()),
+		Type:      "text",
+		Text:      models.Text{Body: text},
+	}
+}
+
+// whatsAppTestMessagePayload returns a messages webhook with one inbound message
+func whatsAppTestMessagePayload(message models.Message) []byte {
+	payload, _ := json.Marshal(models.WebhookResponse{
+		Object: "whatsapp_business_account",
+		Entry: []models.Entry{{
+			ID: "test_entry",
+			Changes: []models.Change{{
+				Field: "messages",
+				Value: models.ChangeValue{
+					MessagingProduct: "whatsapp",
+					Messages:         []models.Message{message},
+				},
+			}},
+		}},
+	})
+	return payload
+}
+
+// waitForBotReply returns the reply of the bot to a message from the file message sink
+func waitForBotReply(t *testing.T, messageID string) utils.FileSinkMessage {
+	var reply utils.FileSinkMessage
+	assert.Eventually(t, func() bool {
+		messages, err := utils.ReadFileSink(testMessageSinkPath)
+		if err != nil {
+			return false
+		}
+		for _, message := range messages {
+			if message.Reference == "bot."+messageID {
+				reply = message
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond, "Bot should reply to %s", messageID)
+	return reply
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"infinirewards/config"
+	"infinirewards/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig(t *testing.T) {
+	t.Setenv("CONFIG_DIR", filepath.Join("..", "..", "config"))
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("NETWORK", "")
+
+	t.Run("Profiles", func(t *testing.T) {
+		setTestConfigEnv(t)
+
+		for _, profile := range config.Profiles {
+			cfg, err := config.LoadProfile(profile)
+			if !assert.NoError(t, err, "Profile %s", profile) {
+				continue
+			}
+			assert.Equal(t, profile, cfg.Profile)
+			assert.Equal(t, ":8080", cfg.Server.Addr)
+			assert.Equal(t, 5*time.Second, cfg.Server.ReadTimeout)
+		}
+
+		cfg, err := config.LoadProfile(config.ProfileMainnet)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "mainnet", cfg.Starknet.Network)
+			assert.Equal(t, "production", cfg.Server.Environment)
+			assert.Equal(t, slog.LevelInfo, cfg.Log.Level)
+			// Variables named after the network are still read
+			assert.Equal(t, "https://mainnet.example.com/rpc", cfg.Starknet.RPCURL)
+			assert.Empty(t, cfg.OTP.Routes, "Production should send codes through the default routes")
+		}
+
+		cfg, err = config.LoadProfile(config.ProfileDevnet)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "*=console", cfg.OTP.Routes)
+		}
+
+		_, err = config.LoadProfile("staging")
+		assert.ErrorContains(t, err, "unknown configuration profile")
+	})
+
+	t.Run("Environment Overrides", func(t *testing.T) {
+		setTestConfigEnv(t)
+		t.Setenv("LOG_LEVEL", "warn")
+		t.Setenv("SERVER_WRITE_TIMEOUT", "30s")
+		t.Setenv("ADMIN_USER_IDS", "admin1, admin2")
+		t.Setenv("TRUST_PROXY_HEADERS", "true")
+		t.Setenv("MASTER_PRIVATE_KEY", "0xabc")
+
+		cfg, err := config.LoadProfile(config.ProfileDevnet)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, slog.LevelWarn, cfg.Log.Level)
+		assert.Equal(t, 30*time.Second, cfg.Server.WriteTimeout)
+		assert.Equal(t, []string{"admin1", "admin2"}, cfg.Admin.UserIDs)
+		assert.True(t, cfg.Server.TrustProxyHeaders)
+		assert.Equal(t, "0xabc", cfg.Starknet.MasterPrivateKey, "The unsuffixed name should win")
+		assert.Equal(t, "http://127.0.0.1:5050", cfg.Starknet.RPCURL, "The profile should provide the RPC URL")
+
+		t.Setenv("SERVER_WRITE_TIMEOUT", "soon")
+		_, err = config.LoadProfile(config.ProfileDevnet)
+		assert.ErrorContains(t, err, "server.writeTimeout: invalid SERVER_WRITE_TIMEOUT")
+	})
+
+	t.Run("Secret Files", func(t *testing.T) {
+		setTestConfigEnv(t)
+		pepper := base64.StdEncoding.EncodeToString([]byte("a pepper read from a secret file"))
+		file := filepath.Join(t.TempDir(), "pepper")
+		require.NoError(t, os.WriteFile(file, []byte(pepper+"\n"), 0o600))
+		t.Setenv("PHONE_NUMBER_PEPPER", "")
+		t.Setenv("PHONE_NUMBER_PEPPER_FILE", file)
+
+		cfg, err := config.LoadProfile(config.ProfileDevnet)
+		if assert.NoError(t, err) {
+			assert.Equal(t, pepper, cfg.Secrets.PhoneNumberPepper)
+		}
+
+		t.Setenv("PHONE_NUMBER_PEPPER", pepper)
+		_, err = config.LoadProfile(config.ProfileDevnet)
+		assert.ErrorContains(t, err, "only one of PHONE_NUMBER_PEPPER and PHONE_NUMBER_PEPPER_FILE")
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		setTestConfigEnv(t)
+		t.Setenv("NATS_URL", "")
+		t.Setenv("PHONE_NUMBER_PEPPER", base64.StdEncoding.EncodeToString([]byte("short")))
+		t.Setenv("RPC_PROVIDER_URL_SEPOLIA", "ftp://sepolia.example.com")
+
+		_, err := config.LoadProfile(config.ProfileSepolia)
+		var invalid *config.ValidationError
+		if assert.True(t, errors.As(err, &invalid), "Error: %v", err) {
+			// Every problem is reported at once
+			assert.Contains(t, invalid.Problems, "nats.url: is required")
+			assert.Contains(t, invalid.Problems, "secrets.phoneNumberPepper: must decode to at least 32 bytes, got 5")
+			assert.Contains(t, invalid.Problems, `starknet.rpcUrl: must use http or https, got "ftp"`)
+		}
+
+		// Misspelled settings are rejected
+		file := filepath.Join(t.TempDir(), "override.yaml")
+		require.NoError(t, os.WriteFile(file, []byte("server:\n  adress: :9090\n"), 0o600))
+		t.Setenv("CONFIG_FILE", file)
+		_, err = config.LoadProfile(config.ProfileTest)
+		assert.ErrorContains(t, err, "field adress not found")
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		setTestConfigEnv(t)
+		file := filepath.Join(t.TempDir(), "override.yaml")
+		require.NoError(t, os.WriteFile(file, []byte("log:\n  level: error\nrateLimits:\n  otp.phone:\n    limit: 3\n"), 0o600))
+		t.Setenv("CONFIG_FILE", file)
+
+		current, err := config.LoadProfile(config.ProfileTest)
+		require.NoError(t, err)
+		assert.Equal(t, slog.LevelError, current.Log.Level)
+
+		defaults := *models.OTPRequestPhoneLimit
+		defer models.ConfigureRateLimits(nil)
+		require.NoError(t, models.ConfigureRateLimits(current.RateLimits))
+		assert.Equal(t, 3, models.OTPRequestPhoneLimit.Limit)
+		assert.Equal(t, defaults.Window, models.OTPRequestPhoneLimit.Window, "Unset values should keep the default")
+		assert.Equal(t, "3 requests per 24h0m0s", models.OTPRequestPhoneLimit.Description)
+
+		// Settings removed from the configuration are restored to the default
+		require.NoError(t, models.ConfigureRateLimits(nil))
+		assert.Equal(t, defaults, *models.OTPRequestPhoneLimit)
+
+		err = models.ConfigureRateLimits(map[string]config.RateLimitConfig{"otp.unknown": {Limit: 1}})
+		assert.ErrorContains(t, err, "unknown rate limit")
+
+		// Only the log level and rate limits apply without a restart
+		next := *current
+		next.Log.Level = slog.LevelDebug
+		next.Server.Addr = ":9090"
+		assert.Equal(t, []string{"server"}, current.RestartRequired(&next))
+	})
+}
+
+// setTestConfigEnv sets the variables the sepolia and mainnet profiles
+// require, using the names suffixed with the network
+func setTestConfigEnv(t *testing.T) {
+	t.Setenv("RPC_PROVIDER_URL_DEVNET", "")
+	t.Setenv("RPC_PROVIDER_URL_SEPOLIA", "https://sepolia.example.com/rpc")
+	t.Setenv("RPC_PROVIDER_URL_MAINNET", "https://mainnet.example.com/rpc")
+	for _, network := range []string{"DEVNET", "SEPOLIA", "MAINNET"} {
+		t.Setenv("MASTER_ACCOUNT_ADDRESS_"+network, "0x1")
+		t.Setenv("MASTER_PRIVATE_KEY_"+network, "0x2")
+		t.Setenv("INFINI_REWARDS_FACTORY_ADDRESS_"+network, "0x3")
+	}
+	for _, name := range []string{"RPC_PROVIDER_URL", "MASTER_ACCOUNT_ADDRESS", "MASTER_PRIVATE_KEY", "INFINI_REWARDS_FACTORY_ADDRESS", "PHONE_NUMBER_PEPPER_FILE", "LOG_LEVEL", "ENV"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("NATS_URL", "nats://127.0.0.1:4222")
+	t.Setenv("NATS_ACCOUNT_PUBLIC_KEY", "test_public_key")
+	t.Setenv("NATS_ACCOUNT_SEED", "test_seed")
+	t.Setenv("WEBAUTHN_RP_ID", "example.com")
+	t.Setenv("PHONE_NUMBER_PEPPER", base64.StdEncoding.EncodeToString([]byte("test_phone_number_pepper_32bytes")))
+}
@@ -0,0 +1,266 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"infinirewards/models"
+	"infinirewards/privacy"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountDeletion(t *testing.T) {
+	router := setupNATSTest(t)
+	ctx := context.Background()
+
+	chain := newFakeChain()
+	privacy.SetChain(chain)
+
+	// A merchant whose points and collectibles the user holds
+	issuer := &models.User{PhoneNumber: generateTestPhoneNumber(), Name: "Issuer"}
+	assert.NoError(t, issuer.CreateUser(ctx))
+	pointsContract := randomTestAddress()
+	collectibleContract := randomTestAddress()
+	shop := &models.Merchant{
+		Name:                 "Deletion Shop",
+		Address:              randomTestAddress(),
+		PointsContracts:      []string{pointsContract},
+		CollectibleContracts: []string{collectibleContract},
+	}
+	assert.NoError(t, shop.CreateMerchant(ctx, issuer))
+
+	token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+	account := randomTestAddress()
+	_, err := models.ModifyUser(ctx, token.User, func(user *models.User) error {
+		user.AccountAddress = account
+		user.PrivateKey = "0xdeletionprivatekey"
+		return nil
+	})
+	assert.NoError(t, err)
+	user := &models.User{}
+	assert.NoError(t, user.GetUser(ctx, token.User))
+	own := &models.Merchant{Name: "Personal Shop", Address: account}
+	assert.NoError(t, own.CreateMerchant(ctx, user))
+	apiKey, err := models.CreateAPIKey(ctx, user.ID, "Deletion Key")
+	assert.NoError(t, err)
+
+	chain.points[pointsContract+account] = big.NewInt(100)
+	chain.tokenIDs[collectibleContract] = []*big.Int{big.NewInt(1), big.NewInt(2)}
+	chain.collectibles[collectibleContract+account+"1"] = big.NewInt(2)
+
+	t.Run("Export", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/user/export", nil)
+		addAuthHeader(req, token.AccessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if !assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			return
+		}
+		assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+		assert.NotContains(t, w.Body.String(), "0xdeletionprivatekey", "The export should not hold the private key")
+		assert.NotContains(t, w.Body.String(), apiKey.Secret, "The export should not hold API key secrets")
+
+		var export privacy.Export
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &export))
+		assert.Equal(t, privacy.ExportFormatVersion, export.FormatVersion)
+		assert.Equal(t, user.ID, export.User.ID)
+		if assert.NotNil(t, export.Merchant) {
+			assert.Equal(t, "Personal Shop", export.Merchant.Name)
+		}
+		assert.Len(t, export.APIKeys, 1)
+		assert.NotEmpty(t, export.Sessions, "The login should be listed as a session")
+		if assert.Len(t, export.Holdings.Points, 1) {
+			assert.Equal(t, "100", export.Holdings.Points[0].Balance)
+			assert.Equal(t, shop.ID, export.Holdings.Points[0].Merchant)
+		}
+		if assert.Len(t, export.Holdings.Collectibles, 1) {
+			assert.Equal(t, "1", export.Holdings.Collectibles[0].TokenID)
+			assert.Equal(t, "2", export.Holdings.Collectibles[0].Balance)
+		}
+	})
+
+	t.Run("Resumes Failed Step", func(t *testing.T) {
+		chain.fail(errors.New("node unavailable"))
+		w := deleteTestUser(router, token.AccessToken)
+		if !assert.Equal(t, http.StatusInternalServerError, w.Code, "Response body: %s", w.Body.String()) {
+			return
+		}
+		var errResp struct {
+			Details map[string]string `json:"details"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+		assert.Equal(t, privacy.StepDisposeAssets, errResp.Details["step"])
+
+		// Steps before the failed one are done, the user is not deleted yet
+		_, err := models.GetAPIKey(ctx, apiKey.ID)
+		assert.Error(t, err, "API keys should be revoked")
+		assert.NoError(t, (&models.User{}).GetUser(ctx, user.ID))
+		deletion, err := models.GetAccountDeletion(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.NotNil(t, deletion.Steps[0].CompletedAt)
+			assert.Nil(t, deletion.Steps[1].CompletedAt)
+			assert.Contains(t, deletion.Steps[1].Error, "node unavailable")
+		}
+
+		w = deleteTestUser(router, token.AccessToken)
+		if !assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			return
+		}
+
+		assert.Zero(t, chain.points[pointsContract+account].Sign(), "Points should be burned")
+		assert.Zero(t, chain.collectibles[collectibleContract+account+"1"].Sign(), "Collectibles should be redeemed")
+		assert.Error(t, (&models.User{}).GetUser(ctx, user.ID), "User should be deleted")
+
+		merchant := &models.Merchant{}
+		if assert.NoError(t, merchant.GetMerchant(ctx, user.ID)) {
+			assert.Equal(t, "Deleted merchant", merchant.Name)
+		}
+
+		tombstone, err := models.GetTombstone(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, account, tombstone.AccountAddress)
+			assert.Len(t, tombstone.Steps[1].Transactions, 2)
+		}
+		_, err = models.GetAccountDeletion(ctx, user.ID)
+		assert.True(t, models.IsNotFound(err), "The deletion should be removed once done")
+
+		// Deleting again is answered from the tombstone
+		w = deleteTestUser(router, token.AccessToken)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		admin := createTestAdminWithAuth(t, router)
+		req := httptest.NewRequest("GET", "/admin/users/"+user.ID, nil)
+		addAuthHeader(req, admin.Token.AccessToken)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusGone, w.Code, "Response body: %s", w.Body.String())
+	})
+
+	t.Run("In Progress", func(t *testing.T) {
+		other := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		deletion := &models.AccountDeletion{UserID: other.User, Running: true, StartedAt: time.Now()}
+		assert.NoError(t, deletion.SaveAccountDeletion(ctx))
+
+		w := deleteTestUser(router, other.AccessToken)
+		assert.Equal(t, http.StatusConflict, w.Code, "Response body: %s", w.Body.String())
+		assert.NoError(t, deletion.RemoveAccountDeletion(ctx))
+	})
+}
+
+func deleteTestUser(router http.Handler, accessToken string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("DELETE", "/user", nil)
+	addAuthHeader(req, accessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// randomTestAddress returns a random StarkNet style address
+func randomTestAddress() string {
+	b := make([]byte, 31)
+	rand.Read(b)
+	return fmt.Sprintf("0x%x", b)
+}
+
+// fakeChain keeps balances in memory, keyed by contract, holder and token ID
+type fakeChain struct {
+	mu           sync.Mutex
+	points       map[string]*big.Int
+	tokenIDs     map[string][]*big.Int
+	collectibles map[string]*big.Int
+	failure      error
+	txs          int
+}
+
+func newFakeChain() *fakeChain {
+	return &fakeChain{
+		points:       map[string]*big.Int{},
+		tokenIDs:     map[string][]*big.Int{},
+		collectibles: map[string]*big.Int{},
+	}
+}
+
+// fail makes the next transaction fail with err
+func (c *fakeChain) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failure = err
+}
+
+func (c *fakeChain) transaction() (string, error) {
+	if err := c.failure; err != nil {
+		c.failure = nil
+		return "", err
+	}
+	c.txs++
+	return fmt.Sprintf("0xtx%d", c.txs), nil
+}
+
+func (c *fakeChain) PointsBalance(ctx context.Context, user *models.User, contract string) (*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return balanceOrZero(c.points[contract+user.AccountAddress]), nil
+}
+
+func (c *fakeChain) BurnPoints(ctx context.Context, user *models.User, contract string, amount *big.Int) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.transaction()
+	if err == nil {
+		key := contract + user.AccountAddress
+		c.points[key] = new(big.Int).Sub(balanceOrZero(c.points[key]), amount)
+	}
+	return tx, err
+}
+
+func (c *fakeChain) TransferPoints(ctx context.Context, user *models.User, contract string, to string, amount *big.Int) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.transaction()
+	if err == nil {
+		from := contract + user.AccountAddress
+		c.points[from] = new(big.Int).Sub(balanceOrZero(c.points[from]), amount)
+		c.points[contract+to] = new(big.Int).Add(balanceOrZero(c.points[contract+to]), amount)
+	}
+	return tx, err
+}
+
+func (c *fakeChain) CollectibleTokenIDs(ctx context.Context, contract string) ([]*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokenIDs[contract], nil
+}
+
+func (c *fakeChain) CollectibleBalance(ctx context.Context, address string, contract string, tokenID *big.Int) (*big.Int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return balanceOrZero(c.collectibles[contract+address+tokenID.String()]), nil
+}
+
+func (c *fakeChain) RedeemCollectible(ctx context.Context, issuer *models.User, merchant *models.Merchant, contract string, holder string, tokenID *big.Int, amount *big.Int) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tx, err := c.transaction()
+	if err == nil {
+		key := contract + holder + tokenID.String()
+		c.collectibles[key] = new(big.Int).Sub(balanceOrZero(c.collectibles[key]), amount)
+	}
+	return tx, err
+}
+
+func balanceOrZero(balance *big.Int) *big.Int {
+	if balance == nil {
+		return big.NewInt(0)
+	}
+	return balance
+}
@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"infinirewards/models"
+	"infinirewards/nats"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexes(t *testing.T) {
+	router := setupNATSTest(t)
+	ctx := context.Background()
+
+	t.Run("User Email", func(t *testing.T) {
+		first := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		second := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+		email := fmt.Sprintf("index.%s@example.com", strings.ToLower(ulid.Make().String()))
+		w := updateUserEmail(router, first.AccessToken, email)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		// Emails are found however they are written
+		user := &models.User{}
+		if assert.NoError(t, user.GetUserFromEmail(ctx, strings.ToUpper(email))) {
+			assert.Equal(t, first.User, user.ID)
+		}
+
+		w = updateUserEmail(router, second.AccessToken, strings.ToUpper(email))
+		assert.Equal(t, http.StatusConflict, w.Code, "Response body: %s", w.Body.String())
+
+		// Changing the email frees the old one
+		w = updateUserEmail(router, first.AccessToken, "changed."+email)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		w = updateUserEmail(router, second.AccessToken, email)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		if assert.NoError(t, user.GetUserFromEmail(ctx, email)) {
+			assert.Equal(t, second.User, user.ID)
+		}
+	})
+
+	t.Run("Account Address", func(t *testing.T) {
+		token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+		address := randomIndexAddress()
+		_, err := models.ModifyUser(ctx, token.User, func(user *models.User) error {
+			user.AccountAddress = address
+			return nil
+		})
+		assert.NoError(t, err)
+
+		owner, err := models.LookupAccountAddress(ctx, address)
+		if assert.NoError(t, err) {
+			assert.Equal(t, token.User, owner)
+		}
+
+		changed := randomIndexAddress()
+		_, err = models.ModifyUser(ctx, token.User, func(user *models.User) error {
+			user.AccountAddress = changed
+			return nil
+		})
+		assert.NoError(t, err)
+
+		_, err = models.LookupAccountAddress(ctx, address)
+		assert.True(t, nats.IsNotFound(err), "Old account address should not be indexed: %v", err)
+		owner, err = models.LookupAccountAddress(ctx, changed)
+		if assert.NoError(t, err) {
+			assert.Equal(t, token.User, owner)
+		}
+	})
+
+	t.Run("Merchant Contracts", func(t *testing.T) {
+		merchant := createIndexedMerchant(t, router)
+		points := merchant.PointsContracts[0]
+
+		found := &models.Merchant{}
+		if assert.NoError(t, found.GetMerchantFromAddress(ctx, merchant.Address)) {
+			assert.Equal(t, merchant.ID, found.ID)
+		}
+		if assert.NoError(t, found.GetMerchantFromContract(ctx, points)) {
+			assert.Equal(t, merchant.ID, found.ID)
+		}
+
+		collectible := randomIndexAddress()
+		_, err := models.ModifyMerchant(ctx, merchant.ID, func(merchant *models.Merchant) error {
+			merchant.CollectibleContracts = append(merchant.CollectibleContracts, collectible)
+			return nil
+		})
+		assert.NoError(t, err)
+		if assert.NoError(t, found.GetMerchantFromContract(ctx, collectible)) {
+			assert.Equal(t, merchant.ID, found.ID)
+		}
+
+		// A contract belongs to one merchant
+		other := createIndexedMerchant(t, router)
+		_, err = models.ModifyMerchant(ctx, other.ID, func(merchant *models.Merchant) error {
+			merchant.CollectibleContracts = append(merchant.CollectibleContracts, collectible)
+			return nil
+		})
+		assert.True(t, errors.Is(err, models.ErrContractTaken), "Another merchant's contract should be refused: %v", err)
+
+		assert.NoError(t, merchant.DeleteMerchant(ctx))
+		err = found.GetMerchantFromContract(ctx, collectible)
+		assert.True(t, nats.IsNotFound(err), "Deleted merchant's contract should not be indexed: %v", err)
+	})
+
+	t.Run("Rebuild", func(t *testing.T) {
+		grace := models.IndexClaimGrace
+		models.IndexClaimGrace = 0
+		defer func() { models.IndexClaimGrace = grace }()
+
+		token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		address := randomIndexAddress()
+		_, err := models.ModifyUser(ctx, token.User, func(user *models.User) error {
+			user.AccountAddress = address
+			return nil
+		})
+		assert.NoError(t, err)
+
+		// Lose the user's entry and leave an entry no user names
+		key, _ := models.NormalizeAccountAddress(address)
+		assert.NoError(t, nats.RemoveKV(ctx, "accountIndex", key))
+		stale := randomIndexAddress()
+		assert.NoError(t, models.IndexAccountAddress(ctx, stale, models.NewUserID()))
+
+		result, err := models.RebuildIndexes(ctx, true)
+		if assert.NoError(t, err) {
+			assert.Positive(t, result.Written)
+			assert.Positive(t, result.Removed)
+		}
+		_, err = models.LookupAccountAddress(ctx, address)
+		assert.Error(t, err, "A dry run should not write entries")
+
+		_, err = models.RebuildIndexes(ctx, false)
+		assert.NoError(t, err)
+
+		owner, err := models.LookupAccountAddress(ctx, address)
+		if assert.NoError(t, err) {
+			assert.Equal(t, token.User, owner)
+		}
+		_, err = models.LookupAccountAddress(ctx, stale)
+		assert.True(t, nats.IsNotFound(err), "Stale entry should be removed: %v", err)
+
+		result, err = models.RebuildIndexes(ctx, true)
+		if assert.NoError(t, err) {
+			assert.Zero(t, result.Written, "A rebuilt index should not change")
+		}
+	})
+}
+
+func updateUserEmail(router http.Handler, accessToken string, email string) *httptest.ResponseRecorder {
+	reqBody, _ := json.Marshal(models.UpdateUserRequest{Name: "Index Test", Email: email})
+	req := httptest.NewRequest("PUT", "/user", bytes.NewBuffer(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	addAuthHeader(req, accessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// createIndexedMerchant stores a merchant for a new user without deploying
+// its contracts
+func createIndexedMerchant(t *testing.T, router http.Handler) *models.Merchant {
+	token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+	merchant := &models.Merchant{
+		Address:         randomIndexAddress(),
+		Name:            "Index Test Merchant",
+		Symbol:          "ITM",
+		PointsContracts: []string{randomIndexAddress()},
+	}
+	assert.NoError(t, merchant.CreateMerchant(context.Background(), &models.User{ID: token.User}))
+	return merchant
+}
+
+func randomIndexAddress() string {
+	return fmt.Sprintf("0x%x%016x", rand.Uint64(), rand.Uint64())
+}
@@ -0,0 +1,242 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+
+	"infinirewards/media"
+	"infinirewards/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMediaUploads(t *testing.T) {
+	router := setupNATSTest(t)
+	ctx := context.Background()
+
+	token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+	t.Run("Avatar", func(t *testing.T) {
+		// A photo taken with the camera turned a quarter
+		photo := withEXIFOrientation(testJPEG(t, 40, 20), 6)
+
+		w := uploadTestMedia(router, token.AccessToken, "/user/avatar", "application/octet-stream", photo)
+		if !assert.Equal(t, http.StatusCreated, w.Code, "Response body: %s", w.Body.String()) {
+			return
+		}
+		var avatar models.Media
+		json.Unmarshal(w.Body.Bytes(), &avatar)
+		assert.Equal(t, "image/jpeg", avatar.ContentType)
+		assert.Equal(t, 20, avatar.Width, "The EXIF orientation should be applied")
+		assert.Equal(t, 40, avatar.Height)
+		assert.Equal(t, models.MediaPurposeAvatar, avatar.Purpose)
+
+		user := &models.User{}
+		if assert.NoError(t, user.GetUser(ctx, token.User)) {
+			assert.Equal(t, avatar.URL, user.Avatar)
+		}
+
+		w = getTestMedia(router, avatar.URL, "")
+		if assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+			assert.Contains(t, w.Header().Get("Cache-Control"), "immutable")
+			assert.NotContains(t, w.Body.String(), "Exif", "EXIF data should be stripped")
+		}
+		etag := w.Header().Get("ETag")
+		assert.NotEmpty(t, etag)
+
+		w = getTestMedia(router, avatar.URL, etag)
+		assert.Equal(t, http.StatusNotModified, w.Code)
+		assert.Zero(t, w.Body.Len())
+
+		w = getTestMedia(router, avatar.ThumbnailURL, "")
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+
+		// A new avatar replaces the previous one
+		w = uploadTestMedia(router, token.AccessToken, "/user/avatar", "image/png", testPNG(t, 600, 300))
+		if !assert.Equal(t, http.StatusCreated, w.Code, "Response body: %s", w.Body.String()) {
+			return
+		}
+		var replaced models.Media
+		json.Unmarshal(w.Body.Bytes(), &replaced)
+		assert.Equal(t, "image/png", replaced.ContentType)
+
+		w = getTestMedia(router, avatar.URL, "")
+		assert.Equal(t, http.StatusNotFound, w.Code, "The previous avatar should be deleted")
+
+		w = getTestMedia(router, replaced.ThumbnailURL, "")
+		if assert.Equal(t, http.StatusOK, w.Code) {
+			thumbnail, err := png.DecodeConfig(w.Body)
+			if assert.NoError(t, err) {
+				assert.Equal(t, media.ThumbnailDimension, thumbnail.Width)
+				assert.Equal(t, media.ThumbnailDimension/2, thumbnail.Height)
+			}
+		}
+	})
+
+	t.Run("Rejected Uploads", func(t *testing.T) {
+		w := uploadTestMedia(router, token.AccessToken, "/user/avatar", "text/plain", []byte("hello"))
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "Response body: %s", w.Body.String())
+
+		// The type is sniffed from the data, not taken from the client
+		w = uploadTestMedia(router, token.AccessToken, "/user/avatar", "image/png", []byte("<html><body>not an image</body></html>"))
+		assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "Response body: %s", w.Body.String())
+
+		w = uploadTestMedia(router, token.AccessToken, "/user/avatar", "image/png", append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 64)...))
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		maxUploadSize := media.MaxUploadSize
+		media.MaxUploadSize = 1024
+		defer func() { media.MaxUploadSize = maxUploadSize }()
+		w = uploadTestMedia(router, token.AccessToken, "/user/avatar", "image/png", testPNG(t, 300, 300))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code, "Response body: %s", w.Body.String())
+
+		req := httptest.NewRequest("POST", "/user/avatar", bytes.NewBufferString("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, token.AccessToken)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = getTestMedia(router, "/media/unknown", "")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Merchant Media", func(t *testing.T) {
+		w := uploadTestMedia(router, token.AccessToken, "/merchant/media", "image/png", testPNG(t, 10, 10))
+		assert.Equal(t, http.StatusForbidden, w.Code, "Users without a merchant cannot upload merchant media")
+
+		merchant := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		user := &models.User{}
+		assert.NoError(t, user.GetUser(ctx, merchant.User))
+		grantTestRole(t, user, models.RoleMerchant)
+		merchant = refreshTestToken(t, router, merchant)
+		shop := &models.Merchant{Name: "Media Shop", Address: randomTestAddress()}
+		assert.NoError(t, shop.CreateMerchant(ctx, user))
+
+		w = uploadTestMedia(router, merchant.AccessToken, "/merchant/media", "image/gif", testGIF(t))
+		if !assert.Equal(t, http.StatusCreated, w.Code, "Response body: %s", w.Body.String()) {
+			return
+		}
+		var upload models.Media
+		json.Unmarshal(w.Body.Bytes(), &upload)
+		assert.Equal(t, models.MediaPurposeMerchant, upload.Purpose)
+		assert.Equal(t, "image/png", upload.ContentType, "GIFs should be stored as PNG")
+
+		w = getTestMedia(router, upload.URL, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		// Collectible tokens reference the media however their contract is written
+		contract := randomTestAddress()
+		assert.NoError(t, models.SetCollectibleImage(ctx, contract, "1", upload.ID))
+		imageURL, err := models.GetCollectibleImage(ctx, "0x000"+contract[2:], "1")
+		if assert.NoError(t, err) {
+			assert.Equal(t, upload.URL, imageURL)
+		}
+		imageURL, err = models.GetCollectibleImage(ctx, contract, "2")
+		if assert.NoError(t, err) {
+			assert.Empty(t, imageURL)
+		}
+
+		// Deleting the user's avatars leaves the merchant's media
+		w = uploadTestMedia(router, merchant.AccessToken, "/user/avatar", "image/png", testPNG(t, 10, 10))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		deleted, err := models.DeleteUserAvatars(ctx, merchant.User)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 1, deleted)
+		}
+		w = getTestMedia(router, upload.URL, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+}
+
+func uploadTestMedia(router http.Handler, accessToken string, path string, contentType string, data []byte) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+	header.Set("Content-Type", contentType)
+	part, _ := form.CreatePart(header)
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest("POST", path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	addAuthHeader(req, accessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func getTestMedia(router http.Handler, url string, etag string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// testImage returns a gradient, so encoders cannot shrink it to nothing
+func testImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+	return img
+}
+
+func testJPEG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, testImage(width, height), nil))
+	return buf.Bytes()
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, testImage(width, height)))
+	return buf.Bytes()
+}
+
+func testGIF(t *testing.T) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, gif.Encode(&buf, testImage(8, 8), nil))
+	return buf.Bytes()
+}
+
+// withEXIFOrientation inserts an Exif segment holding orientation after the
+// start of a JPEG
+func withEXIFOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("II*\x00\x08\x00\x00\x00\x01\x00")
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], 0x0112)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+
+	result := append([]byte{}, data[:2]...)
+	result = append(result, header...)
+	result = append(result, segment...)
+	return append(result, data[2:]...)
+}
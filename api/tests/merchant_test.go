@@ -1,6 +1,9 @@
 package tests
 
 import (
+	"bytes"
+	"encoding/json"
+	"infinirewards/models"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -21,4 +24,33 @@ func TestMerchantManagement(t *testing.T) {
 
 		assert.Equal(t, http.StatusOK, w.Code, "Expected status code to be 200: %v", w.Body.String())
 	})
+
+	t.Run("Create Merchant Requires Admin", func(t *testing.T) {
+		testUser := createTestUserWithAuth(t, router)
+
+		merchantReq := models.CreateMerchantRequest{
+			Name:     testUser.User.Name,
+			Symbol:   "TST",
+			Decimals: 18,
+		}
+		reqBody, _ := json.Marshal(merchantReq)
+
+		req := httptest.NewRequest("POST", "/merchant", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, testUser.Token.AccessToken)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code, "Response body: %s", w.Body.String())
+
+		// Merchant routes need the merchant role
+		req = httptest.NewRequest("GET", "/merchant", nil)
+		addAuthHeader(req, testUser.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code, "Response body: %s", w.Body.String())
+	})
 }
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"infinirewards/commands"
+	"infinirewards/models"
+	"infinirewards/nats"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaMigrations(t *testing.T) {
+	setupNATSTest(t)
+	ctx := context.Background()
+	version := models.SchemaVersion("users")
+
+	// The NATS store outlives test runs, so forget the runs of earlier ones
+	if err := nats.RemoveKV(ctx, "schemaMigrations", "users"); err != nil && !nats.IsNotFound(err) {
+		t.Fatalf("Failed to reset migration state: %v", err)
+	}
+
+	// storeLegacyUser writes a user the way it was stored before schema
+	// versions and roles
+	storeLegacyUser := func(t *testing.T) string {
+		id := models.NewUserID()
+		data, _ := json.Marshal(map[string]any{
+			"id":          id,
+			"phoneNumber": generateTestPhoneNumber(),
+			"name":        "Legacy User",
+		})
+		assert.NoError(t, nats.PutKV(ctx, "users", id, data))
+		return id
+	}
+
+	storedDocument := func(t *testing.T, id string) map[string]any {
+		entry, err := nats.GetKV(ctx, "users", id)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		doc := map[string]any{}
+		assert.NoError(t, json.Unmarshal(entry.Value(), &doc))
+		return doc
+	}
+
+	t.Run("Upgrade On Read", func(t *testing.T) {
+		id := storeLegacyUser(t)
+
+		user := &models.User{}
+		if assert.NoError(t, user.GetUser(ctx, id)) {
+			assert.Equal(t, version, user.SchemaVersion)
+			assert.Equal(t, []models.Role{models.RoleUser}, user.Roles)
+			assert.Equal(t, "Legacy User", user.Name)
+		}
+
+		// Reads do not write; the next write stores the upgraded document
+		assert.NotContains(t, storedDocument(t, id), "schemaVersion")
+		_, err := models.ModifyUser(ctx, id, func(user *models.User) error {
+			user.Name = "Upgraded User"
+			return nil
+		})
+		assert.NoError(t, err)
+		doc := storedDocument(t, id)
+		assert.EqualValues(t, version, doc["schemaVersion"])
+		assert.Equal(t, []any{"user"}, doc["roles"])
+	})
+
+	t.Run("Migrate Command", func(t *testing.T) {
+		id := storeLegacyUser(t)
+
+		results, err := commands.MigrateSchema(ctx, commands.MigrateSchemaOptions{Buckets: []string{"users"}, DryRun: true})
+		if assert.NoError(t, err) && assert.Len(t, results, 1) {
+			assert.Positive(t, results[0].Upgraded)
+		}
+		assert.NotContains(t, storedDocument(t, id), "schemaVersion", "A dry run should not write")
+
+		results, err = commands.MigrateSchema(ctx, commands.MigrateSchemaOptions{Buckets: []string{"users"}, BatchSize: 1})
+		if assert.NoError(t, err) && assert.Len(t, results, 1) {
+			assert.Positive(t, results[0].Upgraded)
+			assert.Equal(t, version, results[0].ToVersion)
+		}
+		doc := storedDocument(t, id)
+		assert.EqualValues(t, version, doc["schemaVersion"])
+		assert.Equal(t, []any{"user"}, doc["roles"])
+
+		state, err := models.GetSchemaMigrationState(ctx, "users")
+		if assert.NoError(t, err) {
+			assert.Equal(t, version, state.Version)
+			assert.Empty(t, state.LastKey)
+			assert.Len(t, state.Applied, version)
+		}
+
+		// A migrated bucket is up to date
+		results, err = commands.MigrateSchema(ctx, commands.MigrateSchemaOptions{Buckets: []string{"users"}})
+		if assert.NoError(t, err) && assert.Len(t, results, 1) {
+			assert.Zero(t, results[0].Scanned)
+		}
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		migrated := storeLegacyUser(t)
+		pending := storeLegacyUser(t)
+
+		// An interrupted run stopped after the first user
+		state, err := models.GetSchemaMigrationState(ctx, "users")
+		assert.NoError(t, err)
+		state.Version = 0
+		state.Target = version
+		state.LastKey = migrated
+		assert.NoError(t, state.UpdateSchemaMigrationState(ctx))
+
+		results, err := commands.MigrateSchema(ctx, commands.MigrateSchemaOptions{Buckets: []string{"users"}})
+		if assert.NoError(t, err) && assert.Len(t, results, 1) {
+			assert.True(t, results[0].Resumed)
+		}
+		assert.NotContains(t, storedDocument(t, migrated), "schemaVersion", "Keys before the resume point should be skipped")
+		assert.EqualValues(t, version, storedDocument(t, pending)["schemaVersion"])
+
+		state, err = models.GetSchemaMigrationState(ctx, "users")
+		if assert.NoError(t, err) {
+			assert.Equal(t, version, state.Version)
+			assert.Zero(t, state.Target)
+		}
+	})
+
+	t.Run("Unknown Bucket", func(t *testing.T) {
+		_, err := commands.MigrateSchema(ctx, commands.MigrateSchemaOptions{Buckets: []string{"notifications"}})
+		assert.Error(t, err)
+	})
+}
@@ -3,9 +3,11 @@ package tests
 import (
 	"fmt"
 	"infinirewards/nats"
+	"os"
 	"time"
 
 	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
 )
 
 func setupNATSServer() error {
@@ -18,6 +20,12 @@ func setupNATSServer() error {
 		}
 	}
 
+	storeDir, err := os.MkdirTemp("", "infinirewards-test-nats-")
+	if err != nil {
+		return fmt.Errorf("failed to create NATS store directory: %v", err)
+	}
+	natsStoreDir = storeDir
+
 	opts := &natsserver.Options{
 		Host:      "127.0.0.1",
 		Port:      4222,
@@ -26,9 +34,9 @@ func setupNATSServer() error {
 		Trace:     true,
 		NoSigs:    true,
 		JetStream: true,
+		StoreDir:  storeDir,
 	}
 
-	var err error
 	natsServer, err = natsserver.NewServer(opts)
 	if err != nil {
 		return fmt.Errorf("failed to create NATS server: %v", err)
@@ -40,6 +48,11 @@ func setupNATSServer() error {
 		return fmt.Errorf("NATS server failed to start")
 	}
 
+	// Sign client credentials with a throwaway account
+	if err := setupTestNATSAccount(); err != nil {
+		return fmt.Errorf("failed to setup NATS account: %v", err)
+	}
+
 	// Initialize NATS module
 	if err := nats.ConnectNatsTest(); err != nil {
 		return fmt.Errorf("failed to initialize NATS module: %v", err)
@@ -47,3 +60,22 @@ func setupNATSServer() error {
 
 	return nil
 }
+
+func setupTestNATSAccount() error {
+	kp, err := nkeys.CreateAccount()
+	if err != nil {
+		return err
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return err
+	}
+	publicKey, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	os.Setenv("NATS_ACCOUNT_PUBLIC_KEY", publicKey)
+	os.Setenv("NATS_ACCOUNT_SEED", string(seed))
+	return nil
+}
@@ -0,0 +1,297 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"infinirewards/models"
+	"infinirewards/notifications"
+	"infinirewards/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotificationFlow(t *testing.T) {
+	router := setupNATSTest(t)
+
+	err := notifications.Start()
+	assert.NoError(t, err, "Failed to start notification service")
+	defer notifications.Stop()
+
+	ctx := context.Background()
+	token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+	req := httptest.NewRequest("GET", "/user", nil)
+	addAuthHeader(req, token.AccessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+	var user models.User
+	err = json.Unmarshal(w.Body.Bytes(), &user)
+	assert.NoError(t, err)
+
+	// The user has no chain account in tests, so one is indexed for them
+	account := "0x0123456789abcdef"
+	err = models.IndexAccountAddress(ctx, account, user.ID)
+	assert.NoError(t, err, "Failed to index account")
+
+	listNotifications := func(t *testing.T, query string) []models.Notification {
+		req := httptest.NewRequest("GET", "/user/notifications"+query, nil)
+		addAuthHeader(req, token.AccessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		var inbox models.Page[models.Notification]
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &inbox))
+		notifications := []models.Notification{}
+		for _, notification := range inbox.Items {
+			notifications = append(notifications, *notification)
+		}
+		return notifications
+	}
+
+	putPreferences := func(t *testing.T, preferences models.NotificationPreferences) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(preferences)
+		req := httptest.NewRequest("PUT", "/user/notification-preferences", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, token.AccessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Inbox", func(t *testing.T) {
+		event := &models.Event{
+			Type:            models.EventPointsMinted,
+			Account:         account,
+			Contract:        "0x1234",
+			Amount:          "100",
+			TransactionHash: "0xinbox",
+		}
+		assert.NoError(t, models.PublishEvent(ctx, event))
+
+		// The same event published again is only notified once
+		assert.NoError(t, models.PublishEvent(ctx, &models.Event{
+			ID:       event.ID,
+			Type:     event.Type,
+			Account:  event.Account,
+			Contract: event.Contract,
+			Amount:   event.Amount,
+		}))
+
+		var inbox []models.Notification
+		assert.Eventually(t, func() bool {
+			inbox = listNotifications(t, "")
+			return len(inbox) > 0
+		}, 5*time.Second, 50*time.Millisecond, "Notification should be added to the inbox")
+		time.Sleep(200 * time.Millisecond)
+		inbox = listNotifications(t, "")
+
+		assert.Len(t, inbox, 1)
+		assert.Equal(t, models.EventPointsMinted, inbox[0].Type)
+		assert.Contains(t, inbox[0].Body, "100")
+		assert.Nil(t, inbox[0].ReadAt)
+
+		// Events of accounts that are not ours are ignored
+		assert.NoError(t, models.PublishEvent(ctx, &models.Event{
+			Type:     models.EventPointsMinted,
+			Account:  "0xfedcba",
+			Contract: "0x1234",
+			Amount:   "1",
+		}))
+
+		req := httptest.NewRequest("POST", "/user/notifications/"+inbox[0].ID+"/read", nil)
+		addAuthHeader(req, token.AccessToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		assert.Empty(t, listNotifications(t, "?unread=true"))
+
+		req = httptest.NewRequest("POST", "/user/notifications/unknown/read", nil)
+		addAuthHeader(req, token.AccessToken)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code, "Response body: %s", w.Body.String())
+	})
+
+	t.Run("Preferences", func(t *testing.T) {
+		w := putPreferences(t, models.NotificationPreferences{Channel: "email"})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		w = putPreferences(t, models.NotificationPreferences{MutedEvents: []models.EventType{"points.stolen"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		w = putPreferences(t, models.NotificationPreferences{QuietHours: &models.QuietHours{Start: "22:00", End: "8am", TimeZone: "UTC"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		w = putPreferences(t, models.NotificationPreferences{
+			Channel:     utils.ChannelSMS,
+			MutedEvents: []models.EventType{models.EventPointsReceived},
+		})
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		req := httptest.NewRequest("GET", "/user/notification-preferences", nil)
+		addAuthHeader(req, token.AccessToken)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		var preferences models.NotificationPreferences
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &preferences))
+		assert.Equal(t, utils.ChannelSMS, preferences.Channel)
+		assert.Equal(t, []models.EventType{models.EventPointsReceived}, preferences.MutedEvents)
+	})
+
+	t.Run("Batched Messages", func(t *testing.T) {
+		for _, event := range []*models.Event{
+			{Type: models.EventPointsMinted, Account: account, Contract: "0x1234", Amount: "20", TransactionHash: "0xbatch1"},
+			{Type: models.EventCollectibleRedeemed, Account: account, Contract: "0x5678", TokenID: "1", Amount: "1", TransactionHash: "0xbatch2"},
+			// Muted events are only added to the inbox
+			{Type: models.EventPointsReceived, Account: account, Contract: "0x1234", Amount: "5", TransactionHash: "0xbatch3"},
+		} {
+			assert.NoError(t, models.PublishEvent(ctx, event))
+		}
+
+		assert.Eventually(t, func() bool {
+			return len(listNotifications(t, "")) == 4
+		}, 5*time.Second, 50*time.Millisecond, "Notifications should be added to the inbox")
+
+		// Nothing is sent before the batch window has passed
+		notifications.FlushDigests(ctx, time.Now())
+		digests, err := models.ListNotificationDigests(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, digests, 1)
+		assert.Len(t, digests[0].Bodies, 2)
+
+		notifications.FlushDigests(ctx, time.Now().Add(notifications.BatchWindow))
+
+		message := readTestMessage(t, "notifications."+user.ID)
+		assert.Equal(t, utils.ChannelSMS, message.Channel)
+		assert.True(t, strings.HasPrefix(message.Body, "You have 2 new"), "Digest body: %s", message.Body)
+		assert.NotContains(t, message.Body, "5 points")
+
+		digests, err = models.ListNotificationDigests(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, digests, "Digest should be removed once sent")
+	})
+
+	t.Run("Quiet Hours", func(t *testing.T) {
+		now := time.Now().UTC()
+		w := putPreferences(t, models.NotificationPreferences{
+			Channel: utils.ChannelSMS,
+			QuietHours: &models.QuietHours{
+				Start:    now.Add(-time.Hour).Format("15:04"),
+				End:      now.Add(time.Hour).Format("15:04"),
+				TimeZone: "UTC",
+			},
+		})
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		assert.NoError(t, models.PublishEvent(ctx, &models.Event{
+			Type: models.EventPointsMinted, Account: account, Contract: "0x1234", Amount: "7", TransactionHash: "0xquiet",
+		}))
+
+		assert.Eventually(t, func() bool {
+			digests, err := models.ListNotificationDigests(ctx)
+			return err == nil && len(digests) == 1
+		}, 5*time.Second, 50*time.Millisecond, "Notification should wait to be sent")
+
+		// Messages are held back until quiet hours end
+		notifications.FlushDigests(ctx, now.Add(notifications.BatchWindow))
+		digests, err := models.ListNotificationDigests(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, digests, 1)
+
+		notifications.FlushDigests(ctx, now.Add(2*time.Hour))
+		message := readTestMessage(t, "notifications."+user.ID)
+		assert.Contains(t, message.Body, "7")
+	})
+
+	t.Run("Redelivered Event", func(t *testing.T) {
+		event := &models.Event{
+			ID:       "redelivered",
+			Type:     models.EventPointsMinted,
+			Account:  account,
+			Contract: "0x1234",
+			Amount:   "9",
+		}
+
+		// The notification was created, but adding it to the digest failed
+		notification := models.Notification{
+			ID:        models.NotificationID(event.ID),
+			UserID:    user.ID,
+			Type:      event.Type,
+			Body:      "You received 9 points.",
+			Event:     *event,
+			CreatedAt: time.Now(),
+		}
+		assert.NoError(t, notification.CreateNotification(ctx))
+
+		assert.NoError(t, models.PublishEvent(ctx, event))
+
+		assert.Eventually(t, func() bool {
+			stored, err := models.GetNotification(ctx, user.ID, notification.ID)
+			return err == nil && stored.Queued
+		}, 5*time.Second, 50*time.Millisecond, "Redelivered notification should be queued")
+
+		digest, err := models.GetNotificationDigest(ctx, user.ID)
+		assert.NoError(t, err)
+		if assert.NotNil(t, digest) {
+			assert.Equal(t, []string{notification.Body}, digest.Bodies)
+		}
+
+		// Adding it again does not send it twice
+		assert.NoError(t, models.AddToNotificationDigest(ctx, user.ID, notification.ID, notification.Body))
+		digest, err = models.GetNotificationDigest(ctx, user.ID)
+		assert.NoError(t, err)
+		if assert.NotNil(t, digest) {
+			assert.Len(t, digest.Bodies, 1)
+		}
+
+		notifications.FlushDigests(ctx, time.Now().Add(2*time.Hour))
+		message := readTestMessage(t, "notifications."+user.ID)
+		assert.Equal(t, notification.Body, message.Body)
+	})
+
+	t.Run("Expiring Collectible", func(t *testing.T) {
+		expiresAt := time.Now().Add(12 * time.Hour).Truncate(time.Second)
+		assert.NoError(t, models.PublishEvent(ctx, &models.Event{
+			Type:            models.EventCollectibleMinted,
+			Account:         account,
+			Contract:        "0x5678",
+			TokenID:         "2",
+			Amount:          "1",
+			TransactionHash: "0xexpiring",
+			ExpiresAt:       &expiresAt,
+		}))
+
+		assert.Eventually(t, func() bool {
+			expiries, err := models.ListCollectibleExpiries(ctx)
+			return err == nil && len(expiries) == 1
+		}, 5*time.Second, 50*time.Millisecond, "Expiry reminder should be stored")
+
+		notifications.RemindExpiringCollectibles(ctx, time.Now())
+
+		assert.Eventually(t, func() bool {
+			for _, notification := range listNotifications(t, "") {
+				if notification.Type == models.EventCollectibleExpiring {
+					return true
+				}
+			}
+			return false
+		}, 5*time.Second, 50*time.Millisecond, "Holder should be reminded of the expiring collectible")
+
+		expiries, err := models.ListCollectibleExpiries(ctx)
+		assert.NoError(t, err)
+		assert.Empty(t, expiries, "Reminder should only be sent once")
+	})
+}
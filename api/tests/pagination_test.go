@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"infinirewards/models"
+	"infinirewards/nats"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPagination(t *testing.T) {
+	router := setupNATSTest(t)
+
+	t.Run("API Keys", func(t *testing.T) {
+		token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+		created := []string{}
+		for i := 0; i < 5; i++ {
+			reqBody, _ := json.Marshal(models.CreateAPIKeyRequest{Name: fmt.Sprintf("Page Key %d", i)})
+			req := httptest.NewRequest("POST", "/user/api-keys", bytes.NewBuffer(reqBody))
+			req.Header.Set("Content-Type", "application/json")
+			addAuthHeader(req, token.AccessToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if !assert.Equal(t, http.StatusCreated, w.Code, "Response body: %s", w.Body.String()) {
+				return
+			}
+			var apiKey models.APIKey
+			json.Unmarshal(w.Body.Bytes(), &apiKey)
+			created = append(created, apiKey.ID)
+		}
+
+		listed := []string{}
+		pages := 0
+		cursor := ""
+		for {
+			var page models.Page[models.APIKey]
+			w := getPage(t, router, token.AccessToken, "/user/api-keys?limit=2&cursor="+cursor, &page)
+			if !assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+				return
+			}
+			pages++
+			for _, apiKey := range page.Items {
+				assert.Empty(t, apiKey.Secret, "Listed keys should not hold their secret")
+				listed = append(listed, apiKey.ID)
+			}
+			if page.NextCursor == "" || pages > 5 {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		assert.Equal(t, created, listed, "Pages should list every key once, oldest first")
+		assert.Equal(t, 3, pages)
+
+		// Invalid limits and cursors are rejected
+		for _, query := range []string{"?limit=0", "?limit=101", "?limit=ten", "?cursor=bogus"} {
+			w := getPage(t, router, token.AccessToken, "/user/api-keys"+query, nil)
+			assert.Equal(t, http.StatusBadRequest, w.Code, "%s: %s", query, w.Body.String())
+		}
+	})
+
+	t.Run("Admin Users", func(t *testing.T) {
+		admin := createTestAdminWithAuth(t, router)
+		staff := &models.User{}
+		assert.NoError(t, staff.GetUser(context.Background(), requestOTPAndAuthenticate(t, router, generateTestPhoneNumber()).User))
+		grantTestRole(t, staff, models.RoleStaff)
+
+		var page models.Page[models.User]
+		w := getPage(t, router, admin.Token.AccessToken, "/admin/users?role=staff&limit=100", &page)
+		if assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			found := false
+			for _, user := range page.Items {
+				assert.True(t, user.HasRole(models.RoleStaff), "Only staff should be listed")
+				assert.Empty(t, user.PrivateKey)
+				found = found || user.ID == staff.ID
+			}
+			assert.True(t, found || page.NextCursor != "", "The staff user should be listed")
+		}
+
+		w = getPage(t, router, admin.Token.AccessToken, "/admin/users?role=owner", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		// Listing users and merchants needs users:read and merchants:read
+		user := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		for _, path := range []string{"/admin/users", "/admin/merchants"} {
+			w = getPage(t, router, user.AccessToken, path, nil)
+			assert.Equal(t, http.StatusForbidden, w.Code, "%s: %s", path, w.Body.String())
+		}
+
+		var merchants models.Page[models.Merchant]
+		w = getPage(t, router, admin.Token.AccessToken, "/admin/merchants?limit=1", &merchants)
+		if assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String()) {
+			assert.LessOrEqual(t, len(merchants.Items), 1)
+		}
+	})
+
+	t.Run("Streams", func(t *testing.T) {
+		ctx := context.Background()
+		subject := nats.DeadLetterSubject(nats.WebhookSubject("pagination", "test"))
+		for i := 0; i < 3; i++ {
+			msg := natsgo.NewMsg(subject)
+			msg.Data = []byte(fmt.Sprintf(`{"page":%d}`, i))
+			_, err := nats.PublishStream(ctx, msg)
+			assert.NoError(t, err)
+		}
+
+		read := []string{}
+		query := nats.StreamQuery{Subject: subject, Limit: 2}
+		for pages := 0; pages < 100; pages++ {
+			next, err := nats.QueryStream(ctx, nats.WebhooksDLQStream, query, func(msg *jetstream.RawStreamMsg) (bool, error) {
+				read = append(read, string(msg.Data))
+				return true, nil
+			})
+			if !assert.NoError(t, err) || next == "" {
+				break
+			}
+			query.Cursor = next
+		}
+		if assert.GreaterOrEqual(t, len(read), 3) {
+			assert.Equal(t, []string{`{"page":0}`, `{"page":1}`, `{"page":2}`}, read[len(read)-3:])
+		}
+	})
+}
+
+// getPage requests a list endpoint and decodes the page into v if it is set
+func getPage(t *testing.T, router http.Handler, accessToken string, path string, v any) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	addAuthHeader(req, accessToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if v != nil && w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+	return w
+}
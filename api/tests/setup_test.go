@@ -7,7 +7,6 @@ import (
 	"infinirewards/nats"
 	"infinirewards/utils"
 	"log/slog"
-	"os"
 	"testing"
 
 	"github.com/nats-io/nats.go/jetstream"
@@ -16,19 +15,17 @@ import (
 func TestSetup(t *testing.T) {
 	t.Log("Starting setup test")
 
-	// Set required environment variables
-	os.Setenv("WHATSAPP_TOKEN", "test_whatsapp_token")
-	os.Setenv("WHATSAPP_PHONE_NUMBER_ID", "test_phone_number_id")
-	os.Setenv("MACROKIOSK_USERNAME", "test_username")
-	os.Setenv("MACROKIOSK_PASSWORD", "test_password")
-	os.Setenv("MACROKIOSK_SENDER_ID", "test_sender")
-	os.Setenv("JWT_SECRET", "test_jwt_secret")
-
 	// Initialize logger
 	logs.InitHandler("")
 
+	cfg, err := loadTestConfig()
+	if err != nil {
+		t.Fatalf("failed to load configuration: %v", err)
+	}
+	testConfig = cfg
+
 	// Initialize WhatsApp
-	if err := utils.InitWhatsApp(); err != nil {
+	if err := utils.InitWhatsApp(cfg.WhatsApp); err != nil {
 		logs.Logger.Error("failed to initialize WhatsApp",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
@@ -37,7 +34,7 @@ func TestSetup(t *testing.T) {
 	}
 
 	// Initialize MacroKiosk
-	if err := utils.InitMacroKiosk(); err != nil {
+	if err := utils.InitMacroKiosk(cfg.MacroKiosk); err != nil {
 		logs.Logger.Error("failed to initialize MacroKiosk",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
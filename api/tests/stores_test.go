@@ -0,0 +1,459 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"infinirewards/models"
+	"infinirewards/nats"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStores(t *testing.T) {
+	t.Run("Memory", func(t *testing.T) {
+		runStoreConformance(t, models.NewMemoryStores())
+	})
+
+	t.Run("KV", func(t *testing.T) {
+		setupNATSTest(t)
+		runStoreConformance(t, models.NewKVStores())
+	})
+}
+
+// runStoreConformance checks the behavior every implementation of the stores
+// must share. The stores may hold records of other tests.
+func runStoreConformance(t *testing.T, stores *models.Stores) {
+	ctx := context.Background()
+
+	t.Run("Users", func(t *testing.T) {
+		user := &models.User{
+			ID:          models.NewUserID(),
+			PhoneNumber: generateTestPhoneNumber(),
+			Name:        "Store Test",
+			Roles:       []models.Role{models.RoleUser},
+			CreatedAt:   time.Now().UTC().Truncate(time.Second),
+		}
+
+		_, err := stores.Users.GetUser(ctx, user.ID)
+		assert.True(t, models.IsNotFound(err), "Missing user should not be found: %v", err)
+
+		err = stores.Users.CreateUser(ctx, user)
+		assert.NoError(t, err)
+		assert.NotZero(t, user.Revision, "Create should set the revision")
+
+		stored, err := stores.Users.GetUser(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, user, stored)
+		}
+
+		// Records are copies, so changing one does not change the store
+		stored.Name = "Changed"
+		again, err := stores.Users.GetUser(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Store Test", again.Name)
+		}
+
+		err = stores.Users.CreateUser(ctx, &models.User{ID: user.ID})
+		assert.True(t, nats.IsConflict(err), "Creating an existing user should conflict: %v", err)
+
+		created := user.Revision
+		user.Name = "Updated"
+		assert.NoError(t, stores.Users.UpdateUser(ctx, user))
+		assert.Greater(t, user.Revision, created, "Update should advance the revision")
+		stored, err = stores.Users.GetUser(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Updated", stored.Name)
+			assert.Equal(t, user.Revision, stored.Revision)
+		}
+
+		// A write based on an old revision loses
+		again.Name = "Stale"
+		err = stores.Users.UpdateUser(ctx, again)
+		assert.True(t, nats.IsConflict(err), "Stale update should conflict: %v", err)
+		stored, err = stores.Users.GetUser(ctx, user.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "Updated", stored.Name)
+		}
+
+		users, err := stores.Users.ListUsers(ctx)
+		assert.NoError(t, err)
+		assert.Contains(t, storeUserIDs(users), user.ID)
+
+		assert.NoError(t, stores.Users.DeleteUser(ctx, user.ID))
+		_, err = stores.Users.GetUser(ctx, user.ID)
+		assert.True(t, models.IsNotFound(err), "Deleted user should not be found: %v", err)
+
+		users, err = stores.Users.ListUsers(ctx)
+		assert.NoError(t, err)
+		assert.NotContains(t, storeUserIDs(users), user.ID)
+	})
+
+	t.Run("Merchants", func(t *testing.T) {
+		merchant := &models.Merchant{
+			ID:      models.NewUserID(),
+			Address: "0x0123",
+			Name:    "Store Test Merchant",
+			Symbol:  "STM",
+		}
+
+		_, err := stores.Merchants.GetMerchant(ctx, merchant.ID)
+		assert.True(t, models.IsNotFound(err), "Missing merchant should not be found: %v", err)
+
+		assert.NoError(t, stores.Merchants.CreateMerchant(ctx, merchant))
+		stored, err := stores.Merchants.GetMerchant(ctx, merchant.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, merchant.Name, stored.Name)
+			assert.Equal(t, merchant.Symbol, stored.Symbol)
+			assert.Equal(t, merchant.Revision, stored.Revision)
+		}
+
+		err = stores.Merchants.CreateMerchant(ctx, &models.Merchant{ID: merchant.ID})
+		assert.True(t, nats.IsConflict(err), "Creating an existing merchant should conflict: %v", err)
+
+		merchant.Name = "Renamed"
+		assert.NoError(t, stores.Merchants.UpdateMerchant(ctx, merchant))
+		stored.Name = "Stale"
+		err = stores.Merchants.UpdateMerchant(ctx, stored)
+		assert.True(t, nats.IsConflict(err), "Stale update should conflict: %v", err)
+
+		assert.NoError(t, stores.Merchants.DeleteMerchant(ctx, merchant.ID))
+		_, err = stores.Merchants.GetMerchant(ctx, merchant.ID)
+		assert.True(t, models.IsNotFound(err), "Deleted merchant should not be found: %v", err)
+	})
+
+	t.Run("API Keys", func(t *testing.T) {
+		userID := models.NewUserID()
+		otherID := models.NewUserID()
+
+		keys := []*models.APIKey{}
+		for i, owner := range []string{userID, userID, otherID} {
+			apiKey := &models.APIKey{
+				ID:     fmt.Sprintf("%s.%s", owner, ulid.Make().String()),
+				UserID: owner,
+				Name:   fmt.Sprintf("key %d", i),
+				Secret: "secret",
+			}
+			assert.NoError(t, stores.APIKeys.PutAPIKey(ctx, apiKey))
+			keys = append(keys, apiKey)
+		}
+
+		stored, err := stores.APIKeys.GetAPIKey(ctx, keys[0].ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "secret", stored.Secret)
+		}
+
+		// Keys are listed per user
+		listed, err := stores.APIKeys.ListAPIKeys(ctx, userID)
+		assert.NoError(t, err)
+		ids := []string{}
+		for _, apiKey := range listed {
+			ids = append(ids, apiKey.ID)
+		}
+		assert.ElementsMatch(t, []string{keys[0].ID, keys[1].ID}, ids)
+
+		assert.NoError(t, stores.APIKeys.DeleteAPIKey(ctx, keys[0].ID))
+		_, err = stores.APIKeys.GetAPIKey(ctx, keys[0].ID)
+		assert.True(t, models.IsNotFound(err), "Deleted API key should not be found: %v", err)
+
+		listed, err = stores.APIKeys.ListAPIKeys(ctx, userID)
+		assert.NoError(t, err)
+		assert.Len(t, listed, 1)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		userID := models.NewUserID()
+		ids := []string{}
+		for i := 0; i < 5; i++ {
+			apiKey := &models.APIKey{
+				ID:     fmt.Sprintf("%s.%s", userID, ulid.Make().String()),
+				UserID: userID,
+				Name:   fmt.Sprintf("page key %d", i),
+			}
+			assert.NoError(t, stores.APIKeys.PutAPIKey(ctx, apiKey))
+			ids = append(ids, apiKey.ID)
+		}
+
+		// Pages follow each other in key order until the cursor is empty
+		paged := []string{}
+		query := models.Query{Limit: 2}
+		for pages := 0; pages < 5; pages++ {
+			page, next, err := stores.APIKeys.PageAPIKeys(ctx, userID, query)
+			if !assert.NoError(t, err) {
+				break
+			}
+			assert.LessOrEqual(t, len(page), 2)
+			for _, apiKey := range page {
+				paged = append(paged, apiKey.ID)
+			}
+			if next == "" {
+				break
+			}
+			query.Cursor = next
+		}
+		assert.Equal(t, ids, paged)
+
+		// Newest first by createdAt, keeping only matches
+		now := time.Now()
+		created := []string{}
+		for i := 0; i < 3; i++ {
+			user := &models.User{
+				ID:          models.NewUserID(),
+				PhoneNumber: generateTestPhoneNumber(),
+				Name:        fmt.Sprintf("Page User %s %d", userID, i),
+				CreatedAt:   now.Add(time.Duration(i) * time.Hour),
+			}
+			assert.NoError(t, stores.Users.CreateUser(ctx, user))
+			created = append(created, user.ID)
+		}
+		match := func(user *models.User) bool {
+			return strings.HasPrefix(user.Name, "Page User "+userID)
+		}
+		users, next, err := stores.Users.PageUsers(ctx, models.Query{Limit: 2, Order: models.OrderCreated, Descending: true}, match)
+		if assert.NoError(t, err) && assert.NotEmpty(t, next) {
+			assert.Equal(t, []string{created[2], created[1]}, storeUserIDs(users))
+			users, _, err = stores.Users.PageUsers(ctx, models.Query{Limit: 2, Order: models.OrderCreated, Descending: true, Cursor: next}, match)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{created[0]}, storeUserIDs(users))
+		}
+
+		// A cursor of another order is rejected
+		_, _, err = stores.Users.PageUsers(ctx, models.Query{Limit: 2, Cursor: next}, match)
+		assert.ErrorIs(t, err, models.ErrInvalidCursor)
+		_, _, err = stores.Users.PageUsers(ctx, models.Query{Limit: 2, Cursor: "not a cursor"}, match)
+		assert.ErrorIs(t, err, models.ErrInvalidCursor)
+	})
+
+	t.Run("Tokens", func(t *testing.T) {
+		token := &models.Token{
+			ID:                 ulid.Make().String(),
+			User:               models.NewUserID(),
+			AccessToken:        "access",
+			AccessTokenExpiry:  time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+			RefreshTokenExpiry: time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second),
+			Device:             "test",
+		}
+
+		_, err := stores.Tokens.GetToken(ctx, token.ID)
+		assert.True(t, models.IsNotFound(err), "Missing token should not be found: %v", err)
+
+		assert.NoError(t, stores.Tokens.PutToken(ctx, token))
+		stored, err := stores.Tokens.GetToken(ctx, token.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, token, stored)
+		}
+
+		tokens, err := stores.Tokens.ListTokens(ctx)
+		assert.NoError(t, err)
+		found := false
+		for _, listed := range tokens {
+			found = found || listed.ID == token.ID
+		}
+		assert.True(t, found, "Token should be listed")
+
+		userTokens, err := stores.Tokens.ListUserTokens(ctx, token.User)
+		if assert.NoError(t, err) && assert.Len(t, userTokens, 1) {
+			assert.Equal(t, token.ID, userTokens[0].ID)
+		}
+
+		// Tokens given to another user are only listed under that user
+		oldUser := token.User
+		token.User = models.NewUserID()
+		assert.NoError(t, stores.Tokens.PutToken(ctx, token))
+		userTokens, err = stores.Tokens.ListUserTokens(ctx, oldUser)
+		assert.NoError(t, err)
+		assert.Empty(t, userTokens)
+		userTokens, err = stores.Tokens.ListUserTokens(ctx, token.User)
+		assert.NoError(t, err)
+		assert.Len(t, userTokens, 1)
+
+		assert.NoError(t, stores.Tokens.DeleteToken(ctx, token.ID))
+		_, err = stores.Tokens.GetToken(ctx, token.ID)
+		assert.True(t, models.IsNotFound(err), "Deleted token should not be found: %v", err)
+		userTokens, err = stores.Tokens.ListUserTokens(ctx, token.User)
+		assert.NoError(t, err)
+		assert.Empty(t, userTokens, "Deleted token should not be listed")
+	})
+
+	t.Run("Verifications", func(t *testing.T) {
+		verification := &models.PhoneNumberVerification{
+			ID:      ulid.Make().String(),
+			Secret:  "secret",
+			User:    models.NewUserID(),
+			Purpose: models.VerificationPurposePhoneChange,
+		}
+
+		_, err := stores.Verifications.GetVerification(ctx, verification.ID)
+		assert.True(t, models.IsNotFound(err), "Missing verification should not be found: %v", err)
+
+		assert.NoError(t, stores.Verifications.PutVerification(ctx, verification))
+		stored, err := stores.Verifications.GetVerification(ctx, verification.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, verification.Secret, stored.Secret)
+			assert.Equal(t, verification.Purpose, stored.Purpose)
+		}
+
+		assert.NoError(t, stores.Verifications.DeleteVerification(ctx, verification.ID))
+		_, err = stores.Verifications.GetVerification(ctx, verification.ID)
+		assert.True(t, models.IsNotFound(err), "Deleted verification should not be found: %v", err)
+	})
+
+	t.Run("Passkeys", func(t *testing.T) {
+		userID := models.NewUserID()
+		passkey := &models.PasskeyCredential{
+			ID:        ulid.Make().String(),
+			UserID:    userID,
+			Name:      "Store Test",
+			CreatedAt: time.Now().UTC().Truncate(time.Second),
+		}
+		passkey.Credential.ID = []byte(passkey.ID)
+
+		_, err := stores.Passkeys.GetPasskey(ctx, userID, passkey.ID)
+		assert.True(t, models.IsNotFound(err), "Missing passkey should not be found: %v", err)
+
+		assert.NoError(t, stores.Passkeys.CreatePasskey(ctx, passkey))
+		assert.NotZero(t, passkey.Revision, "Create should set the revision")
+		assert.True(t, nats.IsConflict(stores.Passkeys.CreatePasskey(ctx, passkey)), "Existing passkey should not be created again")
+
+		stored, err := stores.Passkeys.GetPasskey(ctx, userID, passkey.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, passkey, stored, "Passkey should be stored with its credential")
+		}
+
+		// Listed passkeys carry the revision they are updated at
+		listed, err := stores.Passkeys.ListPasskeys(ctx, userID)
+		if assert.NoError(t, err) && assert.Len(t, listed, 1) {
+			assert.Equal(t, passkey.Revision, listed[0].Revision)
+			listed[0].LastUsedAt = time.Now().UTC().Truncate(time.Second)
+			assert.NoError(t, stores.Passkeys.UpdatePasskey(ctx, listed[0]))
+		}
+		assert.True(t, nats.IsConflict(stores.Passkeys.UpdatePasskey(ctx, passkey)), "Stale passkey should not be written")
+
+		page, next, err := stores.Passkeys.PagePasskeys(ctx, userID, models.Query{Limit: 1, Order: models.OrderCreated})
+		if assert.NoError(t, err) && assert.Len(t, page, 1) {
+			assert.Equal(t, passkey.ID, page[0].ID)
+			assert.Empty(t, next)
+		}
+
+		assert.NoError(t, stores.Passkeys.DeletePasskey(ctx, userID, passkey.ID))
+		listed, err = stores.Passkeys.ListPasskeys(ctx, userID)
+		assert.NoError(t, err)
+		assert.Empty(t, listed, "Deleted passkey should not be listed")
+	})
+
+	t.Run("Rate Limits", func(t *testing.T) {
+		key := "store." + ulid.Make().String()
+
+		state, err := stores.RateLimits.GetRateLimit(ctx, key)
+		if assert.NoError(t, err) {
+			assert.Zero(t, state.Count)
+			assert.Zero(t, state.Revision, "Missing counter should not have a revision")
+		}
+
+		state.Count = 1
+		assert.NoError(t, stores.RateLimits.PutRateLimit(ctx, key, state))
+		assert.NotZero(t, state.Revision)
+
+		stale := &models.RateLimitState{Count: 1}
+		assert.True(t, nats.IsConflict(stores.RateLimits.PutRateLimit(ctx, key, stale)), "Counter should not be created twice")
+
+		state.Count = 2
+		assert.NoError(t, stores.RateLimits.PutRateLimit(ctx, key, state))
+		stored, err := stores.RateLimits.GetRateLimit(ctx, key)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 2, stored.Count)
+		}
+
+		assert.NoError(t, stores.RateLimits.DeleteRateLimit(ctx, key))
+		stored, err = stores.RateLimits.GetRateLimit(ctx, key)
+		if assert.NoError(t, err) {
+			assert.Zero(t, stored.Count, "Deleted counter should start over")
+		}
+	})
+
+	t.Run("Indexes", func(t *testing.T) {
+		key := ulid.Make().String()
+		id := models.NewUserID()
+
+		_, err := stores.EmailIndex.GetEntry(ctx, key)
+		assert.True(t, models.IsNotFound(err), "Missing entry should not be found: %v", err)
+
+		assert.NoError(t, stores.EmailIndex.CreateEntry(ctx, key, id))
+		assert.True(t, nats.IsConflict(stores.EmailIndex.CreateEntry(ctx, key, models.NewUserID())), "Taken key should not be created again")
+
+		entry, err := stores.EmailIndex.GetEntry(ctx, key)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, id, entry.ID)
+		assert.WithinDuration(t, time.Now(), entry.Written, time.Minute)
+
+		// Entries of the other indexes are kept apart
+		_, err = stores.AccountIndex.GetEntry(ctx, key)
+		assert.True(t, models.IsNotFound(err), "Entry should only be in its own index: %v", err)
+
+		newID := models.NewUserID()
+		assert.NoError(t, stores.EmailIndex.UpdateEntry(ctx, key, newID, entry.Revision))
+		assert.True(t, nats.IsConflict(stores.EmailIndex.UpdateEntry(ctx, key, id, entry.Revision)), "Stale entry should not be written")
+		assert.True(t, nats.IsConflict(stores.EmailIndex.RemoveEntry(ctx, key, entry.Revision)), "Stale entry should not be removed")
+
+		entries, err := stores.EmailIndex.ListEntries(ctx)
+		assert.NoError(t, err)
+		found := false
+		for _, listed := range entries {
+			found = found || (listed.Key == key && listed.ID == newID)
+		}
+		assert.True(t, found, "Entry should be listed")
+
+		assert.NoError(t, stores.EmailIndex.RemoveEntry(ctx, key, 0))
+		_, err = stores.EmailIndex.GetEntry(ctx, key)
+		assert.True(t, models.IsNotFound(err), "Removed entry should not be found: %v", err)
+	})
+}
+
+func TestStoresFromContext(t *testing.T) {
+	setupNATSTest(t)
+
+	// Contexts with their own stores do not see each other's records, as two
+	// servers would not
+	first := models.WithStores(context.Background(), models.NewMemoryStores())
+	second := models.WithStores(context.Background(), models.NewMemoryStores())
+
+	phoneNumber := generateTestPhoneNumber()
+	user := &models.User{PhoneNumber: phoneNumber}
+	if !assert.NoError(t, user.CreateUser(first)) {
+		return
+	}
+
+	id, err := models.LookupPhoneNumber(first, phoneNumber)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, id)
+	assert.NoError(t, (&models.User{}).GetUser(first, user.ID))
+
+	_, err = models.LookupPhoneNumber(second, phoneNumber)
+	assert.Error(t, err, "Phone number should only be indexed in the first stores")
+	assert.Error(t, (&models.User{}).GetUser(second, user.ID), "User should only be in the first stores")
+	_, err = models.LookupPhoneNumber(context.Background(), phoneNumber)
+	assert.Error(t, err, "Phone number should not be indexed in the KV stores")
+
+	// Rate limits count per stores
+	limit := &models.RateLimit{Name: "stores.test", Limit: 1, Window: time.Minute, Description: "1 request"}
+	_, err = limit.Allow(first, phoneNumber)
+	assert.NoError(t, err)
+	_, err = limit.Allow(first, phoneNumber)
+	assert.Error(t, err, "Second hit should be limited")
+	_, err = limit.Allow(second, phoneNumber)
+	assert.NoError(t, err, "Other stores should count on their own")
+}
+
+func storeUserIDs(users []*models.User) []string {
+	ids := []string{}
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"infinirewards/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateFlow(t *testing.T) {
+	router := setupNATSTest(t)
+
+	admin := createTestAdminWithAuth(t, router)
+	templatePath := "/admin/templates/testbrand/" + models.TemplateOTP + "/ms-MY"
+
+	t.Run("Manage Templates", func(t *testing.T) {
+		templateReq := models.PutMessageTemplateRequest{
+			Body:             "TESTBRAND: Kod OTP anda ialah {{.Code}}. Sah selama {{.ValidMinutes}} minit.",
+			WhatsAppTemplate: "otp_message",
+			WhatsAppLanguage: "ms",
+			SMSSender:        "TestBrand",
+		}
+		reqBody, _ := json.Marshal(templateReq)
+
+		// Only admins can manage templates
+		token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+		req := httptest.NewRequest("PUT", templatePath, bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, token.AccessToken)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code, "Response body: %s", w.Body.String())
+
+		req = httptest.NewRequest("PUT", templatePath, bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		// Templates must only use the fields messages are rendered with
+		invalidBody, _ := json.Marshal(models.PutMessageTemplateRequest{Body: "Your code is {{.Password}}"})
+		req = httptest.NewRequest("PUT", templatePath, bytes.NewBuffer(invalidBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		req = httptest.NewRequest("PUT", "/admin/templates/testbrand/otp/not_a_locale!", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		req = httptest.NewRequest("GET", "/admin/templates?brand=testbrand", nil)
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		var templates models.Page[models.MessageTemplate]
+		err := json.Unmarshal(w.Body.Bytes(), &templates)
+		assert.NoError(t, err)
+		assert.Len(t, templates.Items, 1)
+		if len(templates.Items) == 1 {
+			assert.Equal(t, "ms-MY", templates.Items[0].Locale)
+			assert.Equal(t, templateReq.Body, templates.Items[0].Body)
+		}
+	})
+
+	t.Run("Localized OTP", func(t *testing.T) {
+		requestOTP := func(brand string, acceptLanguage string) string {
+			reqBody, _ := json.Marshal(models.RequestOTPRequest{PhoneNumber: generateTestPhoneNumber()})
+			req := httptest.NewRequest("POST", "/auth/request-otp", bytes.NewBuffer(reqBody))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-IR-Brand", brand)
+			req.Header.Set("Accept-Language", acceptLanguage)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+			var otpResp models.RequestOTPResponse
+			err := json.Unmarshal(w.Body.Bytes(), &otpResp)
+			assert.NoError(t, err)
+			return otpResp.ID
+		}
+
+		message := readTestMessage(t, requestOTP("testbrand", "fr-FR, ms-MY;q=0.9, en;q=0.8"))
+		assert.True(t, strings.HasPrefix(message.Body, "TESTBRAND: Kod OTP anda ialah "+message.Code), "Body: %s", message.Body)
+		assert.Equal(t, "ms", message.WhatsAppLanguage)
+		assert.Equal(t, "TestBrand", message.Sender)
+
+		// Other languages fall back to the built-in template
+		message = readTestMessage(t, requestOTP("testbrand", "fr-FR"))
+		assert.Equal(t, "Your InfiniRewards verification code is: "+message.Code, message.Body)
+		assert.Equal(t, "en", message.WhatsAppLanguage)
+
+		// Other brands do not use the brand's templates
+		message = readTestMessage(t, requestOTP("otherbrand", "ms-MY"))
+		assert.Equal(t, "Your InfiniRewards verification code is: "+message.Code, message.Body)
+	})
+
+	t.Run("Delete Template", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", templatePath, nil)
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		req = httptest.NewRequest("GET", templatePath, nil)
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusNotFound, w.Code, "Response body: %s", w.Body.String())
+	})
+}
@@ -1,13 +1,19 @@
 package tests
 
 import (
+	"encoding/base64"
 	"fmt"
+	"infinirewards/config"
 	"infinirewards/infinirewards"
 	"infinirewards/jwt"
 	"infinirewards/logs"
+	"infinirewards/middleware"
+	"infinirewards/models"
 	"infinirewards/nats"
+	"infinirewards/notifications"
 	"infinirewards/routes"
 	"infinirewards/utils"
+	"infinirewards/worker"
 	"io"
 	"log"
 	"log/slog"
@@ -16,12 +22,26 @@ import (
 	"path/filepath"
 	"testing"
 
+	"github.com/joho/godotenv"
 	natsserver "github.com/nats-io/nats-server/v2/server"
 )
 
+const (
+	testWhatsAppVerifyToken = "test_whatsapp_verify_token"
+	testWhatsAppAppSecret   = "test_whatsapp_app_secret"
+	testMacroKioskDLRToken  = "test_macrokiosk_dlr_token"
+)
+
 var (
 	testLogger *log.Logger
 	natsServer *natsserver.Server
+	// natsStoreDir holds the JetStream data of one test run, so streams that
+	// deny deletes, like the audit log, start empty every run
+	natsStoreDir string
+	// testConfig is the test profile the services were initialized with
+	testConfig *config.Config
+	// testMessageSinkPath is where the file provider writes the OTPs sent during tests
+	testMessageSinkPath = filepath.Join(os.TempDir(), "infinirewards-test-messages.jsonl")
 )
 
 type StarkNetAccount struct {
@@ -30,7 +50,7 @@ type StarkNetAccount struct {
 }
 
 // Router setup
-func setupTestRouter() *http.ServeMux {
+func setupTestRouter() http.Handler {
 	// Create new router
 	mux := http.NewServeMux()
 
@@ -38,29 +58,43 @@ func setupTestRouter() *http.ServeMux {
 	routes.SetAuthRoutes(mux)
 	routes.SetUserRoutes(mux)
 	routes.SetMerchantRoutes(mux)
+	routes.SetAdminRoutes(mux)
 	routes.SetInfiniRewardsRoutes(mux)
+	routes.SetWebhookRoutes(mux)
+	routes.SetMediaRoutes(mux)
 
-	return mux
+	return middleware.WithStores(models.NewKVStores(), mux)
 }
 
 func initializeServices() error {
-	// Set required environment variables
-	os.Setenv("WHATSAPP_TOKEN", "test_whatsapp_token")
-	os.Setenv("WHATSAPP_PHONE_NUMBER_ID", "test_phone_number_id")
-	os.Setenv("MACROKIOSK_USERNAME", "test_username")
-	os.Setenv("MACROKIOSK_PASSWORD", "test_password")
-	os.Setenv("MACROKIOSK_SENDER_ID", "test_sender")
-	os.Setenv("JWT_SECRET", "test_jwt_secret")
+	cfg, err := loadTestConfig()
+	if err != nil {
+		return err
+	}
+	testConfig = cfg
 
 	// Initialize services
-	if err := utils.InitWhatsApp(); err != nil {
+	if err := utils.InitWhatsApp(cfg.WhatsApp); err != nil {
 		return fmt.Errorf("failed to initialize WhatsApp: %v", err)
 	}
 
-	if err := utils.InitMacroKiosk(); err != nil {
+	if err := utils.InitMacroKiosk(cfg.MacroKiosk); err != nil {
 		return fmt.Errorf("failed to initialize MacroKiosk: %v", err)
 	}
 
+	os.Remove(testMessageSinkPath)
+	if err := utils.InitMessageProviders(cfg.OTP); err != nil {
+		return fmt.Errorf("failed to initialize message providers: %v", err)
+	}
+
+	if err := utils.InitWebAuthn(cfg.WebAuthn); err != nil {
+		return fmt.Errorf("failed to initialize WebAuthn: %v", err)
+	}
+
+	if err := utils.InitPhoneNumberPepper(cfg.Secrets.PhoneNumberPepper); err != nil {
+		return fmt.Errorf("failed to initialize phone number pepper: %v", err)
+	}
+
 	return nil
 }
 
@@ -71,8 +105,25 @@ func addAuthHeader(req *http.Request, token string) {
 	}
 }
 
-// setupTest sets up the test environment
-func setupTest(t *testing.T) *http.ServeMux {
+// setupTest sets up the test environment. The test is skipped when StarkNet
+// is not reachable.
+func setupTest(t *testing.T) http.Handler {
+	router := setupNATSTest(t)
+
+	// Setup StarkNet
+	setupTestStarkNet(t)
+	if infinirewards.Client != nil {
+		testLogger.Printf("✅ StarkNet client initialized")
+	} else {
+		testLogger.Printf("⚠️ StarkNet client not initialized")
+	}
+
+	return router
+}
+
+// setupNATSTest sets up the test environment without StarkNet, for tests that
+// only need the embedded NATS server
+func setupNATSTest(t *testing.T) http.Handler {
 	// Initialize test logger first
 	testLogger = log.New(os.Stdout, "[TEST] ", log.LstdFlags|log.Lshortfile|log.Lmicroseconds)
 	testLogger.Printf("Setting up test environment for: %s", t.Name())
@@ -85,12 +136,6 @@ func setupTest(t *testing.T) *http.ServeMux {
 	}
 	testLogger.Printf("✅ Logs handler initialized")
 
-	// Initialize JWT signing keys
-	if err := setupTestJWTKeys(); err != nil {
-		t.Fatalf("Failed to setup JWT keys: %v", err)
-	}
-	testLogger.Printf("✅ JWT keys initialized")
-
 	// Initialize required services
 	if err := initializeServices(); err != nil {
 		testLogger.Printf("❌ Service initialization failed: %v", err)
@@ -105,13 +150,11 @@ func setupTest(t *testing.T) *http.ServeMux {
 	}
 	testLogger.Printf("✅ NATS setup completed")
 
-	// Setup StarkNet
-	setupTestStarkNet(t)
-	if infinirewards.Client != nil {
-		testLogger.Printf("✅ StarkNet client initialized")
-	} else {
-		testLogger.Printf("⚠️ StarkNet client not initialized")
+	// Initialize JWT signing keys, which are stored in NATS KV
+	if err := setupTestJWTKeys(); err != nil {
+		t.Fatalf("Failed to setup JWT keys: %v", err)
 	}
+	testLogger.Printf("✅ JWT keys initialized")
 
 	// Create and return router
 	router := setupTestRouter()
@@ -126,19 +169,8 @@ func setupTest(t *testing.T) *http.ServeMux {
 
 // Add this function to setup JWT keys for testing
 func setupTestJWTKeys() error {
-	// Create test directories
-	testPrivateKeyDir := ".private_test"
-	testPublicKeyDir := ".public_test"
-
-	// Clean up any existing test directories
-	os.RemoveAll(testPrivateKeyDir)
-	os.RemoveAll(testPublicKeyDir)
-
-	// Set test directories for JWT package
-	jwt.SetKeyDirectories(testPrivateKeyDir, testPublicKeyDir)
-
 	// Initialize JWT keys
-	if err := jwt.InitKeys(); err != nil {
+	if err := jwt.InitKeys(testConfig.Secrets.JWTKeyEncryptionKey); err != nil {
 		return fmt.Errorf("failed to initialize JWT keys: %w", err)
 	}
 
@@ -174,6 +206,11 @@ func setupLogsHandler() error {
 func cleanup() error {
 	testLogger.Println("Starting cleanup process")
 
+	// Stop background work before NATS goes away
+	worker.Stop()
+	notifications.Stop()
+	jwt.StopKeys()
+
 	// Clean up NATS
 	if nats.NC != nil {
 		testLogger.Println("Cleaning up NATS KV buckets")
@@ -191,10 +228,9 @@ func cleanup() error {
 		natsServer.WaitForShutdown()
 	}
 
-	// Clean up JWT test directories
-	testLogger.Println("Cleaning up JWT test directories")
-	os.RemoveAll(".private_test")
-	os.RemoveAll(".public_test")
+	if natsStoreDir != "" {
+		os.RemoveAll(natsStoreDir)
+	}
 
 	// Clean up test log files
 	testLogger.Println("Cleaning up test log files")
@@ -205,6 +241,36 @@ func cleanup() error {
 		}
 	}
 
+	os.Remove(testMessageSinkPath)
+
 	testLogger.Println("Cleanup completed")
 	return nil
 }
+
+// loadTestConfig loads the test profile from the config directory of the
+// repository, with the values the tests check against set on top. The devnet
+// accounts of the Starknet tests are read from .env.
+func loadTestConfig() (*config.Config, error) {
+	godotenv.Load(".env")
+	os.Setenv("CONFIG_DIR", filepath.Join("..", "..", "config"))
+
+	cfg, err := config.LoadProfile(config.ProfileTest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load test configuration: %w", err)
+	}
+
+	cfg.WhatsApp.Token = "test_whatsapp_token"
+	cfg.WhatsApp.PhoneID = "test_phone_number_id"
+	cfg.WhatsApp.WebhookVerifyToken = testWhatsAppVerifyToken
+	cfg.WhatsApp.AppSecret = testWhatsAppAppSecret
+	cfg.MacroKiosk.User = "test_username"
+	cfg.MacroKiosk.Password = "test_password"
+	cfg.MacroKiosk.ServiceID = "test_sender"
+	cfg.MacroKiosk.DLRToken = testMacroKioskDLRToken
+	cfg.WebAuthn.RPID = testWebAuthnRPID
+	cfg.WebAuthn.RPOrigins = []string{testWebAuthnOrigin}
+	cfg.OTP.FileSinkPath = testMessageSinkPath
+	// Encryption key for private keys stored in the jwtKeys bucket
+	cfg.Secrets.JWTKeyEncryptionKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+	return cfg, nil
+}
@@ -2,10 +2,15 @@ package tests
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"infinirewards/commands"
 	"infinirewards/models"
+	"infinirewards/nats"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,8 +23,9 @@ func TestUserManagement(t *testing.T) {
 		testUser := createTestUserWithAuth(t, router)
 
 		updateReq := models.UpdateUserRequest{
-			Name:  "Updated Name",
-			Email: "updated@example.com",
+			Name:   "Updated Name",
+			Email:  "updated@example.com",
+			Locale: "ms_my",
 		}
 		reqBody, _ := json.Marshal(updateReq)
 
@@ -37,6 +43,7 @@ func TestUserManagement(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, updateReq.Name, updatedUser.Name)
 		assert.Equal(t, updateReq.Email, updatedUser.Email)
+		assert.Equal(t, "ms-MY", updatedUser.Locale)
 	})
 
 	t.Run("API Key Management", func(t *testing.T) {
@@ -72,10 +79,10 @@ func TestUserManagement(t *testing.T) {
 
 		assert.Equal(t, http.StatusOK, w.Code)
 
-		var apiKeys []*models.APIKey
+		var apiKeys models.Page[models.APIKey]
 		err = json.Unmarshal(w.Body.Bytes(), &apiKeys)
 		assert.NoError(t, err)
-		assert.NotEmpty(t, apiKeys)
+		assert.NotEmpty(t, apiKeys.Items)
 
 		// Delete API Key
 		req = httptest.NewRequest("DELETE", "/user/api-keys/"+apiKey.ID, nil)
@@ -95,9 +102,10 @@ func TestUserManagement(t *testing.T) {
 
 		assert.Equal(t, http.StatusOK, w.Code)
 
+		apiKeys = models.Page[models.APIKey]{}
 		err = json.Unmarshal(w.Body.Bytes(), &apiKeys)
 		assert.NoError(t, err)
-		assert.Empty(t, apiKeys)
+		assert.Empty(t, apiKeys.Items)
 	})
 
 	t.Run("Delete User", func(t *testing.T) {
@@ -139,4 +147,351 @@ func TestUserManagement(t *testing.T) {
 		assert.Equal(t, testUser.User.PhoneNumber, user.PhoneNumber)
 		assert.Empty(t, user.PrivateKey, "Private key should not be returned")
 	})
+
+	t.Run("Conditional Update", func(t *testing.T) {
+		token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+		getUser := func(t *testing.T) string {
+			req := httptest.NewRequest("GET", "/user", nil)
+			addAuthHeader(req, token.AccessToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+			return w.Header().Get("ETag")
+		}
+
+		updateUser := func(t *testing.T, name string, ifMatch string) *httptest.ResponseRecorder {
+			reqBody, _ := json.Marshal(models.UpdateUserRequest{Name: name})
+			req := httptest.NewRequest("PUT", "/user", bytes.NewBuffer(reqBody))
+			req.Header.Set("Content-Type", "application/json")
+			if ifMatch != "" {
+				req.Header.Set("If-Match", ifMatch)
+			}
+			addAuthHeader(req, token.AccessToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		etag := getUser(t)
+		assert.NotEmpty(t, etag, "GET /user should return an ETag")
+
+		// The first writer with the ETag wins
+		w := updateUser(t, "First Writer", etag)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		newETag := w.Header().Get("ETag")
+		assert.NotEmpty(t, newETag)
+		assert.NotEqual(t, etag, newETag, "An update should change the ETag")
+		assert.Equal(t, newETag, getUser(t))
+
+		// The second writer based on the same read is rejected
+		w = updateUser(t, "Second Writer", etag)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code, "Response body: %s", w.Body.String())
+		assert.Equal(t, newETag, w.Header().Get("ETag"), "412 should return the current ETag")
+
+		var errResp models.ErrorResponse
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &errResp))
+		assert.Equal(t, "PRECONDITION_FAILED", errResp.Code)
+
+		user := &models.User{}
+		assert.NoError(t, user.GetUser(context.Background(), token.User))
+		assert.Equal(t, "First Writer", user.Name, "Rejected update should not be written")
+
+		// Without If-Match the update applies to the latest revision
+		w = updateUser(t, "Unconditional", "")
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		w = updateUser(t, "Any Revision", "*")
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+	})
+
+	t.Run("Concurrent Modifications", func(t *testing.T) {
+		ctx := context.Background()
+		token := requestOTPAndAuthenticate(t, router, generateTestPhoneNumber())
+
+		// A stale copy cannot overwrite a newer write
+		stale := &models.User{}
+		assert.NoError(t, stale.GetUser(ctx, token.User))
+
+		_, err := models.ModifyUser(ctx, token.User, func(user *models.User) error {
+			user.PrivateKey = "0xprivate"
+			return nil
+		})
+		assert.NoError(t, err)
+
+		stale.Name = "Stale"
+		err = stale.UpdateUser(ctx)
+		assert.True(t, nats.IsConflict(err), "Stale update should conflict: %v", err)
+
+		// Modifications racing each other are all applied
+		var wg sync.WaitGroup
+		for _, role := range []models.Role{models.RoleMerchant, models.RoleAdmin} {
+			wg.Add(1)
+			go func(role models.Role) {
+				defer wg.Done()
+				_, err := models.ModifyUser(ctx, token.User, func(user *models.User) error {
+					user.AddRole(role)
+					return nil
+				})
+				assert.NoError(t, err)
+			}(role)
+		}
+		wg.Wait()
+
+		user := &models.User{}
+		assert.NoError(t, user.GetUser(ctx, token.User))
+		assert.Equal(t, "0xprivate", user.PrivateKey, "Private key should not be lost")
+		assert.Contains(t, user.Roles, models.RoleMerchant)
+		assert.Contains(t, user.Roles, models.RoleAdmin)
+	})
+
+	t.Run("Role Management", func(t *testing.T) {
+		testUser := createTestUserWithAuth(t, router)
+		admin := createTestAdminWithAuth(t, router)
+
+		rolesReq := models.SetUserRolesRequest{
+			Roles: []models.Role{models.RoleStaff},
+		}
+		reqBody, _ := json.Marshal(rolesReq)
+
+		// Only admins can change roles
+		req := httptest.NewRequest("PUT", "/admin/users/"+testUser.User.ID+"/roles", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, testUser.Token.AccessToken)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+
+		req = httptest.NewRequest("PUT", "/admin/users/"+testUser.User.ID+"/roles", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, admin.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		var user models.User
+		err := json.Unmarshal(w.Body.Bytes(), &user)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []models.Role{models.RoleUser, models.RoleStaff}, user.Roles)
+
+		// Staff can read other users once their token carries the role
+		testUser.Token = refreshTestToken(t, router, testUser.Token)
+
+		req = httptest.NewRequest("GET", "/admin/users/"+admin.User.ID, nil)
+		addAuthHeader(req, testUser.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+	})
+
+	t.Run("Phone Number Change", func(t *testing.T) {
+		oldPhoneNumber := generateTestPhoneNumber()
+		newPhoneNumber := generateTestPhoneNumber()
+		token := requestOTPAndAuthenticate(t, router, oldPhoneNumber)
+		assert.False(t, models.IsLegacyUserID(token.User), "New users should get a stable ID")
+
+		change := startTestPhoneChange(t, router, "/user/phone", token.AccessToken, newPhoneNumber)
+		assert.NotEmpty(t, change.OldVerificationID, "Current number should receive an OTP")
+
+		// Both numbers must be verified
+		verifyReq := models.VerifyPhoneChangeRequest{
+			ID:       change.ID,
+			NewToken: readTestOTP(t, change.NewVerificationID),
+			Device:   "test_device",
+		}
+		w := verifyTestPhoneChange(router, verifyReq)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		verifyReq.OldToken = readTestOTP(t, change.OldVerificationID)
+		w = verifyTestPhoneChange(router, verifyReq)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		var authResp models.AuthenticateResponse
+		err := json.Unmarshal(w.Body.Bytes(), &authResp)
+		assert.NoError(t, err)
+		assert.Equal(t, token.User, authResp.Token.User, "User ID should not change")
+
+		// The new number belongs to the user and the old one is released
+		userID, err := models.LookupPhoneNumber(context.Background(), newPhoneNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, token.User, userID)
+		_, err = models.LookupPhoneNumber(context.Background(), oldPhoneNumber)
+		assert.Error(t, err)
+
+		// A phone change cannot be verified twice
+		w = verifyTestPhoneChange(router, verifyReq)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "Response body: %s", w.Body.String())
+	})
+
+	t.Run("Assisted Phone Number Change Moves Legacy User", func(t *testing.T) {
+		ctx := context.Background()
+		oldPhoneNumber := generateTestPhoneNumber()
+		newPhoneNumber := generateTestPhoneNumber()
+
+		// Users created before stable IDs are keyed by their phone number hash
+		legacyUser := models.User{
+			ID:          models.LegacyPhoneNumberHash(oldPhoneNumber),
+			PhoneNumber: oldPhoneNumber,
+			Roles:       []models.Role{models.RoleUser},
+		}
+		err := legacyUser.UpdateUser(ctx)
+		assert.NoError(t, err)
+
+		token := requestOTPAndAuthenticate(t, router, oldPhoneNumber)
+		assert.Equal(t, legacyUser.ID, token.User)
+
+		reqBody, _ := json.Marshal(models.CreateAPIKeyRequest{Name: "Legacy Key"})
+		req := httptest.NewRequest("POST", "/user/api-keys", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		addAuthHeader(req, token.AccessToken)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusCreated, w.Code, "Response body: %s", w.Body.String())
+
+		var apiKey models.APIKey
+		err = json.Unmarshal(w.Body.Bytes(), &apiKey)
+		assert.NoError(t, err)
+
+		// Only support can start a change without the current number
+		change := startTestPhoneChange(t, router, "/admin/users/"+legacyUser.ID+"/phone", createTestAdminWithAuth(t, router).Token.AccessToken, newPhoneNumber)
+		assert.Empty(t, change.OldVerificationID, "Lost number should not receive an OTP")
+
+		w = verifyTestPhoneChange(router, models.VerifyPhoneChangeRequest{
+			ID:       change.ID,
+			NewToken: readTestOTP(t, change.NewVerificationID),
+			Device:   "test_device",
+		})
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		var authResp models.AuthenticateResponse
+		err = json.Unmarshal(w.Body.Bytes(), &authResp)
+		assert.NoError(t, err)
+		assert.False(t, models.IsLegacyUserID(authResp.Token.User), "User should be moved to a stable ID")
+
+		user := models.User{}
+		err = user.GetUser(ctx, authResp.Token.User)
+		assert.NoError(t, err)
+		assert.Equal(t, newPhoneNumber, user.PhoneNumber)
+		assert.Equal(t, legacyUser.ID, user.LegacyID)
+		assert.Error(t, user.GetUser(ctx, legacyUser.ID), "Legacy record should be removed")
+
+		// Tokens and API keys issued before the move keep working
+		assert.Equal(t, authResp.Token.User, refreshTestToken(t, router, token).User)
+
+		reqBody, _ = json.Marshal(models.AuthenticateRequest{
+			ID:        apiKey.ID,
+			Token:     apiKey.Secret,
+			Method:    "secret",
+			Signature: "test_device_signature",
+			Device:    "test_device",
+		})
+		req = httptest.NewRequest("POST", "/auth/authenticate", bytes.NewBuffer(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		err = json.Unmarshal(w.Body.Bytes(), &authResp)
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID, authResp.Token.User)
+
+		// The key can also be deleted by the ID it was issued with
+		req = httptest.NewRequest("DELETE", "/user/api-keys/"+apiKey.ID, nil)
+		addAuthHeader(req, authResp.Token.AccessToken)
+
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		_, err = models.GetAPIKey(ctx, apiKey.ID)
+		assert.Error(t, err, "Deleted API key should not be found")
+	})
+
+	t.Run("Migrate Legacy User IDs", func(t *testing.T) {
+		ctx := context.Background()
+		phoneNumber := generateTestPhoneNumber()
+
+		legacyUser := models.User{
+			ID:          models.LegacyPhoneNumberHash(phoneNumber),
+			PhoneNumber: phoneNumber,
+			Roles:       []models.Role{models.RoleUser},
+		}
+		err := legacyUser.UpdateUser(ctx)
+		assert.NoError(t, err)
+
+		token := requestOTPAndAuthenticate(t, router, phoneNumber)
+		assert.Equal(t, legacyUser.ID, token.User)
+
+		result, err := commands.MigrateUserIDs(ctx, commands.MigrateUserIDsOptions{DryRun: true})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, result.Moved, 1)
+		assert.NoError(t, legacyUser.GetUser(ctx, legacyUser.ID), "Dry run should not move users")
+
+		result, err = commands.MigrateUserIDs(ctx, commands.MigrateUserIDsOptions{})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, result.Moved, 1)
+
+		userID, err := models.LookupPhoneNumber(ctx, phoneNumber)
+		assert.NoError(t, err)
+		assert.False(t, models.IsLegacyUserID(userID), "User should be moved to a stable ID")
+		assert.Equal(t, userID, models.ResolveUserID(ctx, legacyUser.ID))
+
+		user := models.User{}
+		err = user.GetUser(ctx, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, legacyUser.ID, user.LegacyID)
+		assert.Error(t, user.GetUser(ctx, legacyUser.ID), "Legacy record should be removed")
+
+		// Running it again leaves migrated users alone
+		_, err = commands.MigrateUserIDs(ctx, commands.MigrateUserIDsOptions{})
+		assert.NoError(t, err)
+		resolvedID, err := models.LookupPhoneNumber(ctx, phoneNumber)
+		assert.NoError(t, err)
+		assert.Equal(t, userID, resolvedID)
+
+		// Sessions started before the migration keep working
+		assert.Equal(t, userID, refreshTestToken(t, router, token).User)
+	})
+}
+
+// errStoreUnavailable is returned by failingUserStore for every write
+var errStoreUnavailable = errors.New("store unavailable")
+
+// failingUserStore fails to create users, as a store that is down would
+type failingUserStore struct {
+	models.UserStore
+}
+
+func (failingUserStore) CreateUser(ctx context.Context, user *models.User) error {
+	return errStoreUnavailable
+}
+
+func TestCreateUserStoreFailure(t *testing.T) {
+	setupNATSTest(t)
+	ctx := context.Background()
+
+	stores := models.NewKVStores()
+	stores.Users = failingUserStore{UserStore: stores.Users}
+	failingCtx := models.WithStores(ctx, stores)
+
+	phoneNumber := generateTestPhoneNumber()
+	user := &models.User{PhoneNumber: phoneNumber}
+	err := user.CreateUser(failingCtx)
+	assert.ErrorIs(t, err, errStoreUnavailable)
+
+	// The phone number is not left reserved for a user that was never stored
+	_, err = models.LookupPhoneNumber(ctx, phoneNumber)
+	assert.Error(t, err, "Phone number should be released")
+
+	user = &models.User{PhoneNumber: phoneNumber}
+	assert.NoError(t, user.CreateUser(ctx), "Phone number should register again")
 }
@@ -0,0 +1,151 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testWebAuthnRPID   = "localhost"
+	testWebAuthnOrigin = "http://localhost:8080"
+)
+
+// testAuthenticator is a software passkey authenticator producing "none"
+// attestations and ES256 assertions
+type testAuthenticator struct {
+	credentialID []byte
+	privateKey   *ecdsa.PrivateKey
+	userHandle   []byte
+	signCount    uint32
+}
+
+// webAuthnOptions is the part of the ceremony options the authenticator needs
+type webAuthnOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		User      struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	} `json:"publicKey"`
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err, "Failed to generate authenticator key")
+
+	credentialID := make([]byte, 32)
+	rand.Read(credentialID)
+
+	return &testAuthenticator{
+		credentialID: credentialID,
+		privateKey:   privateKey,
+	}
+}
+
+// register answers navigator.credentials.create options with a credential
+func (a *testAuthenticator) register(t *testing.T, options json.RawMessage) json.RawMessage {
+	var opts webAuthnOptions
+	assert.NoError(t, json.Unmarshal(options, &opts), "Failed to parse creation options")
+
+	userHandle, err := base64.RawURLEncoding.DecodeString(opts.PublicKey.User.ID)
+	assert.NoError(t, err, "Failed to decode user handle")
+	a.userHandle = userHandle
+
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: padCoordinate(a.privateKey.X.Bytes()),
+		-3: padCoordinate(a.privateKey.Y.Bytes()),
+	})
+	assert.NoError(t, err, "Failed to encode public key")
+
+	// Attested credential data: AAGUID, credential ID length, credential ID, public key
+	attested := make([]byte, 16, 16+2+len(a.credentialID)+len(publicKey))
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, publicKey...)
+
+	// User present, user verified and attested credential data included
+	authData := append(a.authenticatorData(0x01|0x04|0x40), attested...)
+
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	assert.NoError(t, err, "Failed to encode attestation object")
+
+	clientData := a.clientData(t, "webauthn.create", opts.PublicKey.Challenge)
+
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"attestationObject": base64.RawURLEncoding.EncodeToString(attestationObject),
+		},
+	})
+	return credential
+}
+
+// login answers navigator.credentials.get options with an assertion
+func (a *testAuthenticator) login(t *testing.T, options json.RawMessage) json.RawMessage {
+	var opts webAuthnOptions
+	assert.NoError(t, json.Unmarshal(options, &opts), "Failed to parse request options")
+
+	a.signCount++
+	authData := a.authenticatorData(0x01 | 0x04)
+	clientData := a.clientData(t, "webauthn.get", opts.PublicKey.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.privateKey, digest[:])
+	assert.NoError(t, err, "Failed to sign assertion")
+
+	credential, _ := json.Marshal(map[string]interface{}{
+		"id":    base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"rawId": base64.RawURLEncoding.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData),
+			"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+			"signature":         base64.RawURLEncoding.EncodeToString(signature),
+			"userHandle":        base64.RawURLEncoding.EncodeToString(a.userHandle),
+		},
+	})
+	return credential
+}
+
+func (a *testAuthenticator) authenticatorData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testWebAuthnRPID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+func (a *testAuthenticator) clientData(t *testing.T, ceremony string, challenge string) []byte {
+	clientData, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testWebAuthnOrigin,
+	})
+	assert.NoError(t, err, "Failed to encode client data")
+	return clientData
+}
+
+// padCoordinate left pads an EC coordinate to 32 bytes
+func padCoordinate(b []byte) []byte {
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return padded
+}
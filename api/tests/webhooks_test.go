@@ -0,0 +1,312 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"infinirewards/models"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"infinirewards/worker"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookFlow(t *testing.T) {
+	router := setupNATSTest(t)
+
+	err := worker.Start()
+	assert.NoError(t, err, "Failed to start webhook worker")
+	defer worker.Stop()
+
+	t.Run("WhatsApp Subscription Challenge", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/webhooks/whatsapp?hub.mode=subscribe&hub.verify_token="+testWhatsAppVerifyToken+"&hub.challenge=1158201444", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		assert.Equal(t, "1158201444", w.Body.String())
+
+		req = httptest.NewRequest("GET", "/webhooks/whatsapp?hub.mode=subscribe&hub.verify_token=wrong_token&hub.challenge=1158201444", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code, "Response body: %s", w.Body.String())
+	})
+
+	t.Run("WhatsApp Webhook Signature", func(t *testing.T) {
+		payload := whatsAppTestPayload("messages")
+
+		req := httptest.NewRequest("POST", "/webhooks/whatsapp", bytes.NewBuffer(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(make([]byte, 32)))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "Response body: %s", w.Body.String())
+
+		req = httptest.NewRequest("POST", "/webhooks/whatsapp", bytes.NewBuffer(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusUnauthorized, w.Code, "Unsigned webhook should be rejected")
+	})
+
+	t.Run("WhatsApp Webhook Processing", func(t *testing.T) {
+		events := make(chan *models.WhatsAppWebhookEvent, 1)
+		worker.HandleWhatsApp("test_processing", func(ctx context.Context, event *models.WhatsAppWebhookEvent) error {
+			events <- event
+			return nil
+		})
+
+		w := postWhatsAppTestWebhook(router, whatsAppTestPayload("test_processing"))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		select {
+		case event := <-events:
+			assert.Equal(t, "test_entry", event.EntryID)
+			if assert.Len(t, event.Change.Value.Messages, 1) {
+				assert.Equal(t, "hello", event.Change.Value.Messages[0].Text.Body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook was not processed")
+		}
+	})
+
+	t.Run("WhatsApp Webhook Dead Letter Queue", func(t *testing.T) {
+		maxDeliver, retryDelay := worker.MaxDeliver, worker.RetryDelay
+		worker.MaxDeliver, worker.RetryDelay = 2, 10*time.Millisecond
+		defer func() {
+			worker.MaxDeliver, worker.RetryDelay = maxDeliver, retryDelay
+		}()
+
+		attempts := make(chan struct{}, 10)
+		worker.HandleWhatsApp("test_failure", func(ctx context.Context, event *models.WhatsAppWebhookEvent) error {
+			attempts <- struct{}{}
+			return fmt.Errorf("test failure")
+		})
+
+		w := postWhatsAppTestWebhook(router, whatsAppTestPayload("test_failure"))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		subject := nats.DeadLetterSubject(nats.WebhookSubject("whatsapp", "test_failure"))
+		assert.Eventually(t, func() bool {
+			msg, err := nats.GetStreamMsg(context.Background(), nats.WebhooksDLQStream, subject)
+			return err == nil && msg != nil && (*msg).Headers().Get("Dead-Letter-Reason") == "test failure"
+		}, 5*time.Second, 50*time.Millisecond, "Webhook should be moved to the dead-letter queue")
+		assert.Len(t, attempts, 2, "Webhook should be tried MaxDeliver times")
+	})
+
+	t.Run("MacroKiosk Delivery Report", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/webhooks/macrokiosk/dlr?token=wrong_token&msgid=123&status=DELIVERED", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code, "Response body: %s", w.Body.String())
+
+		req = httptest.NewRequest("GET", "/webhooks/macrokiosk/dlr?token="+testMacroKioskDLRToken+"&status=DELIVERED", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, "Response body: %s", w.Body.String())
+
+		// Reports for messages sent by another system are acknowledged
+		req = httptest.NewRequest("GET", "/webhooks/macrokiosk/dlr?token="+testMacroKioskDLRToken+"&msgid=unknown&status=DELIVERED", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		// Reports update the status of SMS sent by this service
+		record := models.MessageDelivery{
+			ID: models.MessageDeliveryID("macrokiosk", "test_sms_1"),
+			Delivery: utils.Delivery{
+				Provider:          "macrokiosk",
+				Channel:           utils.ChannelSMS,
+				ProviderMessageID: "test_sms_1",
+				Status:            utils.DeliveryStatusSent,
+			},
+		}
+		err := record.CreateMessageDelivery(context.Background())
+		assert.NoError(t, err)
+
+		req = httptest.NewRequest("POST", "/webhooks/macrokiosk/dlr", strings.NewReader("token="+testMacroKioskDLRToken+"&msgid=test_sms_1&status=UNDELIVERED"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		err = record.GetMessageDelivery(context.Background(), record.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, utils.DeliveryStatusFailed, record.Status)
+		assert.Equal(t, "UNDELIVERED", record.FailureReason)
+	})
+
+	t.Run("WhatsApp Status Updates Delivery", func(t *testing.T) {
+		record := models.MessageDelivery{
+			ID: models.MessageDeliveryID("whatsapp", "wamid.test_status"),
+			Delivery: utils.Delivery{
+				Provider:          "whatsapp",
+				Channel:           utils.ChannelWhatsApp,
+				ProviderMessageID: "wamid.test_status",
+				Status:            utils.DeliveryStatusSent,
+			},
+		}
+		err := record.CreateMessageDelivery(context.Background())
+		assert.NoError(t, err)
+
+		payload, _ := json.Marshal(models.WebhookResponse{
+			Object: "whatsapp_business_account",
+			Entry: []models.Entry{{
+				ID: "test_entry",
+				Changes: []models.Change{{
+					Field: "messages",
+					Value: models.ChangeValue{
+						MessagingProduct: "whatsapp",
+						Statuses: []models.Status{
+							{ID: "wamid.test_status", Status: "read"},
+							{ID: "wamid.unknown", Status: "delivered"},
+						},
+					},
+				}},
+			}},
+		})
+		w := postWhatsAppTestWebhook(router, payload)
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+
+		assert.Eventually(t, func() bool {
+			err := record.GetMessageDelivery(context.Background(), record.ID)
+			return err == nil && record.Status == utils.DeliveryStatusRead
+		}, 5*time.Second, 50*time.Millisecond, "Status webhook should mark the message read")
+	})
+
+	t.Run("WhatsApp Reachability", func(t *testing.T) {
+		ctx := context.Background()
+		phoneNumber := generateTestPhoneNumber()
+
+		reachability, err := models.GetReachability(ctx, utils.ChannelWhatsApp, phoneNumber)
+		assert.NoError(t, err)
+		assert.Nil(t, reachability, "Reachability of a new number should be unknown")
+
+		postStatus := func(status models.Status) {
+			payload, _ := json.Marshal(models.WebhookResponse{
+				Object: "whatsapp_business_account",
+				Entry: []models.Entry{{
+					ID: "test_entry",
+					Changes: []models.Change{{
+						Field: "messages",
+						Value: models.ChangeValue{
+							MessagingProduct: "whatsapp",
+							Statuses:         []models.Status{status},
+						},
+					}},
+				}},
+			})
+			w := postWhatsAppTestWebhook(router, payload)
+			assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		}
+		waitForReachability := func(reachable bool) {
+			assert.Eventually(t, func() bool {
+				reachability, err := models.GetReachability(ctx, utils.ChannelWhatsApp, phoneNumber)
+				return err == nil && reachability != nil && reachability.Reachable == reachable
+			}, 5*time.Second, 50*time.Millisecond, "Number should be recorded as reachable=%t", reachable)
+		}
+
+		// Failures of the conversation window say nothing about the number
+		postStatus(models.Status{
+			ID:          "wamid.test_window",
+			RecipientID: strings.TrimPrefix(phoneNumber, "+"),
+			Status:      "failed",
+			Errors:      []models.Error{{Code: 131047, Title: "Re-engagement message"}},
+		})
+
+		postStatus(models.Status{
+			ID:          "wamid.test_unreachable",
+			RecipientID: strings.TrimPrefix(phoneNumber, "+"),
+			Status:      "failed",
+			Errors:      []models.Error{{Code: 131026, Title: "Message undeliverable"}},
+		})
+		waitForReachability(false)
+
+		// WhatsApp is skipped for the number without sending it anything
+		_, err = models.SendMessage(ctx, utils.Message{To: phoneNumber, Body: "test", Reference: "test_reachability"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{utils.ChannelWhatsApp}, readTestMessage(t, "test_reachability").Unreachable)
+
+		// Unless the message is restricted to WhatsApp
+		_, err = models.SendMessage(ctx, utils.Message{To: phoneNumber, Body: "test", Reference: "test_reachability_channel", Channel: utils.ChannelWhatsApp})
+		assert.NoError(t, err)
+		assert.Empty(t, readTestMessage(t, "test_reachability_channel").Unreachable)
+
+		postStatus(models.Status{
+			ID:          "wamid.test_reachable",
+			RecipientID: strings.TrimPrefix(phoneNumber, "+"),
+			Status:      "delivered",
+		})
+		waitForReachability(true)
+
+		_, err = models.SendMessage(ctx, utils.Message{To: phoneNumber, Body: "test", Reference: "test_reachability_reachable"})
+		assert.NoError(t, err)
+		assert.Empty(t, readTestMessage(t, "test_reachability_reachable").Unreachable)
+
+		// Numbers that message the business are on WhatsApp
+		otherNumber := generateTestPhoneNumber()
+		assert.NoError(t, models.RecordReachability(ctx, utils.ChannelWhatsApp, otherNumber, false))
+		w := postWhatsAppTestWebhook(router, whatsAppTestMessagePayload(botTestMessage(otherNumber, "hello")))
+		assert.Equal(t, http.StatusOK, w.Code, "Response body: %s", w.Body.String())
+		assert.Eventually(t, func() bool {
+			reachability, err := models.GetReachability(ctx, utils.ChannelWhatsApp, otherNumber)
+			return err == nil && reachability != nil && reachability.Reachable
+		}, 5*time.Second, 50*time.Millisecond, "Inbound message should mark the number reachable")
+	})
+}
+
+// whatsAppTestPayload returns a webhook with one inbound text message for field
+func whatsAppTestPayload(field string) []byte {
+	payload, _ := json.Marshal(models.WebhookResponse{
+		Object: "whatsapp_business_account",
+		Entry: []models.Entry{{
+			ID: "test_entry",
+			Changes: []models.Change{{
+				Field: field,
+				Value: models.ChangeValue{
+					MessagingProduct: "whatsapp",
+					Messages: []models.Message{{
+						From:      "60123456789",
+						ID:        fmt.Sprintf("wamid.%d", time.Now().UnixNano()),
+						Timestamp: fmt.Sprint(time.Now().Unix()),
+						Type:      "text",
+						Text:      models.Text{Body: "hello"},
+					}},
+				},
+			}},
+		}},
+	})
+	return payload
+}
+
+// postWhatsAppTestWebhook posts a payload signed with the test app secret
+func postWhatsAppTestWebhook(router http.Handler, payload []byte) *httptest.ResponseRecorder {
+	mac := hmac.New(sha256.New, []byte(testWhatsAppAppSecret))
+	mac.Write(payload)
+
+	req := httptest.NewRequest("POST", "/webhooks/whatsapp", bytes.NewBuffer(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
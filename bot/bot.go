@@ -0,0 +1,167 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/utils"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// MerchantID is the merchant whose points and rewards the bot answers with,
+// usually the owner of the WhatsApp business number
+var MerchantID string
+
+// errNoMerchant is returned by commands that need MerchantID when it is not set
+var errNoMerchant = errors.New("no merchant configured for the bot")
+
+// Request is a command sent by a user
+type Request struct {
+	// User is the user the WhatsApp number belongs to
+	User *models.User
+	// Args are the words of the message after the command
+	Args []string
+}
+
+// Command answers a command. The reply is sent to the user over WhatsApp.
+type Command func(ctx context.Context, request *Request) (utils.Message, error)
+
+var (
+	commandsMu sync.RWMutex
+	commands   = map[string]Command{
+		"help":    helpCommand,
+		"balance": balanceCommand,
+		"rewards": rewardsCommand,
+		"redeem":  redeemCommand,
+		"confirm": confirmCommand,
+	}
+)
+
+// HandleCommand registers the command for the first word of a message,
+// replacing the previous one
+func HandleCommand(name string, command Command) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	commands[strings.ToLower(name)] = command
+}
+
+// HandleMessage answers an inbound WhatsApp message. Text is routed by its
+// first word; list and button replies by the ID of the row or button, which
+// holds the command to run. Only lookups are retried: each message is claimed
+// before its command runs, so a redelivered webhook skips the messages it
+// already answered, and failures are answered and logged.
+func HandleMessage(ctx context.Context, message models.Message) error {
+	words := strings.Fields(messageCommand(message))
+	if len(words) == 0 {
+		return nil
+	}
+
+	// wa_id is the phone number without the plus sign
+	phoneNumber := "+" + strings.TrimPrefix(message.From, "+")
+	reference := "bot." + message.ID
+
+	user := &models.User{}
+	if err := user.GetUserFromPhoneNumber(ctx, phoneNumber); err != nil {
+		if !models.IsNotFound(err) {
+			return fmt.Errorf("failed to get user: %w", err)
+		}
+		reply(ctx, phoneNumber, reference, textMessage("This number is not registered with InfiniRewards yet. Sign up in the app to collect points and rewards."))
+		return nil
+	}
+
+	if err := models.ClaimBotMessage(ctx, message.ID); err != nil {
+		if errors.Is(err, models.ErrMessageClaimed) {
+			logs.Logger.Info("skipping message already handled",
+				slog.String("handler", "bot"),
+				slog.String("message_id", message.ID),
+			)
+			return nil
+		}
+		return err
+	}
+
+	commandsMu.RLock()
+	command, ok := commands[strings.ToLower(words[0])]
+	commandsMu.RUnlock()
+	if !ok {
+		command = helpCommand
+	}
+
+	response, err := command(ctx, &Request{User: user, Args: words[1:]})
+	if err != nil {
+		if errors.Is(err, errNoMerchant) {
+			response = textMessage("Points and rewards are not available on this number.")
+		} else {
+			logs.Logger.Error("bot command failed",
+				slog.String("handler", "bot"),
+				slog.String("command", words[0]),
+				slog.String("user_id", user.ID),
+				slog.String("error", err.Error()),
+			)
+			response = textMessage("Sorry, something went wrong. Please try again later.")
+		}
+	}
+
+	reply(ctx, user.PhoneNumber, reference, response)
+	return nil
+}
+
+// messageCommand returns the command of a text message or of the row or
+// button a user picked
+func messageCommand(message models.Message) string {
+	switch message.Type {
+	case "text":
+		return message.Text.Body
+	case "interactive":
+		if message.Interactive.ListReply.ID != "" {
+			return message.Interactive.ListReply.ID
+		}
+		return message.Interactive.ButtonReply.ID
+	}
+	return ""
+}
+
+func reply(ctx context.Context, phoneNumber string, reference string, message utils.Message) {
+	message.To = phoneNumber
+	message.Reference = reference
+	message.Channel = utils.ChannelWhatsApp
+
+	if _, err := models.SendMessage(ctx, message); err != nil {
+		logs.Logger.Error("failed to send bot reply",
+			slog.String("handler", "bot"),
+			slog.String("reference", reference),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func textMessage(body string) utils.Message {
+	return utils.Message{Body: body}
+}
+
+// buttonMessage shows up to three reply buttons below the body. The body is
+// also the text sent by channels without buttons.
+func buttonMessage(body string, buttons ...utils.Reply) utils.Message {
+	interactive := &utils.Interactive{
+		Type: "button",
+		Body: utils.InteractiveBody{Text: body},
+	}
+	for _, button := range buttons {
+		interactive.Action.Buttons = append(interactive.Action.Buttons, utils.Button{
+			Type:  "reply",
+			Reply: button,
+		})
+	}
+	return utils.Message{Body: body, Interactive: interactive}
+}
+
+func helpCommand(ctx context.Context, request *Request) (utils.Message, error) {
+	return buttonMessage("Hi! Send \"balance\" to see your points, \"rewards\" to see what you can redeem, or \"redeem\" and the number of a reward to redeem it.",
+		utils.Reply{ID: "balance", Title: "Balance"},
+		utils.Reply{ID: "rewards", Title: "Rewards"},
+	), nil
+}
@@ -0,0 +1,246 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/infinirewards"
+	"infinirewards/models"
+	"infinirewards/utils"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NethermindEth/starknet.go/account"
+)
+
+// maxListRows is the number of rows WhatsApp shows in a list message
+const maxListRows = 10
+
+// catalogItem is a collectible of the merchant that can be redeemed with points
+type catalogItem struct {
+	Contract    string
+	TokenID     *big.Int
+	Price       *big.Int
+	Description string
+}
+
+func balanceCommand(ctx context.Context, request *Request) (utils.Message, error) {
+	if request.User.AccountAddress == "" {
+		return textMessage("Your account is still being set up. Open the app to finish signing up."), nil
+	}
+
+	merchant, err := merchantAccount(ctx)
+	if err != nil {
+		return utils.Message{}, err
+	}
+
+	contracts, err := infinirewards.GetPointsContracts(ctx, merchant)
+	if err != nil {
+		return utils.Message{}, fmt.Errorf("failed to get points contracts: %w", err)
+	}
+
+	user, err := userAccount(request.User)
+	if err != nil {
+		return utils.Message{}, err
+	}
+
+	lines := []string{"Your points:"}
+	for _, contract := range contracts {
+		_, symbol, _, _, _, err := infinirewards.GetPointsContractDetails(ctx, contract)
+		if err != nil {
+			return utils.Message{}, fmt.Errorf("failed to get points contract details: %w", err)
+		}
+
+		balance, err := infinirewards.GetBalance(ctx, user, contract)
+		if err != nil {
+			return utils.Message{}, fmt.Errorf("failed to get balance: %w", err)
+		}
+
+		lines = append(lines, fmt.Sprintf("%s %s", balance, symbol))
+	}
+	if len(contracts) == 0 {
+		lines = append(lines, "None yet")
+	}
+
+	return buttonMessage(strings.Join(lines, "\n"),
+		utils.Reply{ID: "rewards", Title: "Rewards"},
+	), nil
+}
+
+func rewardsCommand(ctx context.Context, request *Request) (utils.Message, error) {
+	catalog, err := loadCatalog(ctx)
+	if err != nil {
+		return utils.Message{}, err
+	}
+	if len(catalog) == 0 {
+		return textMessage("There are no rewards to redeem right now."), nil
+	}
+
+	lines := []string{"Rewards you can redeem:"}
+	rows := []utils.Row{}
+	for i, item := range catalog {
+		lines = append(lines, fmt.Sprintf("%d. %s - %s points", i+1, item.Description, item.Price))
+		if len(rows) < maxListRows {
+			rows = append(rows, utils.Row{
+				ID:       fmt.Sprintf("redeem %d", i+1),
+				Title:    truncate(fmt.Sprintf("%d. %s", i+1, item.Description), 24),
+				Metadata: truncate(item.Price.String()+" points", 72),
+			})
+		}
+	}
+	lines = append(lines, "Send \"redeem\" and the number of a reward to redeem it.")
+
+	return utils.Message{
+		Body: strings.Join(lines, "\n"),
+		Interactive: &utils.Interactive{
+			Type: "list",
+			Body: utils.InteractiveBody{Text: "Pick a reward to redeem it with your points."},
+			Action: utils.InteractiveAction{
+				Button:   "View rewards",
+				Sections: []utils.Section{{Title: "Rewards", Rows: rows}},
+			},
+		},
+	}, nil
+}
+
+func redeemCommand(ctx context.Context, request *Request) (utils.Message, error) {
+	if len(request.Args) != 1 {
+		return textMessage("Send \"redeem\" and the number of a reward, e.g. \"redeem 2\". Send \"rewards\" to see the numbers."), nil
+	}
+	number, err := strconv.Atoi(request.Args[0])
+	if err != nil {
+		return textMessage("Send \"redeem\" and the number of a reward, e.g. \"redeem 2\". Send \"rewards\" to see the numbers."), nil
+	}
+
+	catalog, err := loadCatalog(ctx)
+	if err != nil {
+		return utils.Message{}, err
+	}
+	if number < 1 || number > len(catalog) {
+		return textMessage(fmt.Sprintf("There is no reward %d. Send \"rewards\" to see what you can redeem.", number)), nil
+	}
+	item := catalog[number-1]
+
+	// The contract and token are confirmed rather than the number, which
+	// changes when the catalog does
+	return buttonMessage(fmt.Sprintf("Redeem %s for %s points?", item.Description, item.Price),
+		utils.Reply{ID: fmt.Sprintf("confirm %s %s", item.Contract, item.TokenID), Title: "Redeem"},
+		utils.Reply{ID: "rewards", Title: "Back"},
+	), nil
+}
+
+func confirmCommand(ctx context.Context, request *Request) (utils.Message, error) {
+	if len(request.Args) != 2 {
+		return helpCommand(ctx, request)
+	}
+	if request.User.AccountAddress == "" {
+		return textMessage("Your account is still being set up. Open the app to finish signing up."), nil
+	}
+
+	catalog, err := loadCatalog(ctx)
+	if err != nil {
+		return utils.Message{}, err
+	}
+
+	// Only rewards of the merchant's catalog can be redeemed
+	var item *catalogItem
+	for i := range catalog {
+		if strings.EqualFold(catalog[i].Contract, request.Args[0]) && catalog[i].TokenID.String() == request.Args[1] {
+			item = &catalog[i]
+			break
+		}
+	}
+	if item == nil {
+		return textMessage("This reward is no longer available. Send \"rewards\" to see what you can redeem."), nil
+	}
+
+	user, err := userAccount(request.User)
+	if err != nil {
+		return utils.Message{}, err
+	}
+
+	txHash, err := infinirewards.Purchase(ctx, user, item.Contract, request.User.AccountAddress, item.TokenID, big.NewInt(1))
+	if err != nil {
+		return textMessage(fmt.Sprintf("We could not redeem %s. Check that you have %s points and try again.", item.Description, item.Price)), nil
+	}
+
+	return textMessage(fmt.Sprintf("You redeemed %s. Transaction: %s", item.Description, txHash)), nil
+}
+
+// loadCatalog returns the collectibles of the merchant that have not expired,
+// in the order of their contracts and token IDs
+func loadCatalog(ctx context.Context) ([]catalogItem, error) {
+	merchant, err := merchantAccount(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contracts, err := infinirewards.GetCollectibleContracts(ctx, merchant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get collectible contracts: %w", err)
+	}
+
+	now := uint64(time.Now().Unix())
+	catalog := []catalogItem{}
+	for _, contract := range contracts {
+		_, _, _, tokenIDs, prices, expiries, descriptions, _, err := infinirewards.GetDetails(ctx, contract)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get collectible details: %w", err)
+		}
+
+		for i, tokenID := range tokenIDs {
+			if i >= len(prices) || i >= len(descriptions) {
+				break
+			}
+			if i < len(expiries) && expiries[i] > 0 && expiries[i] < now {
+				continue
+			}
+			catalog = append(catalog, catalogItem{
+				Contract:    contract,
+				TokenID:     tokenID,
+				Price:       prices[i],
+				Description: descriptions[i],
+			})
+		}
+	}
+
+	return catalog, nil
+}
+
+// merchantAccount returns the account of the bot's merchant, used to read
+// its points and collectible contracts
+func merchantAccount(ctx context.Context) (*account.Account, error) {
+	if MerchantID == "" {
+		return nil, errNoMerchant
+	}
+
+	merchant := &models.Merchant{}
+	if err := merchant.GetMerchant(ctx, MerchantID); err != nil {
+		return nil, fmt.Errorf("failed to get merchant: %w", err)
+	}
+
+	user := &models.User{}
+	if err := user.GetUser(ctx, MerchantID); err != nil {
+		return nil, fmt.Errorf("failed to get merchant user: %w", err)
+	}
+
+	return infinirewards.GetAccount(user.PrivateKey, user.PublicKey, merchant.Address)
+}
+
+func userAccount(user *models.User) (*account.Account, error) {
+	account, err := infinirewards.GetAccount(user.PrivateKey, user.PublicKey, user.AccountAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user account: %w", err)
+	}
+	return account, nil
+}
+
+// truncate shortens text to the length WhatsApp allows for a field
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
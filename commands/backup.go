@@ -0,0 +1,645 @@
+package commands
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/nats"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+func init() {
+	register(&Command{
+		Name:        "backup",
+		Description: "Export KV buckets and streams to a compressed archive with checksums, encrypting secret fields",
+		Run:         runBackup,
+	})
+}
+
+func runBackup(ctx context.Context, args []string) error {
+	fs := newFlagSet("backup")
+	out := fs.String("out", "", "archive to write (default infinirewards-backup-<time>.tar.gz)")
+	buckets := fs.String("buckets", "", "comma separated KV buckets to export (default all)")
+	streams := fs.String("streams", "", "comma separated streams to export (default all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = fmt.Sprintf("infinirewards-backup-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	if err := connect(false); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer file.Close()
+
+	manifest, err := Backup(ctx, file, BackupOptions{Buckets: splitNames(*buckets), Streams: splitNames(*streams)})
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	for _, f := range slices.Concat(manifest.Buckets, manifest.Streams) {
+		logs.Logger.Info("backed up",
+			slog.String("handler", "backup"),
+			slog.String("path", f.Path),
+			slog.Int("records", f.Records),
+			slog.Uint64("sequence", f.Sequence),
+			slog.Int("skipped", f.Skipped),
+		)
+	}
+	logs.Logger.Info("wrote backup",
+		slog.String("handler", "backup"),
+		slog.String("archive", *out),
+		slog.Int("buckets", len(manifest.Buckets)),
+		slog.Int("streams", len(manifest.Streams)),
+	)
+
+	return nil
+}
+
+// BackupFormatVersion is the version of the archive layout written by Backup.
+// Restore refuses archives of a newer version. Version 2 encrypts the keys of
+// backupSecretKeys.
+const BackupFormatVersion = 2
+
+const backupManifestPath = "manifest.json"
+
+// backupSecretFields are the fields of JSON documents that are encrypted in
+// archives, by bucket
+var backupSecretFields = map[string][]string{
+	"apikeys":           {"secret"},
+	"phoneVerification": {"secret"},
+	"token":             {"accessToken", "id"},
+	"userTokens":        {"id"},
+	"users":             {"privateKey"},
+}
+
+// backupSecretKeys are the buckets whose keys are secrets, such as the token
+// bucket keyed by refresh token, and are encrypted in archives
+var backupSecretKeys = []string{"token", "userTokens"}
+
+// encryptedPrefix marks an encrypted field value in an archive
+const encryptedPrefix = "enc:"
+
+// BackupOptions selects what a backup exports
+type BackupOptions struct {
+	// Buckets are the KV buckets to export, all buckets if empty
+	Buckets []string
+	// Streams are the streams to export, all streams if empty
+	Streams []string
+}
+
+// BackupManifest describes the files of an archive
+type BackupManifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	CreatedAt     time.Time `json:"createdAt"`
+	// EncryptedFields lists the bucket.field values encrypted with BACKUP_ENCRYPTION_KEY
+	EncryptedFields []string `json:"encryptedFields"`
+	// EncryptedKeys lists the buckets whose keys are encrypted with BACKUP_ENCRYPTION_KEY
+	EncryptedKeys []string     `json:"encryptedKeys"`
+	Buckets       []BackupFile `json:"buckets"`
+	Streams       []BackupFile `json:"streams"`
+}
+
+// BackupFile is a bucket or stream exported to an archive
+type BackupFile struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Records is the number of keys or messages in the file
+	Records int `json:"records"`
+	// Sequence is the last revision or message sequence the export includes
+	Sequence uint64 `json:"sequence"`
+	SHA256   string `json:"sha256"`
+	// Skipped is the number of keys written after the point in time whose
+	// history does not show that they existed at it, which are left out
+	Skipped int `json:"skipped,omitempty"`
+}
+
+// BackupRecord is a KV entry in an archive
+type BackupRecord struct {
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value"`
+	Created time.Time `json:"created"`
+}
+
+// BackupMessage is a stream message in an archive
+type BackupMessage struct {
+	Subject  string              `json:"subject"`
+	Header   map[string][]string `json:"header,omitempty"`
+	Data     []byte              `json:"data"`
+	Sequence uint64              `json:"sequence"`
+	Time     time.Time           `json:"time"`
+}
+
+// BackupArchive is an archive read and verified by ReadBackup
+type BackupArchive struct {
+	Manifest BackupManifest
+	Records  map[string][]BackupRecord
+	Messages map[string][]BackupMessage
+}
+
+// Backup writes the selected buckets and streams to w as a gzipped tar with a
+// manifest of SHA-256 checksums. The last revision of every bucket and the
+// last sequence of every stream are taken first, so the archive holds their
+// state at one point in time: later messages are left out and keys written
+// since are exported at their revision from that time when the bucket keeps
+// it, or left out and counted in the manifest when it does not. Secret fields
+// and the keys of secret buckets are encrypted with BACKUP_ENCRYPTION_KEY.
+func Backup(ctx context.Context, w io.Writer, opts BackupOptions) (*BackupManifest, error) {
+	aead, err := backupCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := selectNames(ctx, opts.Buckets, nats.KeyValueBuckets)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := selectNames(ctx, opts.Streams, nats.StreamNames)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the point in time before anything is read
+	bucketRevisions := map[string]uint64{}
+	for _, bucket := range buckets {
+		if bucketRevisions[bucket], err = nats.KVLastRevision(ctx, bucket); err != nil {
+			return nil, fmt.Errorf("failed to snapshot bucket %s: %w", bucket, err)
+		}
+	}
+	streamSequences := map[string]uint64{}
+	for _, stream := range streams {
+		state, err := nats.StreamState(ctx, stream)
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot stream %s: %w", stream, err)
+		}
+		streamSequences[stream] = state.LastSeq
+	}
+
+	manifest := &BackupManifest{
+		FormatVersion:   BackupFormatVersion,
+		CreatedAt:       time.Now().UTC(),
+		EncryptedFields: []string{},
+		EncryptedKeys:   slices.Clone(backupSecretKeys),
+		Buckets:         []BackupFile{},
+		Streams:         []BackupFile{},
+	}
+	for bucket, fields := range backupSecretFields {
+		for _, field := range fields {
+			manifest.EncryptedFields = append(manifest.EncryptedFields, bucket+"."+field)
+		}
+	}
+	slices.Sort(manifest.EncryptedFields)
+
+	files := map[string][]byte{}
+	for _, bucket := range buckets {
+		data, records, skipped, err := exportBucket(ctx, aead, bucket, bucketRevisions[bucket])
+		if err != nil {
+			return nil, fmt.Errorf("failed to export bucket %s: %w", bucket, err)
+		}
+		file := newBackupFile(bucket, path.Join("kv", bucket+".jsonl"), records, bucketRevisions[bucket], data)
+		file.Skipped = skipped
+		manifest.Buckets = append(manifest.Buckets, file)
+		files[file.Path] = data
+	}
+	for _, stream := range streams {
+		data, records, err := exportStream(ctx, stream, streamSequences[stream])
+		if err != nil {
+			return nil, fmt.Errorf("failed to export stream %s: %w", stream, err)
+		}
+		file := newBackupFile(stream, path.Join("streams", stream+".jsonl"), records, streamSequences[stream], data)
+		manifest.Streams = append(manifest.Streams, file)
+		files[file.Path] = data
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	writeFile := func(name string, data []byte) error {
+		if err := archive.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0o600,
+			Size:    int64(len(data)),
+			ModTime: manifest.CreatedAt,
+		}); err != nil {
+			return err
+		}
+		_, err := archive.Write(data)
+		return err
+	}
+
+	// The manifest comes first so readers know what to expect
+	if err := writeFile(backupManifestPath, manifestData); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+	for _, file := range slices.Concat(manifest.Buckets, manifest.Streams) {
+		if err := writeFile(file.Path, files[file.Path]); err != nil {
+			return nil, fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	return manifest, nil
+}
+
+func newBackupFile(name string, filePath string, records int, sequence uint64, data []byte) BackupFile {
+	sum := sha256.Sum256(data)
+	return BackupFile{
+		Name:     name,
+		Path:     filePath,
+		Records:  records,
+		Sequence: sequence,
+		SHA256:   hex.EncodeToString(sum[:]),
+	}
+}
+
+// exportBucket writes the entries of a bucket as of revision as JSON lines.
+// It returns the number of records written and of keys skipped because they
+// were written after revision and the bucket keeps no older revision of them.
+func exportBucket(ctx context.Context, aead cipher.AEAD, bucket string, revision uint64) ([]byte, int, int, error) {
+	entries, err := nats.GetKVEntries(ctx, bucket, ">")
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	records := []BackupRecord{}
+	skipped := 0
+	for _, entry := range entries {
+		if entry.Revision() > revision {
+			// Written after the point in time, so use the revision of that
+			// time. Without one the history cannot show that the key existed
+			// then, so it is left out.
+			older, ok, err := revisionAt(ctx, bucket, entry.Key(), revision)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			if !ok {
+				skipped++
+				continue
+			}
+			entry = older
+		}
+		if entry.Operation() != jetstream.KeyValuePut {
+			continue
+		}
+
+		value, err := sealFields(aead, bucket, entry.Key(), entry.Value())
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to encrypt %s: %w", entry.Key(), err)
+		}
+		key, err := sealKey(aead, bucket, entry.Key())
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to encrypt key: %w", err)
+		}
+		records = append(records, BackupRecord{Key: key, Value: value, Created: entry.Created()})
+	}
+	slices.SortFunc(records, func(a, b BackupRecord) int { return strings.Compare(a.Key, b.Key) })
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	return buf.Bytes(), len(records), skipped, nil
+}
+
+// revisionAt returns the latest revision of a key at or before revision. It
+// reports false when the bucket does not keep a revision that old.
+func revisionAt(ctx context.Context, bucket string, key string, revision uint64) (jetstream.KeyValueEntry, bool, error) {
+	history, err := nats.GetKVHistory(ctx, bucket, key)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Revision() <= revision {
+			return history[i], true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// exportStream writes the messages of a stream up to lastSeq as JSON lines
+func exportStream(ctx context.Context, stream string, lastSeq uint64) ([]byte, int, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	count := 0
+	err := nats.ReadStream(ctx, stream, lastSeq, func(msg *jetstream.RawStreamMsg) error {
+		count++
+		return encoder.Encode(BackupMessage{
+			Subject:  msg.Subject,
+			Header:   msg.Header,
+			Data:     msg.Data,
+			Sequence: msg.Sequence,
+			Time:     msg.Time,
+		})
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), count, nil
+}
+
+// ReadBackup reads an archive written by Backup, verifies its format version
+// and checksums and decrypts its secret fields
+func ReadBackup(r io.Reader) (*BackupArchive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer gz.Close()
+
+	files := map[string][]byte{}
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		files[header.Name] = data
+	}
+
+	result := &BackupArchive{
+		Records:  map[string][]BackupRecord{},
+		Messages: map[string][]BackupMessage{},
+	}
+	manifestData, ok := files[backupManifestPath]
+	if !ok {
+		return nil, fmt.Errorf("archive has no manifest")
+	}
+	if err := json.Unmarshal(manifestData, &result.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if result.Manifest.FormatVersion > BackupFormatVersion {
+		return nil, fmt.Errorf("archive format version %d is newer than the supported version %d", result.Manifest.FormatVersion, BackupFormatVersion)
+	}
+
+	verified := func(file BackupFile) ([]byte, error) {
+		data, ok := files[file.Path]
+		if !ok {
+			return nil, fmt.Errorf("archive is missing %s", file.Path)
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != file.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s", file.Path)
+		}
+		return data, nil
+	}
+
+	aead, err := backupCipher()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range result.Manifest.Buckets {
+		data, err := verified(file)
+		if err != nil {
+			return nil, err
+		}
+		records, err := decodeLines[BackupRecord](data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file.Path, err)
+		}
+		for i := range records {
+			if records[i].Key, err = openKey(aead, file.Name, records[i].Key); err != nil {
+				return nil, fmt.Errorf("failed to decrypt a key of %s: %w", file.Name, err)
+			}
+			if records[i].Value, err = openFields(aead, file.Name, records[i].Key, records[i].Value); err != nil {
+				return nil, fmt.Errorf("failed to decrypt %s/%s: %w", file.Name, records[i].Key, err)
+			}
+		}
+		result.Records[file.Name] = records
+	}
+	for _, file := range result.Manifest.Streams {
+		data, err := verified(file)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := decodeLines[BackupMessage](data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file.Path, err)
+		}
+		result.Messages[file.Name] = messages
+	}
+
+	return result, nil
+}
+
+func decodeLines[T any](data []byte) ([]T, error) {
+	values := []T{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var value T
+		if err := json.Unmarshal(scanner.Bytes(), &value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, scanner.Err()
+}
+
+// BackupEncryptionKey is the base64 encoded 32 byte key that encrypts the
+// secrets in backups, set from the configuration by Run
+var BackupEncryptionKey string
+
+// backupCipher returns the cipher of BackupEncryptionKey
+func backupCipher() (cipher.AEAD, error) {
+	if BackupEncryptionKey == "" {
+		return nil, fmt.Errorf("backup encryption key is not set")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(BackupEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("backup encryption key must be base64 encoded: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("backup encryption key must decode to 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealKey encrypts the key of a bucket in backupSecretKeys. Other keys are
+// returned unchanged.
+func sealKey(aead cipher.AEAD, bucket string, key string) (string, error) {
+	if !slices.Contains(backupSecretKeys, bucket) {
+		return key, nil
+	}
+	return seal(aead, key, bucket+"/")
+}
+
+// openKey decrypts a key sealed by sealKey
+func openKey(aead cipher.AEAD, bucket string, key string) (string, error) {
+	if !strings.HasPrefix(key, encryptedPrefix) {
+		return key, nil
+	}
+	return open(aead, key, bucket+"/")
+}
+
+// seal encrypts a value bound to additionalData
+func seal(aead cipher.AEAD, plain string, additionalData string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), []byte(additionalData))
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a value sealed by seal
+func open(aead cipher.AEAD, encoded string, additionalData string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, ciphertext, []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// sealFields encrypts the secret fields of a JSON document. The bucket, key
+// and field are bound to the ciphertext so values cannot be swapped.
+func sealFields(aead cipher.AEAD, bucket string, key string, value []byte) ([]byte, error) {
+	return mapSecretFields(bucket, key, value, func(field string, plain string) (string, error) {
+		return seal(aead, plain, bucket+"/"+key+"/"+field)
+	})
+}
+
+// openFields decrypts the secret fields sealed by sealFields
+func openFields(aead cipher.AEAD, bucket string, key string, value []byte) ([]byte, error) {
+	return mapSecretFields(bucket, key, value, func(field string, encoded string) (string, error) {
+		if !strings.HasPrefix(encoded, encryptedPrefix) {
+			return encoded, nil
+		}
+		plain, err := open(aead, encoded, bucket+"/"+key+"/"+field)
+		if err != nil {
+			return "", fmt.Errorf("failed to decrypt %s: %w", field, err)
+		}
+		return plain, nil
+	})
+}
+
+// mapSecretFields replaces the non-empty string secret fields of a JSON
+// document with fn. Other documents are returned unchanged.
+func mapSecretFields(bucket string, key string, value []byte, fn func(field string, value string) (string, error)) ([]byte, error) {
+	fields := backupSecretFields[bucket]
+	if len(fields) == 0 {
+		return value, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(value, &doc); err != nil {
+		return value, nil
+	}
+
+	changed := false
+	for _, field := range fields {
+		var plain string
+		if raw, ok := doc[field]; !ok || json.Unmarshal(raw, &plain) != nil || plain == "" {
+			continue
+		}
+		mapped, err := fn(field, plain)
+		if err != nil {
+			return nil, err
+		}
+		if doc[field], err = json.Marshal(mapped); err != nil {
+			return nil, err
+		}
+		changed = true
+	}
+	if !changed {
+		return value, nil
+	}
+	return json.Marshal(doc)
+}
+
+// selectNames returns names, checked against the existing names, or all
+// existing names when names is empty
+func selectNames(ctx context.Context, names []string, list func(ctx context.Context) ([]string, error)) ([]string, error) {
+	existing, err := list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return existing, nil
+	}
+
+	for _, name := range names {
+		if !slices.Contains(existing, name) {
+			return nil, fmt.Errorf("%s does not exist", name)
+		}
+	}
+	return names, nil
+}
+
+// splitNames splits a comma separated flag value
+func splitNames(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
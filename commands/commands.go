@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"infinirewards/config"
+	"infinirewards/infinirewards"
+	"infinirewards/logs"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"log/slog"
+	"os"
+	"sort"
+)
+
+// Command is a maintenance task run with `infinirewards <name> [flags]`
+// instead of starting the server
+type Command struct {
+	Name        string
+	Description string
+	Run         func(ctx context.Context, args []string) error
+}
+
+var registry = map[string]*Command{}
+
+// cfg is the configuration the commands run with, loaded by Run
+var cfg *config.Config
+
+func register(cmd *Command) {
+	registry[cmd.Name] = cmd
+}
+
+// Run runs the command named by the first argument and returns the exit code
+func Run(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage()
+		return 0
+	}
+
+	cmd, ok := registry[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		usage()
+		return 2
+	}
+
+	var err error
+	if cfg, err = config.Load(); err != nil {
+		logs.Logger.Error("failed to load configuration",
+			slog.String("handler", "commands"),
+			slog.String("error", err.Error()),
+		)
+		return 1
+	}
+	BackupEncryptionKey = cfg.Secrets.BackupEncryptionKey
+
+	if err := cmd.Run(context.Background(), args[1:]); err != nil {
+		logs.Logger.Error("command failed",
+			slog.String("handler", "commands"),
+			slog.String("command", cmd.Name),
+			slog.String("error", err.Error()),
+		)
+		return 1
+	}
+
+	return 0
+}
+
+func usage() {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "Usage: infinirewards [command] [flags]")
+	fmt.Fprintln(os.Stderr, "\nRuns the server when no command is given.\n\nCommands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-20s %s\n", name, registry[name].Description)
+	}
+}
+
+// newFlagSet returns the flag set of a command, printing its description in the usage
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: infinirewards %s [flags]\n\n%s\n\nFlags:\n", name, registry[name].Description)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// connect opens the connections a command needs. Starknet is only connected
+// for commands that write on chain.
+func connect(starknet bool) error {
+	if starknet {
+		if err := infinirewards.ConnectStarknet(cfg.Starknet); err != nil {
+			return fmt.Errorf("failed to connect to Starknet: %w", err)
+		}
+	}
+
+	if err := nats.ConnectNats(cfg.NATS); err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	if err := utils.InitPhoneNumberPepper(cfg.Secrets.PhoneNumberPepper); err != nil {
+		return fmt.Errorf("failed to initialize phone number pepper: %w", err)
+	}
+
+	return nil
+}
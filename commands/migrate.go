@@ -0,0 +1,221 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/nats"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+func init() {
+	register(&Command{
+		Name:        "migrate",
+		Description: "Upgrade the stored users, merchants, API keys and tokens to the current schema version",
+		Run:         runMigrate,
+	})
+}
+
+func runMigrate(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate")
+	buckets := fs.String("buckets", strings.Join(models.SchemaBuckets(), ","), "comma separated buckets to migrate")
+	dryRun := fs.Bool("dry-run", false, "only count the documents that would be upgraded")
+	batchSize := fs.Int("batch-size", 100, "documents migrated between progress reports and checkpoints")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := connect(false); err != nil {
+		return err
+	}
+
+	results, err := MigrateSchema(ctx, MigrateSchemaOptions{
+		Buckets:   strings.Split(*buckets, ","),
+		DryRun:    *dryRun,
+		BatchSize: *batchSize,
+	})
+	for _, result := range results {
+		logs.Logger.Info("migrated bucket",
+			slog.String("handler", "migrate"),
+			slog.String("bucket", result.Bucket),
+			slog.Bool("dry_run", *dryRun),
+			slog.Int("from_version", result.FromVersion),
+			slog.Int("to_version", result.ToVersion),
+			slog.Int("scanned", result.Scanned),
+			slog.Int("upgraded", result.Upgraded),
+			slog.Bool("resumed", result.Resumed),
+		)
+	}
+	return err
+}
+
+// MigrateSchemaOptions controls a schema migration
+type MigrateSchemaOptions struct {
+	// Buckets are the buckets to migrate, all of models.SchemaBuckets if empty
+	Buckets []string
+	// DryRun only counts the documents that would be upgraded
+	DryRun bool
+	// BatchSize is how many documents are scanned between progress reports
+	// and checkpoints of the resume point
+	BatchSize int
+}
+
+// MigrateSchemaResult counts the documents seen by a schema migration of a bucket
+type MigrateSchemaResult struct {
+	Bucket      string
+	FromVersion int
+	ToVersion   int
+	Scanned     int
+	Upgraded    int
+	// Resumed is set when the run continued after the last key of an
+	// interrupted run
+	Resumed bool
+}
+
+// MigrateSchema upgrades the documents of each bucket that is behind the
+// current schema version and records the applied migrations. Documents are
+// migrated in key order and the last migrated key is checkpointed, so a run
+// that was interrupted resumes where it stopped.
+func MigrateSchema(ctx context.Context, opts MigrateSchemaOptions) ([]*MigrateSchemaResult, error) {
+	buckets := opts.Buckets
+	if len(buckets) == 0 {
+		buckets = models.SchemaBuckets()
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	results := []*MigrateSchemaResult{}
+	for _, bucket := range buckets {
+		if !slices.Contains(models.SchemaBuckets(), bucket) {
+			return results, fmt.Errorf("bucket %s has no schema version", bucket)
+		}
+
+		result, err := migrateBucket(ctx, bucket, opts.DryRun, batchSize)
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to migrate %s: %w", bucket, err)
+		}
+	}
+
+	return results, nil
+}
+
+func migrateBucket(ctx context.Context, bucket string, dryRun bool, batchSize int) (*MigrateSchemaResult, error) {
+	state, err := models.GetSchemaMigrationState(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	target := models.SchemaVersion(bucket)
+	result := &MigrateSchemaResult{Bucket: bucket, FromVersion: state.Version, ToVersion: target}
+	if state.Version >= target && state.Target == 0 {
+		return result, nil
+	}
+
+	// A run towards another version starts over
+	after := ""
+	if state.Target == target && state.LastKey != "" {
+		after = state.LastKey
+		result.Resumed = true
+	} else {
+		state.Target = target
+		state.LastKey = ""
+	}
+
+	entries, err := nats.GetKVEntries(ctx, bucket, ">")
+	if err != nil {
+		return result, err
+	}
+	keys := []string{}
+	for _, entry := range entries {
+		if entry.Key() > after {
+			keys = append(keys, entry.Key())
+		}
+	}
+	slices.Sort(keys)
+
+	for i, key := range keys {
+		upgraded, err := migrateDocument(ctx, bucket, key, dryRun)
+		if err != nil {
+			return result, fmt.Errorf("failed to migrate %s: %w", key, err)
+		}
+		result.Scanned++
+		if upgraded {
+			result.Upgraded++
+		}
+
+		if (i+1)%batchSize != 0 && i+1 != len(keys) {
+			continue
+		}
+		logs.Logger.Info("migrating bucket",
+			slog.String("handler", "migrate"),
+			slog.String("bucket", bucket),
+			slog.Bool("dry_run", dryRun),
+			slog.Int("scanned", result.Scanned),
+			slog.Int("remaining", len(keys)-i-1),
+		)
+		if !dryRun {
+			state.LastKey = key
+			if err := state.UpdateSchemaMigrationState(ctx); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	now := time.Now()
+	for _, migration := range models.Migrations(bucket) {
+		if migration.Version > state.Version && migration.Version <= target {
+			state.Applied = append(state.Applied, models.AppliedMigration{
+				Version:     migration.Version,
+				Description: migration.Description,
+				AppliedAt:   now,
+			})
+		}
+	}
+	state.Version = target
+	state.Target = 0
+	state.LastKey = ""
+	if err := state.UpdateSchemaMigrationState(ctx); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+// migrateDocument upgrades one stored document and reports whether it was
+// behind. A document written in between is read and upgraded again.
+func migrateDocument(ctx context.Context, bucket string, key string, dryRun bool) (bool, error) {
+	upgraded := false
+	err := nats.RetryOnConflict(ctx, func() error {
+		entry, err := nats.GetKV(ctx, bucket, key)
+		if err != nil {
+			if nats.IsNotFound(err) {
+				upgraded = false
+				return nil
+			}
+			return err
+		}
+
+		data, changed, err := models.UpgradeDocument(bucket, entry.Value())
+		upgraded = changed
+		if err != nil || !changed || dryRun {
+			return err
+		}
+
+		_, err = nats.UpdateKV(ctx, bucket, key, data, entry.Revision())
+		return err
+	})
+	return upgraded, err
+}
@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/infinirewards"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"log/slog"
+)
+
+func init() {
+	register(&Command{
+		Name:        "migrate-user-ids",
+		Description: "Move users keyed by their phone number hash to stable IDs and re-index phone numbers with the pepper and account addresses",
+		Run:         runMigrateUserIDs,
+	})
+}
+
+func runMigrateUserIDs(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate-user-ids")
+	dryRun := fs.Bool("dry-run", false, "only report the users that would be migrated")
+	onChain := fs.Bool("onchain", false, "also replace the phone number hash stored in user and merchant accounts")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := connect(*onChain); err != nil {
+		return err
+	}
+
+	result, err := MigrateUserIDs(ctx, MigrateUserIDsOptions{DryRun: *dryRun, OnChain: *onChain})
+	if result != nil {
+		logs.Logger.Info("migrated user IDs",
+			slog.String("handler", "migrate-user-ids"),
+			slog.Bool("dry_run", *dryRun),
+			slog.Int("users", result.Users),
+			slog.Int("moved", result.Moved),
+			slog.Int("on_chain", result.OnChain),
+			slog.Int("failed", result.Failed),
+		)
+	}
+
+	return err
+}
+
+// MigrateUserIDsOptions controls a user ID migration
+type MigrateUserIDsOptions struct {
+	// DryRun only counts the users that would be migrated
+	DryRun bool
+	// OnChain replaces the phone number hash stored in the user and merchant
+	// accounts. Accounts keep working with the old hash when it is not set.
+	OnChain bool
+}
+
+// MigrateUserIDsResult counts the users seen by a user ID migration
+type MigrateUserIDsResult struct {
+	Users int
+	Moved int
+	// OnChain counts the users with an account whose phone number hash was
+	// replaced, not those whose accounts already held the new hash
+	OnChain int
+	// Failed counts the users that could not be migrated and are retried
+	// by the next run
+	Failed int
+}
+
+// MigrateUserIDs moves every user still keyed by the raw hash of their phone
+// number to a stable ID, re-keying their merchant, API keys and tokens, and
+// re-indexes all phone numbers with the pepper and all account addresses. A
+// user that fails is logged and skipped so the others are still migrated. It
+// can be run again to resume after an interruption: accounts that already
+// hold the new phone number hash are not sent another transaction.
+func MigrateUserIDs(ctx context.Context, opts MigrateUserIDsOptions) (*MigrateUserIDsResult, error) {
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &MigrateUserIDsResult{Users: len(users)}
+	if !opts.DryRun {
+		// Moved users take their tokens along by looking them up in the index
+		if _, err := models.IndexUserTokens(ctx); err != nil {
+			return result, err
+		}
+	}
+
+	for _, user := range users {
+		if opts.DryRun {
+			if models.IsLegacyUserID(user.ID) {
+				result.Moved++
+			}
+			continue
+		}
+
+		legacyID := user.ID
+		if err := migrateUserID(ctx, user, opts, result); err != nil {
+			result.Failed++
+			logs.Logger.Error("failed to migrate user",
+				slog.String("handler", "migrate-user-ids"),
+				slog.String("user_id", legacyID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+
+	if result.Failed > 0 {
+		return result, fmt.Errorf("failed to migrate %d of %d users, run the migration again to retry them", result.Failed, result.Users)
+	}
+	return result, nil
+}
+
+// migrateUserID moves one user to a stable ID if needed and re-indexes it,
+// counting what was done in result
+func migrateUserID(ctx context.Context, user *models.User, opts MigrateUserIDsOptions, result *MigrateUserIDsResult) error {
+	if models.IsLegacyUserID(user.ID) {
+		legacyID := user.ID
+		if err := user.MoveToStableID(ctx); err != nil {
+			return fmt.Errorf("failed to move user %s: %w", legacyID, err)
+		}
+		result.Moved++
+
+		logs.Logger.Info("moved user",
+			slog.String("handler", "migrate-user-ids"),
+			slog.String("legacy_id", legacyID),
+			slog.String("user_id", user.ID),
+		)
+	}
+
+	if err := user.IndexPhoneNumber(ctx); err != nil {
+		return fmt.Errorf("failed to index user %s: %w", user.ID, err)
+	}
+	if user.AccountAddress != "" {
+		if err := models.IndexAccountAddress(ctx, user.AccountAddress, user.ID); err != nil {
+			return fmt.Errorf("failed to index account of user %s: %w", user.ID, err)
+		}
+	}
+
+	if opts.OnChain {
+		updated, err := infinirewards.UpdatePhoneNumbers(ctx, user.PrivateKey, user.PublicKey, user.AccountAddresses(ctx), user.PhoneNumber)
+		if err != nil {
+			return fmt.Errorf("failed to update accounts of user %s: %w", user.ID, err)
+		}
+		if updated > 0 {
+			result.OnChain++
+		}
+	}
+
+	return nil
+}
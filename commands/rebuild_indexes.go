@@ -0,0 +1,51 @@
+package commands
+
+import (
+	"context"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"log/slog"
+)
+
+func init() {
+	register(&Command{
+		Name:        "rebuild-indexes",
+		Description: "Regenerate the email, account address and contract address indexes from the user and merchant records and index the tokens of each user",
+		Run:         runRebuildIndexes,
+	})
+}
+
+func runRebuildIndexes(ctx context.Context, args []string) error {
+	fs := newFlagSet("rebuild-indexes")
+	dryRun := fs.Bool("dry-run", false, "only report the index entries that would change")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := connect(false); err != nil {
+		return err
+	}
+
+	result, err := models.RebuildIndexes(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	for _, duplicate := range result.Duplicates {
+		logs.Logger.Warn("index entry named by more than one record",
+			slog.String("handler", "rebuild-indexes"),
+			slog.String("entry", duplicate),
+		)
+	}
+
+	logs.Logger.Info("rebuilt indexes",
+		slog.String("handler", "rebuild-indexes"),
+		slog.Bool("dry_run", *dryRun),
+		slog.Int("written", result.Written),
+		slog.Int("removed", result.Removed),
+		slog.Int("tokens", result.Tokens),
+		slog.Int("duplicates", len(result.Duplicates)),
+	)
+
+	return nil
+}
@@ -0,0 +1,283 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/nats"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	natsgo "github.com/nats-io/nats.go"
+)
+
+func init() {
+	register(&Command{
+		Name:        "restore",
+		Description: "Restore KV buckets and streams from an archive written by backup",
+		Run:         runRestore,
+	})
+}
+
+func runRestore(ctx context.Context, args []string) error {
+	fs := newFlagSet("restore")
+	in := fs.String("in", "", "archive to restore")
+	buckets := fs.String("buckets", "", "comma separated KV buckets to restore (default all in the archive)")
+	streams := fs.String("streams", "", "comma separated streams to restore (default all in the archive)")
+	dryRun := fs.Bool("dry-run", false, "only report how the buckets and streams differ from the archive")
+	prune := fs.Bool("prune", false, "also delete keys that are not in the archive")
+	verify := fs.Bool("verify", false, "only verify the archive checksums and encryption, without connecting")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	file, err := os.Open(*in)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	if *verify {
+		archive, err := ReadBackup(file)
+		if err != nil {
+			return err
+		}
+		logs.Logger.Info("verified backup",
+			slog.String("handler", "restore"),
+			slog.String("archive", *in),
+			slog.Time("created_at", archive.Manifest.CreatedAt),
+			slog.Int("buckets", len(archive.Manifest.Buckets)),
+			slog.Int("streams", len(archive.Manifest.Streams)),
+		)
+		return nil
+	}
+
+	if err := connect(false); err != nil {
+		return err
+	}
+
+	results, err := Restore(ctx, file, RestoreOptions{
+		Buckets: splitNames(*buckets),
+		Streams: splitNames(*streams),
+		DryRun:  *dryRun,
+		Prune:   *prune,
+	})
+	for _, result := range results {
+		logs.Logger.Info("restored",
+			slog.String("handler", "restore"),
+			slog.String("name", result.Name),
+			slog.Bool("stream", result.Stream),
+			slog.Bool("dry_run", *dryRun),
+			slog.Int("added", result.Added),
+			slog.Int("changed", result.Changed),
+			slog.Int("removed", result.Removed),
+			slog.Int("unchanged", result.Unchanged),
+			slog.Bool("skipped", result.Skipped),
+		)
+	}
+	return err
+}
+
+// RestoreOptions controls a restore
+type RestoreOptions struct {
+	// Buckets are the KV buckets to restore, all buckets in the archive if empty
+	Buckets []string
+	// Streams are the streams to restore, all streams in the archive if empty
+	Streams []string
+	// DryRun only compares the buckets and streams with the archive
+	DryRun bool
+	// Prune deletes the keys of restored buckets that are not in the archive
+	Prune bool
+}
+
+// RestoreResult compares a bucket or stream with an archive. Removed counts
+// keys that are not in the archive, which are only deleted with Prune.
+type RestoreResult struct {
+	Name      string
+	Stream    bool
+	Added     int
+	Changed   int
+	Removed   int
+	Unchanged int
+	// Skipped is set for streams that already hold messages, which are not
+	// restored so they are not duplicated
+	Skipped bool
+}
+
+// Restore writes the buckets and streams of an archive back after verifying
+// its checksums. Each bucket is compared with the archive again afterwards and
+// Restore fails if it does not match.
+func Restore(ctx context.Context, r io.Reader, opts RestoreOptions) ([]*RestoreResult, error) {
+	archive, err := ReadBackup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*RestoreResult{}
+	for _, file := range archive.Manifest.Buckets {
+		if len(opts.Buckets) > 0 && !slices.Contains(opts.Buckets, file.Name) {
+			continue
+		}
+		result, err := restoreBucket(ctx, file.Name, archive.Records[file.Name], opts)
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to restore bucket %s: %w", file.Name, err)
+		}
+	}
+
+	for _, file := range archive.Manifest.Streams {
+		if len(opts.Streams) > 0 && !slices.Contains(opts.Streams, file.Name) {
+			continue
+		}
+		result, err := restoreStream(ctx, file.Name, archive.Messages[file.Name], opts.DryRun)
+		if result != nil {
+			results = append(results, result)
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to restore stream %s: %w", file.Name, err)
+		}
+	}
+
+	for _, name := range slices.Concat(opts.Buckets, opts.Streams) {
+		if !slices.ContainsFunc(results, func(result *RestoreResult) bool { return result.Name == name }) {
+			return results, fmt.Errorf("%s is not in the archive", name)
+		}
+	}
+
+	return results, nil
+}
+
+func restoreBucket(ctx context.Context, bucket string, records []BackupRecord, opts RestoreOptions) (*RestoreResult, error) {
+	result, live, err := diffBucket(ctx, bucket, records)
+	if err != nil || opts.DryRun {
+		return result, err
+	}
+
+	for _, record := range records {
+		if current, ok := live[record.Key]; ok && sameDocument(current, record.Value) {
+			continue
+		}
+		if err := nats.PutKV(ctx, bucket, record.Key, record.Value); err != nil {
+			return result, fmt.Errorf("failed to restore %s: %w", record.Key, err)
+		}
+	}
+	if opts.Prune {
+		archived := map[string]bool{}
+		for _, record := range records {
+			archived[record.Key] = true
+		}
+		for key := range live {
+			if archived[key] {
+				continue
+			}
+			if err := nats.RemoveKV(ctx, bucket, key); err != nil {
+				return result, fmt.Errorf("failed to remove %s: %w", key, err)
+			}
+		}
+	}
+
+	// Verify the bucket now matches the archive
+	check, _, err := diffBucket(ctx, bucket, records)
+	if err != nil {
+		return result, err
+	}
+	if check.Added > 0 || check.Changed > 0 || (opts.Prune && check.Removed > 0) {
+		return result, fmt.Errorf("bucket does not match the archive after restore: %d missing, %d changed, %d extra", check.Added, check.Changed, check.Removed)
+	}
+
+	return result, nil
+}
+
+// diffBucket compares a bucket with the records of an archive and returns the
+// current values by key
+func diffBucket(ctx context.Context, bucket string, records []BackupRecord) (*RestoreResult, map[string][]byte, error) {
+	entries, err := nats.GetKVEntries(ctx, bucket, ">")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	live := map[string][]byte{}
+	for _, entry := range entries {
+		live[entry.Key()] = entry.Value()
+	}
+
+	result := &RestoreResult{Name: bucket}
+	archived := map[string]bool{}
+	for _, record := range records {
+		archived[record.Key] = true
+		current, ok := live[record.Key]
+		switch {
+		case !ok:
+			result.Added++
+		case sameDocument(current, record.Value):
+			result.Unchanged++
+		default:
+			result.Changed++
+		}
+	}
+	for key := range live {
+		if !archived[key] {
+			result.Removed++
+		}
+	}
+
+	return result, live, nil
+}
+
+// sameDocument compares two values, ignoring the field order of JSON documents
+func sameDocument(a []byte, b []byte) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+
+	var docA, docB any
+	if json.Unmarshal(a, &docA) != nil || json.Unmarshal(b, &docB) != nil {
+		return false
+	}
+	canonicalA, errA := json.Marshal(docA)
+	canonicalB, errB := json.Marshal(docB)
+	return errA == nil && errB == nil && bytes.Equal(canonicalA, canonicalB)
+}
+
+func restoreStream(ctx context.Context, stream string, messages []BackupMessage, dryRun bool) (*RestoreResult, error) {
+	state, err := nats.StreamState(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RestoreResult{Name: stream, Stream: true}
+	if state.Msgs > 0 {
+		result.Skipped = true
+		result.Unchanged = int(state.Msgs)
+		return result, nil
+	}
+
+	result.Added = len(messages)
+	if dryRun {
+		return result, nil
+	}
+
+	for _, message := range messages {
+		msg := natsgo.NewMsg(message.Subject)
+		msg.Data = message.Data
+		for key, values := range message.Header {
+			for _, value := range values {
+				msg.Header.Add(key, value)
+			}
+		}
+		if _, err := nats.PublishStream(ctx, msg); err != nil {
+			return result, fmt.Errorf("failed to publish message %d: %w", message.Sequence, err)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,220 @@
+// Package config holds the typed configuration of the server and the
+// maintenance commands. It is read from the YAML file of a profile, then
+// overridden by environment variables and secret files, see Load.
+package config
+
+import (
+	"log/slog"
+	"reflect"
+	"time"
+)
+
+// Profiles that can be loaded, each from config/<profile>.yaml
+const (
+	ProfileDevnet  = "devnet"
+	ProfileSepolia = "sepolia"
+	ProfileMainnet = "mainnet"
+	ProfileTest    = "test"
+)
+
+// Profiles lists the valid profiles
+var Profiles = []string{ProfileDevnet, ProfileSepolia, ProfileMainnet, ProfileTest}
+
+// Config is the configuration of the server. Fields tagged env can be
+// overridden by the first environment variable of the list that is set, and
+// fields tagged secret can also be read from the file named by the variable
+// with a _FILE suffix. {NETWORK} in a variable name stands for the upper case
+// Starknet network, for the names used before profiles existed.
+type Config struct {
+	// Profile the configuration was loaded for
+	Profile string `yaml:"-"`
+
+	Server     ServerConfig     `yaml:"server"`
+	Log        LogConfig        `yaml:"log"`
+	Starknet   StarknetConfig   `yaml:"starknet"`
+	NATS       NATSConfig       `yaml:"nats"`
+	WhatsApp   WhatsAppConfig   `yaml:"whatsapp"`
+	MacroKiosk MacroKioskConfig `yaml:"macrokiosk"`
+	OTP        OTPConfig        `yaml:"otp"`
+	WebAuthn   WebAuthnConfig   `yaml:"webauthn"`
+	Secrets    SecretsConfig    `yaml:"secrets"`
+	Admin      AdminConfig      `yaml:"admin"`
+	Brand      BrandConfig      `yaml:"brand"`
+	Deletion   DeletionConfig   `yaml:"deletion"`
+	Media      MediaConfig      `yaml:"media"`
+
+	// RateLimits override the rate limits by name, e.g. otp.phone
+	RateLimits map[string]RateLimitConfig `yaml:"rateLimits"`
+}
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	Addr string `yaml:"addr" env:"SERVER_ADDR"`
+
+	// Environment is production to hide the Swagger docs
+	Environment string `yaml:"environment" env:"ENV"`
+
+	// TrustProxyHeaders takes client IPs from the proxy headers, only for
+	// servers behind a reverse proxy
+	TrustProxyHeaders bool `yaml:"trustProxyHeaders" env:"TRUST_PROXY_HEADERS"`
+
+	ReadTimeout     time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout    time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout     time.Duration `yaml:"idleTimeout" env:"SERVER_IDLE_TIMEOUT"`
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+}
+
+// LogConfig configures logging. It is reloaded on SIGHUP.
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level slog.Level `yaml:"level" env:"LOG_LEVEL"`
+}
+
+// StarknetConfig configures the Starknet connection and master account
+type StarknetConfig struct {
+	// Network is devnet, sepolia or mainnet. It is read before the other
+	// fields, which may be named after it.
+	Network string `yaml:"network" env:"NETWORK"`
+
+	RPCURL               string `yaml:"rpcUrl" env:"RPC_PROVIDER_URL,RPC_PROVIDER_URL_{NETWORK}"`
+	MasterAccountAddress string `yaml:"masterAccountAddress" env:"MASTER_ACCOUNT_ADDRESS,MASTER_ACCOUNT_ADDRESS_{NETWORK}"`
+	MasterPrivateKey     string `yaml:"masterPrivateKey" env:"MASTER_PRIVATE_KEY,MASTER_PRIVATE_KEY_{NETWORK}" secret:"true"`
+	FactoryAddress       string `yaml:"factoryAddress" env:"INFINI_REWARDS_FACTORY_ADDRESS,INFINI_REWARDS_FACTORY_ADDRESS_{NETWORK}"`
+}
+
+// NATSConfig configures the NATS connection
+type NATSConfig struct {
+	URL              string `yaml:"url" env:"NATS_URL"`
+	AccountPublicKey string `yaml:"accountPublicKey" env:"NATS_ACCOUNT_PUBLIC_KEY"`
+	AccountSeed      string `yaml:"accountSeed" env:"NATS_ACCOUNT_SEED" secret:"true"`
+
+	// CredentialsFile is the user credentials file of the server
+	CredentialsFile string `yaml:"credentialsFile" env:"NATS_CREDENTIALS_FILE"`
+}
+
+// WhatsAppConfig configures the WhatsApp Cloud API
+type WhatsAppConfig struct {
+	PhoneID            string `yaml:"phoneId" env:"WHATSAPP_PHONE_ID"`
+	Token              string `yaml:"token" env:"WHATSAPP_TOKEN" secret:"true"`
+	WebhookVerifyToken string `yaml:"webhookVerifyToken" env:"WHATSAPP_WEBHOOK_VERIFY_TOKEN" secret:"true"`
+	AppSecret          string `yaml:"appSecret" env:"WHATSAPP_APP_SECRET" secret:"true"`
+
+	// BotMerchantID is the merchant whose points and rewards the bot answers with
+	BotMerchantID string `yaml:"botMerchantId" env:"WHATSAPP_BOT_MERCHANT_ID"`
+}
+
+// MacroKioskConfig configures the MacroKiosk SMS gateway
+type MacroKioskConfig struct {
+	User      string `yaml:"user" env:"BOLD_USER"`
+	Password  string `yaml:"password" env:"BOLD_PASS" secret:"true"`
+	ServiceID string `yaml:"serviceId" env:"BOLD_SERVID"`
+	DLRToken  string `yaml:"dlrToken" env:"BOLD_DLR_TOKEN" secret:"true"`
+}
+
+// OTPConfig configures the delivery of one-time passwords
+type OTPConfig struct {
+	// Routes map phone number prefixes to providers, see
+	// utils.InitMessageProviders. Empty uses the default routes.
+	Routes string `yaml:"routes" env:"OTP_ROUTES"`
+
+	// FileSinkPath enables the file provider, which appends messages to the file
+	FileSinkPath string `yaml:"fileSinkPath" env:"OTP_FILE_SINK_PATH"`
+
+	DiscordWebhookURL string `yaml:"discordWebhookUrl" env:"DISCORD_WEBHOOK_URL" secret:"true"`
+}
+
+// WebAuthnConfig configures the passkey relying party
+type WebAuthnConfig struct {
+	RPID          string   `yaml:"rpId" env:"WEBAUTHN_RP_ID"`
+	RPDisplayName string   `yaml:"rpName" env:"WEBAUTHN_RP_NAME"`
+	RPOrigins     []string `yaml:"rpOrigins" env:"WEBAUTHN_RP_ORIGINS"`
+}
+
+// SecretsConfig holds the base64 encoded keys of the server
+type SecretsConfig struct {
+	// PhoneNumberPepper keys the phone number hashes, at least 32 bytes
+	PhoneNumberPepper string `yaml:"phoneNumberPepper" env:"PHONE_NUMBER_PEPPER" secret:"true"`
+
+	// JWTKeyEncryptionKey encrypts the JWT signing keys stored in NATS, 32 bytes
+	JWTKeyEncryptionKey string `yaml:"jwtKeyEncryptionKey" env:"JWT_KEY_ENCRYPTION_KEY" secret:"true"`
+
+	// BackupEncryptionKey encrypts the secrets in backups, 32 bytes. Only the
+	// backup and restore commands need it.
+	BackupEncryptionKey string `yaml:"backupEncryptionKey" env:"BACKUP_ENCRYPTION_KEY" secret:"true"`
+}
+
+// AdminConfig configures role management
+type AdminConfig struct {
+	// UserIDs are always admins, used to bootstrap role management
+	UserIDs []string `yaml:"userIds" env:"ADMIN_USER_IDS"`
+}
+
+// BrandConfig configures message branding
+type BrandConfig struct {
+	// Default is the brand whose message templates are used when a request
+	// does not name one
+	Default string `yaml:"default" env:"DEFAULT_BRAND"`
+}
+
+// DeletionConfig configures account deletion
+type DeletionConfig struct {
+	// AssetPolicy is what is done with the on-chain assets of deleted
+	// accounts: burn, sweep or keep
+	AssetPolicy string `yaml:"assetPolicy" env:"DELETION_ASSET_POLICY"`
+
+	// SweepAddress receives swept assets
+	SweepAddress string `yaml:"sweepAddress" env:"DELETION_SWEEP_ADDRESS"`
+}
+
+// MediaConfig configures uploads
+type MediaConfig struct {
+	// MaxUploadSize is the largest image accepted, in bytes
+	MaxUploadSize int64 `yaml:"maxUploadSize" env:"MEDIA_MAX_UPLOAD_SIZE"`
+}
+
+// RateLimitConfig overrides a rate limit. Zero values keep the default of the
+// limit. It is reloaded on SIGHUP.
+type RateLimitConfig struct {
+	Limit       int           `yaml:"limit"`
+	Window      time.Duration `yaml:"window"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MaxCooldown time.Duration `yaml:"maxCooldown"`
+	Description string        `yaml:"description"`
+}
+
+// defaults returns the values used when neither the profile nor the
+// environment set them
+func defaults(profile string) *Config {
+	return &Config{
+		Profile: profile,
+		Server: ServerConfig{
+			Addr:            ":8080",
+			ReadTimeout:     5 * time.Second,
+			WriteTimeout:    10 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Log:      LogConfig{Level: slog.LevelDebug},
+		NATS:     NATSConfig{CredentialsFile: "./backend.creds"},
+		WebAuthn: WebAuthnConfig{RPDisplayName: "InfiniRewards"},
+		Deletion: DeletionConfig{AssetPolicy: "burn"},
+		Media:    MediaConfig{MaxUploadSize: 5 << 20},
+	}
+}
+
+// RestartRequired returns the sections that differ in next and are only
+// applied on restart. Log and RateLimits are reloaded while running.
+func (c *Config) RestartRequired(next *Config) []string {
+	var sections []string
+	current, updated := reflect.ValueOf(c).Elem(), reflect.ValueOf(next).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		field := current.Type().Field(i)
+		if field.Name == "Profile" || field.Name == "Log" || field.Name == "RateLimits" {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			sections = append(sections, field.Tag.Get("yaml"))
+		}
+	}
+	return sections
+}
@@ -0,0 +1,213 @@
+package config
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Load reads the configuration of the profile named by CONFIG_PROFILE, or by
+// NETWORK when that is not set, defaulting to devnet. Variables in a .env file
+// in the working directory are added to the environment first, without
+// replacing those already set.
+func Load() (*Config, error) {
+	if err := godotenv.Load(".env"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to load .env file: %w", err)
+	}
+
+	profile := os.Getenv("CONFIG_PROFILE")
+	if profile == "" {
+		profile = os.Getenv("NETWORK")
+	}
+	if profile == "" {
+		profile = ProfileDevnet
+	}
+
+	return LoadProfile(profile)
+}
+
+// LoadProfile reads the configuration of a profile and validates it. Values
+// are applied in this order, each replacing the ones before:
+//
+//   - the defaults
+//   - <profile>.yaml in CONFIG_DIR, which defaults to config
+//   - the file named by CONFIG_FILE, if set
+//   - the environment variables of the fields
+//   - the files named by the _FILE variables of secret fields
+//
+// The returned error lists every problem found.
+func LoadProfile(profile string) (*Config, error) {
+	if !slices.Contains(Profiles, profile) {
+		return nil, fmt.Errorf("unknown configuration profile %q, expected one of %s", profile, strings.Join(Profiles, ", "))
+	}
+
+	c := defaults(profile)
+
+	dir := os.Getenv("CONFIG_DIR")
+	if dir == "" {
+		dir = "config"
+	}
+	if err := c.readFile(filepath.Join(dir, profile+".yaml")); err != nil {
+		return nil, err
+	}
+	if file := os.Getenv("CONFIG_FILE"); file != "" {
+		if err := c.readFile(file); err != nil {
+			return nil, err
+		}
+	}
+
+	if errs := applyEnv(reflect.ValueOf(c).Elem(), "", c); len(errs) > 0 {
+		return nil, &ValidationError{Profile: profile, Problems: errs}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readFile decodes a YAML file over c. Unknown keys are rejected so that
+// misspelled settings are not silently ignored.
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv sets the fields of v from the environment and returns the values
+// that could not be parsed. Fields are visited in order, so the Starknet
+// network is set before the variables named after it are looked up.
+func applyEnv(v reflect.Value, path string, c *Config) []string {
+	var problems []string
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := field.Tag.Get("yaml")
+		if name == "" || name == "-" {
+			continue
+		}
+		if path != "" {
+			name = path + "." + name
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			problems = append(problems, applyEnv(v.Field(i), name, c)...)
+			continue
+		}
+
+		vars := field.Tag.Get("env")
+		if vars == "" {
+			continue
+		}
+		value, source, err := lookupEnv(strings.Split(vars, ","), field.Tag.Get("secret") == "true", c)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if source == "" {
+			continue
+		}
+		if err := setValue(v.Field(i), value); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid %s: %v", name, source, err))
+		}
+	}
+	return problems
+}
+
+// lookupEnv returns the value of the first of vars that is set and the name
+// it was read from, which is empty if none is set. Secrets may be read from
+// the file named by the variable with a _FILE suffix instead.
+func lookupEnv(vars []string, secret bool, c *Config) (string, string, error) {
+	for _, name := range vars {
+		if strings.Contains(name, "{NETWORK}") {
+			if c.Starknet.Network == "" {
+				continue
+			}
+			name = strings.ReplaceAll(name, "{NETWORK}", strings.ToUpper(c.Starknet.Network))
+		}
+
+		value := os.Getenv(name)
+		file := ""
+		if secret {
+			file = os.Getenv(name + "_FILE")
+		}
+
+		switch {
+		case value != "" && file != "":
+			return "", "", fmt.Errorf("only one of %s and %s_FILE may be set", name, name)
+		case file != "":
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return "", "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+			}
+			return strings.TrimSpace(string(data)), name + "_FILE", nil
+		case value != "":
+			return value, name, nil
+		}
+	}
+	return "", "", nil
+}
+
+// setValue parses an environment variable into a field
+func setValue(v reflect.Value, value string) error {
+	if unmarshaler, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		// Lists are comma separated
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
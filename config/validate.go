@@ -0,0 +1,168 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxRateLimitWindow is the TTL of the rateLimits bucket, which no window may exceed
+const maxRateLimitWindow = 24 * time.Hour
+
+// ValidationError lists the problems of a configuration
+type ValidationError struct {
+	Profile  string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration for profile %s:\n  %s", e.Profile, strings.Join(e.Problems, "\n  "))
+}
+
+// Validate checks that the values the server needs are set and that every
+// value set is well formed. The Starknet and NATS connections are optional
+// for the test profile, whose tests connect to local servers.
+func (c *Config) Validate() error {
+	v := &validator{}
+	required := c.Profile != ProfileTest
+
+	v.require("server.addr", c.Server.Addr)
+	v.positive("server.readTimeout", c.Server.ReadTimeout)
+	v.positive("server.writeTimeout", c.Server.WriteTimeout)
+	v.positive("server.idleTimeout", c.Server.IdleTimeout)
+	v.positive("server.shutdownTimeout", c.Server.ShutdownTimeout)
+
+	switch c.Starknet.Network {
+	case ProfileDevnet, ProfileSepolia, ProfileMainnet:
+	default:
+		v.addf("starknet.network: must be devnet, sepolia or mainnet, got %q", c.Starknet.Network)
+	}
+	if required {
+		v.require("starknet.rpcUrl", c.Starknet.RPCURL)
+		v.require("starknet.masterAccountAddress", c.Starknet.MasterAccountAddress)
+		v.require("starknet.masterPrivateKey", c.Starknet.MasterPrivateKey)
+		v.require("starknet.factoryAddress", c.Starknet.FactoryAddress)
+	}
+	v.url("starknet.rpcUrl", c.Starknet.RPCURL, "http", "https")
+	v.felt("starknet.masterAccountAddress", c.Starknet.MasterAccountAddress)
+	v.felt("starknet.masterPrivateKey", c.Starknet.MasterPrivateKey)
+	v.felt("starknet.factoryAddress", c.Starknet.FactoryAddress)
+
+	if required {
+		v.require("nats.url", c.NATS.URL)
+		v.require("nats.accountPublicKey", c.NATS.AccountPublicKey)
+		v.require("nats.accountSeed", c.NATS.AccountSeed)
+		v.require("nats.credentialsFile", c.NATS.CredentialsFile)
+	}
+
+	v.url("otp.discordWebhookUrl", c.OTP.DiscordWebhookURL, "https")
+
+	v.require("webauthn.rpId", c.WebAuthn.RPID)
+	for _, origin := range c.WebAuthn.RPOrigins {
+		v.url("webauthn.rpOrigins", origin, "http", "https")
+	}
+
+	v.require("secrets.phoneNumberPepper", c.Secrets.PhoneNumberPepper)
+	v.key("secrets.phoneNumberPepper", c.Secrets.PhoneNumberPepper, 32, false)
+	v.key("secrets.jwtKeyEncryptionKey", c.Secrets.JWTKeyEncryptionKey, 32, true)
+	v.key("secrets.backupEncryptionKey", c.Secrets.BackupEncryptionKey, 32, true)
+
+	if c.Deletion.AssetPolicy == "sweep" {
+		v.require("deletion.sweepAddress", c.Deletion.SweepAddress)
+	}
+	v.felt("deletion.sweepAddress", c.Deletion.SweepAddress)
+
+	if c.Media.MaxUploadSize <= 0 {
+		v.addf("media.maxUploadSize: must be positive, got %d", c.Media.MaxUploadSize)
+	}
+
+	for name, limit := range c.RateLimits {
+		field := "rateLimits." + name
+		if limit.Limit < 0 {
+			v.addf("%s.limit: must not be negative, got %d", field, limit.Limit)
+		}
+		if limit.Window < 0 || limit.Window > maxRateLimitWindow {
+			v.addf("%s.window: must be between 0 and %s, got %s", field, maxRateLimitWindow, limit.Window)
+		}
+		if limit.Cooldown < 0 || limit.MaxCooldown < 0 {
+			v.addf("%s: cooldowns must not be negative", field)
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Profile: c.Profile, Problems: v.problems}
+	}
+	return nil
+}
+
+// validator collects the problems of a configuration
+type validator struct {
+	problems []string
+}
+
+func (v *validator) addf(format string, args ...any) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+func (v *validator) require(field string, value string) {
+	if value == "" {
+		v.addf("%s: is required", field)
+	}
+}
+
+func (v *validator) positive(field string, d time.Duration) {
+	if d <= 0 {
+		v.addf("%s: must be positive, got %s", field, d)
+	}
+}
+
+// url checks that a set value is an absolute URL with one of schemes. The
+// value is not repeated in the problem as URLs may hold API keys.
+func (v *validator) url(field string, value string, schemes ...string) {
+	if value == "" {
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		v.addf("%s: must be an absolute URL", field)
+		return
+	}
+	for _, scheme := range schemes {
+		if u.Scheme == scheme {
+			return
+		}
+	}
+	v.addf("%s: must use %s, got %q", field, strings.Join(schemes, " or "), u.Scheme)
+}
+
+// felt checks that a set value is a Starknet field element, such as an
+// address or private key
+func (v *validator) felt(field string, value string) {
+	if value == "" {
+		return
+	}
+	if _, ok := new(big.Int).SetString(value, 0); !ok {
+		v.addf("%s: must be a number such as 0x1234, got a value of %d characters", field, len(value))
+	}
+}
+
+// key checks that a set value is base64 encoded and decodes to size bytes,
+// or at least size bytes unless exact
+func (v *validator) key(field string, value string, size int, exact bool) {
+	if value == "" {
+		return
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		v.addf("%s: must be base64 encoded", field)
+		return
+	}
+	if exact && len(key) != size {
+		v.addf("%s: must decode to %d bytes, got %d", field, size, len(key))
+	} else if len(key) < size {
+		v.addf("%s: must decode to at least %d bytes, got %d", field, size, len(key))
+	}
+}
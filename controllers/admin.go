@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// AdminListUsersHandler godoc
+//
+//	@Summary		List users
+//	@Metadata	List all users, newest first, optionally only those with a role or whose name contains a text. Requires the users:read permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			role	query		string						false	"Only users with the role"
+//	@Param			name	query		string						false	"Only users whose name contains it, ignoring case"
+//	@Param			limit	query		int							false	"Page size, at most 100"
+//	@Param			cursor	query		string						false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.User]	"Page of users"
+//	@Failure		400		{object}	models.ErrorResponse		"Invalid role, limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse		"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse		"Missing users:read permission"
+//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/admin/users [get]
+func AdminListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	filter := models.UserFilter{
+		Role: models.Role(r.URL.Query().Get("role")),
+		Name: r.URL.Query().Get("name"),
+	}
+	users, err := models.SearchUsers(ctx, filter, opts)
+	if err != nil {
+		var validationErr *models.ValidationError
+		if errors.As(err, &validationErr) {
+			WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+				"reason": err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
+		logs.Logger.Error("failed to list users",
+			slog.String("handler", "AdminListUsersHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to list users", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	// Remove sensitive information before sending the response
+	for _, user := range users.Items {
+		user.PrivateKey = ""
+	}
+
+	writePage(w, users)
+}
+
+// AdminListMerchantsHandler godoc
+//
+//	@Summary		List merchants
+//	@Metadata	List all merchants, newest first, optionally only those whose name contains a text. Requires the merchants:read permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			name	query		string							false	"Only merchants whose name contains it, ignoring case"
+//	@Param			limit	query		int								false	"Page size, at most 100"
+//	@Param			cursor	query		string							false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.Merchant]	"Page of merchants"
+//	@Failure		400		{object}	models.ErrorResponse			"Invalid limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse			"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse			"Missing merchants:read permission"
+//	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/admin/merchants [get]
+func AdminListMerchantsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	merchants, err := models.SearchMerchants(ctx, models.MerchantFilter{Name: r.URL.Query().Get("name")}, opts)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
+		logs.Logger.Error("failed to list merchants",
+			slog.String("handler", "AdminListMerchantsHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to list merchants", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, merchants)
+}
+
+// AdminGetUserHandler godoc
+//
+//	@Summary		Get any user
+//	@Metadata	Get the details of any user. Requires the users:read permission.
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string					true	"User ID"
+//	@Success		200	{object}	models.User				"User details retrieved successfully"
+//	@Failure		401	{object}	models.ErrorResponse	"Authentication error"
+//	@Failure		403	{object}	models.ErrorResponse	"Missing users:read permission"
+//	@Failure		404	{object}	models.ErrorResponse	"User not found"
+//	@Failure		410	{object}	models.ErrorResponse	"User deleted their account"
+//	@Router			/admin/users/{id} [get]
+func AdminGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logs.Logger.Info("AdminGetUserHandler called", "method", r.Method)
+
+	userID := r.PathValue("id")
+
+	user := &models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		if tombstone, err := models.GetTombstone(ctx, userID); err == nil {
+			WriteError(w, "User deleted", NotFoundError, map[string]string{
+				"reason":    "User deleted their account",
+				"userId":    userID,
+				"deletedAt": tombstone.DeletedAt.Format(time.RFC3339),
+			}, http.StatusGone)
+			return
+		}
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+			"userId": userID,
+		}, http.StatusNotFound)
+		return
+	}
+
+	// Remove sensitive information before sending the response
+	user.PrivateKey = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
+
+// AdminSetUserRolesHandler godoc
+//
+//	@Summary		Set user roles
+//	@Metadata	Replace the roles of a user. Only admins may call it. The user picks up the new roles when their token is refreshed.
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		string						true	"User ID"
+//	@Param			request	body		models.SetUserRolesRequest	true	"Roles"
+//	@Success		200		{object}	models.User					"Roles updated successfully"
+//	@Failure		400		{object}	models.ErrorResponse		"Invalid request format"
+//	@Failure		401		{object}	models.ErrorResponse		"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse		"Not an admin"
+//	@Failure		404		{object}	models.ErrorResponse		"User not found"
+//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Example		{json} Request Body:
+//
+//	{
+//	  "roles": ["user", "staff"]
+//	}
+//
+//	@Router			/admin/users/{id}/roles [put]
+func AdminSetUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logs.Logger.Info("AdminSetUserRolesHandler called", "method", r.Method)
+
+	var rolesReq models.SetUserRolesRequest
+	if err := json.NewDecoder(r.Body).Decode(&rolesReq); err != nil {
+		WriteError(w, "Invalid request format", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := rolesReq.Validate(); err != nil {
+		WriteError(w, "Validation failed", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	userID := r.PathValue("id")
+
+	user, err := models.ModifyUser(ctx, userID, func(user *models.User) error {
+		user.Roles = []models.Role{models.RoleUser}
+		for _, role := range rolesReq.Roles {
+			if !slices.Contains(user.Roles, role) {
+				user.Roles = append(user.Roles, role)
+			}
+		}
+		return nil
+	})
+	if models.IsNotFound(err) {
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+			"userId": userID,
+		}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logs.Logger.Error("AdminSetUserRolesHandler failed to update user", "error", err, "userId", userID)
+		WriteError(w, "Failed to update user", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	// Remove sensitive information before sending the response
+	user.PrivateKey = ""
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user)
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"infinirewards/logs"
+	"infinirewards/middleware"
+	"infinirewards/models"
+	"log/slog"
+	"net/http"
+)
+
+// MerchantAuditHandler godoc
+//
+//	@Summary		Get merchant audit log
+//	@Metadata	List the audit events of requests made as the caller's merchant, oldest first, optionally only those of one user. Requires the merchant:read permission.
+//	@Tags			merchant
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			actor	query		string							false	"Only events of requests sent by this user"
+//	@Param			limit	query		int								false	"Page size, at most 100"
+//	@Param			cursor	query		string							false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.AuditEvent]	"Page of audit events"
+//	@Failure		400		{object}	models.ErrorResponse			"Invalid limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse			"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse			"Missing merchant:read permission"
+//	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/merchant/audit [get]
+func MerchantAuditHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	// A merchant shares the ID of the user it belongs to
+	listAuditEvents(w, r, models.AuditFilter{Merchant: userID, Actor: r.URL.Query().Get("actor")}, "MerchantAuditHandler")
+}
+
+// AdminAuditHandler godoc
+//
+//	@Summary		Get audit log
+//	@Metadata	List the audit events of all requests, oldest first, optionally only those of a merchant or user. Requires the audit:read permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			merchant	query		string							false	"Only events of requests made as this merchant, platform for the others"
+//	@Param			actor		query		string							false	"Only events of requests sent by this user"
+//	@Param			limit		query		int								false	"Page size, at most 100"
+//	@Param			cursor		query		string							false	"nextCursor of the previous page"
+//	@Success		200			{object}	models.Page[models.AuditEvent]	"Page of audit events"
+//	@Failure		400			{object}	models.ErrorResponse			"Invalid limit or cursor"
+//	@Failure		401			{object}	models.ErrorResponse			"Authentication error"
+//	@Failure		403			{object}	models.ErrorResponse			"Missing audit:read permission"
+//	@Failure		500			{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/admin/audit [get]
+func AdminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	listAuditEvents(w, r, models.AuditFilter{Merchant: query.Get("merchant"), Actor: query.Get("actor")}, "AdminAuditHandler")
+}
+
+// AdminVerifyAuditHandler godoc
+//
+//	@Summary		Verify audit log
+//	@Metadata	Check the hash chain of the audit log. An event that was changed, removed or reordered is reported as the point where the chain breaks. Requires the audit:read permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	models.AuditVerification	"Result of the check"
+//	@Failure		401	{object}	models.ErrorResponse		"Authentication error"
+//	@Failure		403	{object}	models.ErrorResponse		"Missing audit:read permission"
+//	@Failure		500	{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/admin/audit/verify [get]
+func AdminVerifyAuditHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	result, err := models.VerifyAuditChain(ctx)
+	if err != nil {
+		logs.Logger.Error("failed to verify audit log",
+			slog.String("handler", "AdminVerifyAuditHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to verify audit log", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	if !result.Valid {
+		logs.Logger.Error("audit log chain is broken",
+			slog.String("handler", "AdminVerifyAuditHandler"),
+			slog.Uint64("sequence", result.BrokenAt),
+			slog.String("reason", result.Reason),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// listAuditEvents writes the page of audit events that match filter
+func listAuditEvents(w http.ResponseWriter, r *http.Request, filter models.AuditFilter, handler string) {
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	events, err := models.ListAuditEvents(r.Context(), filter, opts)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
+		logs.Logger.Error("failed to list audit events",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to list audit events", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, events)
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"infinirewards/jwt"
 	"infinirewards/logs"
@@ -12,6 +13,7 @@ import (
 	"infinirewards/utils"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -22,11 +24,13 @@ import (
 // RequestOTPHandler godoc
 //
 //	@Summary		Request OTP
-//	@Metadata	Request a one-time password for authentication
+//	@Metadata	Request a one-time password for authentication. The message uses the templates of the brand in X-IR-Brand, in the user's locale or the first language of Accept-Language that has a template.
 //	@Tags			auth
 //	@Accept			json
 //	@Produce		json
-//	@Param			request	body		models.RequestOTPRequest	true	"OTP Request"
+//	@Param			request			body		models.RequestOTPRequest	true	"OTP Request"
+//	@Param			X-IR-Brand		header		string						false	"Brand of the message templates"
+//	@Param			Accept-Language	header		string						false	"Preferred message languages"
 //	@Success		200		{object}	models.RequestOTPResponse	"OTP sent successfully"
 //	@Failure		400		{object}	models.ErrorResponse		"Invalid request format or validation failed"
 //	@Failure		429		{object}	models.ErrorResponse		"Too many requests"
@@ -61,8 +65,8 @@ import (
 //	  "message": "Too many OTP requests",
 //	  "code": "RATE_LIMIT_EXCEEDED",
 //	  "details": {
-//	    "retryAfter": "60s",
-//	    "limit": "3 requests per hour"
+//	    "retryAfter": "30s",
+//	    "limit": "10 requests per day per phone number"
 //	  }
 //	}
 //
@@ -101,14 +105,38 @@ func RequestOTPHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	phoneNumber := requestOTPRequest.PhoneNumber
+
+	if !allowRequest(w, r, models.OTPRequestIPLimit, middleware.GetClientIP(r), "Too many OTP requests", "RequestOTPHandler") {
+		return
+	}
+	phoneHash, err := models.HashPhoneNumber(phoneNumber)
+	if err != nil {
+		logs.Logger.Error("failed to hash phone number",
+			slog.String("handler", "RequestOTPHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to send OTP", InternalServerError, map[string]string{
+			"reason": "Failed to hash phone number",
+		}, http.StatusInternalServerError)
+		return
+	}
+	if !allowRequest(w, r, models.OTPRequestPhoneLimit, phoneHash, "Too many OTP requests", "RequestOTPHandler") {
+		return
+	}
+
 	user := models.User{}
-	err := user.GetUserFromPhoneNumber(ctx, phoneNumber)
+	err = user.GetUserFromPhoneNumber(ctx, phoneNumber)
 	if err != nil {
 		user = models.User{
 			PhoneNumber: phoneNumber,
 			CreatedAt:   time.Now(),
 		}
-		if err := user.CreateUser(ctx); err != nil {
+		err := user.CreateUser(ctx)
+		if errors.Is(err, models.ErrPhoneNumberTaken) {
+			// A concurrent request created the user first
+			err = user.GetUserFromPhoneNumber(ctx, phoneNumber)
+		}
+		if err != nil {
 			logs.Logger.Error("failed to create user",
 				slog.String("handler", "RequestOTPHandler"),
 				slog.String("phone_number", phoneNumber),
@@ -121,84 +149,75 @@ func RequestOTPHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	key, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "InfiniRewards Auth",
-		AccountName: phoneNumber,
-	})
+	delivery := newOTPDelivery(r, &user)
+	delivery.Channel = requestOTPRequest.Channel
+	verificationID, err := sendOTP(ctx, user.ID, phoneNumber, models.VerificationPurposeLogin, delivery)
 	if err != nil {
-		logs.Logger.Error("failed to generate TOTP key",
+		logs.Logger.Error("failed to send OTP",
 			slog.String("handler", "RequestOTPHandler"),
+			slog.String("phone_number", phoneNumber),
 			slog.String("error", err.Error()),
 		)
-		WriteError(w, "Failed to generate OTP", InternalServerError, map[string]string{
-			"reason": "Failed to generate TOTP key",
+		WriteError(w, "Failed to send OTP", InternalServerError, map[string]string{
+			"reason": "Failed to send OTP",
 		}, http.StatusInternalServerError)
 		return
 	}
 
-	phoneNumberVerification := models.PhoneNumberVerification{
-		ID:        ulid.Make().String(),
-		Secret:    key.Secret(),
-		User:      user.ID,
-		CreatedAt: time.Now(),
+	response := models.RequestOTPResponse{
+		Message: "OTP sent successfully",
+		ID:      verificationID,
 	}
 
-	data, err := json.Marshal(phoneNumberVerification)
-	if err != nil {
-		logs.Logger.Error("failed to marshal phone verification",
-			slog.String("handler", "RequestOTPHandler"),
-			slog.String("verification_id", phoneNumberVerification.ID),
-			slog.String("error", err.Error()),
-		)
-		WriteError(w, "Internal server error", InternalServerError, map[string]string{
-			"reason": "Failed to marshal phone verification",
-		}, http.StatusInternalServerError)
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-	if err := nats.PutKV(ctx, "phoneVerification", phoneNumberVerification.ID, data); err != nil {
-		logs.Logger.Error("failed to store phone verification",
-			slog.String("handler", "RequestOTPHandler"),
-			slog.String("error", err.Error()),
-		)
-		WriteError(w, "Failed to store verification", InternalServerError, map[string]string{
-			"reason": "Failed to store phone verification",
-		}, http.StatusInternalServerError)
+// OTPStatusHandler godoc
+//
+//	@Summary		Get OTP delivery status
+//	@Metadata	Get whether an OTP was sent, delivered, read or failed, so the app can offer to resend it by SMS
+//	@Tags			auth
+//	@Produce		json
+//	@Param			id	path		string					true	"Verification ID"
+//	@Success		200	{object}	models.OTPStatusResponse	"Delivery status"
+//	@Failure		404	{object}	models.ErrorResponse		"Verification not found or expired"
+//	@Failure		429	{object}	models.ErrorResponse		"Too many status checks"
+//	@Failure		500	{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/auth/otp/{id}/status [get]
+func OTPStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+
+	if !allowRequest(w, r, models.OTPStatusLimit, id, "Too many status checks", "OTPStatusHandler") {
 		return
 	}
 
-	passcode, err := totp.GenerateCodeCustom(key.Secret(), time.Now(), totp.ValidateOpts{
-		Period:    300,
-		Skew:      1,
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA512,
-	})
+	phoneNumberVerification, err := models.StoresFrom(ctx).Verifications.GetVerification(ctx, id)
 	if err != nil {
-		logs.Logger.Error("failed to generate OTP code",
-			slog.String("handler", "RequestOTPHandler"),
-			slog.String("error", err.Error()),
-		)
-		WriteError(w, "Failed to generate OTP", InternalServerError, map[string]string{
-			"reason": "Failed to generate OTP code",
-		}, http.StatusInternalServerError)
+		if models.IsNotFound(err) {
+			WriteError(w, "Verification not found", NotFoundError, map[string]string{
+				"reason": "Invalid or expired verification",
+			}, http.StatusNotFound)
+			return
+		}
+		WriteError(w, "Failed to get verification", InternalServerError, nil, http.StatusInternalServerError)
 		return
 	}
 
-	if err := utils.SendPhoneOTP(phoneNumber, passcode); err != nil {
-		logs.Logger.Error("failed to send OTP",
-			slog.String("handler", "RequestOTPHandler"),
-			slog.String("phone_number", phoneNumber),
-			slog.String("error", err.Error()),
-		)
-		WriteError(w, "Failed to send OTP", InternalServerError, map[string]string{
-			"reason": "Failed to send OTP",
-		}, http.StatusInternalServerError)
+	var delivery models.MessageDelivery
+	if err := delivery.GetMessageDelivery(ctx, phoneNumberVerification.DeliveryID); err != nil {
+		WriteError(w, "Delivery status not found", NotFoundError, map[string]string{
+			"reason": "No delivery was recorded for this verification",
+		}, http.StatusNotFound)
 		return
 	}
 
-	response := models.RequestOTPResponse{
-		Message: "OTP sent successfully",
-		ID:      phoneNumberVerification.ID,
+	response := models.OTPStatusResponse{
+		ID:        phoneNumberVerification.ID,
+		Status:    delivery.Status,
+		Channel:   delivery.Channel,
+		UpdatedAt: delivery.UpdatedAt,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -306,10 +325,23 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch authenticateRequest.Method {
 	case "otp":
-		if err := handleOTPAuthentication(ctx, &user, authenticateRequest); err != nil {
-			WriteError(w, "Authentication failed", AuthenticationError, map[string]string{
+		if remainingAttempts, err := handleOTPAuthentication(ctx, &user, authenticateRequest); err != nil {
+			var rateLimitErr *models.RateLimitError
+			if errors.As(err, &rateLimitErr) {
+				logs.Logger.Warn("OTP verification rate limited",
+					slog.String("handler", "AuthenticateHandler"),
+					slog.String("verification_id", authenticateRequest.ID),
+				)
+				WriteRateLimitError(w, "Too many authentication attempts", rateLimitErr)
+				return
+			}
+			details := map[string]interface{}{
 				"reason": err.Error(),
-			}, http.StatusUnauthorized)
+			}
+			if remainingAttempts >= 0 {
+				details["remainingAttempts"] = remainingAttempts
+			}
+			WriteError(w, "Authentication failed", AuthenticationError, details, http.StatusUnauthorized)
 			return
 		}
 	case "secret":
@@ -328,7 +360,7 @@ func AuthenticateHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate token
-	token, err := createJWT(user.ID, authenticateRequest.Device)
+	token, err := createJWT(ctx, &user, authenticateRequest.Device)
 	if err != nil {
 		WriteError(w, "failed to generate token: "+err.Error(), InternalServerError, map[string]string{
 			"reason": "Failed to generate token",
@@ -444,7 +476,8 @@ func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if oldToken.User != userID {
+	// Access tokens issued before a user moved to a stable ID carry the legacy ID
+	if oldToken.User != models.ResolveUserID(ctx, userID) {
 		WriteError(w, "User mismatch", AuthorizationError, map[string]string{
 			"reason": "User mismatch",
 		}, http.StatusUnauthorized)
@@ -460,7 +493,7 @@ func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Generate new token
-	newToken, err := createJWT(user.ID, oldToken.Device)
+	newToken, err := createJWT(ctx, &user, oldToken.Device)
 	if err != nil {
 		WriteError(w, "Failed to generate token", InternalServerError, map[string]string{
 			"reason": "Failed to generate token",
@@ -485,21 +518,205 @@ func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// NATSCredsHandler godoc
+//
+//	@Summary		Issue NATS credentials
+//	@Metadata	Issue short-lived NATS credentials for realtime balance, transaction and notification updates
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request	body		models.NATSCredsRequest		true	"NATS Credentials Request"
+//	@Success		200		{object}	models.NATSCredsResponse	"Credentials issued successfully"
+//	@Failure		400		{object}	models.ErrorResponse		"Invalid request format"
+//	@Failure		401		{object}	models.ErrorResponse		"Authentication error"
+//	@Failure		404		{object}	models.ErrorResponse		"User not found"
+//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/auth/nats-creds [post]
+func NATSCredsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var credsReq models.NATSCredsRequest
+	if err := json.NewDecoder(r.Body).Decode(&credsReq); err != nil {
+		WriteError(w, "Invalid request body", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := credsReq.Validate(); err != nil {
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	user := models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User not found",
+		}, http.StatusNotFound)
+		return
+	}
+
+	creds, expires, err := nats.GenerateClientCreds(user.ID, credsReq.Device)
+	if err != nil {
+		logs.Logger.Error("failed to generate NATS credentials",
+			slog.String("handler", "NATSCredsHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to generate credentials", InternalServerError, map[string]string{
+			"reason": "Failed to generate credentials",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	logs.Logger.Info("issued NATS credentials",
+		slog.String("handler", "NATSCredsHandler"),
+		slog.String("user_id", user.ID),
+		slog.String("device", credsReq.Device),
+	)
+
+	response := models.NATSCredsResponse{
+		Creds:    string(creds),
+		Subjects: nats.ClientSubjects(user.ID),
+		Expires:  expires,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 // Helper functions
 
-func handleOTPAuthentication(ctx context.Context, user *models.User, req models.AuthenticateRequest) error {
-	entry, err := nats.GetKV(ctx, "phoneVerification", req.ID)
+// handleOTPAuthentication validates an OTP against its verification. Failed
+// guesses are counted per verification ID; the returned number of remaining
+// attempts is -1 when the failure was not a wrong code.
+func handleOTPAuthentication(ctx context.Context, user *models.User, req models.AuthenticateRequest) (int, error) {
+	verification, remaining, err := checkOTP(ctx, req.ID, req.Token)
 	if err != nil {
-		return err
+		return remaining, err
 	}
 
-	var phoneNumberVerification models.PhoneNumberVerification
-	if err := json.Unmarshal(entry.Value(), &phoneNumberVerification); err != nil {
-		return err
+	// Codes sent to confirm a phone number change cannot be used to log in
+	if verification.Purpose != models.VerificationPurposeLogin {
+		return -1, fmt.Errorf("invalid or expired verification")
+	}
+
+	if err := user.GetUser(ctx, models.ResolveUserID(ctx, verification.User)); err != nil {
+		return -1, err
+	}
+
+	consumeOTP(ctx, req.ID)
+
+	return -1, nil
+}
+
+// brandHeader names the brand whose message templates a request's messages use
+const brandHeader = "X-IR-Brand"
+
+// otpDelivery selects how an OTP is sent
+type otpDelivery struct {
+	// Channel, if set, restricts delivery to WhatsApp or SMS
+	Channel string
+	// Brand and Locales select the message template
+	Brand   string
+	Locales []string
+}
+
+// newOTPDelivery sends OTPs with the brand of the request, in the user's
+// locale or else the languages the client accepts
+func newOTPDelivery(r *http.Request, user *models.User) otpDelivery {
+	locales := []string{}
+	if user != nil && user.Locale != "" {
+		locales = append(locales, user.Locale)
+	}
+	locales = append(locales, utils.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+
+	return otpDelivery{
+		Brand:   strings.ToLower(r.Header.Get(brandHeader)),
+		Locales: locales,
+	}
+}
+
+// sendOTP sends a code to phoneNumber and stores its verification for a
+// user. It returns the verification ID.
+func sendOTP(ctx context.Context, userID string, phoneNumber string, purpose string, delivery otpDelivery) (string, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "InfiniRewards Auth",
+		AccountName: phoneNumber,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate TOTP key: %w", err)
+	}
+
+	passcode, err := totp.GenerateCodeCustom(key.Secret(), time.Now(), totp.ValidateOpts{
+		Period:    300,
+		Skew:      1,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA512,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate OTP code: %w", err)
+	}
+
+	phoneNumberVerification := models.PhoneNumberVerification{
+		ID:        ulid.Make().String(),
+		Secret:    key.Secret(),
+		User:      userID,
+		Purpose:   purpose,
+		CreatedAt: time.Now(),
+	}
+
+	message, err := models.NewTemplateMessage(ctx, phoneNumber, models.TemplateOTP, delivery.Brand, delivery.Locales, utils.TemplateData{
+		Code:         passcode,
+		ValidMinutes: 5,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render OTP message: %w", err)
+	}
+	message.Reference = phoneNumberVerification.ID
+	message.Channel = delivery.Channel
+
+	record, err := models.SendMessage(ctx, message)
+	if err != nil {
+		return "", fmt.Errorf("failed to send OTP: %w", err)
+	}
+	phoneNumberVerification.DeliveryID = record.ID
+
+	if err := models.StoresFrom(ctx).Verifications.PutVerification(ctx, &phoneNumberVerification); err != nil {
+		return "", fmt.Errorf("failed to store phone verification: %w", err)
+	}
+
+	return phoneNumberVerification.ID, nil
+}
+
+// checkOTP validates a code against its verification without using it up.
+// Failed guesses are counted per verification ID; the returned number of
+// remaining attempts is -1 when the failure was not a wrong code.
+func checkOTP(ctx context.Context, id string, token string) (*models.PhoneNumberVerification, int, error) {
+	if _, err := models.OTPVerifyLimit.Check(ctx, id); err != nil {
+		return nil, -1, err
+	}
+
+	phoneNumberVerification, err := models.StoresFrom(ctx).Verifications.GetVerification(ctx, id)
+	if err != nil {
+		if models.IsNotFound(err) {
+			return nil, -1, fmt.Errorf("invalid or expired verification")
+		}
+		return nil, -1, err
 	}
 
 	valid, err := totp.ValidateCustom(
-		req.Token,
+		token,
 		phoneNumberVerification.Secret,
 		time.Now(),
 		totp.ValidateOpts{
@@ -509,18 +726,73 @@ func handleOTPAuthentication(ctx context.Context, user *models.User, req models.
 			Algorithm: otp.AlgorithmSHA512,
 		},
 	)
-	if err != nil {
-		return err
+	if err != nil || !valid {
+		status, hitErr := models.OTPVerifyLimit.Hit(ctx, id)
+		if hitErr != nil {
+			return nil, -1, hitErr
+		}
+		if status.Remaining == 0 {
+			// Burn the verification so the code cannot be guessed any further
+			if err := models.StoresFrom(ctx).Verifications.DeleteVerification(ctx, id); err != nil {
+				logs.Logger.Error("failed to remove exhausted verification",
+					slog.String("handler", "checkOTP"),
+					slog.String("verification_id", id),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+		return nil, status.Remaining, fmt.Errorf("invalid OTP")
 	}
-	if !valid {
-		return fmt.Errorf("invalid OTP")
+
+	return phoneNumberVerification, -1, nil
+}
+
+// consumeOTP removes a verification after its code was accepted, since a
+// verification can only be used once
+func consumeOTP(ctx context.Context, id string) {
+	if err := models.StoresFrom(ctx).Verifications.DeleteVerification(ctx, id); err != nil {
+		logs.Logger.Error("failed to remove used verification",
+			slog.String("handler", "consumeOTP"),
+			slog.String("verification_id", id),
+			slog.String("error", err.Error()),
+		)
 	}
+	if err := models.OTPVerifyLimit.Reset(ctx, id); err != nil {
+		logs.Logger.Error("failed to reset verification attempts",
+			slog.String("handler", "consumeOTP"),
+			slog.String("verification_id", id),
+			slog.String("error", err.Error()),
+		)
+	}
+}
 
-	if err := user.GetUser(ctx, phoneNumberVerification.User); err != nil {
-		return err
+// allowRequest counts a request against limit and writes a 429 response if it
+// is exhausted. It returns false when the caller should stop processing.
+func allowRequest(w http.ResponseWriter, r *http.Request, limit *models.RateLimit, key string, message string, handler string) bool {
+	_, err := limit.Allow(r.Context(), key)
+	if err == nil {
+		return true
 	}
 
-	return nil
+	var rateLimitErr *models.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		logs.Logger.Warn("request rate limited",
+			slog.String("handler", handler),
+			slog.String("limit", limit.Name),
+		)
+		WriteRateLimitError(w, message, rateLimitErr)
+		return false
+	}
+
+	logs.Logger.Error("failed to apply rate limit",
+		slog.String("handler", handler),
+		slog.String("limit", limit.Name),
+		slog.String("error", err.Error()),
+	)
+	WriteError(w, "Internal server error", InternalServerError, map[string]string{
+		"reason": "Failed to apply rate limit",
+	}, http.StatusInternalServerError)
+	return false
 }
 
 func handleAPIKeyAuthentication(ctx context.Context, user *models.User, req models.AuthenticateRequest) error {
@@ -533,30 +805,23 @@ func handleAPIKeyAuthentication(ctx context.Context, user *models.User, req mode
 }
 
 func getToken(ctx context.Context, tokenID string) (*models.Token, error) {
-	data, err := nats.GetKV(ctx, "token", tokenID)
-	if err != nil {
-		return nil, err
-	}
-
-	var userToken models.Token
-	if err := json.Unmarshal(data.Value(), &userToken); err != nil {
-		return nil, err
-	}
-
-	return &userToken, nil
+	return models.StoresFrom(ctx).Tokens.GetToken(ctx, tokenID)
 }
 
 func removeToken(ctx context.Context, tokenID string) error {
-	return nats.RemoveKV(ctx, "token", tokenID)
+	return models.StoresFrom(ctx).Tokens.DeleteToken(ctx, tokenID)
 }
 
-func createJWT(userID string, device string) (*models.Token, error) {
+// createJWT issues a token embedding the user's current roles and permissions
+func createJWT(ctx context.Context, user *models.User, device string) (*models.Token, error) {
 	// Generate a random token string
-	if userID == "" {
+	if user.ID == "" {
 		return nil, fmt.Errorf("user ID is required")
 	}
+	userID := user.ID
 
-	token, err := jwt.CreateToken(userID)
+	roleClaims, permissionClaims := user.RoleClaims(ctx)
+	token, err := jwt.CreateToken(userID, roleClaims, permissionClaims)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate token: %w", err)
 	}
@@ -573,13 +838,7 @@ func createJWT(userID string, device string) (*models.Token, error) {
 		CreatedAt:          time.Now(),
 	}
 
-	// Store token in NATS KV
-	tokenBytes, err := json.Marshal(userToken)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal token: %w", err)
-	}
-
-	if err := nats.PutKV(context.Background(), "token", userToken.ID, tokenBytes); err != nil {
+	if err := models.StoresFrom(ctx).Tokens.PutToken(ctx, &userToken); err != nil {
 		return nil, fmt.Errorf("failed to store token: %w", err)
 	}
 
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"infinirewards/models"
 	"net/http"
+	"strconv"
 )
 
 // WriteError writes a standardized error response
@@ -19,13 +20,30 @@ func WriteError(w http.ResponseWriter, message string, code string, details inte
 	json.NewEncoder(w).Encode(errResp)
 }
 
+// WriteRateLimitError writes a 429 response with a Retry-After header
+func WriteRateLimitError(w http.ResponseWriter, message string, err *models.RateLimitError) {
+	retryAfter := int(err.RetryAfter.Seconds())
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	WriteError(w, message, RateLimitError, map[string]string{
+		"retryAfter": strconv.Itoa(retryAfter) + "s",
+		"limit":      err.Limit,
+	}, http.StatusTooManyRequests)
+}
+
 // Common error codes
 const (
-	ValidationError     = "VALIDATION_ERROR"
-	AuthenticationError = "AUTHENTICATION_ERROR"
-	AuthorizationError  = "AUTHORIZATION_ERROR"
-	NotFoundError       = "NOT_FOUND"
-	ConflictError       = "CONFLICT"
-	RateLimitError      = "RATE_LIMIT_EXCEEDED"
-	InternalServerError = "INTERNAL_ERROR"
+	ValidationError         = "VALIDATION_ERROR"
+	AuthenticationError     = "AUTHENTICATION_ERROR"
+	AuthorizationError      = "AUTHORIZATION_ERROR"
+	NotFoundError           = "NOT_FOUND"
+	ConflictError           = "CONFLICT"
+	PreconditionFailedError = "PRECONDITION_FAILED"
+	PayloadTooLargeError    = "PAYLOAD_TOO_LARGE"
+	UnsupportedMediaError   = "UNSUPPORTED_MEDIA_TYPE"
+	RateLimitError          = "RATE_LIMIT_EXCEEDED"
+	InternalServerError     = "INTERNAL_ERROR"
 )
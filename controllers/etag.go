@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errPreconditionFailed is returned from a modification whose If-Match
+// header no longer names the current revision
+var errPreconditionFailed = errors.New("precondition failed")
+
+// revisionETag formats a store revision as a strong entity tag
+func revisionETag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+// matchesIfMatch reports whether the If-Match header of r allows changing a
+// record at revision. A request without the header always matches. Weak tags
+// never match, as If-Match uses strong comparison.
+func matchesIfMatch(r *http.Request, revision uint64) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+
+	etag := revisionETag(revision)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesIfNoneMatch reports whether the If-None-Match header of r names
+// etag, so the client's cached copy is current. If-None-Match uses weak
+// comparison, so weak tags match too.
+func matchesIfNoneMatch(r *http.Request, etag string) bool {
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writePreconditionFailed writes the 412 response of a request whose
+// If-Match header does not name the current revision
+func writePreconditionFailed(w http.ResponseWriter, revision uint64) {
+	w.Header().Set("ETag", revisionETag(revision))
+	WriteError(w, "Precondition failed", PreconditionFailedError, map[string]string{
+		"reason": "The resource was modified since it was read",
+	}, http.StatusPreconditionFailed)
+}
@@ -1,15 +1,18 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"infinirewards/infinirewards"
 	"infinirewards/logs"
 	"infinirewards/middleware"
 	"infinirewards/models"
+	"log/slog"
 	"math/big"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // GetCollectibleBalanceHandler godoc
@@ -334,6 +337,23 @@ func MintCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	event := &models.Event{
+		Type:            models.EventCollectibleMinted,
+		Account:         mintReq.To,
+		Contract:        mintReq.CollectibleAddress,
+		TokenID:         tokenId.String(),
+		Amount:          amount.String(),
+		TransactionHash: txHash,
+	}
+	// The expiry is only used to remind the holder, so minting succeeds without it
+	if _, _, expiry, _, err := infinirewards.GetTokenData(ctx, mintReq.CollectibleAddress, tokenId); err == nil && expiry > 0 {
+		expiresAt := time.Unix(int64(expiry), 0)
+		event.ExpiresAt = &expiresAt
+	}
+	publishEvent(ctx, event, "MintCollectibleHandler")
+
 	resp := models.MintCollectibleResponse{
 		TransactionHash: txHash,
 	}
@@ -364,7 +384,8 @@ func MintCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 //	  "pointsContract": "0x1234...",
 //	  "price": "100",
 //	  "expiry": 1735689600,
-//	  "description": "Limited edition collectible"
+//	  "description": "Limited edition collectible",
+//	  "image": "01J8X5K3ZJ0000000000000000"
 //	}
 //
 //	@Example		{json} Success Response:
@@ -462,6 +483,24 @@ func SetTokenDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The image must be media of the merchant
+	if setReq.Image != "" {
+		image, err := models.GetMedia(ctx, setReq.Image)
+		if err != nil && !models.IsNotFound(err) {
+			WriteError(w, "Failed to get image", InternalServerError, map[string]string{
+				"reason": "Database operation failed",
+			}, http.StatusInternalServerError)
+			return
+		}
+		if err != nil || image.Owner != user.ID || image.Purpose != models.MediaPurposeMerchant {
+			WriteError(w, "Invalid image", ValidationError, map[string]string{
+				"reason": "Image must be the ID of media uploaded with POST /merchant/media",
+				"image":  setReq.Image,
+			}, http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Use user's credentials from database
 	account, err := infinirewards.GetAccount(user.PrivateKey, user.PublicKey, merchant.Address)
 	if err != nil {
@@ -488,6 +527,18 @@ func SetTokenDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	if setReq.Image != "" {
+		if err := models.SetCollectibleImage(ctx, setReq.CollectibleAddress, tokenId.String(), setReq.Image); err != nil {
+			WriteError(w, "Failed to set token image", InternalServerError, map[string]string{
+				"reason":          "Token data was set but its image could not be stored",
+				"transactionHash": txHash,
+			}, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	resp := models.SetTokenDataResponse{
 		TransactionHash: txHash,
 	}
@@ -618,6 +669,16 @@ func MintPointsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	publishEvent(ctx, &models.Event{
+		Type:            models.EventPointsMinted,
+		Account:         mintReq.Recipient,
+		Contract:        mintReq.PointsContract,
+		Amount:          amount.String(),
+		TransactionHash: txHash,
+	}, "MintPointsHandler")
+
 	resp := models.MintPointsResponse{
 		TransactionHash: txHash,
 	}
@@ -726,6 +787,8 @@ func BurnPointsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	resp := models.BurnPointsResponse{
 		TransactionHash: txHash,
 	}
@@ -929,6 +992,16 @@ func TransferPointsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	publishEvent(ctx, &models.Event{
+		Type:            models.EventPointsReceived,
+		Account:         transferReq.To,
+		Contract:        transferReq.PointsContract,
+		Amount:          amount.String(),
+		TransactionHash: txHash,
+	}, "TransferPointsHandler")
+
 	resp := models.TransferPointsResponse{
 		TransactionHash: txHash,
 	}
@@ -956,7 +1029,8 @@ func TransferPointsHandler(w http.ResponseWriter, r *http.Request) {
 //	  "pointsContract": "0x1234...",
 //	  "price": "100",
 //	  "expiry": 1735689600,
-//	  "description": "Limited edition collectible"
+//	  "description": "Limited edition collectible",
+//	  "image": "/media/01J8X5K3ZJ0000000000000000"
 //	}
 //
 //	@Example		{json} Error Response (Invalid Parameters):
@@ -1019,11 +1093,20 @@ func GetTokenDataHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	image, err := models.GetCollectibleImage(ctx, address, tokenId.String())
+	if err != nil {
+		WriteError(w, "Failed to get token image", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
 	resp := models.GetTokenDataResponse{
 		PointsContract: pointsContract,
 		Price:          price.String(),
 		Expiry:         int64(expiry),
 		Metadata:       description,
+		Image:          image,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1152,6 +1235,16 @@ func RedeemCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Collectibles created before contracts were indexed have no owner on
+	// record, so only a collectible of another merchant is refused
+	owner := &models.Merchant{}
+	if err := owner.GetMerchantFromContract(ctx, redeemReq.CollectibleAddress); err == nil && owner.ID != merchant.ID {
+		WriteError(w, "Not authorized", AuthorizationError, map[string]string{
+			"reason": "Collectible belongs to another merchant",
+		}, http.StatusForbidden)
+		return
+	}
+
 	// Use user's credentials from database
 	account, err := infinirewards.GetAccount(user.PrivateKey, user.PublicKey, merchant.Address)
 	if err != nil {
@@ -1177,6 +1270,17 @@ func RedeemCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	publishEvent(ctx, &models.Event{
+		Type:            models.EventCollectibleRedeemed,
+		Account:         redeemReq.User,
+		Contract:        redeemReq.CollectibleAddress,
+		TokenID:         tokenId.String(),
+		Amount:          amount.String(),
+		TransactionHash: txHash,
+	}, "RedeemCollectibleHandler")
+
 	resp := models.RedeemCollectibleResponse{
 		TransactionHash: txHash,
 	}
@@ -1268,9 +1372,18 @@ func GetCollectibleDetailsHandler(w http.ResponseWriter, r *http.Request) {
 	tokenPriceStrings := make([]string, len(tokenPrices))
 	tokenBalanceStrings := make([]string, len(tokenIDs))
 	tokenSupplyStrings := make([]string, len(tokenSupplies))
+	tokenImages := make([]string, len(tokenIDs))
 	for i, id := range tokenIDs {
 		if id != nil {
 			tokenIDStrings[i] = id.String()
+			image, err := models.GetCollectibleImage(ctx, address, id.String())
+			if err != nil {
+				WriteError(w, "Failed to get token image", InternalServerError, map[string]string{
+					"reason": "Database operation failed",
+				}, http.StatusInternalServerError)
+				return
+			}
+			tokenImages[i] = image
 			balance, err := infinirewards.BalanceOf(ctx, user.AccountAddress, address, id)
 			if err != nil {
 				WriteError(w, "Failed to get token balance", InternalServerError, map[string]string{
@@ -1298,6 +1411,7 @@ func GetCollectibleDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		TokenPrices:       tokenPriceStrings,
 		TokenExpiries:     tokenExpiries,
 		TokenDescriptions: tokenDescriptions,
+		TokenImages:       tokenImages,
 		TokenBalances:     tokenBalanceStrings,
 		TokenSupplies:     tokenSupplyStrings,
 	}
@@ -1518,6 +1632,8 @@ func PurchaseCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	resp := models.PurchaseCollectibleResponse{
 		TransactionHash: txHash,
 	}
@@ -1525,3 +1641,16 @@ func PurchaseCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// publishEvent publishes a domain event of a completed transaction. The
+// transaction is already on chain, so a failure is logged and not returned.
+func publishEvent(ctx context.Context, event *models.Event, handler string) {
+	if err := models.PublishEvent(ctx, event); err != nil {
+		logs.Logger.Error("failed to publish event",
+			slog.String("handler", handler),
+			slog.String("type", string(event.Type)),
+			slog.String("transaction_hash", event.TransactionHash),
+			slog.String("error", err.Error()),
+		)
+	}
+}
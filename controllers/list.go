@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"infinirewards/models"
+	"net/http"
+	"strconv"
+)
+
+// parseListOptions reads the limit and cursor query parameters of a list
+// endpoint. It writes a 400 response and returns false for an invalid limit.
+func parseListOptions(w http.ResponseWriter, r *http.Request) (models.ListOptions, bool) {
+	query := r.URL.Query()
+	opts := models.ListOptions{Cursor: query.Get("cursor")}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > models.MaxListLimit {
+			WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+				"reason": fmt.Sprintf("limit must be a number from 1 to %d", models.MaxListLimit),
+			}, http.StatusBadRequest)
+			return opts, false
+		}
+		opts.Limit = n
+	}
+
+	return opts, true
+}
+
+// writeInvalidCursor writes the 400 response of a cursor that was not
+// returned by the list
+func writeInvalidCursor(w http.ResponseWriter) {
+	WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+		"reason": "cursor is not a nextCursor of this list",
+	}, http.StatusBadRequest)
+}
+
+// writePage writes a page of a list in the envelope of list endpoints
+func writePage[T any](w http.ResponseWriter, page *models.Page[T]) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
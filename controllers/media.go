@@ -0,0 +1,334 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"infinirewards/logs"
+	"infinirewards/media"
+	"infinirewards/middleware"
+	"infinirewards/models"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// multipartOverhead is allowed on top of the upload for the rest of the form
+const multipartOverhead = 64 << 10
+
+// mediaCacheControl lets clients and proxies keep media for a year, as the
+// image behind an ID never changes
+const mediaCacheControl = "public, max-age=31536000, immutable"
+
+// UploadAvatarHandler godoc
+//
+//	@Summary		Upload avatar
+//	@Metadata	Upload a JPEG, PNG or GIF image as the authenticated user's avatar. The image is re-encoded without its EXIF data and a thumbnail is made. The avatar of the user is set to the URL of the image and the previous uploaded avatar is deleted.
+//	@Tags			user
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			file	formData	file					true	"Image, at most 5 MB"
+//	@Success		201		{object}	models.Media			"Uploaded avatar"
+//	@Failure		400		{object}	models.ErrorResponse	"Missing file or invalid image"
+//	@Failure		401		{object}	models.ErrorResponse	"Unauthorized access"
+//	@Failure		404		{object}	models.ErrorResponse	"User not found"
+//	@Failure		413		{object}	models.ErrorResponse	"Image is too large"
+//	@Failure		415		{object}	models.ErrorResponse	"Not a JPEG, PNG or GIF image"
+//	@Failure		500		{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/user/avatar [post]
+func UploadAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	avatar := &models.Media{Owner: userID, Purpose: models.MediaPurposeAvatar}
+	if !storeUpload(w, r, avatar, "UploadAvatarHandler") {
+		return
+	}
+
+	var previous string
+	_, err = models.ModifyUser(ctx, userID, func(user *models.User) error {
+		previous = user.Avatar
+		user.Avatar = avatar.URL
+		return nil
+	})
+	if err != nil {
+		avatar.DeleteMedia(ctx)
+		if models.IsNotFound(err) {
+			WriteError(w, "User not found", NotFoundError, map[string]string{
+				"reason": "User does not exist",
+				"userId": userID,
+			}, http.StatusNotFound)
+			return
+		}
+		logs.Logger.Error("failed to set avatar",
+			slog.String("handler", "UploadAvatarHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to set avatar", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	// Avatars set as a URL of another site are left alone
+	if id, ok := strings.CutPrefix(previous, models.MediaURL("")); ok {
+		if old, err := models.GetMedia(ctx, id); err == nil && old.Owner == userID && old.Purpose == models.MediaPurposeAvatar {
+			if err := old.DeleteMedia(ctx); err != nil {
+				logs.Logger.Error("failed to delete previous avatar",
+					slog.String("handler", "UploadAvatarHandler"),
+					slog.String("mediaId", id),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(avatar)
+}
+
+// UploadMerchantMediaHandler godoc
+//
+//	@Summary		Upload merchant media
+//	@Metadata	Upload a JPEG, PNG or GIF image of the caller's merchant, such as the image of a collectible. The image is re-encoded without its EXIF data and a thumbnail is made. Reference it by ID as the image of collectible token data. Requires the merchant:manage permission.
+//	@Tags			merchant
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			file	formData	file					true	"Image, at most 5 MB"
+//	@Success		201		{object}	models.Media			"Uploaded media"
+//	@Failure		400		{object}	models.ErrorResponse	"Missing file or invalid image"
+//	@Failure		401		{object}	models.ErrorResponse	"Unauthorized access"
+//	@Failure		403		{object}	models.ErrorResponse	"Missing merchant:manage permission"
+//	@Failure		404		{object}	models.ErrorResponse	"Merchant not found"
+//	@Failure		413		{object}	models.ErrorResponse	"Image is too large"
+//	@Failure		415		{object}	models.ErrorResponse	"Not a JPEG, PNG or GIF image"
+//	@Failure		500		{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/merchant/media [post]
+func UploadMerchantMediaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	// A merchant shares the ID of the user it belongs to
+	merchant := &models.Merchant{}
+	if err := merchant.GetMerchant(ctx, userID); err != nil {
+		if models.IsNotFound(err) {
+			WriteError(w, "Merchant not found", NotFoundError, map[string]string{
+				"reason": "User has no merchant",
+			}, http.StatusNotFound)
+			return
+		}
+		WriteError(w, "Failed to get merchant", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	upload := &models.Media{Owner: userID, Purpose: models.MediaPurposeMerchant}
+	if !storeUpload(w, r, upload, "UploadMerchantMediaHandler") {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(upload)
+}
+
+// GetMediaHandler godoc
+//
+//	@Summary		Get media
+//	@Metadata	Download an uploaded image or its thumbnail. Media never changes, so responses may be cached for good.
+//	@Tags			media
+//	@Produce		image/jpeg
+//	@Produce		image/png
+//	@Param			id				path		string					true	"Media ID"
+//	@Param			size			query		string					false	"thumbnail for the thumbnail of the image"
+//	@Param			If-None-Match	header		string					false	"ETag of a cached copy"
+//	@Success		200				{file}		binary					"Image"
+//	@Header			200				{string}	ETag					"Entity tag of the image"
+//	@Success		304				{string}	string					"Cached copy is current"
+//	@Failure		400				{object}	models.ErrorResponse	"Invalid size"
+//	@Failure		404				{object}	models.ErrorResponse	"Media not found"
+//	@Failure		500				{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/media/{id} [get]
+func GetMediaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := r.PathValue("id")
+
+	var thumbnail bool
+	switch size := r.URL.Query().Get("size"); size {
+	case "":
+	case "thumbnail":
+		thumbnail = true
+	default:
+		WriteError(w, "Invalid size", ValidationError, map[string]string{
+			"reason": "size must be thumbnail or left out",
+			"size":   size,
+		}, http.StatusBadRequest)
+		return
+	}
+
+	m, err := models.GetMedia(ctx, id)
+	if err != nil {
+		if models.IsNotFound(err) {
+			WriteError(w, "Media not found", NotFoundError, map[string]string{
+				"mediaId": id,
+			}, http.StatusNotFound)
+			return
+		}
+		logs.Logger.Error("failed to get media",
+			slog.String("handler", "GetMediaHandler"),
+			slog.String("mediaId", id),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to get media", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	etag := m.ID
+	if thumbnail {
+		etag += "-thumbnail"
+	}
+	etag = strconv.Quote(etag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", mediaCacheControl)
+	if matchesIfNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	object, err := m.OpenMedia(ctx, thumbnail)
+	if err != nil {
+		logs.Logger.Error("failed to open media",
+			slog.String("handler", "GetMediaHandler"),
+			slog.String("mediaId", id),
+			slog.String("error", err.Error()),
+		)
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		WriteError(w, "Failed to get media", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	w.Header().Set("Content-Type", m.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if info, err := object.Info(); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatUint(info.Size, 10))
+	}
+	if _, err := io.Copy(w, object); err != nil {
+		// The status was sent, so a failure can only be logged
+		logs.Logger.Error("failed to send media",
+			slog.String("handler", "GetMediaHandler"),
+			slog.String("mediaId", id),
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+// storeUpload reads the image in the file field of a multipart request,
+// re-encodes it and stores it as m. It writes the error response and returns
+// false if it fails.
+func storeUpload(w http.ResponseWriter, r *http.Request, m *models.Media, handler string) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, media.MaxUploadSize+multipartOverhead)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeUploadTooLarge(w)
+			return false
+		}
+		WriteError(w, "Invalid upload", ValidationError, map[string]string{
+			"reason": "Request must be multipart/form-data with the image in the file field",
+		}, http.StatusBadRequest)
+		return false
+	}
+	defer file.Close()
+
+	// The type is checked again from the data, but a declared type that is
+	// not an image is refused outright
+	if declared := header.Header.Get("Content-Type"); declared != "" {
+		mediaType, _, _ := mime.ParseMediaType(declared)
+		if !strings.HasPrefix(mediaType, "image/") && mediaType != "application/octet-stream" {
+			writeUnsupportedMedia(w, mediaType)
+			return false
+		}
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, media.MaxUploadSize+1))
+	if err != nil {
+		WriteError(w, "Invalid upload", ValidationError, map[string]string{
+			"reason": "Unable to read the uploaded file",
+		}, http.StatusBadRequest)
+		return false
+	}
+
+	img, err := media.Process(data)
+	switch {
+	case errors.Is(err, media.ErrTooLarge):
+		writeUploadTooLarge(w)
+		return false
+	case errors.Is(err, media.ErrUnsupportedType):
+		writeUnsupportedMedia(w, http.DetectContentType(data))
+		return false
+	case errors.Is(err, media.ErrInvalidImage):
+		WriteError(w, "Invalid image", ValidationError, map[string]string{
+			"reason": "The file could not be decoded as an image",
+		}, http.StatusBadRequest)
+		return false
+	case err != nil:
+		logs.Logger.Error("failed to process upload",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to process image", InternalServerError, nil, http.StatusInternalServerError)
+		return false
+	}
+
+	m.ContentType = img.ContentType
+	m.Width = img.Width
+	m.Height = img.Height
+	if err := m.CreateMedia(r.Context(), img.Data, img.Thumbnail); err != nil {
+		logs.Logger.Error("failed to store upload",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to store image", InternalServerError, map[string]string{
+			"reason": "Storage operation failed",
+		}, http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+func writeUploadTooLarge(w http.ResponseWriter) {
+	WriteError(w, "Image is too large", PayloadTooLargeError, map[string]string{
+		"maxBytes":  strconv.FormatInt(media.MaxUploadSize, 10),
+		"maxPixels": strconv.Itoa(media.MaxPixels),
+	}, http.StatusRequestEntityTooLarge)
+}
+
+func writeUnsupportedMedia(w http.ResponseWriter, contentType string) {
+	WriteError(w, "Unsupported media type", UnsupportedMediaError, map[string]string{
+		"reason":      "Only JPEG, PNG and GIF images are accepted",
+		"contentType": contentType,
+	}, http.StatusUnsupportedMediaType)
+}
@@ -17,20 +17,22 @@ import (
 // CreateMerchantHandler godoc
 //
 //	@Summary		Create new merchant
-//	@Metadata	Create a new merchant account with initial points contract
+//	@Metadata	Create a merchant account with initial points contract on behalf of a user. Requires the merchants:create permission.
 //	@Tags			merchants
 //	@Accept			json
 //	@Produce		json
+//	@Security		BearerAuth
 //	@Param			request	body		models.CreateMerchantRequest	true	"Merchant creation request"
 //	@Success		201		{object}	models.CreateMerchantResponse	"Merchant created successfully"
 //	@Failure		400		{object}	models.ErrorResponse			"Invalid request format or validation failed"
+//	@Failure		403		{object}	models.ErrorResponse			"Missing merchants:create permission"
+//	@Failure		404		{object}	models.ErrorResponse			"User not found"
 //	@Failure		409		{object}	models.ErrorResponse			"Merchant already exists"
 //	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
 //	@Example		{json} Request Body:
 //
 //	{
-//	  "publicKey": "0x1234...",
-//	  "phoneNumber": "+60123456789",
+//	  "userId": "0xabcd...",
 //	  "name": "My Store",
 //	  "symbol": "PTS",
 //	  "decimals": 18
@@ -75,11 +77,16 @@ func CreateMerchantHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admins create merchants on behalf of users
+	if createReq.UserID != "" {
+		userID = createReq.UserID
+	}
+
 	user := &models.User{}
 	if err := user.GetUser(ctx, userID); err != nil {
-		WriteError(w, "Failed to get user", InternalServerError, map[string]string{
-			"reason": "Database operation failed",
-		}, http.StatusInternalServerError)
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+		}, http.StatusNotFound)
 		return
 	}
 
@@ -99,6 +106,8 @@ func CreateMerchantHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	_, err = infinirewards.FundAccount(merchantAddress)
 	if err != nil {
 		logs.Logger.Error("CreateMerchantHandler fund error", "error", err)
@@ -110,12 +119,13 @@ func CreateMerchantHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	merchant := &models.Merchant{
-		Address:   merchantAddress,
-		Name:      createReq.Name,
-		Symbol:    createReq.Symbol,
-		Decimals:  createReq.Decimals,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		Address:         merchantAddress,
+		Name:            createReq.Name,
+		Symbol:          createReq.Symbol,
+		Decimals:        createReq.Decimals,
+		PointsContracts: []string{pointsAddress},
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
 	}
 	if err := merchant.CreateMerchant(ctx, user); err != nil {
 		logs.Logger.Error("CreateMerchantHandler create error", "error", err)
@@ -125,6 +135,18 @@ func CreateMerchantHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The merchant role is picked up by the user's next token
+	if _, err := models.ModifyUser(ctx, user.ID, func(user *models.User) error {
+		user.AddRole(models.RoleMerchant)
+		return nil
+	}); err != nil {
+		logs.Logger.Error("CreateMerchantHandler failed to grant merchant role", "error", err)
+		WriteError(w, "Failed to update user", InternalServerError, map[string]string{
+			"reason": "Failed to grant merchant role",
+		}, http.StatusInternalServerError)
+		return
+	}
+
 	resp := models.CreateMerchantResponse{
 		TransactionHash: txHash,
 		MerchantAddress: merchantAddress,
@@ -245,6 +267,16 @@ func CreateCollectibleHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	// Redemptions check the collectible belongs to the merchant
+	if _, err := models.ModifyMerchant(ctx, merchant.ID, func(merchant *models.Merchant) error {
+		merchant.CollectibleContracts = append(merchant.CollectibleContracts, address)
+		return nil
+	}); err != nil {
+		logs.Logger.Error("CreateCollectibleHandler failed to record collectible", "error", err, "address", address)
+	}
+
 	resp := models.CreateCollectibleResponse{
 		TransactionHash: txHash,
 		Address:         address,
@@ -367,6 +399,15 @@ func CreatePointsContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
+	if _, err := models.ModifyMerchant(ctx, merchant.ID, func(merchant *models.Merchant) error {
+		merchant.PointsContracts = append(merchant.PointsContracts, address)
+		return nil
+	}); err != nil {
+		logs.Logger.Error("CreatePointsContractHandler failed to record points contract", "error", err, "address", address)
+	}
+
 	resp := models.CreatePointsContractResponse{
 		TransactionHash: txHash,
 		Address:         address,
@@ -645,6 +686,7 @@ func GetCollectibleContractsHandler(w http.ResponseWriter, r *http.Request) {
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Success		200	{object}	models.Merchant			"Merchant details"
+//	@Header			200	{string}	ETag					"Revision of the merchant"
 //	@Failure		401	{object}	models.ErrorResponse	"Missing or invalid authentication token"
 //	@Failure		403	{object}	models.ErrorResponse	"Not a merchant account"
 //	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
@@ -670,6 +712,7 @@ func GetMerchantHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", revisionETag(merchant.Revision))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(merchant)
 }
@@ -709,6 +752,11 @@ func UpgradeMerchantContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admins may upgrade the contracts of any merchant
+	if upgradeRequest.MerchantID != "" {
+		userID = upgradeRequest.MerchantID
+	}
+
 	// Get user details
 	user := &models.User{}
 	if err := user.GetUser(ctx, userID); err != nil {
@@ -751,6 +799,8 @@ func UpgradeMerchantContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	resp := models.UpgradeMerchantContractResponse{
 		TransactionHash: txHash,
 	}
@@ -794,6 +844,11 @@ func UpgradePointsContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admins may upgrade the contracts of any merchant
+	if upgradeRequest.MerchantID != "" {
+		userID = upgradeRequest.MerchantID
+	}
+
 	// Get user details
 	user := &models.User{}
 	if err := user.GetUser(ctx, userID); err != nil {
@@ -836,6 +891,8 @@ func UpgradePointsContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	resp := models.UpgradePointsContractResponse{
 		TransactionHash: txHash,
 	}
@@ -879,6 +936,11 @@ func UpgradeCollectibleContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admins may upgrade the contracts of any merchant
+	if upgradeRequest.MerchantID != "" {
+		userID = upgradeRequest.MerchantID
+	}
+
 	// Get user details
 	user := &models.User{}
 	if err := user.GetUser(ctx, userID); err != nil {
@@ -921,6 +983,8 @@ func UpgradeCollectibleContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	resp := models.UpgradeCollectibleContractResponse{
 		TransactionHash: txHash,
 	}
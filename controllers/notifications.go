@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"infinirewards/logs"
+	"infinirewards/middleware"
+	"infinirewards/models"
+	"log/slog"
+	"net/http"
+)
+
+// ListNotificationsHandler godoc
+//
+//	@Summary		List notifications
+//	@Metadata	List the in-app notifications of the authenticated user, newest first
+//	@Tags			notifications
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			unread	query		bool								false	"Only unread notifications"
+//	@Param			limit	query		int									false	"Page size, at most 100"
+//	@Param			cursor	query		string								false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.Notification]	"Page of notifications"
+//	@Failure		400		{object}	models.ErrorResponse				"Invalid limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse				"Authentication error"
+//	@Failure		500		{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/user/notifications [get]
+func ListNotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	notifications, err := models.ListNotifications(ctx, userID, r.URL.Query().Get("unread") == "true", opts)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
+		logs.Logger.Error("failed to list notifications",
+			slog.String("handler", "ListNotificationsHandler"),
+			slog.String("user_id", userID),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to list notifications", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, notifications)
+}
+
+// MarkNotificationReadHandler godoc
+//
+//	@Summary		Mark notification read
+//	@Metadata	Mark a notification of the authenticated user read
+//	@Tags			notifications
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string					true	"Notification ID"
+//	@Success		200	{object}	models.Notification		"Notification marked read"
+//	@Failure		401	{object}	models.ErrorResponse	"Authentication error"
+//	@Failure		404	{object}	models.ErrorResponse	"Notification not found"
+//	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/user/notifications/{id}/read [post]
+func MarkNotificationReadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	notification, err := models.MarkNotificationRead(ctx, userID, r.PathValue("id"))
+	if err != nil {
+		if errors.Is(err, models.ErrNotificationNotFound) {
+			WriteError(w, "Notification not found", NotFoundError, map[string]string{
+				"reason": "No notification with this ID is in the inbox",
+			}, http.StatusNotFound)
+			return
+		}
+		logs.Logger.Error("failed to mark notification read",
+			slog.String("handler", "MarkNotificationReadHandler"),
+			slog.String("user_id", userID),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to mark notification read", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notification)
+}
+
+// GetNotificationPreferencesHandler godoc
+//
+//	@Summary		Get notification preferences
+//	@Metadata	Get how the authenticated user is notified of reward events
+//	@Tags			notifications
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	models.NotificationPreferences	"Notification preferences"
+//	@Header			200	{string}	ETag							"Revision of the user, for If-Match"
+//	@Failure		401	{object}	models.ErrorResponse			"Authentication error"
+//	@Failure		404	{object}	models.ErrorResponse			"User not found"
+//	@Router			/user/notification-preferences [get]
+func GetNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	user := &models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+		}, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", revisionETag(user.Revision))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.NotificationPreferences)
+}
+
+// UpdateNotificationPreferencesHandler godoc
+//
+//	@Summary		Update notification preferences
+//	@Metadata	Replace how the authenticated user is notified of reward events. Notifications are always added to the inbox; the channel also sends them by WhatsApp or SMS, except muted events and during quiet hours.
+//	@Tags			notifications
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request		body		models.NotificationPreferences	true	"Notification preferences"
+//	@Param			If-Match	header		string							false	"ETag of the user the update is based on"
+//	@Success		200			{object}	models.NotificationPreferences	"Notification preferences updated"
+//	@Header			200			{string}	ETag							"Revision of the updated user"
+//	@Failure		400			{object}	models.ErrorResponse			"Invalid preferences"
+//	@Failure		401			{object}	models.ErrorResponse			"Authentication error"
+//	@Failure		404			{object}	models.ErrorResponse			"User not found"
+//	@Failure		412			{object}	models.ErrorResponse			"User was modified since the If-Match ETag"
+//	@Failure		500			{object}	models.ErrorResponse			"Internal server error"
+//	@Example		{json} Request Body:
+//
+//	{
+//	  "channel": "whatsapp",
+//	  "mutedEvents": ["points.received"],
+//	  "quietHours": {
+//	    "start": "22:00",
+//	    "end": "08:00",
+//	    "timeZone": "Asia/Kuala_Lumpur"
+//	  }
+//	}
+//
+//	@Router			/user/notification-preferences [put]
+func UpdateNotificationPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	var preferences models.NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+		WriteError(w, "Invalid request format", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := preferences.Validate(); err != nil {
+		WriteError(w, "Validation failed", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	var revision uint64
+	user, err := models.ModifyUser(ctx, userID, func(user *models.User) error {
+		revision = user.Revision
+		if !matchesIfMatch(r, user.Revision) {
+			return errPreconditionFailed
+		}
+
+		user.NotificationPreferences = preferences
+		return nil
+	})
+	switch {
+	case errors.Is(err, errPreconditionFailed):
+		writePreconditionFailed(w, revision)
+		return
+	case models.IsNotFound(err):
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+		}, http.StatusNotFound)
+		return
+	case err != nil:
+		logs.Logger.Error("failed to update notification preferences",
+			slog.String("handler", "UpdateNotificationPreferencesHandler"),
+			slog.String("user_id", userID),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to update notification preferences", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("ETag", revisionETag(user.Revision))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(user.NotificationPreferences)
+}
@@ -0,0 +1,376 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/infinirewards"
+	"infinirewards/logs"
+	"infinirewards/middleware"
+	"infinirewards/models"
+	"log/slog"
+	"net/http"
+)
+
+// RequestPhoneChangeHandler godoc
+//
+//	@Summary		Request phone number change
+//	@Metadata	Send an OTP to both the current and the new phone number of the authenticated user
+//	@Tags			user
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request	body		models.PhoneChangeRequest	true	"Phone Change Request"
+//	@Success		200		{object}	models.PhoneChangeResponse	"OTPs sent successfully"
+//	@Failure		400		{object}	models.ErrorResponse		"Invalid request format or validation failed"
+//	@Failure		401		{object}	models.ErrorResponse		"Unauthorized access"
+//	@Failure		404		{object}	models.ErrorResponse		"User not found"
+//	@Failure		409		{object}	models.ErrorResponse		"Phone number already in use"
+//	@Failure		429		{object}	models.ErrorResponse		"Too many requests"
+//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/user/phone [post]
+func RequestPhoneChangeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	startPhoneChange(w, r, userID, "", "RequestPhoneChangeHandler")
+}
+
+// AdminRequestPhoneChangeHandler godoc
+//
+//	@Summary		Request phone number change for a user
+//	@Metadata	Support-assisted phone number change for a user who lost their number. Only the new number receives an OTP.
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		string						true	"User ID"
+//	@Param			request	body		models.PhoneChangeRequest	true	"Phone Change Request"
+//	@Success		200		{object}	models.PhoneChangeResponse	"OTP sent successfully"
+//	@Failure		400		{object}	models.ErrorResponse		"Invalid request format or validation failed"
+//	@Failure		401		{object}	models.ErrorResponse		"Unauthorized access"
+//	@Failure		403		{object}	models.ErrorResponse		"Forbidden"
+//	@Failure		404		{object}	models.ErrorResponse		"User not found"
+//	@Failure		409		{object}	models.ErrorResponse		"Phone number already in use"
+//	@Failure		429		{object}	models.ErrorResponse		"Too many requests"
+//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/admin/users/{id}/phone [post]
+func AdminRequestPhoneChangeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	staffID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	startPhoneChange(w, r, r.PathValue("id"), staffID, "AdminRequestPhoneChangeHandler")
+}
+
+// startPhoneChange sends the OTPs for a phone number change and stores it until
+// it is verified. The current number is skipped when support assists the change.
+func startPhoneChange(w http.ResponseWriter, r *http.Request, userID string, assistedBy string, handler string) {
+	ctx := r.Context()
+
+	var changeReq models.PhoneChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&changeReq); err != nil {
+		WriteError(w, "Invalid request body", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := changeReq.Validate(); err != nil {
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	user := models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+			"userId": userID,
+		}, http.StatusNotFound)
+		return
+	}
+
+	if changeReq.NewPhoneNumber == user.PhoneNumber {
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": "new phone number is the current phone number",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	phoneHash, err := models.HashPhoneNumber(changeReq.NewPhoneNumber)
+	if err != nil {
+		logs.Logger.Error("failed to hash phone number",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to send OTP", InternalServerError, map[string]string{
+			"reason": "Failed to hash phone number",
+		}, http.StatusInternalServerError)
+		return
+	}
+	if !allowRequest(w, r, models.OTPRequestPhoneLimit, phoneHash, "Too many OTP requests", handler) {
+		return
+	}
+
+	if _, err := models.LookupPhoneNumber(ctx, changeReq.NewPhoneNumber); err == nil {
+		WriteError(w, "Phone number already in use", ConflictError, map[string]string{
+			"reason": models.ErrPhoneNumberTaken.Error(),
+		}, http.StatusConflict)
+		return
+	}
+
+	change := models.PhoneChange{
+		UserID:         user.ID,
+		NewPhoneNumber: changeReq.NewPhoneNumber,
+		AssistedBy:     assistedBy,
+	}
+
+	if assistedBy == "" {
+		change.OldVerificationID, err = sendOTP(ctx, user.ID, user.PhoneNumber, models.VerificationPurposePhoneChange, newOTPDelivery(r, &user))
+	}
+	if err == nil {
+		change.NewVerificationID, err = sendOTP(ctx, user.ID, changeReq.NewPhoneNumber, models.VerificationPurposePhoneChange, newOTPDelivery(r, &user))
+	}
+	if err != nil {
+		logs.Logger.Error("failed to send OTP",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to send OTP", InternalServerError, map[string]string{
+			"reason": "Failed to send OTP",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	if err := change.CreatePhoneChange(ctx); err != nil {
+		logs.Logger.Error("failed to store phone change",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to store phone change", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	message := "OTP sent to the current and new phone numbers"
+	if assistedBy != "" {
+		message = "OTP sent to the new phone number"
+		logs.Logger.Warn("support-assisted phone change started",
+			slog.String("handler", handler),
+			slog.String("user_id", user.ID),
+			slog.String("assisted_by", assistedBy),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.PhoneChangeResponse{
+		Message: message,
+		ID:      change.ID,
+	})
+}
+
+// VerifyPhoneChangeHandler godoc
+//
+//	@Summary		Verify phone number change
+//	@Metadata	Complete a phone number change with the OTPs sent to the current and new numbers. Support-assisted changes only need the OTP sent to the new number.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		models.VerifyPhoneChangeRequest	true	"Phone Change Verification"
+//	@Success		200		{object}	models.AuthenticateResponse		"Phone number changed successfully"
+//	@Failure		400		{object}	models.ErrorResponse			"Invalid request format or validation failed"
+//	@Failure		401		{object}	models.ErrorResponse			"Verification failed"
+//	@Failure		409		{object}	models.ErrorResponse			"Phone number already in use"
+//	@Failure		429		{object}	models.ErrorResponse			"Too many attempts"
+//	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/auth/phone-change/verify [post]
+func VerifyPhoneChangeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var verifyReq models.VerifyPhoneChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&verifyReq); err != nil {
+		WriteError(w, "Invalid request body", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := verifyReq.Validate(); err != nil {
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	change := models.PhoneChange{}
+	if err := change.GetPhoneChange(ctx, verifyReq.ID); err != nil {
+		WriteError(w, "Verification failed", AuthenticationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	if change.OldVerificationID != "" && verifyReq.OldToken == "" {
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": "oldToken: old token is required",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	// Both codes are checked before either is used up so a typo in one does
+	// not force the user to start over
+	verifications := [][2]string{{change.NewVerificationID, verifyReq.NewToken}}
+	if change.OldVerificationID != "" {
+		verifications = append(verifications, [2]string{change.OldVerificationID, verifyReq.OldToken})
+	}
+	for _, v := range verifications {
+		verification, remainingAttempts, err := checkOTP(ctx, v[0], v[1])
+		if err == nil && (verification.Purpose != models.VerificationPurposePhoneChange || verification.User != change.UserID) {
+			err = fmt.Errorf("invalid or expired verification")
+		}
+		if err != nil {
+			var rateLimitErr *models.RateLimitError
+			if errors.As(err, &rateLimitErr) {
+				WriteRateLimitError(w, "Too many verification attempts", rateLimitErr)
+				return
+			}
+			details := map[string]interface{}{
+				"reason": err.Error(),
+			}
+			if remainingAttempts >= 0 {
+				details["remainingAttempts"] = remainingAttempts
+			}
+			WriteError(w, "Verification failed", AuthenticationError, details, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	user := models.User{}
+	if err := user.GetUser(ctx, models.ResolveUserID(ctx, change.UserID)); err != nil {
+		WriteError(w, "Verification failed", AuthenticationError, map[string]string{
+			"reason": "User does not exist",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	if err := models.ReservePhoneNumber(ctx, change.NewPhoneNumber, user.ID); err != nil {
+		if errors.Is(err, models.ErrPhoneNumberTaken) {
+			WriteError(w, "Phone number already in use", ConflictError, map[string]string{
+				"reason": err.Error(),
+			}, http.StatusConflict)
+			return
+		}
+		logs.Logger.Error("failed to reserve phone number",
+			slog.String("handler", "VerifyPhoneChangeHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to change phone number", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	addresses := user.AccountAddresses(ctx)
+	if err := infinirewards.SetPhoneNumbers(user.PrivateKey, user.PublicKey, addresses, change.NewPhoneNumber); err != nil {
+		logs.Logger.Error("failed to update on-chain phone number",
+			slog.String("handler", "VerifyPhoneChangeHandler"),
+			slog.String("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		if err := models.ReleasePhoneNumber(ctx, change.NewPhoneNumber, user.ID); err != nil {
+			logs.Logger.Error("failed to release phone number",
+				slog.String("handler", "VerifyPhoneChangeHandler"),
+				slog.String("error", err.Error()),
+			)
+		}
+		WriteError(w, "Failed to change phone number", InternalServerError, map[string]string{
+			"reason": "Failed to update account contract",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	oldPhoneNumber := user.PhoneNumber
+	if err := user.ChangePhoneNumber(ctx, change.NewPhoneNumber); err != nil {
+		logs.Logger.Error("failed to change phone number",
+			slog.String("handler", "VerifyPhoneChangeHandler"),
+			slog.String("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		if user.PhoneNumber != change.NewPhoneNumber {
+			revertPhoneChange(ctx, &user, addresses, oldPhoneNumber, change.NewPhoneNumber)
+		}
+		WriteError(w, "Failed to change phone number", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	for _, v := range verifications {
+		consumeOTP(ctx, v[0])
+	}
+	if err := change.DeletePhoneChange(ctx); err != nil {
+		logs.Logger.Error("failed to delete phone change",
+			slog.String("handler", "VerifyPhoneChangeHandler"),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	logs.Logger.Info("phone number changed",
+		slog.String("handler", "VerifyPhoneChangeHandler"),
+		slog.String("user_id", user.ID),
+		slog.String("assisted_by", change.AssistedBy),
+	)
+
+	token, err := createJWT(ctx, &user, verifyReq.Device)
+	if err != nil {
+		WriteError(w, "Failed to generate token", InternalServerError, map[string]string{
+			"reason": "Failed to generate token",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.AuthenticateResponse{
+		Token: *token,
+	})
+}
+
+// revertPhoneChange puts the on-chain phone number hash back to the old number
+// and releases the new one, after the user record could not be changed, so
+// that the user can start the change again
+func revertPhoneChange(ctx context.Context, user *models.User, addresses []string, oldPhoneNumber string, newPhoneNumber string) {
+	if err := infinirewards.SetPhoneNumbers(user.PrivateKey, user.PublicKey, addresses, oldPhoneNumber); err != nil {
+		// The new number stays reserved so nobody else takes the number
+		// the chain already holds
+		logs.Logger.Error("failed to revert on-chain phone number",
+			slog.String("handler", "VerifyPhoneChangeHandler"),
+			slog.String("user_id", user.ID),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	if err := models.ReleasePhoneNumber(ctx, newPhoneNumber, user.ID); err != nil {
+		logs.Logger.Error("failed to release phone number",
+			slog.String("handler", "VerifyPhoneChangeHandler"),
+			slog.String("error", err.Error()),
+		)
+	}
+}
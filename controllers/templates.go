@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"log/slog"
+	"net/http"
+)
+
+// AdminListTemplatesHandler godoc
+//
+//	@Summary		List message templates
+//	@Metadata	List the stored message templates, optionally of one brand. Requires the templates:manage permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			brand	query		string									false	"Brand"
+//	@Param			limit	query		int										false	"Page size, at most 100"
+//	@Param			cursor	query		string									false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.MessageTemplate]	"Page of templates"
+//	@Failure		400		{object}	models.ErrorResponse					"Invalid brand, limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse		"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse		"Missing templates:manage permission"
+//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Router			/admin/templates [get]
+func AdminListTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	templates, err := models.ListMessageTemplates(ctx, r.URL.Query().Get("brand"), opts)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
+		var validationErr *models.ValidationError
+		if errors.As(err, &validationErr) {
+			WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+				"reason": err.Error(),
+			}, http.StatusBadRequest)
+			return
+		}
+		logs.Logger.Error("failed to list message templates",
+			slog.String("handler", "AdminListTemplatesHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to list templates", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, templates)
+}
+
+// AdminGetTemplateHandler godoc
+//
+//	@Summary		Get message template
+//	@Metadata	Get the stored template of a message for a brand and locale. Requires the templates:manage permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			brand	path		string					true	"Brand"
+//	@Param			name	path		string					true	"Message name, e.g. otp"
+//	@Param			locale	path		string					true	"BCP 47 language tag, e.g. ms-MY"
+//	@Success		200		{object}	models.MessageTemplate	"Template"
+//	@Failure		400		{object}	models.ErrorResponse	"Invalid brand, name or locale"
+//	@Failure		401		{object}	models.ErrorResponse	"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse	"Missing templates:manage permission"
+//	@Failure		404		{object}	models.ErrorResponse	"Template not found"
+//	@Failure		500		{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/admin/templates/{brand}/{name}/{locale} [get]
+func AdminGetTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	template := &models.MessageTemplate{}
+	if err := template.GetMessageTemplate(ctx, r.PathValue("brand"), r.PathValue("name"), r.PathValue("locale")); err != nil {
+		writeTemplateError(w, err, "AdminGetTemplateHandler")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// AdminPutTemplateHandler godoc
+//
+//	@Summary		Create or replace message template
+//	@Metadata	Store the template of a message for a brand and locale. The body and footer are Go text/templates with the fields Code, URL and ValidMinutes. Requires the templates:manage permission.
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			brand	path		string								true	"Brand"
+//	@Param			name	path		string								true	"Message name, e.g. otp"
+//	@Param			locale	path		string								true	"BCP 47 language tag, e.g. ms-MY"
+//	@Param			request	body		models.PutMessageTemplateRequest	true	"Template"
+//	@Success		200		{object}	models.MessageTemplate				"Template stored"
+//	@Failure		400		{object}	models.ErrorResponse				"Invalid template"
+//	@Failure		401		{object}	models.ErrorResponse				"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse				"Missing templates:manage permission"
+//	@Failure		500		{object}	models.ErrorResponse				"Internal server error"
+//	@Example		{json} Request Body:
+//
+//	{
+//	  "body": "JOMFI: Thanks for registering JomFi. Your OTP is {{.Code}}. Valid for {{.ValidMinutes}} minutes.",
+//	  "whatsAppTemplate": "otp_message",
+//	  "whatsAppLanguage": "en",
+//	  "smsSender": "JomFi"
+//	}
+//
+//	@Router			/admin/templates/{brand}/{name}/{locale} [put]
+func AdminPutTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var templateReq models.PutMessageTemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&templateReq); err != nil {
+		WriteError(w, "Invalid request format", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := templateReq.Validate(); err != nil {
+		WriteError(w, "Validation failed", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	template := &models.MessageTemplate{
+		Brand:            r.PathValue("brand"),
+		Name:             r.PathValue("name"),
+		Locale:           r.PathValue("locale"),
+		Body:             templateReq.Body,
+		Footer:           templateReq.Footer,
+		WhatsAppTemplate: templateReq.WhatsAppTemplate,
+		WhatsAppLanguage: templateReq.WhatsAppLanguage,
+		SMSSender:        templateReq.SMSSender,
+	}
+	if err := template.PutMessageTemplate(ctx); err != nil {
+		writeTemplateError(w, err, "AdminPutTemplateHandler")
+		return
+	}
+
+	logs.Logger.Info("message template stored",
+		slog.String("handler", "AdminPutTemplateHandler"),
+		slog.String("brand", template.Brand),
+		slog.String("name", template.Name),
+		slog.String("locale", template.Locale),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(template)
+}
+
+// AdminDeleteTemplateHandler godoc
+//
+//	@Summary		Delete message template
+//	@Metadata	Delete the stored template of a message for a brand and locale. Messages fall back to other locales, the default brand and then the built-in template. Requires the templates:manage permission.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			brand	path		string					true	"Brand"
+//	@Param			name	path		string					true	"Message name, e.g. otp"
+//	@Param			locale	path		string					true	"BCP 47 language tag, e.g. ms-MY"
+//	@Success		200		{object}	models.MessageResponse	"Template deleted"
+//	@Failure		400		{object}	models.ErrorResponse	"Invalid brand, name or locale"
+//	@Failure		401		{object}	models.ErrorResponse	"Authentication error"
+//	@Failure		403		{object}	models.ErrorResponse	"Missing templates:manage permission"
+//	@Failure		404		{object}	models.ErrorResponse	"Template not found"
+//	@Failure		500		{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/admin/templates/{brand}/{name}/{locale} [delete]
+func AdminDeleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	brand, name, locale := r.PathValue("brand"), r.PathValue("name"), r.PathValue("locale")
+
+	template := &models.MessageTemplate{}
+	if err := template.GetMessageTemplate(ctx, brand, name, locale); err != nil {
+		writeTemplateError(w, err, "AdminDeleteTemplateHandler")
+		return
+	}
+
+	if err := models.DeleteMessageTemplate(ctx, brand, name, locale); err != nil {
+		writeTemplateError(w, err, "AdminDeleteTemplateHandler")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.MessageResponse{
+		Message: "Template deleted successfully",
+	})
+}
+
+// writeTemplateError maps errors of the template store to responses
+func writeTemplateError(w http.ResponseWriter, err error, handler string) {
+	var validationErr *models.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+	case errors.Is(err, models.ErrTemplateNotFound):
+		WriteError(w, "Template not found", NotFoundError, map[string]string{
+			"reason": "No template is stored for this brand, name and locale",
+		}, http.StatusNotFound)
+	default:
+		logs.Logger.Error("message template operation failed",
+			slog.String("handler", handler),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to access template", InternalServerError, nil, http.StatusInternalServerError)
+	}
+}
@@ -2,17 +2,25 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"infinirewards/infinirewards"
 	"infinirewards/logs"
 	"infinirewards/middleware"
 	"infinirewards/models"
+	"infinirewards/privacy"
+	"infinirewards/utils"
+	"log/slog"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/NethermindEth/starknet.go/account"
 )
 
+// errUserAlreadyCreated is returned when another request set up the user's
+// account first
+var errUserAlreadyCreated = errors.New("user has already been created")
+
 // UserGetUserHandler godoc
 //
 //	@Summary		Get user details
@@ -22,6 +30,7 @@ import (
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Success		200	{object}	models.User				"User details retrieved successfully"
+//	@Header			200	{string}	ETag					"Revision of the user, for If-Match"
 //	@Failure		401	{object}	models.ErrorResponse	"Authentication error"
 //	@Failure		404	{object}	models.ErrorResponse	"User not found"
 //	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
@@ -66,6 +75,7 @@ func UserGetUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Remove sensitive information before sending the response
 	user.PrivateKey = ""
 
+	w.Header().Set("ETag", revisionETag(user.Revision))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
@@ -80,7 +90,7 @@ func UserGetUserHandler(w http.ResponseWriter, r *http.Request) {
 //	@Param			request	body		models.CreateUserRequest	true	"User Creation Request"
 //	@Success		201		{object}	models.User					"User created successfully"
 //	@Failure		400		{object}	models.ErrorResponse		"Invalid request format"
-//	@Failure		409		{object}	models.ErrorResponse		"User already exists"
+//	@Failure		409		{object}	models.ErrorResponse		"User already exists or email already in use"
 //	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
 //	@Example		{json} Request Body:
 //
@@ -178,16 +188,35 @@ func UserCreateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.Name = createUserRequest.Name
-	user.Email = createUserRequest.Email
-	user.Avatar = createUserRequest.Avatar
+	// The profile may have changed while the account was created, so the
+	// keys are written to the latest revision unless another request won
+	user, err = models.ModifyUser(ctx, userID, func(user *models.User) error {
+		if user.PrivateKey != "" {
+			return errUserAlreadyCreated
+		}
 
-	user.PrivateKey = privateKey.String()
-	user.PublicKey = publicKey.String()
-	user.AccountAddress = addr
-	user.UpdatedAt = time.Now()
+		user.Name = createUserRequest.Name
+		user.Email = createUserRequest.Email
+		user.Avatar = createUserRequest.Avatar
 
-	err = user.UpdateUser(ctx)
+		user.PrivateKey = privateKey.String()
+		user.PublicKey = publicKey.String()
+		user.AccountAddress = addr
+		return nil
+	})
+	if errors.Is(err, errUserAlreadyCreated) {
+		logs.Logger.Error("userCreateUserHandler user was created concurrently", "userId", userID, "address", addr)
+		WriteError(w, "User already exists", ConflictError, map[string]string{
+			"reason": "User has already been created",
+		}, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, models.ErrEmailTaken) {
+		WriteError(w, "Email already in use", ConflictError, map[string]string{
+			"reason": "Email belongs to another user",
+		}, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		logs.Logger.Error("userCreateUserHandler Failed to create user", "error", err)
 		WriteError(w, "Failed to create user", InternalServerError, map[string]string{
@@ -199,6 +228,7 @@ func UserCreateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Remove sensitive information before sending the response
 	user.PrivateKey = ""
 
+	w.Header().Set("ETag", revisionETag(user.Revision))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
@@ -212,12 +242,16 @@ func UserCreateUserHandler(w http.ResponseWriter, r *http.Request) {
 //	@Accept			json
 //	@Produce		json
 //	@Security		BearerAuth
-//	@Param			request	body		models.UpdateUserRequest	true	"User Update Request"
-//	@Success		200		{object}	models.User					"User updated successfully"
-//	@Failure		400		{object}	models.ErrorResponse		"Invalid request format"
-//	@Failure		401		{object}	models.ErrorResponse		"Unauthorized access"
-//	@Failure		404		{object}	models.ErrorResponse		"User not found"
-//	@Failure		500		{object}	models.ErrorResponse		"Internal server error"
+//	@Param			request		body		models.UpdateUserRequest	true	"User Update Request"
+//	@Param			If-Match	header		string						false	"ETag of the user the update is based on"
+//	@Success		200			{object}	models.User					"User updated successfully"
+//	@Header			200			{string}	ETag						"Revision of the updated user"
+//	@Failure		400			{object}	models.ErrorResponse		"Invalid request format"
+//	@Failure		401			{object}	models.ErrorResponse		"Unauthorized access"
+//	@Failure		404			{object}	models.ErrorResponse		"User not found"
+//	@Failure		409			{object}	models.ErrorResponse		"Email already in use"
+//	@Failure		412			{object}	models.ErrorResponse		"User was modified since the If-Match ETag"
+//	@Failure		500			{object}	models.ErrorResponse		"Internal server error"
 //	@Example		{json} Request Body:
 //
 //	{
@@ -268,22 +302,36 @@ func UserUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := &models.User{}
-	if err := user.GetUser(ctx, userID); err != nil {
+	var revision uint64
+	user, err := models.ModifyUser(ctx, userID, func(user *models.User) error {
+		revision = user.Revision
+		if !matchesIfMatch(r, user.Revision) {
+			return errPreconditionFailed
+		}
+
+		// Update user fields
+		user.Name = updateUserRequest.Name
+		user.Email = updateUserRequest.Email
+		user.Avatar = updateUserRequest.Avatar
+		user.Locale = utils.NormalizeLocale(updateUserRequest.Locale)
+		return nil
+	})
+	switch {
+	case errors.Is(err, errPreconditionFailed):
+		writePreconditionFailed(w, revision)
+		return
+	case models.IsNotFound(err):
 		WriteError(w, "User not found", NotFoundError, map[string]string{
 			"reason": "User does not exist",
 			"userId": userID,
 		}, http.StatusNotFound)
 		return
-	}
-
-	// Update user fields
-	user.Name = updateUserRequest.Name
-	user.Email = updateUserRequest.Email
-	user.Avatar = updateUserRequest.Avatar
-	user.UpdatedAt = time.Now()
-
-	if err := user.UpdateUser(ctx); err != nil {
+	case errors.Is(err, models.ErrEmailTaken):
+		WriteError(w, "Email already in use", ConflictError, map[string]string{
+			"reason": "Email belongs to another user",
+		}, http.StatusConflict)
+		return
+	case err != nil:
 		WriteError(w, "Failed to update user", InternalServerError, map[string]string{
 			"reason": "Database operation failed",
 		}, http.StatusInternalServerError)
@@ -293,6 +341,7 @@ func UserUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 	// Remove sensitive information before sending response
 	user.PrivateKey = ""
 
+	w.Header().Set("ETag", revisionETag(user.Revision))
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
 }
@@ -300,7 +349,7 @@ func UserUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 // UserDeleteUserHandler godoc
 //
 //	@Summary		Delete user
-//	@Metadata	Delete authenticated user
+//	@Metadata	Delete the authenticated user and everything held about them. Sessions and keys are revoked, on-chain assets are burned or swept by the asset policy, the merchant is anonymized and personal data is deleted. A deletion that failed resumes at the failed step when it is requested again.
 //	@Tags			user
 //	@Accept			json
 //	@Produce		json
@@ -308,7 +357,8 @@ func UserUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
 //	@Success		200	{object}	models.MessageResponse	"User deleted successfully"
 //	@Failure		401	{object}	models.ErrorResponse	"Unauthorized access"
 //	@Failure		404	{object}	models.ErrorResponse	"User not found"
-//	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
+//	@Failure		409	{object}	models.ErrorResponse	"Deletion already in progress"
+//	@Failure		500	{object}	models.ErrorResponse	"Deletion step failed"
 //	@Router			/user [delete]
 func UserDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -323,29 +373,27 @@ func UserDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user := &models.User{}
-	if err := user.GetUser(ctx, userID); err != nil {
+	_, err = privacy.DeleteAccount(ctx, userID)
+	var stepErr *privacy.StepError
+	switch {
+	case errors.Is(err, privacy.ErrUserNotFound):
 		WriteError(w, "User not found", NotFoundError, map[string]string{
 			"reason": "User does not exist",
 			"userId": userID,
 		}, http.StatusNotFound)
 		return
-	}
-
-	// Check and delete merchant if exists
-	merchant := &models.Merchant{}
-	if err := merchant.GetMerchant(ctx, userID); err == nil {
-		// Merchant exists, delete it
-		if err := merchant.DeleteMerchant(ctx); err != nil {
-			WriteError(w, "Failed to delete merchant", InternalServerError, map[string]string{
-				"reason": "Failed to delete associated merchant account",
-			}, http.StatusInternalServerError)
-			return
-		}
-		logs.Logger.Info("Deleted associated merchant account", "userId", userID)
-	}
-
-	if err := user.DeleteUser(ctx); err != nil {
+	case errors.Is(err, privacy.ErrDeletionInProgress):
+		WriteError(w, "Deletion already in progress", ConflictError, map[string]string{
+			"reason": "The account is being deleted by another request",
+		}, http.StatusConflict)
+		return
+	case errors.As(err, &stepErr):
+		WriteError(w, "Failed to delete user", InternalServerError, map[string]string{
+			"reason": "A deletion step failed, retry to resume it",
+			"step":   stepErr.Step,
+		}, http.StatusInternalServerError)
+		return
+	case err != nil:
 		WriteError(w, "Failed to delete user", InternalServerError, map[string]string{
 			"reason": "Database operation failed",
 		}, http.StatusInternalServerError)
@@ -358,6 +406,55 @@ func UserDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// UserExportHandler godoc
+//
+//	@Summary		Export user data
+//	@Metadata	Download everything held about the authenticated user as a JSON archive, including the on-chain holdings of their account. Secrets are left out.
+//	@Tags			user
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	privacy.Export			"Personal data export"
+//	@Failure		401	{object}	models.ErrorResponse	"Unauthorized access"
+//	@Failure		404	{object}	models.ErrorResponse	"User not found"
+//	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/user/export [get]
+func UserExportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	export, err := privacy.ExportAccount(ctx, userID)
+	if errors.Is(err, privacy.ErrUserNotFound) {
+		WriteError(w, "User not found", NotFoundError, map[string]string{
+			"reason": "User does not exist",
+			"userId": userID,
+		}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logs.Logger.Error("failed to export user data",
+			slog.String("handler", "UserExportHandler"),
+			slog.String("userId", userID),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to export user data", InternalServerError, map[string]string{
+			"reason": "Failed to collect user data",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("infinirewards-export-%s.json", export.ExportedAt.UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	json.NewEncoder(w).Encode(export)
+}
+
 // UserCreateAPIKeyHandler godoc
 //
 //	@Summary		Create API key
@@ -431,23 +528,29 @@ func UserCreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 // UserListAPIKeysHandler godoc
 //
 //	@Summary		List API keys
-//	@Metadata	List all API keys for authenticated user
+//	@Metadata	List the API keys of the authenticated user, oldest first
 //	@Tags			api-keys
 //	@Accept			json
 //	@Produce		json
 //	@Security		BearerAuth
-//	@Success		200	{array}		models.APIKey			"List of API keys"
-//	@Failure		401	{object}	models.ErrorResponse	"Unauthorized access"
-//	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
+//	@Param			limit	query		int								false	"Page size, at most 100"
+//	@Param			cursor	query		string							false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.APIKey]		"Page of API keys"
+//	@Failure		400		{object}	models.ErrorResponse			"Invalid limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse			"Unauthorized access"
+//	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
 //	@Example		{json} Success Response:
 //
-//	[
-//	  {
-//	    "id": "key_01HNA...",
-//	    "name": "My API Key",
-//	    "createdAt": "2024-01-01T00:00:00Z"
-//	  }
-//	]
+//	{
+//	  "items": [
+//	    {
+//	      "id": "key_01HNA...",
+//	      "name": "My API Key",
+//	      "createdAt": "2024-01-01T00:00:00Z"
+//	    }
+//	  ],
+//	  "nextCursor": "eyJvIjoia2V5Ii..."
+//	}
 //
 //	@Router			/user/api-keys [get]
 func UserListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
@@ -463,16 +566,24 @@ func UserListAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiKeys, err := models.ListAPIKeys(ctx, userID)
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	apiKeys, err := models.ListAPIKeys(ctx, userID, opts)
 	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
 		WriteError(w, "Failed to list API keys", InternalServerError, map[string]string{
 			"reason": err.Error(),
 		}, http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(apiKeys)
+	writePage(w, apiKeys)
 }
 
 // UserDeleteAPIKeyHandler godoc
@@ -528,9 +639,10 @@ func UserDeleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	keyID := parts[len(parts)-1]
 
-	// Verify the API key belongs to the user
+	// Verify the API key belongs to the user, who may have been moved off
+	// the legacy ID the key was issued under
 	keyUserID := strings.Split(keyID, ".")[0]
-	if keyUserID != userID {
+	if keyUserID != userID && models.ResolveUserID(ctx, keyUserID) != models.ResolveUserID(ctx, userID) {
 		WriteError(w, "Unauthorized", AuthorizationError, map[string]string{
 			"reason": "API key does not belong to user",
 		}, http.StatusUnauthorized)
@@ -585,6 +697,11 @@ func UpgradeUserContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admins may upgrade the account contract of any user
+	if upgradeRequest.UserID != "" {
+		userID = upgradeRequest.UserID
+	}
+
 	// Get user details
 	user := &models.User{}
 	if err := user.GetUser(ctx, userID); err != nil {
@@ -618,6 +735,8 @@ func UpgradeUserContractHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	middleware.AuditTransaction(ctx, txHash)
+
 	resp := models.UpgradeUserContractResponse{
 		TransactionHash: txHash,
 	}
@@ -0,0 +1,462 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/middleware"
+	"infinirewards/models"
+	"infinirewards/utils"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// BeginPasskeyRegistrationHandler godoc
+//
+//	@Summary		Begin passkey registration
+//	@Metadata	Start registering a passkey for the authenticated user
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request	body		models.BeginPasskeyRegistrationRequest	true	"Registration Request"
+//	@Success		200		{object}	models.BeginWebAuthnResponse			"Credential creation options"
+//	@Failure		400		{object}	models.ErrorResponse					"Invalid request format"
+//	@Failure		401		{object}	models.ErrorResponse					"Authentication error"
+//	@Failure		500		{object}	models.ErrorResponse					"Internal server error"
+//	@Router			/auth/webauthn/register/begin [post]
+func BeginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var beginReq models.BeginPasskeyRegistrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&beginReq); err != nil {
+		WriteError(w, "Invalid request format", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := beginReq.Validate(); err != nil {
+		WriteError(w, "Validation failed", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	webAuthnUser, err := models.LoadWebAuthnUser(ctx, userID)
+	if err != nil {
+		logs.Logger.Error("failed to load passkeys",
+			slog.String("handler", "BeginPasskeyRegistrationHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to load user", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	options, sessionData, err := utils.WebAuthn.BeginRegistration(webAuthnUser,
+		webauthn.WithExclusions(webAuthnUser.Exclusions()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+	)
+	if err != nil {
+		logs.Logger.Error("failed to begin passkey registration",
+			slog.String("handler", "BeginPasskeyRegistrationHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to begin registration", InternalServerError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	session := &models.WebAuthnSession{
+		Purpose: models.WebAuthnPurposeRegistration,
+		UserID:  userID,
+		Name:    beginReq.Name,
+		Data:    *sessionData,
+	}
+	if err := session.CreateWebAuthnSession(ctx); err != nil {
+		logs.Logger.Error("failed to store WebAuthn session",
+			slog.String("handler", "BeginPasskeyRegistrationHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to begin registration", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.BeginWebAuthnResponse{
+		SessionID: session.ID,
+		Options:   options,
+	})
+}
+
+// FinishPasskeyRegistrationHandler godoc
+//
+//	@Summary		Finish passkey registration
+//	@Metadata	Verify the attestation returned by the browser and store the passkey
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request	body		models.FinishWebAuthnRequest	true	"Attestation"
+//	@Success		201		{object}	models.PasskeyCredential		"Passkey registered"
+//	@Failure		400		{object}	models.ErrorResponse			"Invalid request format or attestation"
+//	@Failure		401		{object}	models.ErrorResponse			"Authentication error"
+//	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/auth/webauthn/register/finish [post]
+func FinishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var finishReq models.FinishWebAuthnRequest
+	if err := json.NewDecoder(r.Body).Decode(&finishReq); err != nil {
+		WriteError(w, "Invalid request format", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := finishReq.Validate(); err != nil {
+		WriteError(w, "Validation failed", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	session, err := models.ConsumeWebAuthnSession(ctx, finishReq.SessionID, models.WebAuthnPurposeRegistration)
+	if err != nil || session.UserID != userID {
+		WriteError(w, "Invalid session", ValidationError, map[string]string{
+			"reason": "Invalid or expired session",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(finishReq.Credential)
+	if err != nil {
+		WriteError(w, "Invalid credential", ValidationError, map[string]string{
+			"reason": webAuthnErrorReason(err),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	webAuthnUser, err := models.LoadWebAuthnUser(ctx, userID)
+	if err != nil {
+		WriteError(w, "Failed to load user", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := utils.WebAuthn.CreateCredential(webAuthnUser, session.Data, parsed)
+	if err != nil {
+		WriteError(w, "Invalid credential", ValidationError, map[string]string{
+			"reason": webAuthnErrorReason(err),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	passkey := &models.PasskeyCredential{
+		UserID:     userID,
+		Name:       session.Name,
+		Credential: *credential,
+	}
+	if err := passkey.CreatePasskey(ctx); err != nil {
+		logs.Logger.Error("failed to store passkey",
+			slog.String("handler", "FinishPasskeyRegistrationHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to register passkey", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(passkey)
+}
+
+// BeginPasskeyLoginHandler godoc
+//
+//	@Summary		Begin passkey login
+//	@Metadata	Start a login with a discoverable passkey
+//	@Tags			auth
+//	@Produce		json
+//	@Success		200	{object}	models.BeginWebAuthnResponse	"Credential request options"
+//	@Failure		429	{object}	models.ErrorResponse			"Too many requests"
+//	@Failure		500	{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/auth/webauthn/login/begin [post]
+func BeginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !allowRequest(w, r, models.WebAuthnLoginIPLimit, middleware.GetClientIP(r), "Too many login attempts", "BeginPasskeyLoginHandler") {
+		return
+	}
+
+	options, sessionData, err := utils.WebAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		logs.Logger.Error("failed to begin passkey login",
+			slog.String("handler", "BeginPasskeyLoginHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to begin login", InternalServerError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	session := &models.WebAuthnSession{
+		Purpose: models.WebAuthnPurposeLogin,
+		Data:    *sessionData,
+	}
+	if err := session.CreateWebAuthnSession(ctx); err != nil {
+		logs.Logger.Error("failed to store WebAuthn session",
+			slog.String("handler", "BeginPasskeyLoginHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to begin login", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.BeginWebAuthnResponse{
+		SessionID: session.ID,
+		Options:   options,
+	})
+}
+
+// FinishPasskeyLoginHandler godoc
+//
+//	@Summary		Finish passkey login
+//	@Metadata	Verify the assertion returned by the browser and issue a token
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			request	body		models.FinishWebAuthnRequest	true	"Assertion"
+//	@Success		200		{object}	models.AuthenticateResponse		"Authentication successful"
+//	@Failure		400		{object}	models.ErrorResponse			"Invalid request format"
+//	@Failure		401		{object}	models.ErrorResponse			"Authentication failed"
+//	@Failure		500		{object}	models.ErrorResponse			"Internal server error"
+//	@Router			/auth/webauthn/login/finish [post]
+func FinishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var finishReq models.FinishWebAuthnRequest
+	if err := json.NewDecoder(r.Body).Decode(&finishReq); err != nil {
+		WriteError(w, "Invalid request format", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if err := finishReq.Validate(); err != nil {
+		WriteError(w, "Validation failed", ValidationError, map[string]string{
+			"reason": err.Error(),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	session, err := models.ConsumeWebAuthnSession(ctx, finishReq.SessionID, models.WebAuthnPurposeLogin)
+	if err != nil {
+		WriteError(w, "Authentication failed", AuthenticationError, map[string]string{
+			"reason": "Invalid or expired session",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(finishReq.Credential)
+	if err != nil {
+		WriteError(w, "Invalid credential", ValidationError, map[string]string{
+			"reason": webAuthnErrorReason(err),
+		}, http.StatusBadRequest)
+		return
+	}
+
+	user, passkey, err := validatePasskeyLogin(ctx, session, parsed)
+	if err != nil {
+		logs.Logger.Warn("passkey login failed",
+			slog.String("handler", "FinishPasskeyLoginHandler"),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Authentication failed", AuthenticationError, map[string]string{
+			"reason": webAuthnErrorReason(err),
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	passkey.LastUsedAt = time.Now()
+	if err := passkey.UpdatePasskey(ctx); err != nil {
+		if errors.Is(err, models.ErrPasskeyChanged) {
+			// Deleted, or its sign count moved on with another login
+			WriteError(w, "Authentication failed", AuthenticationError, map[string]string{
+				"reason": "Passkey was deleted or used by another login",
+			}, http.StatusUnauthorized)
+			return
+		}
+		logs.Logger.Error("failed to update passkey",
+			slog.String("handler", "FinishPasskeyLoginHandler"),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	token, err := createJWT(ctx, user, finishReq.Device)
+	if err != nil {
+		WriteError(w, "Failed to generate token", InternalServerError, map[string]string{
+			"reason": "Failed to generate token",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.AuthenticateResponse{
+		Token: *token,
+	})
+}
+
+// ListPasskeysHandler godoc
+//
+//	@Summary		List passkeys
+//	@Metadata	List the passkeys registered by the authenticated user, in the order they were registered
+//	@Tags			auth
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			limit	query		int										false	"Page size, at most 100"
+//	@Param			cursor	query		string									false	"nextCursor of the previous page"
+//	@Success		200		{object}	models.Page[models.PasskeyCredential]	"Page of registered passkeys"
+//	@Failure		400		{object}	models.ErrorResponse					"Invalid limit or cursor"
+//	@Failure		401		{object}	models.ErrorResponse					"Authentication error"
+//	@Failure		500		{object}	models.ErrorResponse					"Internal server error"
+//	@Router			/auth/webauthn/credentials [get]
+func ListPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	opts, ok := parseListOptions(w, r)
+	if !ok {
+		return
+	}
+
+	passkeys, err := models.ListPasskeys(ctx, userID, opts)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidCursor) {
+			writeInvalidCursor(w)
+			return
+		}
+		WriteError(w, "Failed to list passkeys", InternalServerError, map[string]string{
+			"reason": "Database operation failed",
+		}, http.StatusInternalServerError)
+		return
+	}
+
+	writePage(w, passkeys)
+}
+
+// DeletePasskeyHandler godoc
+//
+//	@Summary		Delete passkey
+//	@Metadata	Remove a passkey of the authenticated user
+//	@Tags			auth
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string					true	"Passkey ID"
+//	@Success		200	{object}	models.MessageResponse	"Passkey deleted"
+//	@Failure		401	{object}	models.ErrorResponse	"Authentication error"
+//	@Failure		404	{object}	models.ErrorResponse	"Passkey not found"
+//	@Router			/auth/webauthn/credentials/{id} [delete]
+func DeletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userID, err := middleware.GetUserIDFromContext(ctx)
+	if err != nil {
+		WriteError(w, "Unauthorized", AuthenticationError, map[string]string{
+			"reason": "Missing or invalid authentication token",
+		}, http.StatusUnauthorized)
+		return
+	}
+
+	passkeyID := r.PathValue("id")
+	if err := models.DeletePasskey(ctx, userID, passkeyID); err != nil {
+		WriteError(w, "Passkey not found", NotFoundError, map[string]string{
+			"reason": "Passkey does not exist",
+			"id":     passkeyID,
+		}, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.MessageResponse{
+		Message: "Passkey deleted successfully",
+	})
+}
+
+// validatePasskeyLogin verifies an assertion of a discoverable passkey and
+// returns its owner and the passkey with an updated sign count
+func validatePasskeyLogin(ctx context.Context, session *models.WebAuthnSession, parsed *protocol.ParsedCredentialAssertionData) (*models.User, *models.PasskeyCredential, error) {
+	var webAuthnUser *models.WebAuthnUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+		webAuthnUser, err = models.LoadWebAuthnUser(ctx, models.ResolveUserID(ctx, models.UserIDFromWebAuthnHandle(userHandle)))
+		return webAuthnUser, err
+	}
+
+	_, credential, err := utils.WebAuthn.ValidatePasskeyLogin(handler, session.Data, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A sign count that went backwards means the authenticator may have been cloned
+	if credential.Authenticator.CloneWarning {
+		return nil, nil, fmt.Errorf("authenticator sign count mismatch")
+	}
+
+	passkey := webAuthnUser.Passkey(credential.ID)
+	if passkey == nil {
+		return nil, nil, fmt.Errorf("passkey not found")
+	}
+	passkey.Credential.Authenticator = credential.Authenticator
+	passkey.Credential.Flags = credential.Flags
+
+	return webAuthnUser.User, passkey, nil
+}
+
+// webAuthnErrorReason returns the detail of protocol errors, which explain why a ceremony failed
+func webAuthnErrorReason(err error) string {
+	if protocolErr, ok := err.(*protocol.Error); ok && protocolErr.DevInfo != "" {
+		return protocolErr.Details + ": " + protocolErr.DevInfo
+	}
+	return err.Error()
+}
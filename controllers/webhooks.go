@@ -0,0 +1,184 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// maxWebhookBodySize is the largest webhook payload accepted
+const maxWebhookBodySize = 1 << 20
+
+var webhookKindRegex = regexp.MustCompile(`^[a-z_]+$`)
+
+// VerifyWhatsAppWebhookHandler godoc
+//
+//	@Summary		Verify WhatsApp webhook
+//	@Metadata	Answer the hub challenge sent by Meta when the webhook is subscribed
+//	@Tags			webhooks
+//	@Produce		plain
+//	@Param			hub.mode			query		string	true	"Always subscribe"
+//	@Param			hub.verify_token	query		string	true	"Configured verify token"
+//	@Param			hub.challenge		query		string	true	"Challenge to echo"
+//	@Success		200					{string}	string	"The challenge"
+//	@Failure		403					{object}	models.ErrorResponse	"Verify token mismatch"
+//	@Router			/webhooks/whatsapp [get]
+func VerifyWhatsAppWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("hub.mode") != "subscribe" || !utils.VerifyWhatsAppWebhookToken(query.Get("hub.verify_token")) {
+		logs.Logger.Warn("rejected webhook subscription",
+			slog.String("handler", "VerifyWhatsAppWebhookHandler"),
+			slog.String("mode", query.Get("hub.mode")),
+		)
+		WriteError(w, "Invalid verify token", AuthorizationError, nil, http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(query.Get("hub.challenge")))
+}
+
+// ReceiveWhatsAppWebhookHandler godoc
+//
+//	@Summary		Receive WhatsApp webhook
+//	@Metadata	Queue the changes of a signed WhatsApp Cloud API webhook for processing
+//	@Tags			webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Param			X-Hub-Signature-256	header	string					true	"sha256=<hex HMAC-SHA256 of the body keyed with the app secret>"
+//	@Param			request				body	models.WebhookResponse	true	"Webhook payload"
+//	@Success		200
+//	@Failure		400	{object}	models.ErrorResponse	"Invalid payload"
+//	@Failure		401	{object}	models.ErrorResponse	"Invalid signature"
+//	@Failure		500	{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/webhooks/whatsapp [post]
+func ReceiveWhatsAppWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		WriteError(w, "Invalid request body", ValidationError, map[string]string{
+			"reason": "Unable to read request body",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if !utils.VerifyWhatsAppSignature(body, r.Header.Get("X-Hub-Signature-256")) {
+		logs.Logger.Warn("rejected webhook with invalid signature",
+			slog.String("handler", "ReceiveWhatsAppWebhookHandler"),
+		)
+		WriteError(w, "Invalid signature", AuthenticationError, nil, http.StatusUnauthorized)
+		return
+	}
+
+	var payload models.WebhookResponse
+	if err := json.Unmarshal(body, &payload); err != nil {
+		WriteError(w, "Invalid request body", ValidationError, map[string]string{
+			"reason": "Unable to parse JSON request",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	// Meta retries webhooks that are not answered in time, so each change is
+	// de-duplicated by the payload hash
+	payloadHash := sha256.Sum256(body)
+	receivedAt := time.Now()
+	for i, entry := range payload.Entry {
+		for j, change := range entry.Changes {
+			kind := change.Field
+			if !webhookKindRegex.MatchString(kind) {
+				kind = "unknown"
+			}
+
+			data, err := json.Marshal(models.WhatsAppWebhookEvent{
+				EntryID:    entry.ID,
+				Change:     change,
+				ReceivedAt: receivedAt,
+			})
+			if err != nil {
+				WriteError(w, "Failed to queue webhook", InternalServerError, nil, http.StatusInternalServerError)
+				return
+			}
+
+			msgID := fmt.Sprintf("%s.%d.%d", hex.EncodeToString(payloadHash[:16]), i, j)
+			if _, err := nats.PublishStreamDedup(ctx, nats.WebhookSubject("whatsapp", kind), data, msgID); err != nil {
+				logs.Logger.Error("failed to queue webhook",
+					slog.String("handler", "ReceiveWhatsAppWebhookHandler"),
+					slog.String("error", err.Error()),
+				)
+				WriteError(w, "Failed to queue webhook", InternalServerError, nil, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// MacroKioskDLRHandler godoc
+//
+//	@Summary		Receive SMS delivery report
+//	@Metadata	Update the delivery status of an SMS from a MacroKiosk delivery report
+//	@Tags			webhooks
+//	@Produce		plain
+//	@Param			token	query		string	true	"Configured delivery report token"
+//	@Param			msgid	query		string	true	"MacroKiosk message ID"
+//	@Param			status	query		string	true	"Delivery status, e.g. DELIVERED or UNDELIVERED"
+//	@Success		200		{string}	string	"OK"
+//	@Failure		400		{object}	models.ErrorResponse	"Missing message ID"
+//	@Failure		403		{object}	models.ErrorResponse	"Invalid token"
+//	@Failure		500		{object}	models.ErrorResponse	"Internal server error"
+//	@Router			/webhooks/macrokiosk/dlr [get]
+func MacroKioskDLRHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if !utils.VerifyMacroKioskDLRToken(r.FormValue("token")) {
+		logs.Logger.Warn("rejected delivery report with invalid token",
+			slog.String("handler", "MacroKioskDLRHandler"),
+		)
+		WriteError(w, "Invalid token", AuthorizationError, nil, http.StatusForbidden)
+		return
+	}
+
+	msgID := r.FormValue("msgid")
+	if msgID == "" {
+		WriteError(w, "Invalid request parameters", ValidationError, map[string]string{
+			"reason": "msgid is required",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	reportStatus := strings.ToUpper(r.FormValue("status"))
+	status := utils.DeliveryStatusSent
+	switch reportStatus {
+	case "DELIVERED":
+		status = utils.DeliveryStatusDelivered
+	case "UNDELIVERED", "REJECTED", "EXPIRED", "FAILED":
+		status = utils.DeliveryStatusFailed
+	}
+
+	if _, err := models.UpdateMessageDeliveryStatus(ctx, "macrokiosk", msgID, status, reportStatus); err != nil && !errors.Is(err, models.ErrMessageDeliveryNotFound) {
+		logs.Logger.Error("failed to update SMS delivery status",
+			slog.String("handler", "MacroKioskDLRHandler"),
+			slog.String("msg_id", msgID),
+			slog.String("error", err.Error()),
+		)
+		WriteError(w, "Failed to update delivery status", InternalServerError, nil, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("OK"))
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"fmt"
+	"infinirewards/config"
 	"infinirewards/infinirewards"
 	"infinirewards/logs"
+	"infinirewards/utils"
 	"math/big"
 	"testing"
 	"time"
@@ -20,12 +22,19 @@ func TestInfiniRewards(t *testing.T) {
 	t.Logf("Starting InfiniRewards Test")
 	logs.InitHandler("")
 	ctx := context.Background()
-	err := infinirewards.ConnectStarknet()
+	cfg, err := config.Load()
+	require.NoError(t, err)
+
+	err = infinirewards.ConnectStarknet(cfg.Starknet)
 	if err != nil {
 		t.Logf("Error connecting to Starknet: %v", err)
 	}
 	require.NoError(t, err)
 
+	// Phone numbers are hashed with the pepper before they are stored on chain
+	err = utils.InitPhoneNumberPepper(cfg.Secrets.PhoneNumberPepper)
+	require.NoError(t, err)
+
 	// Test Merchant and User Flow
 	t.Run("MerchantAndUserFlow", func(t *testing.T) {
 		// Generate random keypair for merchant
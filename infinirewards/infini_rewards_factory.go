@@ -2,7 +2,6 @@ package infinirewards
 
 import (
 	"context"
-	"crypto/sha256"
 	"fmt"
 	"math/big"
 
@@ -22,8 +21,10 @@ func CreateUser(publicKey string, phoneNumber string) (string, string, error) {
 		return "", "", fmt.Errorf("failed to convert public key to felt: %w", err)
 	}
 
-	phoneNumberHash := sha256.Sum256([]byte(phoneNumber))
-	phoneNumberHashFelt := new(felt.Felt).SetBytes(phoneNumberHash[:])
+	phoneNumberHashFelt, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return "", "", err
+	}
 
 	receipt, err := InvokeTransactionMaster(InfiniRewardsFactoryAddress, "create_user", []*felt.Felt{publicKeyFelt, phoneNumberHashFelt})
 	if err != nil {
@@ -43,7 +44,10 @@ func CreateUser(publicKey string, phoneNumber string) (string, string, error) {
 //	@param		decimals:		The	decimals	of		the	initial	points	contract
 //	@return:	The transaction hash, the address of the merchant, the address of the points, and an error
 func CreateMerchant(publicKey string, phoneNumber string, name string, symbol string, decimals uint64) (string, string, string, error) {
-	phoneNumberHashFelt := HashPhoneNumber(phoneNumber)
+	phoneNumberHashFelt, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return "", "", "", err
+	}
 	// Convert publicKey and phoneNumberHash to felt
 	publicKeyFelt, err := utils.HexToFelt(publicKey)
 	if err != nil {
@@ -21,3 +21,79 @@ func GetPhoneNumber(ctx context.Context, account *account.Account) (string, erro
 
 	return PadZerosInFelt(resp[0]), nil
 }
+
+// SetPhoneNumber sets the phone number hash stored in a user or merchant account
+//	@param		account:		The	account	of	the	user	or	merchant
+//	@param		phoneNumber:	The	new	phone	number
+//	@return:	The transaction hash and an error
+func SetPhoneNumber(account *account.Account, phoneNumber string) (string, error) {
+	hash, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return "", err
+	}
+	calldata := []*felt.Felt{hash}
+
+	resp, err := InvokeTransaction(account, account.AccountAddress.String(), "set_phone_number", calldata)
+	if err != nil {
+		return "", fmt.Errorf("failed to set phone number: %w", err)
+	}
+
+	return resp.TransactionHash.String(), nil
+}
+
+// SetPhoneNumbers sets the phone number hash stored in each account owned by a key pair
+//	@param		privateKey:		The	private	key	of	the	accounts
+//	@param		publicKey:		The	public	key	of	the	accounts
+//	@param		addresses:		The	addresses	of	the	accounts
+//	@param		phoneNumber:	The	new	phone	number
+//	@return:	An error
+func SetPhoneNumbers(privateKey string, publicKey string, addresses []string, phoneNumber string) error {
+	for _, address := range addresses {
+		account, err := GetAccount(privateKey, publicKey, address)
+		if err != nil {
+			return fmt.Errorf("failed to get account %s: %w", address, err)
+		}
+		if _, err := SetPhoneNumber(account, phoneNumber); err != nil {
+			return fmt.Errorf("failed to set phone number of %s: %w", address, err)
+		}
+	}
+
+	return nil
+}
+
+// UpdatePhoneNumbers sets the phone number hash of the accounts owned by a key
+// pair that do not hold it yet, so running it again sends no transaction for
+// the accounts already updated
+//	@param		privateKey:		The	private	key	of	the	accounts
+//	@param		publicKey:		The	public	key	of	the	accounts
+//	@param		addresses:		The	addresses	of	the	accounts
+//	@param		phoneNumber:	The	new	phone	number
+//	@return:	The number of accounts updated and an error
+func UpdatePhoneNumbers(ctx context.Context, privateKey string, publicKey string, addresses []string, phoneNumber string) (int, error) {
+	hashFelt, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return 0, err
+	}
+	hash := PadZerosInFelt(hashFelt)
+
+	updated := 0
+	for _, address := range addresses {
+		account, err := GetAccount(privateKey, publicKey, address)
+		if err != nil {
+			return updated, fmt.Errorf("failed to get account %s: %w", address, err)
+		}
+		current, err := GetPhoneNumber(ctx, account)
+		if err != nil {
+			return updated, fmt.Errorf("failed to get phone number of %s: %w", address, err)
+		}
+		if current == hash {
+			continue
+		}
+		if _, err := SetPhoneNumber(account, phoneNumber); err != nil {
+			return updated, fmt.Errorf("failed to set phone number of %s: %w", address, err)
+		}
+		updated++
+	}
+
+	return updated, nil
+}
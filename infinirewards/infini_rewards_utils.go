@@ -2,7 +2,6 @@ package infinirewards
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"log/slog"
@@ -10,6 +9,7 @@ import (
 	"time"
 
 	"infinirewards/logs"
+	appUtils "infinirewards/utils"
 
 	"github.com/NethermindEth/juno/core/felt"
 	"github.com/NethermindEth/starknet.go/account"
@@ -495,11 +495,14 @@ func PanicRPC(err error) error {
 	return fmt.Errorf("RPC error: %w", err)
 }
 
-func HashPhoneNumber(phoneNumber string) *felt.Felt {
-	h := sha256.New()
-	h.Write([]byte(phoneNumber))
-	// phoneNumberHash := hex.EncodeToString(h.Sum(nil))
-	return new(felt.Felt).SetBytes(h.Sum(nil))
+// HashPhoneNumber hashes a phone number for storage in an account contract.
+// The hash is keyed with the server pepper because contract storage is public.
+func HashPhoneNumber(phoneNumber string) (*felt.Felt, error) {
+	hash, err := appUtils.HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash phone number: %w", err)
+	}
+	return new(felt.Felt).SetBytes(hash), nil
 }
 
 func BigInt256ToFelt(bi *big.Int) []*felt.Felt {
@@ -3,14 +3,13 @@ package infinirewards
 import (
 	"context"
 	"fmt"
+	"infinirewards/config"
 	"infinirewards/logs"
 	"log/slog"
 	"math/big"
-	"os"
 
 	"github.com/NethermindEth/starknet.go/account"
 	"github.com/NethermindEth/starknet.go/rpc"
-	"github.com/joho/godotenv"
 )
 
 var Client *rpc.Provider
@@ -20,41 +19,23 @@ var masterAccnt *account.Account
 // New variables for InfiniRewards contracts
 var InfiniRewardsFactoryAddress string
 
-func ConnectStarknet() error {
+// ConnectStarknet connects to the RPC provider of the configured network and
+// opens the master account
+func ConnectStarknet(cfg config.StarknetConfig) error {
+	rpcProviderUrl := cfg.RPCURL
+	masterPrivKey := cfg.MasterPrivateKey
+	masterAccntAddress := cfg.MasterAccountAddress
+	InfiniRewardsFactoryAddress = cfg.FactoryAddress
 
-	err := godotenv.Load(".env")
-	if err != nil {
-		return fmt.Errorf("failed to load .env file: %w", err)
-	}
-
-	var rpcProviderUrl string
-	var masterPrivKey string
-	var masterAccntAddress string
-
-	network := os.Getenv("NETWORK")
 	logs.Logger.Info("connecting to starknet",
-		slog.String("network", network),
+		slog.String("network", cfg.Network),
 	)
-	switch network {
-	case "devnet":
-		rpcProviderUrl = os.Getenv("RPC_PROVIDER_URL_DEVNET")
-		masterPrivKey = os.Getenv("MASTER_PRIVATE_KEY_DEVNET")
-		masterAccntAddress = os.Getenv("MASTER_ACCOUNT_ADDRESS_DEVNET")
-		InfiniRewardsFactoryAddress = os.Getenv("INFINI_REWARDS_FACTORY_ADDRESS_DEVNET")
-	case "sepolia":
-		rpcProviderUrl = os.Getenv("RPC_PROVIDER_URL_SEPOLIA")
-		masterPrivKey = os.Getenv("MASTER_PRIVATE_KEY_SEPOLIA")
-		masterAccntAddress = os.Getenv("MASTER_ACCOUNT_ADDRESS_SEPOLIA")
-		InfiniRewardsFactoryAddress = os.Getenv("INFINI_REWARDS_FACTORY_ADDRESS_SEPOLIA")
-	case "mainnet":
-		rpcProviderUrl = os.Getenv("RPC_PROVIDER_URL_MAINNET")
-		masterPrivKey = os.Getenv("MASTER_PRIVATE_KEY_MAINNET")
-		masterAccntAddress = os.Getenv("MASTER_ACCOUNT_ADDRESS_MAINNET")
-		InfiniRewardsFactoryAddress = os.Getenv("INFINI_REWARDS_FACTORY_ADDRESS_MAINNET")
-	default:
-		return fmt.Errorf("invalid network configuration: %s", network)
+	if rpcProviderUrl == "" || masterPrivKey == "" || masterAccntAddress == "" || InfiniRewardsFactoryAddress == "" {
+		return fmt.Errorf("missing Starknet configuration for network %s: RPC URL=%v, PrivateKey=%v, AccountAddress=%v, FactoryAddress=%v",
+			cfg.Network, rpcProviderUrl != "", masterPrivKey != "", masterAccntAddress != "", InfiniRewardsFactoryAddress != "")
 	}
 
+	var err error
 	Client, err = rpc.NewProvider(rpcProviderUrl)
 	if err != nil {
 		return fmt.Errorf("failed to create RPC provider for URL %s: %w", rpcProviderUrl, err)
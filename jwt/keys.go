@@ -1,205 +1,411 @@
 package jwt
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ed25519"
 	crand "crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"infinirewards/nats"
 	"log/slog"
 	"math/rand"
-	"os"
-	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
 	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// KeyState is the lifecycle state of a signing key
+type KeyState string
+
+const (
+	// KeyStateActive keys sign new tokens and verify existing ones
+	KeyStateActive KeyState = "active"
+	// KeyStateVerifyOnly keys no longer sign but still verify tokens issued before rotation
+	KeyStateVerifyOnly KeyState = "verify-only"
+	// KeyStateRetired keys are no longer trusted and are deleted after retiredRetention
+	KeyStateRetired KeyState = "retired"
 )
 
 type KeyPair struct {
 	ID        string
 	Private   ed25519.PrivateKey
 	Public    ed25519.PublicKey
+	State     KeyState
 	CreatedAt time.Time
+	RotatedAt time.Time
+}
+
+// storedKey is the representation of a KeyPair in the jwtKeys bucket. The
+// private key is sealed with AES-256-GCM using the key passed to InitKeys.
+type storedKey struct {
+	ID               string    `json:"id"`
+	State            KeyState  `json:"state"`
+	Public           []byte    `json:"public"`
+	EncryptedPrivate []byte    `json:"encryptedPrivate"`
+	CreatedAt        time.Time `json:"createdAt"`
+	RotatedAt        time.Time `json:"rotatedAt,omitempty"`
 }
 
+const (
+	keysBucket   = "jwtKeys"
+	leaderBucket = "jwtLeader"
+	leaderKey    = "leader"
+
+	// tokenLifetime is the expiry of tokens issued by CreateToken
+	tokenLifetime = time.Hour
+	// activeKeyCount is the number of keys the leader keeps available for signing
+	activeKeyCount = 3
+	// retiredRetention is how long retired keys are kept before being deleted
+	retiredRetention = 24 * time.Hour
+	// leaderInterval is how often the leader lease is renewed. The lease
+	// bucket TTL is three intervals so a crashed leader is replaced quickly.
+	leaderInterval = 10 * time.Second
+)
+
 var (
 	activeKeys     = make(map[string]*KeyPair)
 	keyMutex       sync.RWMutex
-	privateKeyDir  = ".private"
-	publicKeyDir   = ".public"
 	keyRotationAge = 24 * time.Hour
+	// verifyOnlyAge is how long a rotated key keeps verifying tokens. It
+	// covers the lifetime of the last token signed with it plus clock skew.
+	verifyOnlyAge = tokenLifetime + 5*time.Minute
+
+	encryptionKey []byte
+	instanceID    string
+	isLeader      bool
+	stopKeys      context.CancelFunc
 )
 
-// SetKeyDirectories allows setting test directories
-func SetKeyDirectories(privateDir, publicDir string) {
-	keyMutex.Lock()
-	defer keyMutex.Unlock()
+// InitKeys loads the key ring from NATS KV, keeps it in sync with the other
+// replicas and takes part in the election of the replica that rotates keys.
+// The private keys are stored encrypted with the base64 encoded 32 byte
+// encodedKey. NATS must be connected before calling it.
+func InitKeys(encodedKey string) error {
+	StopKeys()
 
-	privateKeyDir = privateDir
-	publicKeyDir = publicDir
-}
+	var err error
+	encryptionKey, err = loadEncryptionKey(encodedKey)
+	if err != nil {
+		return err
+	}
 
-// InitKeys initializes the JWT keys and starts key rotation
-func InitKeys() error {
 	keyMutex.Lock()
-	defer keyMutex.Unlock()
-	fmt.Printf("Initializing JWT keys")
-
-	// Clear existing keys
 	activeKeys = make(map[string]*KeyPair)
+	keyMutex.Unlock()
+
+	instanceID = generateKeyID()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopKeys = cancel
+
+	kv, err := nats.KeyValue(ctx, keysBucket)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to open JWT key bucket: %w", err)
+	}
 
-	// Create directories if they don't exist
-	if err := os.MkdirAll(privateKeyDir, 0700); err != nil {
-		return fmt.Errorf("failed to create private key directory: %w", err)
+	watcher, err := kv.WatchAll(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to watch JWT key bucket: %w", err)
 	}
-	if err := os.MkdirAll(publicKeyDir, 0755); err != nil {
-		return fmt.Errorf("failed to create public key directory: %w", err)
+
+	// The watcher replays the current keys and then sends nil
+	synced := make(chan struct{})
+	go watchKeys(watcher, synced)
+
+	select {
+	case <-synced:
+	case <-time.After(10 * time.Second):
+		cancel()
+		return fmt.Errorf("timed out loading JWT keys")
 	}
 
-	fmt.Printf("Private key directory: %s\n", privateKeyDir)
-	fmt.Printf("Public key directory: %s\n", publicKeyDir)
+	// Bootstrap the key ring right away if this replica wins the election
+	if err := electAndRotate(ctx); err != nil {
+		slog.Error("Failed to rotate keys",
+			slog.String("error", err.Error()),
+		)
+	}
 
-	// Load existing keys or generate initial keys
-	if err := loadOrGenerateKeys(); err != nil {
-		return err
+	// Wait for the leader to publish signing keys
+	deadline := time.Now().Add(10 * time.Second)
+	for GetRandomActiveKey() == nil {
+		if time.Now().After(deadline) {
+			cancel()
+			return fmt.Errorf("no active JWT signing keys available")
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
 
-	fmt.Printf("Loaded %d keys\n", len(activeKeys))
+	slog.Info("JWT keys initialized",
+		slog.Int("keys", keyCount()),
+		slog.Bool("leader", leader()),
+	)
 
-	// Start key rotation
-	go rotateKeys()
+	go rotateKeys(ctx)
 
 	return nil
 }
 
-// loadOrGenerateKeys loads existing keys or generates initial keys if none exist
-func loadOrGenerateKeys() error {
+// StopKeys stops watching and rotating keys and hands over leadership
+func StopKeys() {
+	if stopKeys == nil {
+		return
+	}
+	stopKeys()
+	stopKeys = nil
+
+	if leader() {
+		keyMutex.Lock()
+		isLeader = false
+		keyMutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		if entry, err := nats.GetKV(ctx, leaderBucket, leaderKey); err == nil && string(entry.Value()) == instanceID {
+			nats.RemoveKV(ctx, leaderBucket, leaderKey)
+		}
+	}
+}
+
+func loadEncryptionKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, fmt.Errorf("JWT key encryption key is not set")
+	}
 
-	files, err := os.ReadDir(privateKeyDir)
+	key, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
-		return fmt.Errorf("failed to read private key directory: %w", err)
+		return nil, fmt.Errorf("JWT key encryption key must be base64 encoded: %w", err)
 	}
-
-	if len(files) == 0 {
-		// Generate initial keys
-		for i := 0; i < 3; i++ {
-			if err := generateNewKeyPair(); err != nil {
-				return fmt.Errorf("failed to generate initial key pair: %w", err)
-			}
-		}
-		return nil
+	if len(key) != 32 {
+		return nil, fmt.Errorf("JWT key encryption key must decode to 32 bytes, got %d", len(key))
 	}
 
-	// Load existing keys
-	for _, file := range files {
-		id := file.Name()
-		info, err := file.Info()
-		if err != nil {
-			return fmt.Errorf("failed to get file info for %s: %w", id, err)
-		}
+	return key, nil
+}
 
-		privPath := filepath.Join(privateKeyDir, id)
-		privBytes, err := os.ReadFile(privPath)
-		if err != nil {
-			return fmt.Errorf("failed to read private key %s: %w", id, err)
+// watchKeys applies key ring updates published by the leader
+func watchKeys(watcher jetstream.KeyWatcher, synced chan struct{}) {
+	defer watcher.Stop()
+
+	initial := true
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			if initial {
+				initial = false
+				close(synced)
+			}
+			continue
 		}
 
-		pubPath := filepath.Join(publicKeyDir, id+".pub")
-		pubBytes, err := os.ReadFile(pubPath)
-		if err != nil {
-			return fmt.Errorf("failed to read public key %s: %w", id, err)
+		if entry.Operation() != jetstream.KeyValuePut {
+			keyMutex.Lock()
+			delete(activeKeys, entry.Key())
+			keyMutex.Unlock()
+			continue
 		}
 
-		pair := &KeyPair{
-			ID:        id,
-			Private:   ed25519.PrivateKey(privBytes),
-			Public:    ed25519.PublicKey(pubBytes),
-			CreatedAt: info.ModTime(),
+		pair, err := decodeKey(entry.Value())
+		if err != nil {
+			slog.Error("Failed to load JWT key",
+				slog.String("kid", entry.Key()),
+				slog.String("error", err.Error()),
+			)
+			continue
 		}
 
-		activeKeys[id] = pair
+		keyMutex.Lock()
+		activeKeys[pair.ID] = pair
+		keyMutex.Unlock()
 	}
-
-	return nil
 }
 
-// rotateKeys handles key rotation every 24 hours
-func rotateKeys() {
-	ticker := time.NewTicker(time.Hour)
+// rotateKeys renews the leader lease and, on the leader, rotates keys
+func rotateKeys(ctx context.Context) {
+	ticker := time.NewTicker(leaderInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		if err := performKeyRotation(); err != nil {
-			slog.Error("Failed to rotate keys",
-				slog.String("error", err.Error()),
-			)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := electAndRotate(ctx); err != nil {
+				slog.Error("Failed to rotate keys",
+					slog.String("error", err.Error()),
+				)
+			}
 		}
 	}
 }
 
-// performKeyRotation performs the actual key rotation
-func performKeyRotation() error {
+// electAndRotate acquires or renews the leader lease and rotates keys if this
+// replica holds it. The lease lives in a bucket with a TTL, so it lapses when
+// the leader stops renewing it.
+func electAndRotate(ctx context.Context) error {
+	leading := false
+
+	entry, err := nats.GetKV(ctx, leaderBucket, leaderKey)
+	switch {
+	case nats.IsNotFound(err):
+		_, err = nats.CreateKV(ctx, leaderBucket, leaderKey, []byte(instanceID))
+		leading = err == nil
+		if err != nil && !nats.IsConflict(err) {
+			return fmt.Errorf("failed to acquire leader lease: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to read leader lease: %w", err)
+	case string(entry.Value()) == instanceID:
+		_, err = nats.UpdateKV(ctx, leaderBucket, leaderKey, []byte(instanceID), entry.Revision())
+		leading = err == nil
+		if err != nil && !nats.IsConflict(err) {
+			return fmt.Errorf("failed to renew leader lease: %w", err)
+		}
+	}
+
 	keyMutex.Lock()
-	defer keyMutex.Unlock()
+	if leading != isLeader {
+		slog.Info("JWT key leadership changed",
+			slog.String("instance", instanceID),
+			slog.Bool("leader", leading),
+		)
+	}
+	isLeader = leading
+	keyMutex.Unlock()
+
+	if !leading {
+		return nil
+	}
+	return performKeyRotation(ctx)
+}
 
-	// Check for expired keys
+// performKeyRotation moves keys through their lifecycle and tops up the
+// number of active keys. Only the leader calls it.
+func performKeyRotation(ctx context.Context) error {
 	now := time.Now()
-	var expiredKeys []string
-	activeCount := 0
 
-	for id, key := range activeKeys {
-		if now.Sub(key.CreatedAt) >= keyRotationAge {
-			expiredKeys = append(expiredKeys, id)
-		} else {
-			activeCount++
-		}
+	keyMutex.RLock()
+	pairs := make([]KeyPair, 0, len(activeKeys))
+	for _, pair := range activeKeys {
+		pairs = append(pairs, *pair)
 	}
+	keyMutex.RUnlock()
 
-	// Generate new keys if needed
-	if activeCount < 3 {
-		for i := 0; i < 3-activeCount; i++ {
-			if err := generateNewKeyPair(); err != nil {
-				return fmt.Errorf("failed to generate new key pair: %w", err)
+	activeCount := 0
+	for _, pair := range pairs {
+		switch {
+		case pair.State == KeyStateActive && now.Sub(pair.CreatedAt) >= keyRotationAge:
+			pair.State = KeyStateVerifyOnly
+			pair.RotatedAt = now
+		case pair.State == KeyStateVerifyOnly && now.Sub(pair.RotatedAt) >= verifyOnlyAge:
+			pair.State = KeyStateRetired
+		case pair.State == KeyStateRetired && now.Sub(pair.RotatedAt) >= verifyOnlyAge+retiredRetention:
+			if err := nats.RemoveKV(ctx, keysBucket, pair.ID); err != nil {
+				return fmt.Errorf("failed to delete retired key %s: %w", pair.ID, err)
 			}
+			continue
+		default:
+			if pair.State == KeyStateActive {
+				activeCount++
+			}
+			continue
+		}
+
+		if err := storeKey(ctx, &pair); err != nil {
+			return fmt.Errorf("failed to update key %s: %w", pair.ID, err)
 		}
 	}
 
-	// Remove expired keys
-	for _, id := range expiredKeys {
-		delete(activeKeys, id)
-		os.Remove(filepath.Join(privateKeyDir, id))
-		os.Remove(filepath.Join(publicKeyDir, id+".pub"))
+	for i := activeCount; i < activeKeyCount; i++ {
+		if err := generateNewKeyPair(ctx); err != nil {
+			return fmt.Errorf("failed to generate new key pair: %w", err)
+		}
 	}
 
 	return nil
 }
 
-// GetKeyByID returns a key pair by ID
+// GetKeyByID returns a key pair by ID, fetching it from NATS KV if this
+// replica has not received it from the watcher yet
 func GetKeyByID(kid string) (*KeyPair, bool) {
+	keyMutex.RLock()
 	key, ok := activeKeys[kid]
-	return key, ok
+	keyMutex.RUnlock()
+	if ok {
+		return key, true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	entry, err := nats.GetKV(ctx, keysBucket, kid)
+	if err != nil {
+		return nil, false
+	}
+	key, err = decodeKey(entry.Value())
+	if err != nil {
+		return nil, false
+	}
+
+	keyMutex.Lock()
+	activeKeys[key.ID] = key
+	keyMutex.Unlock()
+
+	return key, true
 }
 
-// GetJWKS returns the JWKS for public key verification
+// GetJWKS returns the JWKS for public key verification, including keys that
+// no longer sign but still verify unexpired tokens
 func GetJWKS() (*jose.JSONWebKeySet, error) {
-	var keys []jose.JSONWebKey
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+
+	keys := []jose.JSONWebKey{}
 	for _, pair := range activeKeys {
-		if time.Since(pair.CreatedAt) < keyRotationAge {
-			key := jose.JSONWebKey{
-				Key:       pair.Public,
-				KeyID:     pair.ID,
-				Algorithm: string(jose.EdDSA),
-				Use:       "sig",
-			}
-			keys = append(keys, key)
+		if pair.State == KeyStateRetired {
+			continue
 		}
+		keys = append(keys, jose.JSONWebKey{
+			Key:       pair.Public,
+			KeyID:     pair.ID,
+			Algorithm: string(jose.EdDSA),
+			Use:       "sig",
+		})
 	}
 	return &jose.JSONWebKeySet{Keys: keys}, nil
 }
 
-// CreateToken creates a new JWT token
-func CreateToken(userID string) (string, error) {
+// Claims are the claims of tokens issued by CreateToken
+type Claims struct {
+	jwt.Claims
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// NewClaims returns the claims of a request authenticated without a token,
+// such as a signed request
+func NewClaims(userID string, roles []string, permissions []string) *Claims {
+	now := time.Now()
+	return &Claims{
+		Claims: jwt.Claims{
+			Subject:  userID,
+			Issuer:   "infinirewards",
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		Roles:       roles,
+		Permissions: permissions,
+	}
+}
+
+// CreateToken creates a new JWT token carrying the user's roles and permissions
+func CreateToken(userID string, roles []string, permissions []string) (string, error) {
 	// Get random key
 	key := GetRandomActiveKey()
 	if key == nil {
@@ -219,13 +425,17 @@ func CreateToken(userID string) (string, error) {
 	}
 
 	// Create claims
-	cl := jwt.Claims{
-		Subject:   userID,
-		Issuer:    "infinirewards",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Expiry:    jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
-		NotBefore: jwt.NewNumericDate(time.Now()),
-		Audience:  jwt.Audience{"infinirewards"},
+	cl := Claims{
+		Claims: jwt.Claims{
+			Subject:   userID,
+			Issuer:    "infinirewards",
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Expiry:    jwt.NewNumericDate(time.Now().Add(tokenLifetime)),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+			Audience:  jwt.Audience{"infinirewards"},
+		},
+		Roles:       roles,
+		Permissions: permissions,
 	}
 
 	// Sign token
@@ -233,7 +443,7 @@ func CreateToken(userID string) (string, error) {
 }
 
 // VerifyToken verifies a JWT token
-func VerifyToken(tokenString string) (*jwt.Claims, error) {
+func VerifyToken(tokenString string) (*Claims, error) {
 	tok, err := jwt.ParseSigned(tokenString)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse token: %w", err)
@@ -250,78 +460,175 @@ func VerifyToken(tokenString string) (*jwt.Claims, error) {
 	if !ok {
 		return nil, fmt.Errorf("key not found: %s", kid)
 	}
+	if key.State == KeyStateRetired {
+		return nil, fmt.Errorf("key retired: %s", kid)
+	}
 
 	// Verify claims
-	var claims jwt.Claims
+	var claims Claims
 	if err := tok.Claims(key.Public, &claims); err != nil {
 		return nil, fmt.Errorf("failed to verify claims: %w", err)
 	}
 
+	if err := claims.Validate(jwt.Expected{
+		Issuer:   "infinirewards",
+		Audience: jwt.Audience{"infinirewards"},
+		Time:     time.Now(),
+	}); err != nil {
+		return nil, fmt.Errorf("failed to validate claims: %w", err)
+	}
+
 	return &claims, nil
 }
 
 // GetRandomActiveKey returns a random active key pair
 func GetRandomActiveKey() *KeyPair {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+
 	var validKeys []*KeyPair
 	for _, key := range activeKeys {
-		if time.Since(key.CreatedAt) < keyRotationAge {
+		if key.State == KeyStateActive {
 			validKeys = append(validKeys, key)
 		}
 	}
 
 	if len(validKeys) == 0 {
-		// If no valid keys, trigger key rotation and try again
-		if err := performKeyRotation(); err != nil {
-			slog.Error("Failed to rotate keys when no valid keys found",
-				slog.String("error", err.Error()),
-			)
-			return nil
-		}
-		// Try getting valid keys again after rotation
-		for _, key := range activeKeys {
-			if time.Since(key.CreatedAt) < keyRotationAge {
-				validKeys = append(validKeys, key)
-			}
-		}
-		if len(validKeys) == 0 {
-			return nil // Still no valid keys after rotation
-		}
+		return nil
 	}
 
 	return validKeys[rand.Intn(len(validKeys))]
 }
 
-// generateNewKeyPair generates a new key pair
-func generateNewKeyPair() error {
+// generateNewKeyPair generates a new key pair and publishes it to the key ring
+func generateNewKeyPair(ctx context.Context) error {
 	pub, priv, err := ed25519.GenerateKey(crand.Reader)
 	if err != nil {
 		return fmt.Errorf("failed to generate EdDSA key pair: %w", err)
 	}
 
-	id := generateKeyID()
 	pair := &KeyPair{
-		ID:        id,
+		ID:        generateKeyID(),
 		Private:   priv,
 		Public:    pub,
+		State:     KeyStateActive,
 		CreatedAt: time.Now(),
 	}
 
-	// Save private key
-	privPath := filepath.Join(privateKeyDir, id)
-	if err := os.WriteFile(privPath, priv, 0600); err != nil {
-		return fmt.Errorf("failed to save private key: %w", err)
+	if err := storeKey(ctx, pair); err != nil {
+		return err
 	}
 
-	// Save public key
-	pubPath := filepath.Join(publicKeyDir, id+".pub")
-	if err := os.WriteFile(pubPath, pub, 0644); err != nil {
-		return fmt.Errorf("failed to save public key: %w", err)
+	// Make the key usable on this replica without waiting for the watcher
+	keyMutex.Lock()
+	activeKeys[pair.ID] = pair
+	keyMutex.Unlock()
+
+	return nil
+}
+
+// storeKey encrypts and saves a key pair to the jwtKeys bucket
+func storeKey(ctx context.Context, pair *KeyPair) error {
+	encrypted, err := encryptPrivateKey(pair.ID, pair.Private)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(storedKey{
+		ID:               pair.ID,
+		State:            pair.State,
+		Public:           pair.Public,
+		EncryptedPrivate: encrypted,
+		CreatedAt:        pair.CreatedAt,
+		RotatedAt:        pair.RotatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, keysBucket, pair.ID, data); err != nil {
+		return fmt.Errorf("failed to save key: %w", err)
 	}
 
-	activeKeys[id] = pair
 	return nil
 }
 
+// decodeKey decrypts a key pair read from the jwtKeys bucket
+func decodeKey(data []byte) (*KeyPair, error) {
+	var stored storedKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key: %w", err)
+	}
+
+	private, err := decryptPrivateKey(stored.ID, stored.EncryptedPrivate)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{
+		ID:        stored.ID,
+		Private:   ed25519.PrivateKey(private),
+		Public:    ed25519.PublicKey(stored.Public),
+		State:     stored.State,
+		CreatedAt: stored.CreatedAt,
+		RotatedAt: stored.RotatedAt,
+	}, nil
+}
+
+// encryptPrivateKey seals a private key, binding it to its key ID
+func encryptPrivateKey(kid string, private []byte) ([]byte, error) {
+	gcm, err := newKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	return gcm.Seal(nonce, nonce, private, []byte(kid)), nil
+}
+
+func decryptPrivateKey(kid string, sealed []byte) ([]byte, error) {
+	gcm, err := newKeyCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted key %s is too short", kid)
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	private, err := gcm.Open(nil, nonce, ciphertext, []byte(kid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key %s: %w", kid, err)
+	}
+
+	return private, nil
+}
+
+func newKeyCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func keyCount() int {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	return len(activeKeys)
+}
+
+func leader() bool {
+	keyMutex.RLock()
+	defer keyMutex.RUnlock()
+	return isLeader
+}
+
 // generateKeyID generates a new key ID
 func generateKeyID() string {
 	b := make([]byte, 16)
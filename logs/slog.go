@@ -12,7 +12,14 @@ import (
 )
 
 var Logger *slog.Logger
-var LogLevel slog.Level = slog.LevelDebug
+
+// LogLevel is shared by every handler, so changing it applies to the loggers
+// already created
+var LogLevel = func() *slog.LevelVar {
+	level := new(slog.LevelVar)
+	level.Set(slog.LevelDebug)
+	return level
+}()
 
 // multiWriter implements io.Writer to write to multiple destinations
 type multiWriter struct {
@@ -49,12 +56,12 @@ func (n *natsLogWriter) Write(p []byte) (int, error) {
 type customHandler struct {
 	terminalHandler slog.Handler
 	natsHandler     slog.Handler
-	level           slog.Level
+	level           slog.Leveler
 	natsOnly        bool // if true, only logs to NATS
 }
 
 func (h *customHandler) Enabled(ctx context.Context, level slog.Level) bool {
-	return level >= h.level
+	return level >= h.level.Level()
 }
 
 func (h *customHandler) Handle(ctx context.Context, r slog.Record) error {
@@ -145,10 +152,10 @@ func InitHandler(id string) {
 
 // UpdateLogLevel updates the logging level
 func UpdateLogLevel(ctx context.Context, level int) {
-	LogLevel = slog.Level(level)
-	Logger.Log(ctx, LogLevel, "log level updated",
+	LogLevel.Set(slog.Level(level))
+	Logger.Log(ctx, LogLevel.Level(), "log level updated",
 		slog.String("handler", "UpdateLogLevel"),
-		slog.String("new_level", LogLevel.String()),
+		slog.String("new_level", LogLevel.Level().String()),
 	)
 }
 
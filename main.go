@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
+	"infinirewards/bot"
+	"infinirewards/commands"
+	"infinirewards/config"
 	_ "infinirewards/docs" // This line is necessary for swagger
 	"infinirewards/infinirewards"
 	"infinirewards/jwt"
 	"infinirewards/logs"
+	"infinirewards/media"
+	"infinirewards/middleware"
+	"infinirewards/models"
 	"infinirewards/nats"
+	"infinirewards/notifications"
+	"infinirewards/privacy"
 	"infinirewards/routes"
 	"infinirewards/utils"
+	"infinirewards/worker"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	httpSwagger "github.com/swaggo/http-swagger"
 )
@@ -40,6 +49,11 @@ import (
 //	@name						Authorization
 //	@description				Enter your bearer token in the format **Bearer <token>**
 
+//	@securityDefinitions.apikey	SignedRequest
+//	@in							header
+//	@name						Authorization
+//	@description				Sign each request with an API key in the format **IR1-HMAC-SHA256 Credential=<key id>, Signature=<hex HMAC-SHA256>** and send the X-IR-Timestamp and X-IR-Nonce headers
+
 //	@x-extension-openapi	{"example": "value on a json format"}
 
 // Create a CORS middleware handler
@@ -48,7 +62,7 @@ func corsMiddleware(next http.Handler) http.Handler {
 		// Set CORS headers
 		w.Header().Set("Access-Control-Allow-Origin", "*") // Consider restricting this in production
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-IR-Brand")
 		w.Header().Set("Access-Control-Max-Age", "3600")
 
 		// Handle preflight requests
@@ -77,25 +91,74 @@ func (w *slogWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// reloadConfig loads the configuration again and applies the values that can
+// change while running, the log level and rate limits. It returns the
+// configuration in effect, which is current if the new one is invalid.
+func reloadConfig(current *config.Config) *config.Config {
+	next, err := config.Load()
+	if err == nil {
+		err = models.ConfigureRateLimits(next.RateLimits)
+	}
+	if err != nil {
+		logs.Logger.Error("failed to reload configuration, keeping the current one",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		return current
+	}
+
+	logs.LogLevel.Set(next.Log.Level)
+	logs.Logger.Info("reloaded configuration",
+		slog.String("handler", "main"),
+		slog.String("log_level", next.Log.Level.String()),
+		slog.Int("rate_limits", len(next.RateLimits)),
+	)
+	if sections := current.RestartRequired(next); len(sections) > 0 {
+		logs.Logger.Warn("configuration changes that need a restart were not applied",
+			slog.String("handler", "main"),
+			slog.String("sections", strings.Join(sections, ", ")),
+		)
+	}
+
+	applied := *current
+	applied.Log = next.Log
+	applied.RateLimits = next.RateLimits
+	return &applied
+}
+
 func main() {
 	// Initialize logger
 	logs.InitHandler("")
 
-	logs.Logger.Info("starting server",
-		slog.String("handler", "main"),
-	)
+	// Run a maintenance command instead of the server
+	if len(os.Args) > 1 {
+		os.Exit(commands.Run(os.Args[1:]))
+	}
 
-	// Initialize JWT keys
-	if err := jwt.InitKeys(); err != nil {
-		logs.Logger.Error("failed to initialize JWT keys",
+	cfg, err := config.Load()
+	if err != nil {
+		logs.Logger.Error("failed to load configuration",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	logs.LogLevel.Set(cfg.Log.Level)
+	if err := models.ConfigureRateLimits(cfg.RateLimits); err != nil {
+		logs.Logger.Error("invalid rate limit configuration",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
 		)
 		os.Exit(1)
 	}
 
+	logs.Logger.Info("starting server",
+		slog.String("handler", "main"),
+		slog.String("profile", cfg.Profile),
+	)
+
 	// Initialize Starknet connection
-	if err := infinirewards.ConnectStarknet(); err != nil {
+	if err := infinirewards.ConnectStarknet(cfg.Starknet); err != nil {
 		logs.Logger.Error("failed to connect to Starknet",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
@@ -104,7 +167,7 @@ func main() {
 	}
 
 	// Initialize WhatsApp
-	if err := utils.InitWhatsApp(); err != nil {
+	if err := utils.InitWhatsApp(cfg.WhatsApp); err != nil {
 		logs.Logger.Error("failed to initialize WhatsApp",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
@@ -112,7 +175,7 @@ func main() {
 		os.Exit(1)
 	}
 	// Initialize MacroKiosk
-	if err := utils.InitMacroKiosk(); err != nil {
+	if err := utils.InitMacroKiosk(cfg.MacroKiosk); err != nil {
 		logs.Logger.Error("failed to initialize MacroKiosk",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
@@ -120,7 +183,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := nats.ConnectNats(); err != nil {
+	// Initialize the OTP delivery providers and their routes
+	if err := utils.InitMessageProviders(cfg.OTP); err != nil {
+		logs.Logger.Error("failed to initialize message providers",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	// Initialize WebAuthn
+	if err := utils.InitWebAuthn(cfg.WebAuthn); err != nil {
+		logs.Logger.Error("failed to initialize WebAuthn",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	// Initialize the pepper used to hash phone numbers
+	if err := utils.InitPhoneNumberPepper(cfg.Secrets.PhoneNumberPepper); err != nil {
+		logs.Logger.Error("failed to initialize phone number pepper",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	if err := nats.ConnectNats(cfg.NATS); err != nil {
 		logs.Logger.Error("failed to connect to NATS",
 			slog.String("handler", "main"),
 			slog.String("error", err.Error()),
@@ -128,6 +218,66 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Initialize JWT keys, which are shared by all replicas through NATS KV
+	if err := jwt.InitKeys(cfg.Secrets.JWTKeyEncryptionKey); err != nil {
+		logs.Logger.Error("failed to initialize JWT keys",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	// Process queued webhooks
+	if err := worker.Start(); err != nil {
+		logs.Logger.Error("failed to start webhook worker",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	// Notify users of reward events
+	if err := notifications.Start(); err != nil {
+		logs.Logger.Error("failed to start notification service",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+
+	// Only trust client IP headers when running behind a reverse proxy
+	middleware.TrustProxyHeaders = cfg.Server.TrustProxyHeaders
+
+	// Users that are always admins, used to bootstrap role management
+	models.BootstrapAdminIDs = cfg.Admin.UserIDs
+
+	// Brand whose message templates are used when a request does not name one
+	if cfg.Brand.Default != "" {
+		models.DefaultBrand = cfg.Brand.Default
+	}
+
+	// Merchant whose points and rewards the WhatsApp bot answers with
+	bot.MerchantID = cfg.WhatsApp.BotMerchantID
+
+	// What is done with the on-chain assets of deleted accounts
+	assetPolicy, err := privacy.ParseAssetPolicy(cfg.Deletion.AssetPolicy)
+	if err != nil {
+		logs.Logger.Error("invalid deletion asset policy",
+			slog.String("handler", "main"),
+			slog.String("error", err.Error()),
+		)
+		os.Exit(1)
+	}
+	privacy.DefaultAssetPolicy = assetPolicy
+	privacy.SweepAddress = cfg.Deletion.SweepAddress
+
+	// Largest image accepted by the upload endpoints, in bytes
+	media.MaxUploadSize = cfg.Media.MaxUploadSize
+
+	// Users, merchants, API keys, tokens, verifications, passkeys, rate limits
+	// and the indexes live in the KV buckets
+	stores := models.NewKVStores()
+
 	// Create new ServeMux
 	mux := http.NewServeMux()
 
@@ -135,10 +285,13 @@ func main() {
 	routes.SetAuthRoutes(mux)
 	routes.SetUserRoutes(mux)
 	routes.SetMerchantRoutes(mux)
+	routes.SetAdminRoutes(mux)
 	routes.SetInfiniRewardsRoutes(mux)
+	routes.SetWebhookRoutes(mux)
+	routes.SetMediaRoutes(mux)
 
 	// Only serve Swagger docs in development/staging environments
-	if os.Getenv("ENV") != "production" {
+	if cfg.Server.Environment != "production" {
 		mux.HandleFunc("GET /swagger/*", httpSwagger.Handler(
 			httpSwagger.URL("/swagger/doc.json"),
 			httpSwagger.DeepLinking(true),
@@ -149,8 +302,8 @@ func main() {
 
 	// Create server with proper error logging
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: corsMiddleware(mux),
+		Addr:    cfg.Server.Addr,
+		Handler: corsMiddleware(middleware.WithStores(stores, mux)),
 		ErrorLog: log.New(
 			&slogWriter{
 				logger: logs.Logger.WithGroup("server"),
@@ -158,10 +311,9 @@ func main() {
 			"", // No prefix
 			0,  // No flags since we handle formatting in slog
 		), // Use existing logger
-		// Add reasonable timeouts
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  cfg.Server.ReadTimeout,
+		WriteTimeout: cfg.Server.WriteTimeout,
+		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
 
 	// Start server in goroutine
@@ -178,6 +330,16 @@ func main() {
 		}
 	}()
 
+	// Reload the log level and rate limits on SIGHUP
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	go func() {
+		current := cfg
+		for range reloadCh {
+			current = reloadConfig(current)
+		}
+	}()
+
 	// Handle graceful shutdown
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -187,7 +349,7 @@ func main() {
 		slog.String("handler", "main"),
 	)
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
@@ -198,6 +360,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Leave unfinished webhooks to another replica
+	worker.Stop()
+	notifications.Stop()
+
+	// Hand over key rotation to another replica
+	jwt.StopKeys()
+
 	logs.Logger.Info("server stopped gracefully",
 		slog.String("handler", "main"),
 	)
@@ -0,0 +1,178 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+)
+
+// Limits of uploaded images, set from the configuration in main
+var (
+	// MaxUploadSize is the largest upload accepted, in bytes
+	MaxUploadSize int64 = 5 << 20
+	// MaxPixels is the largest width times height that is decoded, so small
+	// files cannot expand to huge images in memory
+	MaxPixels = 40_000_000
+)
+
+const (
+	// maxDimension is the longest side an image is stored with
+	maxDimension = 2048
+	// ThumbnailDimension is the longest side of thumbnails
+	ThumbnailDimension = 256
+
+	jpegQuality = 85
+)
+
+var (
+	// ErrUnsupportedType is returned for uploads that are not JPEG, PNG or
+	// GIF images
+	ErrUnsupportedType = errors.New("unsupported media type")
+	// ErrTooLarge is returned for uploads or images over the limits
+	ErrTooLarge = errors.New("media is too large")
+	// ErrInvalidImage is returned for uploads that cannot be decoded
+	ErrInvalidImage = errors.New("invalid image")
+)
+
+// decoders are the accepted content types, detected from the data
+var decoders = map[string]func([]byte) (image.Image, error){
+	"image/jpeg": func(data []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(data)) },
+	"image/png":  func(data []byte) (image.Image, error) { return png.Decode(bytes.NewReader(data)) },
+	// Only the first frame of an animated GIF is kept
+	"image/gif": func(data []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(data)) },
+}
+
+// Image is an upload that was re-encoded for storing
+type Image struct {
+	// ContentType is image/jpeg for photos and image/png for the others
+	ContentType string
+	Width       int
+	Height      int
+	Data        []byte
+
+	// Thumbnail has the same content type and fits in ThumbnailDimension
+	Thumbnail []byte
+}
+
+// Process validates an uploaded image and re-encodes it. Decoding and
+// encoding the pixels drops EXIF and every other metadata block, after the
+// EXIF orientation was applied so photos keep showing upright.
+func Process(data []byte) (*Image, error) {
+	if int64(len(data)) > MaxUploadSize {
+		return nil, ErrTooLarge
+	}
+
+	// The type is sniffed from the data rather than trusted from the client
+	contentType := http.DetectContentType(data)
+	decode, ok := decoders[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedType, contentType)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrInvalidImage
+	}
+	if config.Width*config.Height > MaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels", ErrTooLarge, config.Width, config.Height)
+	}
+
+	decoded, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	img := toRGBA(decoded)
+	if contentType == "image/jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	img = fit(img, maxDimension)
+
+	result := &Image{
+		ContentType: "image/png",
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}
+	if contentType == "image/jpeg" {
+		result.ContentType = "image/jpeg"
+	}
+
+	if result.Data, err = encode(img, result.ContentType); err != nil {
+		return nil, err
+	}
+	if result.Thumbnail, err = encode(fit(img, ThumbnailDimension), result.ContentType); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func encode(img image.Image, contentType string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode image: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// toRGBA copies img to an RGBA image whose bounds start at the origin
+func toRGBA(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// fit scales img down so its longest side is at most size. Each pixel is the
+// average of the pixels it covers. Smaller images are returned as they are.
+func fit(img *image.RGBA, size int) *image.RGBA {
+	srcW, srcH := img.Bounds().Dx(), img.Bounds().Dy()
+	if srcW <= size && srcH <= size {
+		return img
+	}
+
+	dstW, dstH := size, srcH*size/srcW
+	if srcH > srcW {
+		dstW, dstH = srcW*size/srcH, size
+	}
+	dstW, dstH = max(dstW, 1), max(dstH, 1)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, max((y+1)*srcH/dstH, y*srcH/dstH+1)
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, max((x+1)*srcW/dstW, x*srcW/dstW+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := img.Pix[sy*img.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += uint64(p[0])
+					g += uint64(p[1])
+					b += uint64(p[2])
+					a += uint64(p[3])
+					n++
+				}
+			}
+
+			p := dst.Pix[y*dst.Stride+x*4 : y*dst.Stride+x*4+4]
+			p[0], p[1], p[2], p[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/utils"
+)
+
+// auditEventKey holds the audit event of the request
+var auditEventKey = contextKey{"audit_event"}
+
+// AuditRecordTimeout bounds how long recording an audit event may wait for
+// the appends of other requests. Events are appended one at a time to keep
+// the hash chain, so a slow append holds up every mutating request behind
+// it; the bound keeps that stall to a few seconds. The response was already
+// sent when an event is recorded, so an event that runs out of time is not
+// dropped silently but logged in full and alerted on, see
+// alertAuditEventLost
+var AuditRecordTimeout = 5 * time.Second
+
+// maxAuditDrain bounds how much of a body the handler did not read is
+// still read to complete the request hash
+const maxAuditDrain = 1 << 20
+
+// statusRecorder remembers the status code written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Audit records every request to the audit log once it was handled, with
+// who sent it, how it was authenticated and how it ended. route is the
+// pattern of the route. Requests to merchant routes are recorded under the
+// caller's merchant. It must be wrapped by AuthMiddleware.
+func Audit(route string, merchantRoute bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// The body is hashed as the handler reads it rather than read up
+		// front, so the size limits of the handler still apply
+		hash := sha256.New()
+		io.WriteString(hash, r.Method+" "+r.URL.RequestURI()+"\n")
+		body := r.Body
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(body, hash), body}
+
+		event := &models.AuditEvent{
+			AuthMethod: models.AuthMethodBearer,
+			IP:         GetClientIP(r),
+			Route:      route,
+			Path:       r.URL.Path,
+		}
+		event.Actor, _ = GetUserIDFromContext(ctx)
+		if apiKeyID, ok := ctx.Value(apiKeyIDKey).(string); ok {
+			event.AuthMethod = models.AuthMethodAPIKey
+			event.APIKeyID = apiKeyID
+		}
+		if merchantRoute {
+			// A merchant shares the ID of the user it belongs to
+			event.Merchant = event.Actor
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(ctx, auditEventKey, event)))
+
+		// Hash what the handler left unread, up to a bound, so the hash
+		// covers the whole body of ordinary requests
+		io.Copy(hash, io.LimitReader(body, maxAuditDrain))
+		event.RequestHash = hex.EncodeToString(hash.Sum(nil))
+
+		event.Status = recorder.status
+		if event.Status == 0 {
+			event.Status = http.StatusOK
+		}
+		event.Outcome = models.AuditOutcomeSuccess
+		if event.Status >= http.StatusBadRequest {
+			event.Outcome = models.AuditOutcomeFailure
+		}
+
+		// The response was sent, so the event is recorded even if the
+		// client went away, bounded so a stuck stream does not pile up
+		// requests
+		recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), AuditRecordTimeout)
+		defer cancel()
+		if err := models.RecordAuditEvent(recordCtx, event); err != nil {
+			alertAuditEventLost(route, event, err)
+		}
+	}
+}
+
+// alertAuditEventLost logs an event that could not be recorded, in full so
+// that it can be appended by hand, and alerts the operators, as the audit log
+// is expected to hold every mutating request
+func alertAuditEventLost(route string, event *models.AuditEvent, err error) {
+	data, _ := json.Marshal(event)
+	logs.Logger.Error("failed to record audit event",
+		slog.String("handler", "Audit"),
+		slog.String("route", route),
+		slog.String("actor", event.Actor),
+		slog.String("event", string(data)),
+		slog.String("error", err.Error()),
+	)
+
+	go func() {
+		message := fmt.Sprintf("Audit event %s for %s by %s was not recorded: %v", event.ID, route, event.Actor, err)
+		if err := utils.SendDiscordMessage(message); err != nil {
+			logs.Logger.Error("failed to send audit alert",
+				slog.String("handler", "Audit"),
+				slog.String("error", err.Error()),
+			)
+		}
+	}()
+}
+
+// AuditTransaction records the on-chain transaction a request sent in its
+// audit event
+func AuditTransaction(ctx context.Context, txHash string) {
+	if event, ok := ctx.Value(auditEventKey).(*models.AuditEvent); ok {
+		event.TransactionHash = txHash
+	}
+}
@@ -2,13 +2,19 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"infinirewards/jwt"
 	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/utils"
 )
 
 // Define a custom type for context keys
@@ -19,8 +25,42 @@ type contextKey struct {
 // Define the user ID key as a variable
 var userIDKey = contextKey{"user_id"}
 
+// claimsKey holds the verified token claims
+var claimsKey = contextKey{"claims"}
+
+// apiKeyIDKey holds the ID of the API key that signed the request
+var apiKeyIDKey = contextKey{"api_key_id"}
+
+// TrustProxyHeaders makes GetClientIP honour X-Forwarded-For and X-Real-IP.
+// Only enable it when the server is reachable exclusively through a proxy
+// that overwrites these headers, otherwise clients can spoof their address.
+var TrustProxyHeaders = false
+
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// Server-to-server integrations sign each request with an API key
+		if utils.IsSignedRequest(r) {
+			claims, apiKeyID, err := verifySignedRequest(w, r)
+			if err != nil {
+				logs.Logger.Error("Failed to verify signed request",
+					slog.String("error", err.Error()),
+				)
+				var tooLarge *http.MaxBytesError
+				if errors.As(err, &tooLarge) {
+					http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, "Invalid signature", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), userIDKey, claims.Subject)
+			ctx = context.WithValue(ctx, claimsKey, claims)
+			ctx = context.WithValue(ctx, apiKeyIDKey, apiKeyID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if !strings.HasPrefix(authHeader, "Bearer ") {
 			http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
@@ -41,10 +81,101 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 
 		// Add the user ID from claims to the context using the custom key
 		ctx := context.WithValue(r.Context(), userIDKey, claims.Subject)
+		ctx = context.WithValue(ctx, claimsKey, claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
 
+// verifySignedRequest authenticates a request signed with an API key secret
+// and returns the claims of the key's user and the ID of the key. The body is
+// only read for fresh requests of known keys, and the nonce is only recorded
+// once the signature is valid so it cannot be burned by anyone else.
+func verifySignedRequest(w http.ResponseWriter, r *http.Request) (*jwt.Claims, string, error) {
+	signed, err := utils.ParseSignedRequest(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if skew := time.Since(signed.Timestamp); skew > utils.RequestSigningWindow || skew < -utils.RequestSigningWindow {
+		return nil, "", fmt.Errorf("timestamp is outside the replay window")
+	}
+
+	apiKey, err := models.GetAPIKey(r.Context(), signed.KeyID)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := signed.HashBody(w, r); err != nil {
+		return nil, "", err
+	}
+	if !signed.Verify(apiKey.Secret) {
+		return nil, "", fmt.Errorf("signature mismatch for API key %s", apiKey.ID)
+	}
+
+	if err := models.UseRequestNonce(r.Context(), apiKey.ID, signed.Nonce); err != nil {
+		return nil, "", err
+	}
+
+	user := models.User{}
+	if err := user.GetUser(r.Context(), apiKey.UserID); err != nil {
+		return nil, "", err
+	}
+	roles, permissions := user.RoleClaims(r.Context())
+
+	return jwt.NewClaims(user.ID, roles, permissions), apiKey.ID, nil
+}
+
+// RequireRole only lets requests through whose token grants role. It must be
+// wrapped by AuthMiddleware.
+func RequireRole(role models.Role, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasRole(r.Context(), role) {
+			logs.Logger.Warn("Missing required role",
+				slog.String("role", string(role)),
+				slog.String("path", r.URL.Path),
+			)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// RequirePermission only lets requests through whose token grants
+// permission. It must be wrapped by AuthMiddleware.
+func RequirePermission(permission models.Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !HasPermission(r.Context(), permission) {
+			logs.Logger.Warn("Missing required permission",
+				slog.String("permission", string(permission)),
+				slog.String("path", r.URL.Path),
+			)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// WithStores makes the handlers and models read and write stores while they
+// serve a request. It wraps the whole router of a server.
+func WithStores(stores *models.Stores, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(models.WithStores(r.Context(), stores)))
+	})
+}
+
+// HasRole reports whether the token of the request grants role
+func HasRole(ctx context.Context, role models.Role) bool {
+	claims, ok := ctx.Value(claimsKey).(*jwt.Claims)
+	return ok && slices.Contains(claims.Roles, string(role))
+}
+
+// HasPermission reports whether the token of the request grants permission
+func HasPermission(ctx context.Context, permission models.Permission) bool {
+	claims, ok := ctx.Value(claimsKey).(*jwt.Claims)
+	return ok && slices.Contains(claims.Permissions, string(permission))
+}
+
 func GetUserIDFromContext(ctx context.Context) (string, error) {
 	userID, ok := ctx.Value(userIDKey).(string)
 	if !ok {
@@ -52,3 +183,21 @@ func GetUserIDFromContext(ctx context.Context) (string, error) {
 	}
 	return userID, nil
 }
+
+// GetClientIP returns the IP address of the client that sent the request
+func GetClientIP(r *http.Request) string {
+	if TrustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return strings.TrimSpace(realIP)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const accountIndexBucket = "accountIndex"
+
+// NormalizeAccountAddress returns an account address as a zero padded, lower
+// case felt, so the same account is indexed once however it was written
+func NormalizeAccountAddress(address string) (string, error) {
+	value, ok := new(big.Int).SetString(strings.TrimPrefix(strings.ToLower(address), "0x"), 16)
+	if !ok || value.Sign() < 0 {
+		return "", fmt.Errorf("invalid account address %q", address)
+	}
+	return fmt.Sprintf("0x%064x", value), nil
+}
+
+// IndexAccountAddress records the user an on-chain account belongs to
+func IndexAccountAddress(ctx context.Context, address string, userID string) error {
+	key, err := NormalizeAccountAddress(address)
+	if err != nil {
+		return err
+	}
+
+	if err := StoresFrom(ctx).AccountIndex.PutEntry(ctx, key, userID); err != nil {
+		return fmt.Errorf("failed to index account address: %w", err)
+	}
+
+	return nil
+}
+
+// LookupAccountAddress returns the ID of the user an on-chain account belongs to
+func LookupAccountAddress(ctx context.Context, address string) (string, error) {
+	key, err := NormalizeAccountAddress(address)
+	if err != nil {
+		return "", err
+	}
+
+	entry, err := StoresFrom(ctx).AccountIndex.GetEntry(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("failed to get account owner: %w", err)
+	}
+
+	return ResolveUserID(ctx, entry.ID), nil
+}
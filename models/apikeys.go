@@ -2,18 +2,24 @@ package models
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"infinirewards/nats"
 	"infinirewards/utils"
+	"strings"
 	"time"
 
-	"github.com/nats-io/nats.go/jetstream"
 	"github.com/oklog/ulid/v2"
 )
 
 const KV_BUCKET = "apikeys"
 
+// requestNoncesBucket holds the nonces of signed requests for the replay window
+const requestNoncesBucket = "requestNonces"
+
+// ErrNonceUsed is returned when a signed request is replayed
+var ErrNonceUsed = errors.New("nonce already used")
+
 type APIKey struct {
 	ID        string    `json:"id"`
 	UserID    string    `json:"userId"`
@@ -21,6 +27,9 @@ type APIKey struct {
 	Secret    string    `json:"secret"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
+
+	// SchemaVersion is the version of the stored document's schema
+	SchemaVersion int `json:"schemaVersion"`
 }
 
 type CreateAPIKeyRequest struct {
@@ -49,68 +58,104 @@ func CreateAPIKey(ctx context.Context, userID string, name string) (*APIKey, err
 		UpdatedAt: time.Now(),
 	}
 
-	// Store the API key using hierarchical subject
-	subject := apiKey.ID
-	data, err := json.Marshal(apiKey)
-	if err != nil {
-		return nil, err
-	}
-
-	if err := nats.PutKV(ctx, KV_BUCKET, subject, data); err != nil {
+	// Keys are stored under the user's ID so they can be listed per user
+	if err := StoresFrom(ctx).APIKeys.PutAPIKey(ctx, apiKey); err != nil {
 		return nil, err
 	}
 
 	return apiKey, nil
 }
 
-// ListAPIKeys lists all API keys for a user
-func ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
-	prefix := fmt.Sprintf("%s.*", userID)
-	transformFunc := func(entry jetstream.KeyValueEntry, apiKey *APIKey) {
+// ListAPIKeys returns a page of the API keys of a user, oldest first
+func ListAPIKeys(ctx context.Context, userID string, opts ListOptions) (*Page[APIKey], error) {
+	// Key IDs end with a ULID, so key order is creation order
+	apiKeys, next, err := StoresFrom(ctx).APIKeys.PageAPIKeys(ctx, userID, opts.query(OrderKey, false))
+	if err != nil {
+		return nil, err
+	}
+	for _, apiKey := range apiKeys {
 		apiKey.Secret = "" // Remove secret before returning
 	}
 
-	apiKeys, err := nats.GetKVValues[APIKey](ctx, KV_BUCKET, prefix, transformFunc)
+	return &Page[APIKey]{Items: apiKeys, NextCursor: next}, nil
+}
+
+// DeleteUserAPIKeys deletes all API keys of a user and returns how many were
+// deleted
+func DeleteUserAPIKeys(ctx context.Context, userID string) (int, error) {
+	keys := StoresFrom(ctx).APIKeys
+	apiKeys, err := keys.ListAPIKeys(ctx, userID)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("failed to list API keys: %w", err)
 	}
 
-	return apiKeys, nil
+	for _, apiKey := range apiKeys {
+		if err := keys.DeleteAPIKey(ctx, apiKey.ID); err != nil {
+			return 0, fmt.Errorf("failed to delete API key: %w", err)
+		}
+	}
+	return len(apiKeys), nil
 }
 
-// DeleteAPIKey deletes an API key
+// DeleteAPIKey deletes an API key. Like GetAPIKey it finds the keys of moved
+// users by the ID they had before the move.
 func DeleteAPIKey(ctx context.Context, keyID string) error {
-	// Get the key first to verify ownership
-	entry, err := nats.GetKV(ctx, KV_BUCKET, keyID)
+	apiKey, err := GetAPIKey(ctx, keyID)
 	if err != nil {
-		return fmt.Errorf("API key not found")
+		if IsNotFound(err) {
+			return fmt.Errorf("API key not found")
+		}
+		return err
 	}
 
-	var apiKey APIKey
-	if err := json.Unmarshal(entry.Value(), &apiKey); err != nil {
-		return err
+	return StoresFrom(ctx).APIKeys.DeleteAPIKey(ctx, apiKey.ID)
+}
+
+// GetAPIKey retrieves an API key, including its secret
+func GetAPIKey(ctx context.Context, keyID string) (*APIKey, error) {
+	keys := StoresFrom(ctx).APIKeys
+	apiKey, err := keys.GetAPIKey(ctx, keyID)
+	if err != nil {
+		// Keys of moved users were re-keyed under their stable ID
+		userID, suffix, _ := strings.Cut(keyID, ".")
+		movedID := ResolveUserID(ctx, userID)
+		if movedID == userID {
+			return nil, fmt.Errorf("API key not found: %w", err)
+		}
+		if apiKey, err = keys.GetAPIKey(ctx, movedID+"."+suffix); err != nil {
+			return nil, fmt.Errorf("API key not found: %w", err)
+		}
 	}
 
-	return nats.RemoveKV(ctx, KV_BUCKET, keyID)
+	return apiKey, nil
 }
 
 // ValidateAPIKey validates an API key and secret
 func ValidateAPIKey(ctx context.Context, keyID, secret string) (*APIKey, error) {
-	entry, err := nats.GetKV(ctx, KV_BUCKET, keyID)
+	apiKey, err := GetAPIKey(ctx, keyID)
 	if err != nil {
-		return nil, fmt.Errorf("API key not found: %w", err)
-	}
-
-	var apiKey APIKey
-	if err := json.Unmarshal(entry.Value(), &apiKey); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal API key: %w", err)
+		return nil, err
 	}
 
 	if apiKey.Secret != secret {
 		return nil, fmt.Errorf("invalid API key secret")
 	}
 
-	return &apiKey, nil
+	return apiKey, nil
+}
+
+// UseRequestNonce records the nonce of a signed request. It fails with
+// ErrNonceUsed when the nonce was already used with the API key within the
+// replay window.
+func UseRequestNonce(ctx context.Context, keyID string, nonce string) error {
+	if _, err := nats.CreateKV(ctx, requestNoncesBucket, keyID+"."+nonce, []byte{}); err != nil {
+		if nats.IsConflict(err) {
+			return ErrNonceUsed
+		}
+		return fmt.Errorf("failed to record nonce: %w", err)
+	}
+
+	return nil
 }
 
 func (r *CreateAPIKeyRequest) Validate() error {
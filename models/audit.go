@@ -0,0 +1,251 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"infinirewards/nats"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/oklog/ulid/v2"
+)
+
+// Authentication methods of audited requests
+const (
+	// AuthMethodBearer is a request authenticated with an access token
+	AuthMethodBearer = "bearer"
+	// AuthMethodAPIKey is a request signed with an API key
+	AuthMethodAPIKey = "apiKey"
+)
+
+// Outcomes of audited requests
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// AuditEvent records a mutating request. Each event holds the hash of the
+// event before it in the audit stream, so changing, removing or reordering
+// events breaks the chain.
+type AuditEvent struct {
+	// Sequence is the position of the event in the audit stream
+	// example: 42
+	Sequence uint64 `json:"sequence"`
+
+	// ID identifies the event
+	// example: 01J8X5K3ZJ0000000000000000
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+
+	// Actor is the ID of the user that sent the request
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	Actor string `json:"actor"`
+
+	// AuthMethod is how the request was authenticated, bearer or apiKey
+	// example: bearer
+	AuthMethod string `json:"authMethod"`
+
+	// APIKeyID is the API key that signed the request
+	APIKeyID string `json:"apiKeyId,omitempty"`
+
+	// Merchant is the ID of the merchant the request acted as, if any
+	Merchant string `json:"merchant,omitempty"`
+
+	// IP is the address of the client
+	// example: 203.0.113.7
+	IP string `json:"ip"`
+
+	// Route is the pattern of the route
+	// example: POST /points/mint
+	Route string `json:"route"`
+
+	// Path is the path of the request
+	// example: /points/mint
+	Path string `json:"path"`
+
+	// RequestHash is the SHA-256 of the method, URL and body of the request.
+	// Of a body the handler stopped reading, such as one over its size limit,
+	// at most 1 MiB more is hashed.
+	RequestHash string `json:"requestHash"`
+
+	// TransactionHash is the on-chain transaction the request sent, if any
+	TransactionHash string `json:"transactionHash,omitempty"`
+
+	// Status is the HTTP status of the response
+	// example: 200
+	Status int `json:"status"`
+
+	// Outcome is success or failure
+	// example: success
+	Outcome string `json:"outcome"`
+
+	// PrevHash is the Hash of the event before it, empty for the first event
+	PrevHash string `json:"prevHash"`
+
+	// Hash is the SHA-256 of PrevHash and the event without Hash
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the chain hash of the event
+func (e *AuditEvent) computeHash() (string, error) {
+	unhashed := *e
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit event: %w", err)
+	}
+
+	sum := sha256.Sum256(append([]byte(e.PrevHash), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// RecordAuditEvent appends an event to the audit stream, chained to the last
+// event. The sequence, ID, hashes and time are set on event. A conflict with
+// another replica is retried until ctx is done.
+func RecordAuditEvent(ctx context.Context, event *AuditEvent) error {
+	if event.ID == "" {
+		event.ID = ulid.Make().String()
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	_, err := nats.AppendStream(ctx, nats.AuditStream, func(last *jetstream.RawStreamMsg, seq uint64) (*natsgo.Msg, error) {
+		event.Sequence = seq
+		event.PrevHash = ""
+		if last != nil {
+			var prev AuditEvent
+			if err := json.Unmarshal(last.Data, &prev); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal last audit event: %w", err)
+			}
+			event.PrevHash = prev.Hash
+		}
+
+		hash, err := event.computeHash()
+		if err != nil {
+			return nil, err
+		}
+		event.Hash = hash
+
+		msg := natsgo.NewMsg(nats.AuditSubject(event.Merchant, event.Actor))
+		msg.Data, err = json.Marshal(event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal audit event: %w", err)
+		}
+		return msg, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record audit event: %w", err)
+	}
+	return nil
+}
+
+// AuditFilter selects the events of ListAuditEvents. Empty fields match all
+// events.
+type AuditFilter struct {
+	// Merchant matches the events of requests acting as the merchant
+	Merchant string
+	// Actor matches the events of requests sent by the user
+	Actor string
+}
+
+// ListAuditEvents returns a page of the audit events that match filter,
+// oldest first
+func ListAuditEvents(ctx context.Context, filter AuditFilter, opts ListOptions) (*Page[AuditEvent], error) {
+	page := &Page[AuditEvent]{Items: []*AuditEvent{}}
+	query := nats.StreamQuery{Subject: nats.AuditSubjectFilter(filter.Merchant, filter.Actor), Limit: opts.limit(), Cursor: opts.Cursor}
+	next, err := nats.QueryStream(ctx, nats.AuditStream, query, func(msg *jetstream.RawStreamMsg) (bool, error) {
+		var event AuditEvent
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			return false, fmt.Errorf("failed to unmarshal audit event %d: %w", msg.Sequence, err)
+		}
+		page.Items = append(page.Items, &event)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page.NextCursor = next
+	return page, nil
+}
+
+// AuditVerification is the result of checking the hash chain of the audit
+// stream
+type AuditVerification struct {
+	// Valid is false if an event was changed, removed or reordered
+	Valid bool `json:"valid"`
+
+	// Checked is the number of events whose hash was checked
+	Checked int `json:"checked"`
+
+	// FirstSequence and LastSequence are the events that were checked.
+	// Events that expired are not checked, so the chain starts at the
+	// oldest event that is still stored.
+	FirstSequence uint64 `json:"firstSequence"`
+	LastSequence  uint64 `json:"lastSequence"`
+
+	// BrokenAt is the sequence of the first event that does not fit the chain
+	BrokenAt uint64 `json:"brokenAt,omitempty"`
+	// Reason is why the chain is broken
+	Reason string `json:"reason,omitempty"`
+}
+
+// VerifyAuditChain checks that every stored audit event holds its own hash
+// and the hash of the event before it
+func VerifyAuditChain(ctx context.Context) (*AuditVerification, error) {
+	state, err := nats.StreamState(ctx, nats.AuditStream)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AuditVerification{Valid: true}
+	var prev *AuditEvent
+	err = nats.ReadStream(ctx, nats.AuditStream, state.LastSeq, func(msg *jetstream.RawStreamMsg) error {
+		if !result.Valid {
+			return nil
+		}
+		broken := func(reason string) {
+			result.Valid = false
+			result.BrokenAt = msg.Sequence
+			result.Reason = reason
+		}
+
+		var event AuditEvent
+		if err := json.Unmarshal(msg.Data, &event); err != nil {
+			broken("event is not valid JSON")
+			return nil
+		}
+		if result.FirstSequence == 0 {
+			result.FirstSequence = msg.Sequence
+		}
+		result.LastSequence = msg.Sequence
+		result.Checked++
+
+		hash, err := event.computeHash()
+		if err != nil {
+			return err
+		}
+		switch {
+		case event.Sequence != msg.Sequence:
+			broken(fmt.Sprintf("event claims sequence %d", event.Sequence))
+		case hash != event.Hash:
+			broken("event does not match its hash")
+		case prev != nil && prev.Sequence+1 != event.Sequence:
+			broken(fmt.Sprintf("events after %d are missing", prev.Sequence))
+		case prev != nil && event.PrevHash != prev.Hash:
+			broken("event does not follow the event before it")
+		}
+		prev = &event
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
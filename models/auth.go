@@ -1,6 +1,11 @@
 package models
 
-import "time"
+import (
+	"context"
+	"fmt"
+	"infinirewards/utils"
+	"time"
+)
 
 type Token struct {
 	ID          string `json:"id"`
@@ -12,19 +17,31 @@ type Token struct {
 	Device             string    `json:"device"`
 	Service            string    `json:"service"`
 	CreatedAt          time.Time `json:"createdAt"`
+
+	// SchemaVersion is the version of the stored document's schema
+	SchemaVersion int `json:"schemaVersion"`
 }
 
 type PhoneNumberVerification struct {
-	ID        string    `json:"id"`
-	Secret    string    `json:"secret"`
-	User      string    `json:"user"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+	User   string `json:"user"`
+	// Purpose is empty for login and VerificationPurposePhoneChange for a phone number change
+	Purpose string `json:"purpose,omitempty"`
+	// DeliveryID is the ID of the delivery record of the code
+	DeliveryID string    `json:"deliveryId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
 }
 
 type RequestOTPRequest struct {
 	// PhoneNumber must be in E.164 format (e.g. +60123456789)
 	// example: +60123456789
 	PhoneNumber string `json:"phoneNumber" validate:"required,e164"`
+
+	// Channel restricts delivery to whatsapp or sms, e.g. to resend by SMS
+	// when WhatsApp delivery failed. Any channel is used when it is empty.
+	// example: sms
+	Channel string `json:"channel,omitempty" validate:"omitempty,oneof=whatsapp sms"`
 }
 
 type RequestOTPResponse struct {
@@ -41,6 +58,24 @@ type RefreshTokenResponse struct {
 	Creds string `json:"creds"`
 }
 
+type NATSCredsRequest struct {
+	// Device names the device the credentials are issued to
+	// example: device_123
+	Device string `json:"device" validate:"required"`
+}
+
+type NATSCredsResponse struct {
+	// Creds is a NATS credentials file for connecting to the realtime server
+	Creds string `json:"creds"`
+
+	// Subjects lists the subjects the credentials may subscribe to
+	// example: ["users.0x1234.notifications"]
+	Subjects []string `json:"subjects"`
+
+	// Expires is the time the credentials stop being accepted
+	Expires time.Time `json:"expires"`
+}
+
 type AuthenticateRequest struct {
 	// ID is either a verification ID (for OTP) or API key ID
 	// example: 01HNAJ6640M9JRRJFQSZZVE3HH
@@ -75,6 +110,12 @@ func (r *RequestOTPRequest) Validate() error {
 		}
 	}
 	// Add phone number format validation if needed
+	if r.Channel != "" && r.Channel != utils.ChannelWhatsApp && r.Channel != utils.ChannelSMS {
+		return &ValidationError{
+			Field:   "channel",
+			Message: "channel must be whatsapp or sms",
+		}
+	}
 	return nil
 }
 
@@ -88,6 +129,22 @@ func (r *RefreshTokenRequest) Validate() error {
 	return nil
 }
 
+func (r *NATSCredsRequest) Validate() error {
+	if r.Device == "" {
+		return &ValidationError{
+			Field:   "device",
+			Message: "device is required",
+		}
+	}
+	if len(r.Device) > 100 {
+		return &ValidationError{
+			Field:   "device",
+			Message: "device must be less than 100 characters",
+		}
+	}
+	return nil
+}
+
 func (r *AuthenticateRequest) Validate() error {
 	if r.ID == "" {
 		return &ValidationError{
@@ -115,3 +172,47 @@ func (r *AuthenticateRequest) Validate() error {
 	}
 	return nil
 }
+
+// ListUserTokens returns the tokens issued to a user
+func ListUserTokens(ctx context.Context, userID string) ([]*Token, error) {
+	tokens, err := StoresFrom(ctx).Tokens.ListUserTokens(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// IndexUserTokens indexes every stored token under the user it was issued to,
+// so that tokens issued before the index existed are found by ListUserTokens.
+// It returns how many tokens were indexed.
+func IndexUserTokens(ctx context.Context) (int, error) {
+	tokens := StoresFrom(ctx).Tokens
+	all, err := tokens.ListTokens(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list tokens: %w", err)
+	}
+
+	for _, token := range all {
+		if err := tokens.IndexToken(ctx, token); err != nil {
+			return 0, fmt.Errorf("failed to index token: %w", err)
+		}
+	}
+	return len(all), nil
+}
+
+// RevokeUserTokens deletes the tokens issued to a user, so they can no longer
+// be refreshed, and returns how many were deleted. Access tokens that were
+// already issued stay valid until they expire.
+func RevokeUserTokens(ctx context.Context, userID string) (int, error) {
+	tokens, err := ListUserTokens(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, token := range tokens {
+		if err := StoresFrom(ctx).Tokens.DeleteToken(ctx, token.ID); err != nil {
+			return 0, fmt.Errorf("failed to revoke token: %w", err)
+		}
+	}
+	return len(tokens), nil
+}
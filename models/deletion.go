@@ -0,0 +1,152 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"time"
+)
+
+const (
+	accountDeletionsBucket = "accountDeletions"
+	tombstonesBucket       = "tombstones"
+)
+
+// ErrDeletionInProgress is returned when an account deletion was changed by
+// another deletion of the same account
+var ErrDeletionInProgress = errors.New("account deletion is already in progress")
+
+// AccountDeletion is the progress of the deletion of an account. Its steps run
+// in order and each is recorded when it completes, so a deletion that failed
+// or was interrupted resumes at the first step that did not complete.
+type AccountDeletion struct {
+	UserID string `json:"userId"`
+
+	// AccountAddress is the user's on-chain account, kept for the tombstone
+	AccountAddress string `json:"accountAddress,omitempty"`
+
+	// AssetPolicy is what is done with the on-chain assets of the account
+	AssetPolicy string `json:"assetPolicy"`
+
+	Steps []DeletionStep `json:"steps"`
+
+	// Running is set while a deletion runs its steps. A running deletion
+	// that was not saved for a while was interrupted and may be resumed.
+	Running bool `json:"running"`
+
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Revision is the KV revision the deletion was read at
+	Revision uint64 `json:"-"`
+}
+
+// DeletionStep is one step of an account deletion
+type DeletionStep struct {
+	// Name identifies the step
+	// example: revokeSessions
+	Name string `json:"name"`
+
+	// CompletedAt is set once the step completed
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+
+	// Removed counts the records the step deleted
+	Removed int `json:"removed,omitempty"`
+
+	// Transactions are the hashes of the on-chain transactions of the step
+	Transactions []string `json:"transactions,omitempty"`
+
+	// Error is why the last attempt of the step failed
+	Error string `json:"error,omitempty"`
+}
+
+// Tombstone records that an account was deleted. It holds no personal data.
+type Tombstone struct {
+	UserID         string         `json:"userId"`
+	AccountAddress string         `json:"accountAddress,omitempty"`
+	AssetPolicy    string         `json:"assetPolicy"`
+	Steps          []DeletionStep `json:"steps"`
+	DeletedAt      time.Time      `json:"deletedAt"`
+}
+
+// GetAccountDeletion returns the deletion of an account that has not
+// completed. The error matches IsNotFound if there is none.
+func GetAccountDeletion(ctx context.Context, userID string) (*AccountDeletion, error) {
+	entry, err := nats.GetKV(ctx, accountDeletionsBucket, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var deletion AccountDeletion
+	if err := json.Unmarshal(entry.Value(), &deletion); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal account deletion: %w", err)
+	}
+	deletion.Revision = entry.Revision()
+
+	return &deletion, nil
+}
+
+// SaveAccountDeletion stores the progress of a deletion. A deletion that was
+// not read from the store is created. It fails with ErrDeletionInProgress if
+// the deletion was saved by someone else since it was read.
+func (d *AccountDeletion) SaveAccountDeletion(ctx context.Context) error {
+	d.UpdatedAt = time.Now()
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal account deletion: %w", err)
+	}
+
+	var revision uint64
+	if d.Revision == 0 {
+		revision, err = nats.CreateKV(ctx, accountDeletionsBucket, d.UserID, data)
+	} else {
+		revision, err = nats.UpdateKV(ctx, accountDeletionsBucket, d.UserID, data, d.Revision)
+	}
+	if err != nil {
+		if nats.IsConflict(err) {
+			return ErrDeletionInProgress
+		}
+		return fmt.Errorf("failed to store account deletion: %w", err)
+	}
+
+	d.Revision = revision
+	return nil
+}
+
+// RemoveAccountDeletion removes a deletion once its tombstone was written
+func (d *AccountDeletion) RemoveAccountDeletion(ctx context.Context) error {
+	if err := nats.RemoveKVRevision(ctx, accountDeletionsBucket, d.UserID, d.Revision); err != nil {
+		return fmt.Errorf("failed to remove account deletion: %w", err)
+	}
+	return nil
+}
+
+// PutTombstone records that an account was deleted
+func (t *Tombstone) PutTombstone(ctx context.Context) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tombstone: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, tombstonesBucket, t.UserID, data); err != nil {
+		return fmt.Errorf("failed to store tombstone: %w", err)
+	}
+	return nil
+}
+
+// GetTombstone returns the tombstone of a deleted account. The error matches
+// IsNotFound if the account was not deleted.
+func GetTombstone(ctx context.Context, userID string) (*Tombstone, error) {
+	entry, err := nats.GetKV(ctx, tombstonesBucket, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var tombstone Tombstone
+	if err := json.Unmarshal(entry.Value(), &tombstone); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tombstone: %w", err)
+	}
+	return &tombstone, nil
+}
@@ -0,0 +1,168 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"log/slog"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const messageDeliveriesBucket = "messageDeliveries"
+
+// ErrMessageDeliveryNotFound is returned for status updates of messages that
+// were not sent by this service, or whose record has expired
+var ErrMessageDeliveryNotFound = errors.New("message delivery not found")
+
+// MessageDelivery records the provider that delivered a message and its status.
+// It is keyed by the provider message ID so status callbacks can find it.
+type MessageDelivery struct {
+	ID string `json:"id"`
+	// Reference identifies what the message was sent for, such as a verification ID
+	Reference string `json:"reference,omitempty"`
+	utils.Delivery
+	// FailureReason is the error the provider reported for a failed message
+	FailureReason string    `json:"failureReason,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// OTPStatusResponse is the delivery status of an OTP
+type OTPStatusResponse struct {
+	// ID is the verification ID
+	ID string `json:"id" example:"01HNAJ6640M9JRRJFQSZZVE3HH"`
+	// Status is sent, delivered, read or failed
+	Status utils.DeliveryStatus `json:"status" example:"delivered"`
+	// Channel is whatsapp or sms, or empty in development
+	Channel   string    `json:"channel,omitempty" example:"whatsapp"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// deliveryStatusRank orders statuses so late callbacks cannot move a message back
+var deliveryStatusRank = map[utils.DeliveryStatus]int{
+	utils.DeliveryStatusFailed:    0,
+	utils.DeliveryStatusSent:      1,
+	utils.DeliveryStatusDelivered: 2,
+	utils.DeliveryStatusRead:      3,
+}
+
+// MessageDeliveryID returns the key of the record of a message sent by a provider
+func MessageDeliveryID(provider string, providerMessageID string) string {
+	return provider + "." + base64.RawURLEncoding.EncodeToString([]byte(providerMessageID))
+}
+
+// SendMessage sends a message through its route and records the delivery.
+// Channels the recipient is known not to be on are skipped, unless the
+// message is restricted to one. The record is returned even when every
+// provider failed.
+func SendMessage(ctx context.Context, message utils.Message) (*MessageDelivery, error) {
+	if message.Channel == "" {
+		message.Unreachable = UnreachableChannels(ctx, message.To)
+	}
+
+	delivery, sendErr := utils.SendMessage(message)
+	recordDeliveryReachability(ctx, message.To, delivery)
+
+	record := &MessageDelivery{
+		ID:        ulid.Make().String(),
+		Reference: message.Reference,
+		Delivery:  *delivery,
+	}
+	if delivery.ProviderMessageID != "" {
+		record.ID = MessageDeliveryID(delivery.Provider, delivery.ProviderMessageID)
+	}
+
+	if err := record.CreateMessageDelivery(ctx); err != nil {
+		logs.Logger.Error("failed to record message delivery",
+			slog.String("handler", "SendMessage"),
+			slog.String("reference", message.Reference),
+			slog.String("error", err.Error()),
+		)
+	}
+
+	return record, sendErr
+}
+
+// CreateMessageDelivery stores a delivery record in NATS KV Store
+func (d *MessageDelivery) CreateMessageDelivery(ctx context.Context) error {
+	d.CreatedAt = time.Now()
+	d.UpdatedAt = d.CreatedAt
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message delivery: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, messageDeliveriesBucket, d.ID, data); err != nil {
+		return fmt.Errorf("failed to store message delivery: %w", err)
+	}
+
+	return nil
+}
+
+// GetMessageDelivery retrieves a delivery record by ID from NATS KV Store
+func (d *MessageDelivery) GetMessageDelivery(ctx context.Context, id string) error {
+	entry, err := nats.GetKV(ctx, messageDeliveriesBucket, id)
+	if err != nil {
+		return fmt.Errorf("failed to get message delivery: %w", err)
+	}
+
+	return json.Unmarshal(entry.Value(), d)
+}
+
+// UpdateMessageDeliveryStatus applies a status reported by a provider to the
+// record of one of its messages. Statuses that are older than the stored one
+// are ignored.
+func UpdateMessageDeliveryStatus(ctx context.Context, provider string, providerMessageID string, status utils.DeliveryStatus, reason string) (*MessageDelivery, error) {
+	id := MessageDeliveryID(provider, providerMessageID)
+
+	// Callbacks for the same message may race, so the update is retried on conflict
+	for attempt := 0; attempt < 3; attempt++ {
+		entry, err := nats.GetKV(ctx, messageDeliveriesBucket, id)
+		if err != nil {
+			if nats.IsNotFound(err) {
+				return nil, ErrMessageDeliveryNotFound
+			}
+			return nil, fmt.Errorf("failed to get message delivery: %w", err)
+		}
+
+		var delivery MessageDelivery
+		if err := json.Unmarshal(entry.Value(), &delivery); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message delivery: %w", err)
+		}
+
+		if status == utils.DeliveryStatusFailed {
+			// Only messages that did not reach the device can fail
+			if delivery.Status != utils.DeliveryStatusSent {
+				return &delivery, nil
+			}
+			delivery.FailureReason = reason
+		} else if deliveryStatusRank[status] <= deliveryStatusRank[delivery.Status] {
+			return &delivery, nil
+		}
+		delivery.Status = status
+		delivery.UpdatedAt = time.Now()
+
+		data, err := json.Marshal(delivery)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal message delivery: %w", err)
+		}
+
+		if _, err := nats.UpdateKV(ctx, messageDeliveriesBucket, id, data, entry.Revision()); err != nil {
+			if nats.IsConflict(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to update message delivery: %w", err)
+		}
+
+		return &delivery, nil
+	}
+
+	return nil, fmt.Errorf("failed to update message delivery: too many concurrent updates")
+}
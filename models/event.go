@@ -0,0 +1,90 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"infinirewards/nats"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// EventType identifies what happened in a domain event
+type EventType string
+
+const (
+	// EventPointsMinted is published when a merchant mints points to an account
+	EventPointsMinted EventType = "points.minted"
+	// EventPointsReceived is published when points are transferred to an account
+	EventPointsReceived EventType = "points.received"
+	// EventCollectibleMinted is published when a merchant mints a collectible to an account
+	EventCollectibleMinted EventType = "collectible.minted"
+	// EventCollectibleRedeemed is published when a merchant redeems a collectible of an account
+	EventCollectibleRedeemed EventType = "collectible.redeemed"
+	// EventCollectibleExpiring is published when a collectible held by an account is about to expire
+	EventCollectibleExpiring EventType = "collectible.expiring"
+)
+
+// EventTypes lists the domain events, e.g. for notification preferences
+var EventTypes = []EventType{
+	EventPointsMinted,
+	EventPointsReceived,
+	EventCollectibleMinted,
+	EventCollectibleRedeemed,
+	EventCollectibleExpiring,
+}
+
+// Event is a domain event published to the events stream
+type Event struct {
+	// ID identifies the event. Events with the same ID are only stored once.
+	ID   string    `json:"id"`
+	Type EventType `json:"type"`
+
+	// Account is the address of the account the event happened to
+	Account string `json:"account"`
+
+	// Contract is the points or collectible contract address
+	Contract string `json:"contract"`
+
+	// TokenID is the collectible token ID
+	TokenID string `json:"tokenId,omitempty"`
+
+	// Amount is the number of points or collectibles
+	Amount string `json:"amount"`
+
+	// TransactionHash is the transaction the event happened in
+	TransactionHash string `json:"transactionHash,omitempty"`
+
+	// ExpiresAt is when a collectible expires, if it does
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PublishEvent publishes a domain event. Events of a transaction are
+// identified by the transaction, type and account, so retried publishes of
+// the same event are only stored once.
+func PublishEvent(ctx context.Context, event *Event) error {
+	if event.ID == "" {
+		if event.TransactionHash != "" {
+			event.ID = fmt.Sprintf("%s.%s.%s", event.TransactionHash, event.Type, event.Account)
+		} else {
+			event.ID = ulid.Make().String()
+		}
+	}
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	if _, err := nats.PublishStreamDedup(ctx, nats.EventSubject(string(event.Type)), data, event.ID); err != nil {
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,348 @@
+package models
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	emailIndexBucket    = "emailIndex"
+	merchantIndexBucket = "merchantIndex"
+	contractIndexBucket = "contractIndex"
+)
+
+// IndexClaimGrace is how long a new index entry counts as held by its owner
+// even though the owner's record does not name it yet, so an entry being
+// claimed is not taken over before the record is written
+var IndexClaimGrace = time.Minute
+
+var (
+	// ErrEmailTaken is returned when an email belongs to another user
+	ErrEmailTaken = errors.New("email already in use")
+
+	// ErrAccountAddressTaken is returned when an account address belongs to
+	// another user or merchant
+	ErrAccountAddressTaken = errors.New("account address already in use")
+
+	// ErrContractTaken is returned when a contract address belongs to another merchant
+	ErrContractTaken = errors.New("contract address already in use")
+)
+
+// indexEntry is a key of one of the secondary index buckets
+type indexEntry struct {
+	bucket string
+	key    string
+}
+
+// holdsFunc reports whether the record of owner still names an index entry
+type holdsFunc func(ctx context.Context, owner string, entry indexEntry) bool
+
+// emailIndexKey returns the key an email is indexed by. Emails are encoded
+// because KV keys cannot hold characters such as '@' and '+'.
+func emailIndexKey(email string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strings.ToLower(strings.TrimSpace(email))))
+}
+
+// userIndexEntries returns the index entries a user record names
+func userIndexEntries(u *User) []indexEntry {
+	entries := []indexEntry{}
+	if strings.TrimSpace(u.Email) != "" {
+		entries = append(entries, indexEntry{emailIndexBucket, emailIndexKey(u.Email)})
+	}
+	if address, err := NormalizeAccountAddress(u.AccountAddress); u.AccountAddress != "" && err == nil {
+		entries = append(entries, indexEntry{accountIndexBucket, address})
+	}
+	return entries
+}
+
+// merchantIndexEntries returns the index entries a merchant record names
+func merchantIndexEntries(m *Merchant) []indexEntry {
+	entries := []indexEntry{}
+	if address, err := NormalizeAccountAddress(m.Address); m.Address != "" && err == nil {
+		entries = append(entries, indexEntry{merchantIndexBucket, address})
+	}
+	for _, contract := range slices.Concat(m.PointsContracts, m.CollectibleContracts) {
+		if address, err := NormalizeAccountAddress(contract); err == nil {
+			entries = append(entries, indexEntry{contractIndexBucket, address})
+		}
+	}
+	return entries
+}
+
+func userHolds(ctx context.Context, owner string, entry indexEntry) bool {
+	user, err := StoresFrom(ctx).Users.GetUser(ctx, ResolveUserID(ctx, owner))
+	return err == nil && slices.Contains(userIndexEntries(user), entry)
+}
+
+func merchantHolds(ctx context.Context, owner string, entry indexEntry) bool {
+	merchant, err := StoresFrom(ctx).Merchants.GetMerchant(ctx, ResolveUserID(ctx, owner))
+	return err == nil && slices.Contains(merchantIndexEntries(merchant), entry)
+}
+
+// indexTakenError returns the error for an entry that belongs to someone else
+func indexTakenError(entry indexEntry) error {
+	switch entry.bucket {
+	case emailIndexBucket:
+		return ErrEmailTaken
+	case contractIndexBucket:
+		return ErrContractTaken
+	default:
+		return ErrAccountAddressTaken
+	}
+}
+
+// claimIndexEntry points an index entry at id. An entry of a user that was
+// moved to id is rewritten, and an entry whose owner no longer names it is
+// taken over. It reports whether the entry was written.
+func claimIndexEntry(ctx context.Context, entry indexEntry, id string, holds holdsFunc) (bool, error) {
+	index := StoresFrom(ctx).index(entry.bucket)
+	claimed := false
+	err := nats.RetryOnConflict(ctx, func() error {
+		current, err := index.GetEntry(ctx, entry.key)
+		if IsNotFound(err) {
+			err = index.CreateEntry(ctx, entry.key, id)
+			claimed = err == nil
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		owner := current.ID
+		if owner == id {
+			return nil
+		}
+		if ResolveUserID(ctx, owner) != id &&
+			(time.Since(current.Written) < IndexClaimGrace || holds(ctx, owner, entry)) {
+			return indexTakenError(entry)
+		}
+
+		err = index.UpdateEntry(ctx, entry.key, id, current.Revision)
+		claimed = err == nil
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return claimed, nil
+}
+
+// releaseIndexEntry removes an index entry if it still points at id
+func releaseIndexEntry(ctx context.Context, entry indexEntry, id string) error {
+	index := StoresFrom(ctx).index(entry.bucket)
+	current, err := index.GetEntry(ctx, entry.key)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	if owner := current.ID; owner != id && ResolveUserID(ctx, owner) != id {
+		return nil
+	}
+
+	if err := index.RemoveEntry(ctx, entry.key, current.Revision); err != nil && !nats.IsConflict(err) {
+		return err
+	}
+	return nil
+}
+
+// reindex writes a record together with its index entries. Entries the record
+// gains are claimed before write, and given back if the claim or write
+// fails. Entries it loses are released after write; a release that fails
+// leaves an entry that claims take over and RebuildIndexes removes.
+func reindex(ctx context.Context, id string, previous []indexEntry, current []indexEntry, holds holdsFunc, write func() error) error {
+	claimed := []indexEntry{}
+	rollback := func() {
+		for _, entry := range claimed {
+			releaseIndexEntry(ctx, entry, id)
+		}
+	}
+
+	for _, entry := range current {
+		if slices.Contains(previous, entry) {
+			continue
+		}
+		ok, err := claimIndexEntry(ctx, entry, id, holds)
+		if err != nil {
+			rollback()
+			if errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrAccountAddressTaken) || errors.Is(err, ErrContractTaken) {
+				return err
+			}
+			return fmt.Errorf("failed to index %s: %w", entry.bucket, err)
+		}
+		if ok {
+			claimed = append(claimed, entry)
+		}
+	}
+
+	if err := write(); err != nil {
+		rollback()
+		return err
+	}
+
+	for _, entry := range previous {
+		if !slices.Contains(current, entry) {
+			releaseIndexEntry(ctx, entry, id)
+		}
+	}
+
+	return nil
+}
+
+// lookupIndex returns the ID of the record an index entry points at
+func lookupIndex(ctx context.Context, entry indexEntry) (string, error) {
+	current, err := StoresFrom(ctx).index(entry.bucket).GetEntry(ctx, entry.key)
+	if err != nil {
+		return "", err
+	}
+
+	return ResolveUserID(ctx, current.ID), nil
+}
+
+// GetUserFromEmail retrieves a user by email from the user store
+func (u *User) GetUserFromEmail(ctx context.Context, email string) error {
+	id, err := lookupIndex(ctx, indexEntry{emailIndexBucket, emailIndexKey(email)})
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	return u.GetUser(ctx, id)
+}
+
+// GetMerchantFromAddress retrieves a merchant by its account address from the merchant store
+func (m *Merchant) GetMerchantFromAddress(ctx context.Context, address string) error {
+	key, err := NormalizeAccountAddress(address)
+	if err != nil {
+		return err
+	}
+
+	id, err := lookupIndex(ctx, indexEntry{merchantIndexBucket, key})
+	if err != nil {
+		return fmt.Errorf("failed to get merchant: %w", err)
+	}
+
+	return m.GetMerchant(ctx, id)
+}
+
+// GetMerchantFromContract retrieves the merchant a points or collectible
+// contract belongs to from the merchant store
+func (m *Merchant) GetMerchantFromContract(ctx context.Context, contract string) error {
+	key, err := NormalizeAccountAddress(contract)
+	if err != nil {
+		return err
+	}
+
+	id, err := lookupIndex(ctx, indexEntry{contractIndexBucket, key})
+	if err != nil {
+		return fmt.Errorf("failed to get merchant: %w", err)
+	}
+
+	return m.GetMerchant(ctx, id)
+}
+
+// IndexRebuild is the outcome of RebuildIndexes
+type IndexRebuild struct {
+	// Written is the number of entries that were missing or pointed elsewhere
+	Written int
+
+	// Removed is the number of entries no record names
+	Removed int
+
+	// Duplicates lists the entries named by more than one record; the entry
+	// keeps pointing at the first record found
+	Duplicates []string
+
+	// Tokens is the number of tokens indexed under their user, none for a
+	// dry run
+	Tokens int
+}
+
+// RebuildIndexes regenerates the secondary indexes from the user and merchant
+// records and indexes the tokens by user. With dryRun it only reports what it
+// would change in the secondary indexes.
+func RebuildIndexes(ctx context.Context, dryRun bool) (*IndexRebuild, error) {
+	stores := StoresFrom(ctx)
+	result := &IndexRebuild{}
+
+	desired := map[indexEntry]string{}
+	want := func(id string, entries []indexEntry) {
+		for _, entry := range entries {
+			if owner, ok := desired[entry]; ok && owner != id {
+				result.Duplicates = append(result.Duplicates, entry.bucket+"/"+entry.key)
+				continue
+			}
+			desired[entry] = id
+		}
+	}
+
+	users, err := stores.Users.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	for _, user := range users {
+		want(user.ID, userIndexEntries(user))
+	}
+
+	merchants, err := stores.Merchants.ListMerchants(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list merchants: %w", err)
+	}
+	for _, merchant := range merchants {
+		want(merchant.ID, merchantIndexEntries(merchant))
+	}
+
+	for entry, id := range desired {
+		current, err := stores.index(entry.bucket).GetEntry(ctx, entry.key)
+		if err == nil && current.ID == id {
+			continue
+		}
+		if err != nil && !IsNotFound(err) {
+			return nil, fmt.Errorf("failed to read %s: %w", entry.bucket, err)
+		}
+		result.Written++
+		if dryRun {
+			continue
+		}
+		if err := stores.index(entry.bucket).PutEntry(ctx, entry.key, id); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", entry.bucket, err)
+		}
+	}
+
+	for _, bucket := range []string{emailIndexBucket, accountIndexBucket, merchantIndexBucket, contractIndexBucket} {
+		entries, err := stores.index(bucket).ListEntries(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", bucket, err)
+		}
+		for _, current := range entries {
+			// Entries being claimed are kept until their record is written
+			if _, ok := desired[indexEntry{bucket, current.Key}]; ok || time.Since(current.Written) < IndexClaimGrace {
+				continue
+			}
+			result.Removed++
+			if dryRun {
+				continue
+			}
+			if err := stores.index(bucket).RemoveEntry(ctx, current.Key, current.Revision); err != nil && !nats.IsConflict(err) {
+				return nil, fmt.Errorf("failed to remove from %s: %w", bucket, err)
+			}
+		}
+	}
+
+	if !dryRun {
+		if result.Tokens, err = IndexUserTokens(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.Sort(result.Duplicates)
+	return result, nil
+}
@@ -72,6 +72,10 @@ type GetTokenDataResponse struct {
 	// Metadata is the token's metadata description
 	// example: Limited edition collectible
 	Metadata string `json:"description"`
+
+	// Image is the URL of the image of the token, if it has one
+	// example: /media/01J8X5K3ZJ0000000000000000
+	Image string `json:"image,omitempty"`
 }
 
 // RedeemCollectibleRequest represents a request to redeem a collectible
@@ -495,6 +499,11 @@ type SetTokenDataRequest struct {
 	// Metadata is the token's metadata description
 	// example: Limited edition collectible
 	Metadata string `json:"description" validate:"required,min=1,max=500"`
+
+	// Image is the ID of merchant media shown for the token, uploaded with
+	// POST /merchant/media
+	// example: 01J8X5K3ZJ0000000000000000
+	Image string `json:"image,omitempty"`
 }
 
 type SetTokenDataResponse struct {
@@ -536,6 +545,11 @@ type GetCollectibleDetailsResponse struct {
 	// example: ["Gold","Silver","Bronze"]
 	TokenDescriptions []string `json:"tokenDescriptions"`
 
+	// TokenImages lists the image URL of each token, empty for tokens
+	// without an image
+	// example: ["/media/01J8X5K3ZJ0000000000000000","",""]
+	TokenImages []string `json:"tokenImages"`
+
 	// TokenBalances lists balances for each token
 	// example: ["10","20","30"]
 	TokenBalances []string `json:"tokenBalances"`
@@ -674,6 +688,10 @@ type UpgradePointsContractRequest struct {
 	// PointsContract is the address of the points contract to upgrade
 	// example: 0x1234567890abcdef1234567890abcdef12345678
 	PointsContract string `json:"pointsContract"`
+
+	// MerchantID is the merchant owning the contract, defaults to the caller
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	MerchantID string `json:"merchantId,omitempty"`
 }
 
 // UpgradePointsContractResponse represents the response for upgrading a points contract
@@ -692,6 +710,10 @@ type UpgradeCollectibleContractRequest struct {
 	// CollectibleAddress is the address of the collectible contract to upgrade
 	// example: 0x1234567890abcdef1234567890abcdef12345678
 	CollectibleAddress string `json:"collectibleAddress"`
+
+	// MerchantID is the merchant owning the contract, defaults to the caller
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	MerchantID string `json:"merchantId,omitempty"`
 }
 
 // UpgradeCollectibleContractResponse represents the response for upgrading a collectible contract
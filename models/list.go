@@ -0,0 +1,119 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"infinirewards/nats"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// DefaultListLimit is the page size of lists that are not given a limit
+	DefaultListLimit = 50
+	// MaxListLimit is the largest page size of lists
+	MaxListLimit = 100
+)
+
+// ErrInvalidCursor is returned for list cursors that were not returned by
+// the same list
+var ErrInvalidCursor = nats.ErrInvalidCursor
+
+// ListOptions selects a page of a list
+type ListOptions struct {
+	// Limit is the maximum number of items, DefaultListLimit if zero and at
+	// most MaxListLimit
+	Limit int
+	// Cursor is the nextCursor of the previous page, empty for the first page
+	Cursor string
+}
+
+// Page is a page of a list. NextCursor is passed back to get the next page
+// and is empty on the last page.
+type Page[T any] struct {
+	Items      []*T   `json:"items"`
+	NextCursor string `json:"nextCursor,omitempty" example:"eyJvIjoia2V5IiwiayI6IjAxSjhYIn0"`
+}
+
+// limit returns the page size of the options
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return min(o.Limit, MaxListLimit)
+}
+
+// Order is the order of a page of records
+type Order string
+
+const (
+	// OrderKey sorts records by key
+	OrderKey Order = "key"
+	// OrderCreated sorts records by their createdAt field and then by key
+	OrderCreated Order = "created"
+)
+
+// Query selects a page of the records of a store
+type Query struct {
+	// Limit is the maximum number of records of a page, unlimited if zero
+	Limit int
+	// Cursor is the next cursor of the previous page, empty for the first page
+	Cursor string
+	// Order sorts the records, OrderKey if empty
+	Order      Order
+	Descending bool
+}
+
+// query returns the query of the page in the order of a list
+func (o ListOptions) query(order Order, descending bool) Query {
+	return Query{Limit: o.limit(), Cursor: o.Cursor, Order: order, Descending: descending}
+}
+
+// kvQuery returns the KV query of q over the keys that match filter. The
+// orders are named like those of the KV queries.
+func (q Query) kvQuery(filter string) nats.KVQuery {
+	query := nats.KVQuery{Filter: filter, Limit: q.Limit, Cursor: q.Cursor, Order: nats.KVOrder(q.Order), Descending: q.Descending}
+	if q.Order == OrderCreated {
+		query.CreatedAt = func(entry jetstream.KeyValueEntry) time.Time {
+			return documentCreatedAt(entry.Value(), entry.Created())
+		}
+	}
+	return query
+}
+
+// documentCreatedAt returns the createdAt field of a stored document, or
+// written for documents without one
+func documentCreatedAt(data []byte, written time.Time) time.Time {
+	var doc struct {
+		CreatedAt time.Time `json:"createdAt"`
+	}
+	if json.Unmarshal(data, &doc) != nil || doc.CreatedAt.IsZero() {
+		return written
+	}
+	return doc.CreatedAt
+}
+
+// queryPage decodes the JSON values of a page of the keys of a bucket that
+// match filter, keeping those that match accepts
+func queryPage[T any](ctx context.Context, bucket string, filter string, query Query, match func(value *T) bool) (*Page[T], error) {
+	page := &Page[T]{Items: []*T{}}
+	next, err := nats.QueryKV(ctx, bucket, query.kvQuery(filter), func(entry jetstream.KeyValueEntry) (bool, error) {
+		var value T
+		if err := json.Unmarshal(entry.Value(), &value); err != nil {
+			return false, fmt.Errorf("failed to decode %s: %w", entry.Key(), err)
+		}
+		if match != nil && !match(&value) {
+			return false, nil
+		}
+		page.Items = append(page.Items, &value)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	page.NextCursor = next
+	return page, nil
+}
@@ -0,0 +1,201 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"infinirewards/nats"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	mediaBucket             = "media"
+	collectibleImagesBucket = "collectibleImages"
+)
+
+// Purposes of uploaded media
+const (
+	// MediaPurposeAvatar is a user's avatar, deleted with the user
+	MediaPurposeAvatar = "avatar"
+	// MediaPurposeMerchant is an image of a merchant, such as a collectible
+	// image, kept as long as the merchant
+	MediaPurposeMerchant = "merchant"
+)
+
+// Media is an uploaded image. The image and its thumbnail are kept in the
+// media object store, the record in the media bucket.
+type Media struct {
+	// ID identifies the media
+	// example: 01J8X5K3ZJ0000000000000000
+	ID string `json:"id"`
+
+	// Owner is the ID of the user that uploaded the media. Merchant media is
+	// owned by the merchant's user.
+	// example: 01J8X5K3ZJ0000000000000000
+	Owner string `json:"owner"`
+
+	// Purpose is avatar or merchant
+	// example: avatar
+	Purpose string `json:"purpose"`
+
+	// ContentType of the image and its thumbnail
+	// example: image/jpeg
+	ContentType string `json:"contentType"`
+
+	// Size of the image in bytes
+	// example: 48213
+	Size int `json:"size"`
+
+	// Width and Height of the image in pixels
+	// example: 1024
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// URL serves the image
+	// example: /media/01J8X5K3ZJ0000000000000000
+	URL string `json:"url"`
+
+	// ThumbnailURL serves the thumbnail of the image
+	// example: /media/01J8X5K3ZJ0000000000000000?size=thumbnail
+	ThumbnailURL string `json:"thumbnailUrl"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MediaURL returns the path that serves media
+func MediaURL(id string) string {
+	return "/media/" + id
+}
+
+// mediaObject returns the name of the object holding media or its thumbnail
+func mediaObject(id string, thumbnail bool) string {
+	if thumbnail {
+		return id + "/thumbnail"
+	}
+	return id
+}
+
+// CreateMedia stores an image and its thumbnail, then records them. The ID,
+// size, URLs and time are set on m.
+func (m *Media) CreateMedia(ctx context.Context, data []byte, thumbnail []byte) error {
+	m.ID = ulid.Make().String()
+	m.Size = len(data)
+	m.URL = MediaURL(m.ID)
+	m.ThumbnailURL = MediaURL(m.ID) + "?size=thumbnail"
+	m.CreatedAt = time.Now()
+
+	if _, err := nats.PutObject(ctx, nats.MediaObjectStore, mediaObject(m.ID, false), m.ContentType, data); err != nil {
+		return fmt.Errorf("failed to store media: %w", err)
+	}
+	if _, err := nats.PutObject(ctx, nats.MediaObjectStore, mediaObject(m.ID, true), m.ContentType, thumbnail); err != nil {
+		return fmt.Errorf("failed to store media thumbnail: %w", err)
+	}
+
+	// Objects without a record are never served
+	record, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal media: %w", err)
+	}
+	if err := nats.PutKV(ctx, mediaBucket, m.ID, record); err != nil {
+		return fmt.Errorf("failed to store media record: %w", err)
+	}
+	return nil
+}
+
+// GetMedia returns the record of media. The error matches IsNotFound if there
+// is none.
+func GetMedia(ctx context.Context, id string) (*Media, error) {
+	entry, err := nats.GetKV(ctx, mediaBucket, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var media Media
+	if err := json.Unmarshal(entry.Value(), &media); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal media: %w", err)
+	}
+	return &media, nil
+}
+
+// OpenMedia returns the image of media, or its thumbnail. The caller must
+// close it.
+func (m *Media) OpenMedia(ctx context.Context, thumbnail bool) (jetstream.ObjectResult, error) {
+	return nats.GetObject(ctx, nats.MediaObjectStore, mediaObject(m.ID, thumbnail))
+}
+
+// DeleteMedia removes media and its images
+func (m *Media) DeleteMedia(ctx context.Context) error {
+	if err := nats.RemoveKV(ctx, mediaBucket, m.ID); err != nil && !nats.IsNotFound(err) {
+		return fmt.Errorf("failed to delete media record: %w", err)
+	}
+	for _, thumbnail := range []bool{false, true} {
+		if err := nats.RemoveObject(ctx, nats.MediaObjectStore, mediaObject(m.ID, thumbnail)); err != nil && !nats.IsNotFound(err) {
+			return fmt.Errorf("failed to delete media: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteUserAvatars deletes the avatars a user uploaded and returns how many
+// were deleted. Merchant media stays with the merchant.
+func DeleteUserAvatars(ctx context.Context, userID string) (int, error) {
+	// Media is keyed by ID alone so it can be served, which leaves scanning
+	// the records to find those of a user
+	media, err := nats.GetKVValues(ctx, mediaBucket, ">", func(entry jetstream.KeyValueEntry, media *Media) {})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list media: %w", err)
+	}
+
+	deleted := 0
+	for _, m := range media {
+		if m.Owner != userID || m.Purpose != MediaPurposeAvatar {
+			continue
+		}
+		if err := m.DeleteMedia(ctx); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// collectibleImageKey returns the key of the image of a collectible token
+func collectibleImageKey(contract string, tokenID string) (string, error) {
+	address, err := NormalizeAccountAddress(contract)
+	if err != nil {
+		return "", err
+	}
+	return address + "." + tokenID, nil
+}
+
+// SetCollectibleImage shows media for a collectible token
+func SetCollectibleImage(ctx context.Context, contract string, tokenID string, mediaID string) error {
+	key, err := collectibleImageKey(contract, tokenID)
+	if err != nil {
+		return err
+	}
+	if err := nats.PutKV(ctx, collectibleImagesBucket, key, []byte(mediaID)); err != nil {
+		return fmt.Errorf("failed to store collectible image: %w", err)
+	}
+	return nil
+}
+
+// GetCollectibleImage returns the URL of the image of a collectible token,
+// empty if it has none
+func GetCollectibleImage(ctx context.Context, contract string, tokenID string) (string, error) {
+	key, err := collectibleImageKey(contract, tokenID)
+	if err != nil {
+		return "", err
+	}
+	entry, err := nats.GetKV(ctx, collectibleImagesBucket, key)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to get collectible image: %w", err)
+	}
+	return MediaURL(string(entry.Value())), nil
+}
@@ -2,9 +2,9 @@ package models
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"infinirewards/nats"
+	"strings"
 	"time"
 )
 
@@ -20,6 +20,10 @@ type CreateMerchantRequest struct {
 	// Decimals for the points token
 	// example: 18
 	Decimals uint8 `json:"decimals" validate:"required,gte=0,lte=18"`
+
+	// UserID is the user the merchant is created for, defaults to the caller
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	UserID string `json:"userId,omitempty"`
 }
 
 type CreateMerchantResponse struct {
@@ -41,6 +45,10 @@ type UpgradeMerchantContractRequest struct {
 	// NewClassHash is the class hash of the new implementation contract
 	// example: 0xabcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890
 	NewClassHash string `json:"newClassHash"`
+
+	// MerchantID is the merchant whose contract is upgraded, defaults to the caller
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	MerchantID string `json:"merchantId,omitempty"`
 }
 
 // UpgradeMerchantContractResponse represents the response for upgrading a merchant contract
@@ -58,88 +66,156 @@ type Merchant struct {
 	Decimals  uint8     `json:"decimals"`
 	CreatedAt time.Time `json:"createdAt"`
 	UpdatedAt time.Time `json:"updatedAt"`
+
+	// PointsContracts are the addresses of the points contracts the merchant created
+	PointsContracts []string `json:"pointsContracts,omitempty"`
+
+	// CollectibleContracts are the addresses of the collectible contracts the merchant created
+	CollectibleContracts []string `json:"collectibleContracts,omitempty"`
+
+	// SchemaVersion is the version of the stored document's schema
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Revision is the store revision the merchant was read at, used to
+	// detect concurrent updates
+	Revision uint64 `json:"-"`
 }
 
 const (
 	merchantsBucket = "merchants"
 )
 
-// CreateMerchant creates a new merchant in NATS KV Store
+// CreateMerchant creates a new merchant in the merchant store
 func (m *Merchant) CreateMerchant(ctx context.Context, user *User) error {
-	// Generate ID from phone number hash
-	m.ID = HashPhoneNumber(user.PhoneNumber)
+	// A merchant shares the ID of the user it belongs to
+	m.ID = user.ID
 	m.CreatedAt = time.Now()
 	m.UpdatedAt = time.Now()
 
-	// Store merchant data
-	merchantData, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("failed to marshal merchant: %w", err)
-	}
-
-	// Check for existing merchant
-	existingMerchant := &Merchant{}
-	if err := existingMerchant.GetMerchant(ctx, m.ID); err == nil {
-		return fmt.Errorf("merchant with phone number %s already exists", user.PhoneNumber)
-	}
-
-	if err := nats.PutKV(ctx, merchantsBucket, m.ID, merchantData); err != nil {
+	merchants := StoresFrom(ctx).Merchants
+	if err := reindex(ctx, m.ID, nil, merchantIndexEntries(m), merchantHolds, func() error {
+		return merchants.CreateMerchant(ctx, m)
+	}); err != nil {
+		if nats.IsConflict(err) {
+			return fmt.Errorf("merchant for user %s already exists", user.ID)
+		}
 		return fmt.Errorf("failed to store merchant: %w", err)
 	}
 
 	return nil
 }
 
-// GetMerchant retrieves a merchant by ID from NATS KV Store
+// GetMerchant retrieves a merchant by ID from the merchant store
 func (m *Merchant) GetMerchant(ctx context.Context, id string) error {
-	merchantKV, err := nats.GetKV(ctx, merchantsBucket, id)
+	merchant, err := StoresFrom(ctx).Merchants.GetMerchant(ctx, id)
 	if err != nil {
 		return fmt.Errorf("failed to get merchant: %w", err)
 	}
 
-	return json.Unmarshal(merchantKV.Value(), m)
+	*m = *merchant
+	return nil
 }
 
-// GetMerchantFromPhoneNumber retrieves a merchant by phone number from NATS KV Store
+// GetMerchantFromPhoneNumber retrieves a merchant by phone number from the merchant store
 func (m *Merchant) GetMerchantFromPhoneNumber(ctx context.Context, phoneNumber string) error {
-	// Generate ID from phone number hash
-	id := HashPhoneNumber(phoneNumber)
-
-	// Get merchant data directly using the hashed phone number as ID
-	merchantKV, err := nats.GetKV(ctx, merchantsBucket, id)
+	id, err := LookupPhoneNumber(ctx, phoneNumber)
 	if err != nil {
 		return fmt.Errorf("failed to get merchant: %w", err)
 	}
 
-	return json.Unmarshal(merchantKV.Value(), m)
+	return m.GetMerchant(ctx, id)
 }
 
-// UpdateMerchant updates an existing merchant in NATS KV Store
+// UpdateMerchant writes the merchant back if it was not changed since it was
+// read, and fails with a conflict (nats.IsConflict) otherwise. A merchant
+// that was not read from the merchant store is created. Its address and
+// contract indexes are updated with it.
 func (m *Merchant) UpdateMerchant(ctx context.Context) error {
 	m.UpdatedAt = time.Now()
-	merchantData, err := json.Marshal(m)
-	if err != nil {
-		return fmt.Errorf("failed to marshal merchant: %w", err)
+
+	merchants := StoresFrom(ctx).Merchants
+	previous := []indexEntry{}
+	write := func() error { return merchants.CreateMerchant(ctx, m) }
+	if m.Revision != 0 {
+		stored, err := merchants.GetMerchant(ctx, m.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update merchant: %w", err)
+		}
+		if stored.Revision != m.Revision {
+			return fmt.Errorf("failed to update merchant: %w", nats.ErrConflict)
+		}
+		previous = merchantIndexEntries(stored)
+		write = func() error { return merchants.UpdateMerchant(ctx, m) }
 	}
 
-	if err := nats.PutKV(ctx, merchantsBucket, m.ID, merchantData); err != nil {
+	if err := reindex(ctx, m.ID, previous, merchantIndexEntries(m), merchantHolds, write); err != nil {
 		return fmt.Errorf("failed to update merchant: %w", err)
 	}
 
 	return nil
 }
 
-// DeleteMerchant deletes a merchant from NATS KV Store
+// ModifyMerchant reads a merchant, changes it with fn and writes it back. If
+// the merchant was updated in between, it is read again and fn is called again.
+func ModifyMerchant(ctx context.Context, id string, fn func(merchant *Merchant) error) (*Merchant, error) {
+	merchant := &Merchant{}
+	err := nats.RetryOnConflict(ctx, func() error {
+		if err := merchant.GetMerchant(ctx, id); err != nil {
+			return err
+		}
+		if err := fn(merchant); err != nil {
+			return err
+		}
+		return merchant.UpdateMerchant(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return merchant, nil
+}
+
+// DeleteMerchant deletes a merchant from the merchant store
 func (m *Merchant) DeleteMerchant(ctx context.Context) error {
+	merchants := StoresFrom(ctx).Merchants
+	entries := merchantIndexEntries(m)
+	if stored, err := merchants.GetMerchant(ctx, m.ID); err == nil {
+		entries = merchantIndexEntries(stored)
+	}
 
 	// Delete merchant data
-	if err := nats.RemoveKV(ctx, merchantsBucket, m.ID); err != nil {
+	if err := merchants.DeleteMerchant(ctx, m.ID); err != nil {
 		return fmt.Errorf("failed to delete merchant: %w", err)
 	}
+	for _, entry := range entries {
+		if err := releaseIndexEntry(ctx, entry, m.ID); err != nil {
+			return fmt.Errorf("failed to delete merchant: %w", err)
+		}
+	}
 
 	return nil
 }
 
+// MerchantFilter selects the merchants of SearchMerchants. Empty fields match
+// all merchants.
+type MerchantFilter struct {
+	// Name matches merchants whose name contains it, ignoring case
+	Name string
+}
+
+// SearchMerchants returns a page of the merchants that match filter, newest first
+func SearchMerchants(ctx context.Context, filter MerchantFilter, opts ListOptions) (*Page[Merchant], error) {
+	name := strings.ToLower(filter.Name)
+	merchants, next, err := StoresFrom(ctx).Merchants.PageMerchants(ctx, opts.query(OrderCreated, true), func(merchant *Merchant) bool {
+		return strings.Contains(strings.ToLower(merchant.Name), name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list merchants: %w", err)
+	}
+
+	return &Page[Merchant]{Items: merchants, NextCursor: next}, nil
+}
+
 func (r *CreateMerchantRequest) Validate() error {
 	if r.Name == "" {
 		return &ValidationError{
@@ -0,0 +1,18 @@
+package models
+
+// Migrations of the stored documents, in version order per bucket. A new
+// migration is appended to its bucket with the next version; released
+// migrations are never changed.
+func init() {
+	RegisterMigration(Migration{
+		Bucket:      usersBucket,
+		Version:     1,
+		Description: "Grant the user role to users stored before roles existed",
+		Up: func(doc map[string]any) error {
+			if roles, ok := doc["roles"].([]any); !ok || len(roles) == 0 {
+				doc["roles"] = []any{string(RoleUser)}
+			}
+			return nil
+		},
+	})
+}
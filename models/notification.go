@@ -0,0 +1,465 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	notificationsBucket       = "notifications"
+	notificationDigestsBucket = "notificationDigests"
+	collectibleExpiriesBucket = "collectibleExpiries"
+)
+
+var (
+	// ErrNotificationExists is returned when the notification of an event was already created
+	ErrNotificationExists = errors.New("notification already exists")
+	// ErrNotificationNotFound is returned for notifications that are not in the user's inbox
+	ErrNotificationNotFound = errors.New("notification not found")
+)
+
+// Notification is an entry of a user's in-app inbox
+type Notification struct {
+	// ID is derived from the event, so each event is only notified once
+	// example: 3f2a9c0b7d4e1a6f8b5c2d9e0f1a2b3c
+	ID     string    `json:"id"`
+	UserID string    `json:"userId"`
+	Type   EventType `json:"type" example:"points.minted"`
+
+	// Body is the rendered notification text in the user's locale
+	// example: You received 100 points.
+	Body string `json:"body"`
+
+	// Event is the domain event the notification is about
+	Event Event `json:"event"`
+
+	CreatedAt time.Time `json:"createdAt"`
+
+	// ReadAt is when the user marked the notification read
+	ReadAt *time.Time `json:"readAt,omitempty"`
+
+	// Queued is set once the notification was added to the digest sent by
+	// message, so that a redelivered event adds it only once
+	Queued bool `json:"queued,omitempty"`
+}
+
+// NotificationPreferences controls how a user is notified of reward events
+type NotificationPreferences struct {
+	// Channel is whatsapp or sms to also send notifications by message.
+	// Notifications are only added to the inbox when it is empty.
+	// example: whatsapp
+	Channel string `json:"channel,omitempty"`
+
+	// MutedEvents are only added to the inbox, never sent by message
+	// example: ["points.received"]
+	MutedEvents []EventType `json:"mutedEvents,omitempty"`
+
+	// QuietHours holds back messages until they end
+	QuietHours *QuietHours `json:"quietHours,omitempty"`
+}
+
+// QuietHours is a daily period in which no messages are sent. It may span midnight.
+type QuietHours struct {
+	// Start is the local time quiet hours start at
+	// example: 22:00
+	Start string `json:"start"`
+
+	// End is the local time quiet hours end at
+	// example: 08:00
+	End string `json:"end"`
+
+	// TimeZone is the IANA time zone of Start and End
+	// example: Asia/Kuala_Lumpur
+	TimeZone string `json:"timeZone"`
+}
+
+var clockRegex = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+
+func (p *NotificationPreferences) Validate() error {
+	if p.Channel != "" && p.Channel != utils.ChannelWhatsApp && p.Channel != utils.ChannelSMS {
+		return &ValidationError{
+			Field:   "channel",
+			Message: "channel must be whatsapp, sms or empty",
+		}
+	}
+	for _, eventType := range p.MutedEvents {
+		if !slices.Contains(EventTypes, eventType) {
+			return &ValidationError{
+				Field:   "mutedEvents",
+				Message: fmt.Sprintf("unknown event %q", eventType),
+			}
+		}
+	}
+	if p.QuietHours != nil {
+		if !clockRegex.MatchString(p.QuietHours.Start) || !clockRegex.MatchString(p.QuietHours.End) {
+			return &ValidationError{
+				Field:   "quietHours",
+				Message: "start and end must be times in the format HH:MM",
+			}
+		}
+		if _, err := time.LoadLocation(p.QuietHours.TimeZone); err != nil || p.QuietHours.TimeZone == "" {
+			return &ValidationError{
+				Field:   "quietHours",
+				Message: "timeZone must be an IANA time zone such as Asia/Kuala_Lumpur",
+			}
+		}
+	}
+	return nil
+}
+
+// Mutes reports whether notifications of an event are kept out of messages
+func (p *NotificationPreferences) Mutes(eventType EventType) bool {
+	return slices.Contains(p.MutedEvents, eventType)
+}
+
+// InQuietHours reports whether messages must be held back at t
+func (p *NotificationPreferences) InQuietHours(t time.Time) bool {
+	q := p.QuietHours
+	if q == nil {
+		return false
+	}
+
+	location, err := time.LoadLocation(q.TimeZone)
+	if err != nil {
+		return false
+	}
+	local := t.In(location)
+	now := local.Hour()*60 + local.Minute()
+	start, end := clockMinutes(q.Start), clockMinutes(q.End)
+
+	if start <= end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+func clockMinutes(clock string) int {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// NotificationID returns the ID of the notification of an event
+func NotificationID(eventID string) string {
+	hash := sha256.Sum256([]byte(eventID))
+	return hex.EncodeToString(hash[:16])
+}
+
+// CreateNotification adds a notification to the user's inbox. It returns
+// ErrNotificationExists if the event was already notified.
+func (n *Notification) CreateNotification(ctx context.Context) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	if _, err := nats.CreateKV(ctx, notificationsBucket, n.UserID+"."+n.ID, data); err != nil {
+		if nats.IsConflict(err) {
+			return ErrNotificationExists
+		}
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+
+	return nil
+}
+
+// ListNotifications returns a page of the inbox of a user, newest first, only
+// of the unread notifications if unreadOnly is set
+func ListNotifications(ctx context.Context, userID string, unreadOnly bool, opts ListOptions) (*Page[Notification], error) {
+	page, err := queryPage(ctx, notificationsBucket, userID+".>", opts.query(OrderCreated, true), func(notification *Notification) bool {
+		return !unreadOnly || notification.ReadAt == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notifications: %w", err)
+	}
+
+	return page, nil
+}
+
+// DeleteUserNotifications empties the inbox of a user and drops the digest
+// waiting to be sent to them. It returns how many notifications were deleted.
+func DeleteUserNotifications(ctx context.Context, userID string) (int, error) {
+	entries, err := nats.GetKVEntries(ctx, notificationsBucket, userID+".>")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list notifications: %w", err)
+	}
+
+	for _, entry := range entries {
+		if err := nats.RemoveKV(ctx, notificationsBucket, entry.Key()); err != nil {
+			return 0, fmt.Errorf("failed to delete notification: %w", err)
+		}
+	}
+
+	if err := nats.RemoveKV(ctx, notificationDigestsBucket, userID); err != nil && !nats.IsNotFound(err) {
+		return 0, fmt.Errorf("failed to delete notification digest: %w", err)
+	}
+
+	return len(entries), nil
+}
+
+// GetNotification returns a notification of the user's inbox
+func GetNotification(ctx context.Context, userID string, id string) (*Notification, error) {
+	entry, err := nats.GetKV(ctx, notificationsBucket, userID+"."+id)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil, ErrNotificationNotFound
+		}
+		return nil, fmt.Errorf("failed to get notification: %w", err)
+	}
+
+	var notification Notification
+	if err := json.Unmarshal(entry.Value(), &notification); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal notification: %w", err)
+	}
+
+	return &notification, nil
+}
+
+// MarkNotificationRead marks a notification of the user's inbox read
+func MarkNotificationRead(ctx context.Context, userID string, id string) (*Notification, error) {
+	notification, err := GetNotification(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if notification.ReadAt != nil {
+		return notification, nil
+	}
+
+	now := time.Now()
+	notification.ReadAt = &now
+
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, notificationsBucket, userID+"."+id, data); err != nil {
+		return nil, fmt.Errorf("failed to update notification: %w", err)
+	}
+
+	return notification, nil
+}
+
+// MarkNotificationQueued records that the notification was added to the
+// digest of the user
+func (n *Notification) MarkNotificationQueued(ctx context.Context) error {
+	_, err := nats.UpdateKVFunc(ctx, notificationsBucket, n.UserID+"."+n.ID, func(value []byte) ([]byte, error) {
+		if value == nil {
+			return nil, ErrNotificationNotFound
+		}
+		var notification Notification
+		if err := json.Unmarshal(value, &notification); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal notification: %w", err)
+		}
+		notification.Queued = true
+		return json.Marshal(notification)
+	})
+	if err != nil {
+		if errors.Is(err, ErrNotificationNotFound) {
+			return err
+		}
+		return fmt.Errorf("failed to update notification: %w", err)
+	}
+
+	n.Queued = true
+	return nil
+}
+
+// NotificationDigest collects the notifications of a user that are waiting
+// to be sent together in one message
+type NotificationDigest struct {
+	UserID string `json:"userId"`
+
+	// Bodies are the rendered notifications, oldest first
+	Bodies []string `json:"bodies"`
+
+	// NotificationIDs are the IDs of the notifications in Bodies
+	NotificationIDs []string `json:"notificationIds,omitempty"`
+
+	// FirstAt is when the oldest notification was added
+	FirstAt time.Time `json:"firstAt"`
+
+	// Revision is the KV revision the digest was read at
+	Revision uint64 `json:"-"`
+}
+
+// AddToNotificationDigest queues a rendered notification to be sent to the
+// user. Notifications already in the digest are not added again.
+func AddToNotificationDigest(ctx context.Context, userID string, notificationID string, body string) error {
+	// Events of the same user may be processed concurrently, so the update is retried on conflict
+	for attempt := 0; attempt < 5; attempt++ {
+		digest := NotificationDigest{UserID: userID, FirstAt: time.Now()}
+
+		entry, err := nats.GetKV(ctx, notificationDigestsBucket, userID)
+		if err != nil && !nats.IsNotFound(err) {
+			return fmt.Errorf("failed to get notification digest: %w", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(entry.Value(), &digest); err != nil {
+				return fmt.Errorf("failed to unmarshal notification digest: %w", err)
+			}
+		}
+		if slices.Contains(digest.NotificationIDs, notificationID) {
+			return nil
+		}
+		digest.Bodies = append(digest.Bodies, body)
+		digest.NotificationIDs = append(digest.NotificationIDs, notificationID)
+
+		data, err := json.Marshal(digest)
+		if err != nil {
+			return fmt.Errorf("failed to marshal notification digest: %w", err)
+		}
+
+		if entry == nil {
+			_, err = nats.CreateKV(ctx, notificationDigestsBucket, userID, data)
+		} else {
+			_, err = nats.UpdateKV(ctx, notificationDigestsBucket, userID, data, entry.Revision())
+		}
+		if err == nil {
+			return nil
+		}
+		if !nats.IsConflict(err) {
+			return fmt.Errorf("failed to store notification digest: %w", err)
+		}
+	}
+
+	return fmt.Errorf("failed to store notification digest: too many concurrent updates")
+}
+
+// GetNotificationDigest returns the digest waiting to be sent to a user, or
+// nil if there is none
+func GetNotificationDigest(ctx context.Context, userID string) (*NotificationDigest, error) {
+	entry, err := nats.GetKV(ctx, notificationDigestsBucket, userID)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get notification digest: %w", err)
+	}
+
+	var digest NotificationDigest
+	if err := json.Unmarshal(entry.Value(), &digest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal notification digest: %w", err)
+	}
+	digest.Revision = entry.Revision()
+
+	return &digest, nil
+}
+
+// ListNotificationDigests returns the digests waiting to be sent
+func ListNotificationDigests(ctx context.Context) ([]*NotificationDigest, error) {
+	digests, err := nats.GetKVValues(ctx, notificationDigestsBucket, ">", func(entry jetstream.KeyValueEntry, digest *NotificationDigest) {
+		digest.Revision = entry.Revision()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list notification digests: %w", err)
+	}
+
+	return digests, nil
+}
+
+// ClaimNotificationDigest removes a digest so that only one replica sends
+// it. It fails if notifications were added since the digest was read.
+func (d *NotificationDigest) ClaimNotificationDigest(ctx context.Context) error {
+	return nats.RemoveKVRevision(ctx, notificationDigestsBucket, d.UserID, d.Revision)
+}
+
+// CollectibleExpiry reminds the holder of a collectible before it expires
+type CollectibleExpiry struct {
+	Account   string    `json:"account"`
+	Contract  string    `json:"contract"`
+	TokenID   string    `json:"tokenId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// Revision is the KV revision the reminder was read at
+	Revision uint64 `json:"-"`
+}
+
+// Key returns the KV key of the reminder, one per account and collectible
+func (e *CollectibleExpiry) Key() (string, error) {
+	account, err := NormalizeAccountAddress(e.Account)
+	if err != nil {
+		return "", err
+	}
+	contract, err := NormalizeAccountAddress(e.Contract)
+	if err != nil {
+		return "", err
+	}
+	if !collectibleTokenIDRegex.MatchString(e.TokenID) {
+		return "", fmt.Errorf("invalid token ID %q", e.TokenID)
+	}
+	return account + "." + contract + "." + e.TokenID, nil
+}
+
+var collectibleTokenIDRegex = regexp.MustCompile(`^[0-9a-zA-Z]{1,78}$`)
+
+// PutCollectibleExpiry stores a reminder in NATS KV Store
+func (e *CollectibleExpiry) PutCollectibleExpiry(ctx context.Context) error {
+	key, err := e.Key()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal collectible expiry: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, collectibleExpiriesBucket, key, data); err != nil {
+		return fmt.Errorf("failed to store collectible expiry: %w", err)
+	}
+
+	return nil
+}
+
+// ListCollectibleExpiries returns the pending reminders
+func ListCollectibleExpiries(ctx context.Context) ([]*CollectibleExpiry, error) {
+	expiries, err := nats.GetKVValues(ctx, collectibleExpiriesBucket, ">", func(entry jetstream.KeyValueEntry, expiry *CollectibleExpiry) {
+		expiry.Revision = entry.Revision()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collectible expiries: %w", err)
+	}
+
+	return expiries, nil
+}
+
+// ListAccountCollectibleExpiries returns the pending reminders of an account
+func ListAccountCollectibleExpiries(ctx context.Context, account string) ([]*CollectibleExpiry, error) {
+	account, err := NormalizeAccountAddress(account)
+	if err != nil {
+		return nil, err
+	}
+
+	expiries, err := nats.GetKVValues(ctx, collectibleExpiriesBucket, account+".>", func(entry jetstream.KeyValueEntry, expiry *CollectibleExpiry) {
+		expiry.Revision = entry.Revision()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collectible expiries: %w", err)
+	}
+
+	return expiries, nil
+}
+
+// RemoveCollectibleExpiry removes a reminder unless it was replaced since it was read
+func (e *CollectibleExpiry) RemoveCollectibleExpiry(ctx context.Context) error {
+	key, err := e.Key()
+	if err != nil {
+		return err
+	}
+
+	return nats.RemoveKVRevision(ctx, collectibleExpiriesBucket, key, e.Revision)
+}
@@ -0,0 +1,428 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	phoneIndexBucket   = "phoneIndex"
+	phoneChangesBucket = "phoneChanges"
+	movedUsersBucket   = "movedUsers"
+
+	// VerificationPurposeLogin marks a verification that logs the user in
+	VerificationPurposeLogin = ""
+	// VerificationPurposePhoneChange marks a verification that confirms a phone number change
+	VerificationPurposePhoneChange = "phoneChange"
+)
+
+// ErrPhoneNumberTaken is returned when a phone number already belongs to a user
+var ErrPhoneNumberTaken = errors.New("phone number is already in use")
+
+// PhoneChangeRequest represents the request for changing a user's phone number
+type PhoneChangeRequest struct {
+	// NewPhoneNumber must be in E.164 format (e.g. +60123456789)
+	// example: +60123456789
+	NewPhoneNumber string `json:"newPhoneNumber"`
+}
+
+// PhoneChangeResponse represents the response for starting a phone number change
+type PhoneChangeResponse struct {
+	Message string `json:"message" example:"OTP sent to the current and new phone numbers"`
+	ID      string `json:"id" example:"01HNAJ6640M9JRRJFQSZZVE3HH"`
+}
+
+// VerifyPhoneChangeRequest represents the request for completing a phone number change
+type VerifyPhoneChangeRequest struct {
+	// ID is the phone change returned when it was started
+	// example: 01HNAJ6640M9JRRJFQSZZVE3HH
+	ID string `json:"id"`
+
+	// OldToken is the OTP sent to the current number, not used for support-assisted changes
+	// example: 123456
+	OldToken string `json:"oldToken,omitempty"`
+
+	// NewToken is the OTP sent to the new number
+	// example: 654321
+	NewToken string `json:"newToken"`
+
+	// Device identifies the device for the issued token
+	// example: device_123
+	Device string `json:"device"`
+}
+
+// PhoneChange is a phone number change waiting for its OTPs to be verified
+type PhoneChange struct {
+	ID             string `json:"id"`
+	UserID         string `json:"userId"`
+	NewPhoneNumber string `json:"newPhoneNumber"`
+
+	// OldVerificationID is the OTP sent to the current number, empty for support-assisted changes
+	OldVerificationID string `json:"oldVerificationId,omitempty"`
+	NewVerificationID string `json:"newVerificationId"`
+
+	// AssistedBy is the staff member who started a change for a user who lost their number
+	AssistedBy string    `json:"assistedBy,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// NewUserID generates a stable user ID that does not depend on the phone number
+func NewUserID() string {
+	return ulid.Make().String()
+}
+
+// IsLegacyUserID reports whether id is a phone number hash from before user IDs were stable
+func IsLegacyUserID(id string) bool {
+	return strings.HasPrefix(id, "0x")
+}
+
+// ReservePhoneNumber indexes a phone number to a user unless it already belongs to someone
+func ReservePhoneNumber(ctx context.Context, phoneNumber string, userID string) error {
+	if _, ok := legacyPhoneNumberOwner(ctx, phoneNumber); ok {
+		return ErrPhoneNumberTaken
+	}
+
+	key, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return err
+	}
+	if err := StoresFrom(ctx).PhoneIndex.CreateEntry(ctx, key, userID); err != nil {
+		if nats.IsConflict(err) {
+			return ErrPhoneNumberTaken
+		}
+		return fmt.Errorf("failed to index phone number: %w", err)
+	}
+
+	return nil
+}
+
+// ReleasePhoneNumber removes a phone number from the index if it belongs to
+// the user, so that a number someone else took in the meantime is kept
+func ReleasePhoneNumber(ctx context.Context, phoneNumber string, userID string) error {
+	hash, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return err
+	}
+	phoneIndex := StoresFrom(ctx).PhoneIndex
+	for _, key := range []string{hash, LegacyPhoneNumberHash(phoneNumber)} {
+		entry, err := phoneIndex.GetEntry(ctx, key)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("failed to release phone number: %w", err)
+		}
+		if entry.ID != userID && ResolveUserID(ctx, entry.ID) != userID {
+			continue
+		}
+		if err := phoneIndex.RemoveEntry(ctx, key, entry.Revision); err != nil && !IsNotFound(err) {
+			return fmt.Errorf("failed to release phone number: %w", err)
+		}
+	}
+	return nil
+}
+
+// LookupPhoneNumber returns the ID of the user a phone number belongs to
+func LookupPhoneNumber(ctx context.Context, phoneNumber string) (string, error) {
+	key, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return "", err
+	}
+	entry, err := StoresFrom(ctx).PhoneIndex.GetEntry(ctx, key)
+	if err == nil {
+		return entry.ID, nil
+	}
+
+	if id, ok := legacyPhoneNumberOwner(ctx, phoneNumber); ok {
+		return id, nil
+	}
+
+	return "", fmt.Errorf("failed to get user: %w", err)
+}
+
+// legacyPhoneNumberOwner finds a user by the unkeyed phone number hash, either
+// through an index entry written before the pepper or because the user is
+// still keyed by it. Both go away when the user IDs are migrated.
+func legacyPhoneNumberOwner(ctx context.Context, phoneNumber string) (string, bool) {
+	legacyHash := LegacyPhoneNumberHash(phoneNumber)
+
+	stores := StoresFrom(ctx)
+	if entry, err := stores.PhoneIndex.GetEntry(ctx, legacyHash); err == nil {
+		return entry.ID, true
+	}
+
+	if _, err := stores.Users.GetUser(ctx, legacyHash); err == nil {
+		return legacyHash, true
+	}
+
+	return "", false
+}
+
+// ResolveUserID returns the current ID of a user that may have been moved off a legacy ID
+func ResolveUserID(ctx context.Context, id string) string {
+	if !IsLegacyUserID(id) {
+		return id
+	}
+
+	entry, err := StoresFrom(ctx).MovedUsers.GetEntry(ctx, id)
+	if err != nil {
+		return id
+	}
+
+	return entry.ID
+}
+
+// ChangePhoneNumber moves the user to a new phone number that was reserved for
+// them. Users still keyed by their phone number hash are moved to a stable ID.
+// When it fails before the user record is stored with the new number,
+// u.PhoneNumber is left at the old number so the caller can undo the change.
+func (u *User) ChangePhoneNumber(ctx context.Context, newPhoneNumber string) error {
+	oldPhoneNumber := u.PhoneNumber
+	u.PhoneNumber = newPhoneNumber
+
+	var err error
+	if IsLegacyUserID(u.ID) {
+		err = u.MoveToStableID(ctx)
+	} else {
+		err = u.UpdateUser(ctx)
+	}
+	if err != nil {
+		// A record that cannot be read back is assumed stored, as undoing a
+		// change that was stored would leave the user on neither number
+		if stored, getErr := StoresFrom(ctx).Users.GetUser(ctx, u.ID); getErr == nil && stored.PhoneNumber != newPhoneNumber {
+			u.PhoneNumber = oldPhoneNumber
+		}
+		return err
+	}
+
+	key, err := HashPhoneNumber(newPhoneNumber)
+	if err != nil {
+		return err
+	}
+	if err := StoresFrom(ctx).PhoneIndex.PutEntry(ctx, key, u.ID); err != nil {
+		return fmt.Errorf("failed to index phone number: %w", err)
+	}
+
+	return ReleasePhoneNumber(ctx, oldPhoneNumber, u.ID)
+}
+
+// ForgetMovedUser removes the record of a legacy ID that was moved to a
+// stable ID
+func ForgetMovedUser(ctx context.Context, legacyID string) error {
+	if err := StoresFrom(ctx).MovedUsers.RemoveEntry(ctx, legacyID, 0); err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to forget moved user: %w", err)
+	}
+	return nil
+}
+
+// MoveToStableID moves a user keyed by their phone number hash to a stable ID,
+// together with their merchant, API keys, tokens and passkeys. A move that was
+// interrupted is resumed with the ID it already started with.
+func (u *User) MoveToStableID(ctx context.Context) error {
+	oldID := u.ID
+	if !IsLegacyUserID(oldID) {
+		return nil
+	}
+
+	u.ID = ResolveUserID(ctx, oldID)
+	if u.ID == oldID {
+		u.ID = NewUserID()
+	}
+	u.LegacyID = oldID
+
+	// Old access tokens, API key IDs and passkey user handles still carry the
+	// legacy ID, and the index entries of the legacy user are handed over
+	if err := StoresFrom(ctx).MovedUsers.PutEntry(ctx, oldID, u.ID); err != nil {
+		return fmt.Errorf("failed to record moved user: %w", err)
+	}
+
+	// The record under the stable ID is new, unless a move is resumed
+	u.Revision = 0
+	moved := &User{}
+	if err := moved.GetUser(ctx, u.ID); err == nil {
+		u.Revision = moved.Revision
+	}
+
+	if err := u.UpdateUser(ctx); err != nil {
+		return err
+	}
+
+	return moveUser(ctx, oldID, u.ID)
+}
+
+// IndexPhoneNumber writes the keyed phone index entry of a user and removes
+// the entry written before the pepper
+func (u *User) IndexPhoneNumber(ctx context.Context) error {
+	key, err := HashPhoneNumber(u.PhoneNumber)
+	if err != nil {
+		return err
+	}
+	phoneIndex := StoresFrom(ctx).PhoneIndex
+	if err := phoneIndex.PutEntry(ctx, key, u.ID); err != nil {
+		return fmt.Errorf("failed to index phone number: %w", err)
+	}
+
+	if err := phoneIndex.RemoveEntry(ctx, LegacyPhoneNumberHash(u.PhoneNumber), 0); err != nil {
+		return fmt.Errorf("failed to remove legacy phone index: %w", err)
+	}
+
+	return nil
+}
+
+// AccountAddresses returns the on-chain accounts of a user: their own account
+// and, if they have one, their merchant account
+func (u *User) AccountAddresses(ctx context.Context) []string {
+	addresses := []string{}
+	if u.AccountAddress != "" {
+		addresses = append(addresses, u.AccountAddress)
+	}
+	merchant := Merchant{}
+	if err := merchant.GetMerchant(ctx, u.ID); err == nil && merchant.Address != "" {
+		addresses = append(addresses, merchant.Address)
+	}
+
+	return addresses
+}
+
+// moveUser re-keys the records of a user from a legacy ID to a stable ID and
+// removes the legacy user record
+func moveUser(ctx context.Context, oldID string, newID string) error {
+	stores := StoresFrom(ctx)
+
+	merchant := &Merchant{}
+	if err := merchant.GetMerchant(ctx, oldID); err == nil {
+		merchant.ID = newID
+		merchant.Revision = 0
+		moved := &Merchant{}
+		if err := moved.GetMerchant(ctx, newID); err == nil {
+			merchant.Revision = moved.Revision
+		}
+		if err := merchant.UpdateMerchant(ctx); err != nil {
+			return fmt.Errorf("failed to move merchant: %w", err)
+		}
+		if err := stores.Merchants.DeleteMerchant(ctx, oldID); err != nil {
+			return fmt.Errorf("failed to move merchant: %w", err)
+		}
+	}
+
+	apiKeys, err := stores.APIKeys.ListAPIKeys(ctx, oldID)
+	if err != nil {
+		return fmt.Errorf("failed to move API keys: %w", err)
+	}
+	for _, apiKey := range apiKeys {
+		oldKeyID := apiKey.ID
+		apiKey.ID = newID + strings.TrimPrefix(oldKeyID, oldID)
+		apiKey.UserID = newID
+		if err := stores.APIKeys.PutAPIKey(ctx, apiKey); err != nil {
+			return fmt.Errorf("failed to move API key: %w", err)
+		}
+		if err := stores.APIKeys.DeleteAPIKey(ctx, oldKeyID); err != nil {
+			return fmt.Errorf("failed to move API key: %w", err)
+		}
+	}
+
+	tokens, err := stores.Tokens.ListUserTokens(ctx, oldID)
+	if err != nil {
+		return fmt.Errorf("failed to move tokens: %w", err)
+	}
+	for _, token := range tokens {
+		token.User = newID
+		if err := stores.Tokens.PutToken(ctx, token); err != nil {
+			return fmt.Errorf("failed to move token: %w", err)
+		}
+	}
+
+	passkeys, err := GetPasskeys(ctx, oldID)
+	if err != nil {
+		return fmt.Errorf("failed to move passkeys: %w", err)
+	}
+	for _, passkey := range passkeys {
+		passkey.UserID = newID
+		if err := passkey.putPasskey(ctx); err != nil {
+			return fmt.Errorf("failed to move passkey: %w", err)
+		}
+		if err := DeletePasskey(ctx, oldID, passkey.ID); err != nil {
+			return fmt.Errorf("failed to move passkey: %w", err)
+		}
+	}
+
+	if err := stores.Users.DeleteUser(ctx, oldID); err != nil {
+		return fmt.Errorf("failed to remove legacy user: %w", err)
+	}
+
+	return nil
+}
+
+// CreatePhoneChange stores a phone number change until it is verified
+func (c *PhoneChange) CreatePhoneChange(ctx context.Context) error {
+	c.ID = ulid.Make().String()
+	c.CreatedAt = time.Now()
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal phone change: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, phoneChangesBucket, c.ID, data); err != nil {
+		return fmt.Errorf("failed to store phone change: %w", err)
+	}
+
+	return nil
+}
+
+// GetPhoneChange retrieves a pending phone number change
+func (c *PhoneChange) GetPhoneChange(ctx context.Context, id string) error {
+	entry, err := nats.GetKV(ctx, phoneChangesBucket, id)
+	if err != nil {
+		return fmt.Errorf("invalid or expired phone change")
+	}
+
+	return json.Unmarshal(entry.Value(), c)
+}
+
+// DeletePhoneChange removes a phone number change once it is completed
+func (c *PhoneChange) DeletePhoneChange(ctx context.Context) error {
+	if err := nats.RemoveKV(ctx, phoneChangesBucket, c.ID); err != nil {
+		return fmt.Errorf("failed to delete phone change: %w", err)
+	}
+	return nil
+}
+
+func (r *PhoneChangeRequest) Validate() error {
+	if r.NewPhoneNumber == "" {
+		return &ValidationError{
+			Field:   "newPhoneNumber",
+			Message: "new phone number is required",
+		}
+	}
+	return nil
+}
+
+func (r *VerifyPhoneChangeRequest) Validate() error {
+	if r.ID == "" {
+		return &ValidationError{
+			Field:   "id",
+			Message: "id is required",
+		}
+	}
+	if r.NewToken == "" {
+		return &ValidationError{
+			Field:   "newToken",
+			Message: "new token is required",
+		}
+	}
+	if r.Device == "" {
+		return &ValidationError{
+			Field:   "device",
+			Message: "device is required",
+		}
+	}
+	return nil
+}
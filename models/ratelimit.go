@@ -0,0 +1,328 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/config"
+	"infinirewards/nats"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rateLimitsBucket = "rateLimits"
+
+	// rateLimitRetries bounds how often a counter update is retried when
+	// another replica wrote the same key concurrently
+	rateLimitRetries = 5
+)
+
+// RateLimit is a counter kept in the rate limit store so that limits are shared by all replicas.
+// Every hit within Window counts towards Limit, and when Cooldown is set each hit
+// blocks the key for Cooldown doubled per previous hit, capped at MaxCooldown.
+type RateLimit struct {
+	// Name prefixes the KV key and identifies the limit in logs
+	Name string
+
+	// Limit is the number of hits allowed within Window
+	Limit int
+
+	// Window is the period after which the counter starts over. It must not
+	// exceed the TTL of the rateLimits bucket (24h).
+	Window time.Duration
+
+	// Cooldown is the wait enforced after the first hit, doubled for every further hit
+	Cooldown time.Duration
+
+	// MaxCooldown caps the exponential backoff
+	MaxCooldown time.Duration
+
+	// Description is returned to clients in the limit detail of a 429 response
+	Description string
+}
+
+// RateLimitStatus describes the state of a rate limit counter
+type RateLimitStatus struct {
+	Count      int
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// RateLimitError is returned when a rate limit counter is exhausted or cooling down
+type RateLimitError struct {
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded (%s), retry after %s", e.Limit, e.RetryAfter)
+}
+
+// RateLimitState is the counter of a rate limit for one key
+type RateLimitState struct {
+	Count        int       `json:"count"`
+	WindowStart  time.Time `json:"windowStart"`
+	LastHit      time.Time `json:"lastHit"`
+	BlockedUntil time.Time `json:"blockedUntil"`
+
+	// Revision is the store revision the counter was read at, zero for a
+	// counter that is not stored
+	Revision uint64 `json:"-"`
+}
+
+var (
+	// OTPRequestPhoneLimit throttles OTP sends to a single phone number
+	OTPRequestPhoneLimit = &RateLimit{
+		Name:        "otp.phone",
+		Limit:       10,
+		Window:      24 * time.Hour,
+		Cooldown:    30 * time.Second,
+		MaxCooldown: time.Hour,
+		Description: "10 requests per day per phone number",
+	}
+
+	// OTPRequestIPLimit throttles OTP sends triggered from a single client IP
+	OTPRequestIPLimit = &RateLimit{
+		Name:        "otp.ip",
+		Limit:       50,
+		Window:      24 * time.Hour,
+		Description: "50 requests per day per IP address",
+	}
+
+	// OTPVerifyLimit bounds failed guesses against a single verification
+	OTPVerifyLimit = &RateLimit{
+		Name:        "otp.verify",
+		Limit:       5,
+		Window:      5 * time.Minute,
+		Cooldown:    2 * time.Second,
+		MaxCooldown: 30 * time.Second,
+		Description: "5 attempts per verification",
+	}
+
+	// OTPStatusLimit throttles delivery status polling of a single verification
+	OTPStatusLimit = &RateLimit{
+		Name:        "otp.status",
+		Limit:       60,
+		Window:      5 * time.Minute,
+		Description: "60 status checks per verification",
+	}
+
+	// WebAuthnLoginIPLimit throttles passkey login ceremonies started from a single client IP
+	WebAuthnLoginIPLimit = &RateLimit{
+		Name:        "webauthn.ip",
+		Limit:       100,
+		Window:      time.Hour,
+		Description: "100 passkey logins per hour per IP address",
+	}
+)
+
+// rateLimits are the limits that can be configured, by name
+var rateLimits = map[string]*RateLimit{}
+
+// rateLimitDefaults keeps the limits as declared, so that removing a setting
+// from the configuration restores the default
+var rateLimitDefaults = map[string]RateLimit{}
+
+// rateLimitsMu guards the settings of the limits while they are reconfigured
+var rateLimitsMu sync.RWMutex
+
+func init() {
+	for _, limit := range []*RateLimit{OTPRequestPhoneLimit, OTPRequestIPLimit, OTPVerifyLimit, OTPStatusLimit, WebAuthnLoginIPLimit} {
+		rateLimits[limit.Name] = limit
+		rateLimitDefaults[limit.Name] = *limit
+	}
+}
+
+// ConfigureRateLimits applies the configured settings over the defaults of
+// the rate limits. It is called again when the configuration is reloaded.
+// Nothing is changed if a setting names an unknown limit.
+func ConfigureRateLimits(settings map[string]config.RateLimitConfig) error {
+	for name := range settings {
+		if _, ok := rateLimits[name]; !ok {
+			return fmt.Errorf("unknown rate limit %q", name)
+		}
+	}
+
+	rateLimitsMu.Lock()
+	defer rateLimitsMu.Unlock()
+
+	for name, limit := range rateLimits {
+		*limit = rateLimitDefaults[name]
+		setting, ok := settings[name]
+		if !ok {
+			continue
+		}
+
+		if setting.Limit > 0 {
+			limit.Limit = setting.Limit
+		}
+		if setting.Window > 0 {
+			limit.Window = setting.Window
+		}
+		if setting.Cooldown > 0 {
+			limit.Cooldown = setting.Cooldown
+		}
+		if setting.MaxCooldown > 0 {
+			limit.MaxCooldown = setting.MaxCooldown
+		}
+		switch {
+		case setting.Description != "":
+			limit.Description = setting.Description
+		case setting.Limit > 0 || setting.Window > 0:
+			limit.Description = fmt.Sprintf("%d requests per %s", limit.Limit, limit.Window)
+		}
+	}
+	return nil
+}
+
+// settings returns a copy of the limit, which is not changed by a
+// concurrent ConfigureRateLimits
+func (l *RateLimit) settings() *RateLimit {
+	rateLimitsMu.RLock()
+	defer rateLimitsMu.RUnlock()
+	settings := *l
+	return &settings
+}
+
+// Check returns the current status without counting a hit. It returns a
+// *RateLimitError if the key is blocked.
+func (l *RateLimit) Check(ctx context.Context, key string) (*RateLimitStatus, error) {
+	l = l.settings()
+	state, err := l.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	status := l.status(*state, time.Now())
+	if status.RetryAfter > 0 {
+		return status, l.limitError(status)
+	}
+	return status, nil
+}
+
+// Hit counts a hit regardless of whether the key is currently blocked
+func (l *RateLimit) Hit(ctx context.Context, key string) (*RateLimitStatus, error) {
+	return l.update(ctx, key, false)
+}
+
+// Allow counts a hit if the key is not blocked and returns a *RateLimitError otherwise
+func (l *RateLimit) Allow(ctx context.Context, key string) (*RateLimitStatus, error) {
+	return l.update(ctx, key, true)
+}
+
+// Reset clears the counter for key
+func (l *RateLimit) Reset(ctx context.Context, key string) error {
+	err := StoresFrom(ctx).RateLimits.DeleteRateLimit(ctx, l.key(key))
+	if err != nil && !IsNotFound(err) {
+		return fmt.Errorf("failed to reset rate limit %s: %w", l.Name, err)
+	}
+	return nil
+}
+
+func (l *RateLimit) update(ctx context.Context, key string, enforce bool) (*RateLimitStatus, error) {
+	l = l.settings()
+	for attempt := 0; attempt < rateLimitRetries; attempt++ {
+		state, err := l.load(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		if status := l.status(*state, now); enforce && status.RetryAfter > 0 {
+			return status, l.limitError(status)
+		}
+
+		if state.WindowStart.IsZero() || now.Sub(state.WindowStart) >= l.Window {
+			*state = RateLimitState{WindowStart: now, Revision: state.Revision}
+		}
+		state.Count++
+		state.LastHit = now
+		state.BlockedUntil = now.Add(l.cooldown(state.Count))
+		if state.Count >= l.Limit {
+			state.BlockedUntil = state.WindowStart.Add(l.Window)
+		}
+
+		err = StoresFrom(ctx).RateLimits.PutRateLimit(ctx, l.key(key), state)
+		if nats.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to store rate limit %s: %w", l.Name, err)
+		}
+
+		return l.status(*state, now), nil
+	}
+
+	return nil, fmt.Errorf("failed to store rate limit %s: too much contention", l.Name)
+}
+
+func (l *RateLimit) load(ctx context.Context, key string) (*RateLimitState, error) {
+	state, err := StoresFrom(ctx).RateLimits.GetRateLimit(ctx, l.key(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rate limit %s: %w", l.Name, err)
+	}
+	return state, nil
+}
+
+func (l *RateLimit) status(state RateLimitState, now time.Time) *RateLimitStatus {
+	if !state.WindowStart.IsZero() && now.Sub(state.WindowStart) >= l.Window {
+		return &RateLimitStatus{Remaining: l.Limit}
+	}
+
+	status := &RateLimitStatus{
+		Count:     state.Count,
+		Remaining: l.Limit - state.Count,
+	}
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	if state.BlockedUntil.After(now) {
+		status.RetryAfter = state.BlockedUntil.Sub(now).Round(time.Second)
+		if status.RetryAfter == 0 {
+			status.RetryAfter = time.Second
+		}
+	}
+	return status
+}
+
+// cooldown returns the exponential backoff for the nth hit
+func (l *RateLimit) cooldown(count int) time.Duration {
+	if l.Cooldown <= 0 || count <= 0 {
+		return 0
+	}
+
+	cooldown := l.Cooldown
+	for i := 1; i < count; i++ {
+		cooldown *= 2
+		if l.MaxCooldown > 0 && cooldown >= l.MaxCooldown {
+			return l.MaxCooldown
+		}
+	}
+	return cooldown
+}
+
+func (l *RateLimit) limitError(status *RateLimitStatus) error {
+	return &RateLimitError{
+		Limit:      l.Description,
+		RetryAfter: status.RetryAfter,
+	}
+}
+
+func (l *RateLimit) key(key string) string {
+	return l.Name + "." + sanitizeKVKey(key)
+}
+
+// sanitizeKVKey replaces characters that are not valid in a NATS KV key
+func sanitizeKVKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '=':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+}
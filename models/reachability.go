@@ -0,0 +1,149 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"log/slog"
+	"time"
+)
+
+const reachabilityBucket = "reachability"
+
+// reachabilityChannels are the channels reachability is learned for
+var reachabilityChannels = []string{utils.ChannelWhatsApp}
+
+// Reachability records whether a phone number could last be reached on a
+// channel. It is learned from send results, status webhooks and inbound
+// messages, and expires with the bucket TTL so numbers are tried again.
+type Reachability struct {
+	Channel   string    `json:"channel"`
+	Reachable bool      `json:"reachable"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// reachabilityKey keys reachability by channel and the keyed hash of the
+// phone number, so the bucket holds no phone numbers
+func reachabilityKey(channel string, phoneNumber string) (string, error) {
+	hash, err := HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return "", err
+	}
+	return channel + "." + hash, nil
+}
+
+// RecordReachability stores whether a phone number can be reached on a channel
+func RecordReachability(ctx context.Context, channel string, phoneNumber string, reachable bool) error {
+	data, err := json.Marshal(Reachability{
+		Channel:   channel,
+		Reachable: reachable,
+		UpdatedAt: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal reachability: %w", err)
+	}
+
+	key, err := reachabilityKey(channel, phoneNumber)
+	if err != nil {
+		return err
+	}
+	if err := nats.PutKV(ctx, reachabilityBucket, key, data); err != nil {
+		return fmt.Errorf("failed to store reachability: %w", err)
+	}
+
+	return nil
+}
+
+// GetReachability returns whether a phone number can be reached on a
+// channel, or nil if that is not known
+func GetReachability(ctx context.Context, channel string, phoneNumber string) (*Reachability, error) {
+	key, err := reachabilityKey(channel, phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := nats.GetKV(ctx, reachabilityBucket, key)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get reachability: %w", err)
+	}
+
+	var reachability Reachability
+	if err := json.Unmarshal(entry.Value(), &reachability); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal reachability: %w", err)
+	}
+
+	return &reachability, nil
+}
+
+// UnreachableChannels returns the channels a phone number is known not to
+// be on. Lookup failures are logged and the channel is tried.
+func UnreachableChannels(ctx context.Context, phoneNumber string) []string {
+	channels := []string{}
+	for _, channel := range reachabilityChannels {
+		reachability, err := GetReachability(ctx, channel, phoneNumber)
+		if err != nil {
+			logs.Logger.Warn("failed to get reachability",
+				slog.String("handler", "UnreachableChannels"),
+				slog.String("channel", channel),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		if reachability != nil && !reachability.Reachable {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// recordDeliveryReachability learns from the providers that rejected a
+// message as unreachable
+func recordDeliveryReachability(ctx context.Context, phoneNumber string, delivery *utils.Delivery) {
+	for _, attempt := range delivery.Attempts {
+		if !attempt.Unreachable || attempt.Channel == "" {
+			continue
+		}
+		if err := RecordReachability(ctx, attempt.Channel, phoneNumber, false); err != nil {
+			logs.Logger.Warn("failed to record reachability",
+				slog.String("handler", "SendMessage"),
+				slog.String("channel", attempt.Channel),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+// ListReachability returns what is known about reaching a phone number on
+// each channel
+func ListReachability(ctx context.Context, phoneNumber string) ([]*Reachability, error) {
+	known := []*Reachability{}
+	for _, channel := range reachabilityChannels {
+		reachability, err := GetReachability(ctx, channel, phoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		if reachability != nil {
+			known = append(known, reachability)
+		}
+	}
+	return known, nil
+}
+
+// ForgetReachability removes what is known about reaching a phone number
+func ForgetReachability(ctx context.Context, phoneNumber string) error {
+	for _, channel := range reachabilityChannels {
+		key, err := reachabilityKey(channel, phoneNumber)
+		if err != nil {
+			return err
+		}
+		if err := nats.RemoveKV(ctx, reachabilityBucket, key); err != nil && !nats.IsNotFound(err) {
+			return fmt.Errorf("failed to forget reachability: %w", err)
+		}
+	}
+	return nil
+}
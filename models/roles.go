@@ -0,0 +1,157 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"slices"
+)
+
+// Role groups the permissions granted to a user
+type Role string
+
+const (
+	// RoleUser is granted to every user and covers their own account
+	RoleUser Role = "user"
+	// RoleMerchant is granted when a merchant is created for the user
+	RoleMerchant Role = "merchant"
+	// RoleStaff is granted to platform support staff
+	RoleStaff Role = "staff"
+	// RoleAdmin unlocks platform operations
+	RoleAdmin Role = "admin"
+)
+
+// Permission is an operation a route may require
+type Permission string
+
+const (
+	// PermissionMerchantRead allows reading the caller's merchant and its contracts
+	PermissionMerchantRead Permission = "merchant:read"
+	// PermissionMerchantManage allows creating contracts, minting and redeeming as the caller's merchant
+	PermissionMerchantManage Permission = "merchant:manage"
+	// PermissionMerchantsCreate allows creating merchants on behalf of users
+	PermissionMerchantsCreate Permission = "merchants:create"
+	// PermissionMerchantsRead allows listing all merchants
+	PermissionMerchantsRead Permission = "merchants:read"
+	// PermissionContractsUpgrade allows upgrading user, merchant, points and collectible contracts
+	PermissionContractsUpgrade Permission = "contracts:upgrade"
+	// PermissionUsersRead allows reading any user
+	PermissionUsersRead Permission = "users:read"
+	// PermissionUsersManage allows changing the phone number of any user
+	PermissionUsersManage Permission = "users:manage"
+	// PermissionRolesManage allows changing the roles of any user
+	PermissionRolesManage Permission = "roles:manage"
+	// PermissionTemplatesManage allows reading and changing message templates
+	PermissionTemplatesManage Permission = "templates:manage"
+	// PermissionAuditRead allows reading and verifying the audit log of all requests
+	PermissionAuditRead Permission = "audit:read"
+)
+
+// RolePermissions lists the permissions granted by each role
+var RolePermissions = map[Role][]Permission{
+	RoleUser: {},
+	RoleMerchant: {
+		PermissionMerchantRead,
+		PermissionMerchantManage,
+	},
+	RoleStaff: {
+		PermissionMerchantsRead,
+		PermissionUsersRead,
+		PermissionUsersManage,
+	},
+	RoleAdmin: {
+		PermissionMerchantRead,
+		PermissionMerchantManage,
+		PermissionMerchantsCreate,
+		PermissionMerchantsRead,
+		PermissionContractsUpgrade,
+		PermissionUsersRead,
+		PermissionUsersManage,
+		PermissionRolesManage,
+		PermissionTemplatesManage,
+		PermissionAuditRead,
+	},
+}
+
+// BootstrapAdminIDs are user IDs that are always granted RoleAdmin, so that
+// the first admin can be created before anyone can manage roles
+var BootstrapAdminIDs []string
+
+// SetUserRolesRequest represents the request for changing a user's roles
+type SetUserRolesRequest struct {
+	// Roles replaces the user's roles. RoleUser is always kept.
+	// example: ["user","staff"]
+	Roles []Role `json:"roles"`
+}
+
+func (r *SetUserRolesRequest) Validate() error {
+	for _, role := range r.Roles {
+		if _, ok := RolePermissions[role]; !ok {
+			return &ValidationError{
+				Field:   "roles",
+				Message: fmt.Sprintf("unknown role %q", role),
+			}
+		}
+	}
+	return nil
+}
+
+// HasRole reports whether the user has been granted role
+func (u *User) HasRole(role Role) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// AddRole grants role to the user. It does not persist the user.
+func (u *User) AddRole(role Role) {
+	if !u.HasRole(role) {
+		u.Roles = append(u.Roles, role)
+	}
+}
+
+// ResolveRoles returns the roles to embed in the user's tokens. Users stored
+// before roles existed get RoleUser, and RoleMerchant if they own a merchant.
+func (u *User) ResolveRoles(ctx context.Context) []Role {
+	roles := slices.Clone(u.Roles)
+	if !slices.Contains(roles, RoleUser) {
+		roles = append(roles, RoleUser)
+	}
+
+	if !slices.Contains(roles, RoleMerchant) {
+		merchant := &Merchant{}
+		if err := merchant.GetMerchant(ctx, u.ID); err == nil {
+			roles = append(roles, RoleMerchant)
+		}
+	}
+
+	if !slices.Contains(roles, RoleAdmin) && slices.Contains(BootstrapAdminIDs, u.ID) {
+		roles = append(roles, RoleAdmin)
+	}
+
+	return roles
+}
+
+// RoleClaims returns the role and permission claims of the user's tokens
+func (u *User) RoleClaims(ctx context.Context) ([]string, []string) {
+	roles := u.ResolveRoles(ctx)
+	roleClaims := make([]string, 0, len(roles))
+	for _, role := range roles {
+		roleClaims = append(roleClaims, string(role))
+	}
+	permissionClaims := []string{}
+	for _, permission := range PermissionsForRoles(roles) {
+		permissionClaims = append(permissionClaims, string(permission))
+	}
+	return roleClaims, permissionClaims
+}
+
+// PermissionsForRoles returns the union of the permissions granted by roles
+func PermissionsForRoles(roles []Role) []Permission {
+	permissions := []Permission{}
+	for _, role := range roles {
+		for _, permission := range RolePermissions[role] {
+			if !slices.Contains(permissions, permission) {
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
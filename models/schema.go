@@ -0,0 +1,188 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"infinirewards/nats"
+	"slices"
+	"time"
+)
+
+// schemaMigrationsBucket records the migrations applied to each bucket
+const schemaMigrationsBucket = "schemaMigrations"
+
+// schemaVersionField is the JSON field documents record their schema version in
+const schemaVersionField = "schemaVersion"
+
+// Migration upgrades the documents of a bucket from Version-1 to Version.
+// Up changes the decoded JSON document in place; numbers are json.Number.
+type Migration struct {
+	Bucket      string
+	Version     int
+	Description string
+	Up          func(doc map[string]any) error
+}
+
+var migrations = map[string][]Migration{}
+
+// RegisterMigration adds the next migration of a bucket. Migrations are
+// registered at init in version order, starting at 1.
+func RegisterMigration(m Migration) {
+	if want := len(migrations[m.Bucket]) + 1; m.Version != want {
+		panic(fmt.Sprintf("migration %d of bucket %s registered out of order, want version %d", m.Version, m.Bucket, want))
+	}
+	migrations[m.Bucket] = append(migrations[m.Bucket], m)
+}
+
+// SchemaVersion returns the version documents of a bucket are written at
+func SchemaVersion(bucket string) int {
+	return len(migrations[bucket])
+}
+
+// Migrations returns the migrations registered for a bucket in version order
+func Migrations(bucket string) []Migration {
+	return slices.Clone(migrations[bucket])
+}
+
+// SchemaBuckets returns the buckets whose documents carry a schema version
+func SchemaBuckets() []string {
+	return []string{KV_BUCKET, merchantsBucket, tokenBucket, usersBucket}
+}
+
+// versioned is implemented by documents that record their schema version
+type versioned interface {
+	setSchemaVersion(version int)
+}
+
+func (u *User) setSchemaVersion(version int)     { u.SchemaVersion = version }
+func (m *Merchant) setSchemaVersion(version int) { m.SchemaVersion = version }
+func (k *APIKey) setSchemaVersion(version int)   { k.SchemaVersion = version }
+func (t *Token) setSchemaVersion(version int)    { t.SchemaVersion = version }
+
+// UpgradeDocument applies the migrations a document of a bucket is missing
+// and reports whether it changed. Documents written by a newer schema are
+// left as they are.
+func UpgradeDocument(bucket string, data []byte) ([]byte, bool, error) {
+	target := SchemaVersion(bucket)
+	if target == 0 {
+		return data, false, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc map[string]any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false, fmt.Errorf("failed to decode %s document: %w", bucket, err)
+	}
+
+	version := 0
+	if number, ok := doc[schemaVersionField].(json.Number); ok {
+		v, err := number.Int64()
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid schema version %s: %w", number, err)
+		}
+		version = int(v)
+	}
+	if version >= target {
+		return data, false, nil
+	}
+
+	for _, m := range migrations[bucket][version:] {
+		if err := m.Up(doc); err != nil {
+			return nil, false, fmt.Errorf("failed to migrate %s document to version %d: %w", bucket, m.Version, err)
+		}
+	}
+	doc[schemaVersionField] = target
+
+	upgraded, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to encode %s document: %w", bucket, err)
+	}
+	return upgraded, true, nil
+}
+
+// decodeDocument decodes a stored document, upgrading it first if it was
+// written at an older schema version. The upgrade is not written back; the
+// next write of the record or the migrate command stores it.
+func decodeDocument[T any](bucket string, data []byte) (*T, error) {
+	upgraded, _, err := UpgradeDocument(bucket, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var value T
+	if err := json.Unmarshal(upgraded, &value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// encodeDocument encodes a document for a bucket at the current schema version
+func encodeDocument[T any](bucket string, value *T) ([]byte, error) {
+	if v, ok := any(value).(versioned); ok {
+		v.setSchemaVersion(SchemaVersion(bucket))
+	}
+	return json.Marshal(value)
+}
+
+// SchemaMigrationState records how far the documents of a bucket were migrated
+type SchemaMigrationState struct {
+	Bucket string `json:"bucket"`
+
+	// Version is the schema version every document was migrated to
+	Version int `json:"version"`
+
+	// Target is the version of a migration run that did not finish
+	Target int `json:"target,omitempty"`
+
+	// LastKey is the last key the unfinished run migrated; keys sort after it
+	LastKey string `json:"lastKey,omitempty"`
+
+	// Applied lists the migrations whose runs finished
+	Applied []AppliedMigration `json:"applied"`
+
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// AppliedMigration is a migration that was applied to every document of a bucket
+type AppliedMigration struct {
+	Version     int       `json:"version"`
+	Description string    `json:"description"`
+	AppliedAt   time.Time `json:"appliedAt"`
+}
+
+// GetSchemaMigrationState retrieves the migration state of a bucket. A bucket
+// that was never migrated is at version 0.
+func GetSchemaMigrationState(ctx context.Context, bucket string) (*SchemaMigrationState, error) {
+	entry, err := nats.GetKV(ctx, schemaMigrationsBucket, bucket)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return &SchemaMigrationState{Bucket: bucket, Applied: []AppliedMigration{}}, nil
+		}
+		return nil, fmt.Errorf("failed to get migration state: %w", err)
+	}
+
+	state := &SchemaMigrationState{}
+	if err := json.Unmarshal(entry.Value(), state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal migration state: %w", err)
+	}
+	return state, nil
+}
+
+// UpdateSchemaMigrationState stores the migration state of a bucket
+func (s *SchemaMigrationState) UpdateSchemaMigrationState(ctx context.Context) error {
+	s.UpdatedAt = time.Now()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal migration state: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, schemaMigrationsBucket, s.Bucket, data); err != nil {
+		return fmt.Errorf("failed to store migration state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,953 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	tokenBucket             = "token"
+	userTokensBucket        = "userTokens"
+	phoneVerificationBucket = "phoneVerification"
+)
+
+// ErrNotFound is returned by stores when a record does not exist. Errors of
+// the JetStream stores also match nats.IsNotFound.
+var ErrNotFound = errors.New("not found")
+
+// IsNotFound reports whether err is a missing record of a store or a bucket
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || nats.IsNotFound(err)
+}
+
+// UserStore stores users by ID. Users are read with their revision and
+// written back only if they are still at it.
+type UserStore interface {
+	GetUser(ctx context.Context, id string) (*User, error)
+	// CreateUser stores a user that does not exist yet
+	CreateUser(ctx context.Context, user *User) error
+	// UpdateUser stores a user if it is still at user.Revision, and fails
+	// with nats.ErrConflict otherwise
+	UpdateUser(ctx context.Context, user *User) error
+	DeleteUser(ctx context.Context, id string) error
+	ListUsers(ctx context.Context) ([]*User, error)
+	// PageUsers returns a page of the users that match accepts and the cursor
+	// of the next page
+	PageUsers(ctx context.Context, query Query, match func(*User) bool) ([]*User, string, error)
+}
+
+// MerchantStore stores merchants by the ID of the user they belong to, with
+// the same revision checks as UserStore
+type MerchantStore interface {
+	GetMerchant(ctx context.Context, id string) (*Merchant, error)
+	CreateMerchant(ctx context.Context, merchant *Merchant) error
+	UpdateMerchant(ctx context.Context, merchant *Merchant) error
+	DeleteMerchant(ctx context.Context, id string) error
+	ListMerchants(ctx context.Context) ([]*Merchant, error)
+	PageMerchants(ctx context.Context, query Query, match func(*Merchant) bool) ([]*Merchant, string, error)
+}
+
+// APIKeyStore stores API keys by their ID, which starts with the ID of the
+// user they belong to
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+	PutAPIKey(ctx context.Context, apiKey *APIKey) error
+	DeleteAPIKey(ctx context.Context, id string) error
+	ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error)
+	PageAPIKeys(ctx context.Context, userID string, query Query) ([]*APIKey, string, error)
+}
+
+// TokenStore stores issued tokens by their ID, which is also the refresh
+// token, and indexes them by the user they were issued to
+type TokenStore interface {
+	GetToken(ctx context.Context, id string) (*Token, error)
+	// PutToken stores a token and indexes it under its user, moving the
+	// index entry if the token was issued to another user before
+	PutToken(ctx context.Context, token *Token) error
+	DeleteToken(ctx context.Context, id string) error
+	ListTokens(ctx context.Context) ([]*Token, error)
+	// ListUserTokens returns the tokens indexed under a user
+	ListUserTokens(ctx context.Context, userID string) ([]*Token, error)
+	// IndexToken indexes a stored token under its user without writing the
+	// token, for tokens stored before the index existed
+	IndexToken(ctx context.Context, token *Token) error
+}
+
+// VerificationStore stores pending OTP verifications by ID
+type VerificationStore interface {
+	GetVerification(ctx context.Context, id string) (*PhoneNumberVerification, error)
+	PutVerification(ctx context.Context, verification *PhoneNumberVerification) error
+	DeleteVerification(ctx context.Context, id string) error
+}
+
+// PasskeyStore stores passkeys by the user they belong to and their ID, with
+// the same revision checks as UserStore
+type PasskeyStore interface {
+	GetPasskey(ctx context.Context, userID string, id string) (*PasskeyCredential, error)
+	// CreatePasskey stores a passkey that does not exist yet
+	CreatePasskey(ctx context.Context, passkey *PasskeyCredential) error
+	// UpdatePasskey stores a passkey if it is still at passkey.Revision, and
+	// fails with nats.ErrConflict otherwise
+	UpdatePasskey(ctx context.Context, passkey *PasskeyCredential) error
+	// PutPasskey stores a passkey whatever was stored under its key
+	PutPasskey(ctx context.Context, passkey *PasskeyCredential) error
+	DeletePasskey(ctx context.Context, userID string, id string) error
+	ListPasskeys(ctx context.Context, userID string) ([]*PasskeyCredential, error)
+	PagePasskeys(ctx context.Context, userID string, query Query) ([]*PasskeyCredential, string, error)
+}
+
+// RateLimitStore stores the counters of the rate limits by key
+type RateLimitStore interface {
+	// GetRateLimit returns a counter, or a zero counter at revision zero if
+	// it was never hit or was reset
+	GetRateLimit(ctx context.Context, key string) (*RateLimitState, error)
+	// PutRateLimit stores a counter if it is still at state.Revision, or does
+	// not exist yet when that is zero, and fails with nats.ErrConflict
+	// otherwise
+	PutRateLimit(ctx context.Context, key string, state *RateLimitState) error
+	DeleteRateLimit(ctx context.Context, key string) error
+}
+
+// IndexEntry points a key of an index at the ID of a record
+type IndexEntry struct {
+	Key      string
+	ID       string
+	Revision uint64
+	// Written is when the entry was last written
+	Written time.Time
+}
+
+// IndexStore stores the entries of an index, such as the users by phone
+// number. Entries are written back only if they are still at the revision
+// they were read at.
+type IndexStore interface {
+	GetEntry(ctx context.Context, key string) (*IndexEntry, error)
+	// CreateEntry points a key at id unless it is indexed already, and fails
+	// with nats.ErrConflict otherwise
+	CreateEntry(ctx context.Context, key string, id string) error
+	// UpdateEntry points a key at id if it is still at revision, and fails
+	// with nats.ErrConflict otherwise
+	UpdateEntry(ctx context.Context, key string, id string, revision uint64) error
+	// PutEntry points a key at id whatever it pointed at
+	PutEntry(ctx context.Context, key string, id string) error
+	// RemoveEntry removes a key if it is still at revision, and fails with
+	// nats.ErrConflict otherwise. A revision of zero removes it at any
+	// revision.
+	RemoveEntry(ctx context.Context, key string, revision uint64) error
+	ListEntries(ctx context.Context) ([]*IndexEntry, error)
+}
+
+// Stores holds the stores of the records the API reads and writes
+type Stores struct {
+	Users         UserStore
+	Merchants     MerchantStore
+	APIKeys       APIKeyStore
+	Tokens        TokenStore
+	Verifications VerificationStore
+	Passkeys      PasskeyStore
+	RateLimits    RateLimitStore
+
+	// PhoneIndex points phone number hashes at users and MovedUsers points
+	// legacy user IDs at the stable IDs they were moved to
+	PhoneIndex IndexStore
+	MovedUsers IndexStore
+
+	// The secondary indexes of user and merchant records
+	EmailIndex    IndexStore
+	AccountIndex  IndexStore
+	MerchantIndex IndexStore
+	ContractIndex IndexStore
+}
+
+// NewKVStores returns stores backed by the JetStream KV buckets
+func NewKVStores() *Stores {
+	return &Stores{
+		Users:         userStore{records: kvRecords[User]{bucket: usersBucket}},
+		Merchants:     merchantStore{records: kvRecords[Merchant]{bucket: merchantsBucket}},
+		APIKeys:       apiKeyStore{records: kvRecords[APIKey]{bucket: KV_BUCKET}},
+		Tokens:        tokenStore{records: kvRecords[Token]{bucket: tokenBucket}, index: kvRecords[tokenRef]{bucket: userTokensBucket}},
+		Verifications: verificationStore{records: kvRecords[PhoneNumberVerification]{bucket: phoneVerificationBucket}},
+		Passkeys:      passkeyStore{records: kvRecords[storedPasskey]{bucket: passkeysBucket}},
+		RateLimits:    rateLimitStore{records: kvRecords[RateLimitState]{bucket: rateLimitsBucket}},
+		PhoneIndex:    kvIndex{bucket: phoneIndexBucket},
+		MovedUsers:    kvIndex{bucket: movedUsersBucket},
+		EmailIndex:    kvIndex{bucket: emailIndexBucket},
+		AccountIndex:  kvIndex{bucket: accountIndexBucket},
+		MerchantIndex: kvIndex{bucket: merchantIndexBucket},
+		ContractIndex: kvIndex{bucket: contractIndexBucket},
+	}
+}
+
+// NewMemoryStores returns stores that keep records in memory, for tests and
+// tools that run without NATS. Records expire after the TTL of their bucket.
+func NewMemoryStores() *Stores {
+	return &Stores{
+		Users:         userStore{records: newMemoryRecords[User](usersBucket, 0)},
+		Merchants:     merchantStore{records: newMemoryRecords[Merchant](merchantsBucket, 0)},
+		APIKeys:       apiKeyStore{records: newMemoryRecords[APIKey](KV_BUCKET, 0)},
+		Tokens:        tokenStore{records: newMemoryRecords[Token](tokenBucket, 90*24*time.Hour), index: newMemoryRecords[tokenRef](userTokensBucket, 90*24*time.Hour)},
+		Verifications: verificationStore{records: newMemoryRecords[PhoneNumberVerification](phoneVerificationBucket, 5*time.Minute)},
+		Passkeys:      passkeyStore{records: newMemoryRecords[storedPasskey](passkeysBucket, 0)},
+		RateLimits:    rateLimitStore{records: newMemoryRecords[RateLimitState](rateLimitsBucket, 24*time.Hour)},
+		PhoneIndex:    newMemoryIndex(),
+		MovedUsers:    newMemoryIndex(),
+		EmailIndex:    newMemoryIndex(),
+		AccountIndex:  newMemoryIndex(),
+		MerchantIndex: newMemoryIndex(),
+		ContractIndex: newMemoryIndex(),
+	}
+}
+
+// index returns the store of one of the secondary index buckets
+func (s *Stores) index(bucket string) IndexStore {
+	switch bucket {
+	case emailIndexBucket:
+		return s.EmailIndex
+	case accountIndexBucket:
+		return s.AccountIndex
+	case merchantIndexBucket:
+		return s.MerchantIndex
+	default:
+		return s.ContractIndex
+	}
+}
+
+// storesKey is the context key of the stores of a request
+type storesKey struct{}
+
+// kvStores are the stores of contexts that were not given any
+var kvStores = NewKVStores()
+
+// WithStores returns a context whose reads and writes go to s. Servers set it
+// on every request; work started without it, such as the commands and the
+// background workers, uses the JetStream KV stores.
+func WithStores(ctx context.Context, s *Stores) context.Context {
+	return context.WithValue(ctx, storesKey{}, s)
+}
+
+// StoresFrom returns the stores set on ctx with WithStores, or the JetStream
+// KV stores if it has none
+func StoresFrom(ctx context.Context) *Stores {
+	if s, ok := ctx.Value(storesKey{}).(*Stores); ok {
+		return s
+	}
+	return kvStores
+}
+
+// records stores JSON records of one type by key. Every write of a key gets
+// a new revision. prefix lists the records whose keys start with it and must
+// be empty or end with a dot. page returns a page of the listed records that
+// match accepts, which may be nil, and the cursor of the next page.
+type records[T any] interface {
+	get(ctx context.Context, key string) (*T, uint64, error)
+	put(ctx context.Context, key string, value *T) error
+	create(ctx context.Context, key string, value *T) (uint64, error)
+	update(ctx context.Context, key string, value *T, revision uint64) (uint64, error)
+	remove(ctx context.Context, key string) error
+	list(ctx context.Context, prefix string) ([]*T, error)
+	page(ctx context.Context, prefix string, query Query, match func(*T) bool) ([]*T, string, error)
+}
+
+// revisioned is implemented by records that keep the revision they were read
+// at, which list and page set
+type revisioned interface {
+	setRevision(revision uint64)
+}
+
+// setRevision sets the revision of value if it keeps one
+func setRevision[T any](value *T, revision uint64) {
+	if v, ok := any(value).(revisioned); ok {
+		v.setRevision(revision)
+	}
+}
+
+// kvRecords stores records in a JetStream KV bucket
+type kvRecords[T any] struct {
+	bucket string
+}
+
+func (r kvRecords[T]) get(ctx context.Context, key string) (*T, uint64, error) {
+	entry, err := nats.GetKV(ctx, r.bucket, key)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil, 0, fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		return nil, 0, err
+	}
+
+	value, err := decodeDocument[T](r.bucket, entry.Value())
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, entry.Revision(), nil
+}
+
+func (r kvRecords[T]) put(ctx context.Context, key string, value *T) error {
+	data, err := encodeDocument(r.bucket, value)
+	if err != nil {
+		return err
+	}
+	return nats.PutKV(ctx, r.bucket, key, data)
+}
+
+func (r kvRecords[T]) create(ctx context.Context, key string, value *T) (uint64, error) {
+	data, err := encodeDocument(r.bucket, value)
+	if err != nil {
+		return 0, err
+	}
+	return nats.CreateKV(ctx, r.bucket, key, data)
+}
+
+func (r kvRecords[T]) update(ctx context.Context, key string, value *T, revision uint64) (uint64, error) {
+	data, err := encodeDocument(r.bucket, value)
+	if err != nil {
+		return 0, err
+	}
+	return nats.UpdateKV(ctx, r.bucket, key, data, revision)
+}
+
+func (r kvRecords[T]) remove(ctx context.Context, key string) error {
+	return nats.RemoveKV(ctx, r.bucket, key)
+}
+
+func (r kvRecords[T]) list(ctx context.Context, prefix string) ([]*T, error) {
+	entries, err := nats.GetKVEntries(ctx, r.bucket, prefix+">")
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*T, 0, len(entries))
+	for _, entry := range entries {
+		value, err := decodeDocument[T](r.bucket, entry.Value())
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", entry.Key(), err)
+		}
+		setRevision(value, entry.Revision())
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r kvRecords[T]) page(ctx context.Context, prefix string, query Query, match func(*T) bool) ([]*T, string, error) {
+	values := []*T{}
+	next, err := nats.QueryKV(ctx, r.bucket, query.kvQuery(prefix+">"), func(entry jetstream.KeyValueEntry) (bool, error) {
+		value, err := decodeDocument[T](r.bucket, entry.Value())
+		if err != nil {
+			return false, fmt.Errorf("failed to decode %s: %w", entry.Key(), err)
+		}
+		if match != nil && !match(value) {
+			return false, nil
+		}
+		setRevision(value, entry.Revision())
+		values = append(values, value)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return values, next, nil
+}
+
+// memoryRecords keeps records as JSON so callers never share them
+type memoryRecords[T any] struct {
+	bucket   string
+	mu       *sync.RWMutex
+	ttl      time.Duration
+	entries  map[string]memoryEntry
+	revision *uint64
+}
+
+type memoryEntry struct {
+	data     []byte
+	revision uint64
+	written  time.Time
+	expires  time.Time
+}
+
+func newMemoryRecords[T any](bucket string, ttl time.Duration) memoryRecords[T] {
+	return memoryRecords[T]{
+		bucket:   bucket,
+		mu:       &sync.RWMutex{},
+		ttl:      ttl,
+		entries:  map[string]memoryEntry{},
+		revision: new(uint64),
+	}
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+func (r memoryRecords[T]) get(ctx context.Context, key string) (*T, uint64, error) {
+	r.mu.RLock()
+	entry, ok := r.entries[key]
+	r.mu.RUnlock()
+	if !ok || entry.expired(time.Now()) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+
+	value, err := decodeDocument[T](r.bucket, entry.data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, entry.revision, nil
+}
+
+func (r memoryRecords[T]) put(ctx context.Context, key string, value *T) error {
+	_, err := r.write(key, value, func(memoryEntry, bool) bool { return true })
+	return err
+}
+
+func (r memoryRecords[T]) create(ctx context.Context, key string, value *T) (uint64, error) {
+	return r.write(key, value, func(current memoryEntry, exists bool) bool {
+		return !exists
+	})
+}
+
+func (r memoryRecords[T]) update(ctx context.Context, key string, value *T, revision uint64) (uint64, error) {
+	return r.write(key, value, func(current memoryEntry, exists bool) bool {
+		return exists && current.revision == revision
+	})
+}
+
+// write stores a record under a new revision if allowed accepts the current
+// entry, and fails with nats.ErrConflict otherwise
+func (r memoryRecords[T]) write(key string, value *T, allowed func(current memoryEntry, exists bool) bool) (uint64, error) {
+	data, err := encodeDocument(r.bucket, value)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	current, exists := r.entries[key]
+	if exists && current.expired(now) {
+		exists = false
+	}
+	if !allowed(current, exists) {
+		return 0, fmt.Errorf("%w: %s", nats.ErrConflict, key)
+	}
+
+	*r.revision++
+	entry := memoryEntry{data: data, revision: *r.revision, written: now}
+	if r.ttl > 0 {
+		entry.expires = now.Add(r.ttl)
+	}
+	r.entries[key] = entry
+	return entry.revision, nil
+}
+
+func (r memoryRecords[T]) remove(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, key)
+	return nil
+}
+
+func (r memoryRecords[T]) list(ctx context.Context, prefix string) ([]*T, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := []string{}
+	now := time.Now()
+	for key, entry := range r.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+	// Sort the keys so listings are stable
+	sort.Strings(keys)
+
+	values := []*T{}
+	for _, key := range keys {
+		value, err := decodeDocument[T](r.bucket, r.entries[key].data)
+		if err != nil {
+			return nil, err
+		}
+		setRevision(value, r.entries[key].revision)
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (r memoryRecords[T]) page(ctx context.Context, prefix string, query Query, match func(*T) bool) ([]*T, string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	positions := []nats.KVPosition{}
+	now := time.Now()
+	for key, entry := range r.entries {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			// Documents sort by their createdAt field like the KV queries of
+			// the models
+			positions = append(positions, nats.KVPosition{Key: key, Created: documentCreatedAt(entry.data, entry.written)})
+		}
+	}
+
+	values := []*T{}
+	next, err := nats.PageKV(positions, query.kvQuery(""), func(position nats.KVPosition) (bool, error) {
+		value, err := decodeDocument[T](r.bucket, r.entries[position.Key].data)
+		if err != nil {
+			return false, err
+		}
+		if match != nil && !match(value) {
+			return false, nil
+		}
+		setRevision(value, r.entries[position.Key].revision)
+		values = append(values, value)
+		return true, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return values, next, nil
+}
+
+type userStore struct {
+	records records[User]
+}
+
+func (s userStore) GetUser(ctx context.Context, id string) (*User, error) {
+	user, revision, err := s.records.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	user.Revision = revision
+	return user, nil
+}
+
+func (s userStore) CreateUser(ctx context.Context, user *User) error {
+	revision, err := s.records.create(ctx, user.ID, user)
+	if err != nil {
+		return err
+	}
+	user.Revision = revision
+	return nil
+}
+
+func (s userStore) UpdateUser(ctx context.Context, user *User) error {
+	revision, err := s.records.update(ctx, user.ID, user, user.Revision)
+	if err != nil {
+		return err
+	}
+	user.Revision = revision
+	return nil
+}
+
+func (s userStore) DeleteUser(ctx context.Context, id string) error {
+	return s.records.remove(ctx, id)
+}
+
+func (s userStore) ListUsers(ctx context.Context) ([]*User, error) {
+	return s.records.list(ctx, "")
+}
+
+func (s userStore) PageUsers(ctx context.Context, query Query, match func(*User) bool) ([]*User, string, error) {
+	return s.records.page(ctx, "", query, match)
+}
+
+type merchantStore struct {
+	records records[Merchant]
+}
+
+func (s merchantStore) GetMerchant(ctx context.Context, id string) (*Merchant, error) {
+	merchant, revision, err := s.records.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	merchant.Revision = revision
+	return merchant, nil
+}
+
+func (s merchantStore) CreateMerchant(ctx context.Context, merchant *Merchant) error {
+	revision, err := s.records.create(ctx, merchant.ID, merchant)
+	if err != nil {
+		return err
+	}
+	merchant.Revision = revision
+	return nil
+}
+
+func (s merchantStore) UpdateMerchant(ctx context.Context, merchant *Merchant) error {
+	revision, err := s.records.update(ctx, merchant.ID, merchant, merchant.Revision)
+	if err != nil {
+		return err
+	}
+	merchant.Revision = revision
+	return nil
+}
+
+func (s merchantStore) DeleteMerchant(ctx context.Context, id string) error {
+	return s.records.remove(ctx, id)
+}
+
+func (s merchantStore) ListMerchants(ctx context.Context) ([]*Merchant, error) {
+	return s.records.list(ctx, "")
+}
+
+func (s merchantStore) PageMerchants(ctx context.Context, query Query, match func(*Merchant) bool) ([]*Merchant, string, error) {
+	return s.records.page(ctx, "", query, match)
+}
+
+type apiKeyStore struct {
+	records records[APIKey]
+}
+
+func (s apiKeyStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	apiKey, _, err := s.records.get(ctx, id)
+	return apiKey, err
+}
+
+func (s apiKeyStore) PutAPIKey(ctx context.Context, apiKey *APIKey) error {
+	return s.records.put(ctx, apiKey.ID, apiKey)
+}
+
+func (s apiKeyStore) DeleteAPIKey(ctx context.Context, id string) error {
+	return s.records.remove(ctx, id)
+}
+
+func (s apiKeyStore) ListAPIKeys(ctx context.Context, userID string) ([]*APIKey, error) {
+	return s.records.list(ctx, userID+".")
+}
+
+func (s apiKeyStore) PageAPIKeys(ctx context.Context, userID string, query Query) ([]*APIKey, string, error) {
+	return s.records.page(ctx, userID+".", query, nil)
+}
+
+type tokenStore struct {
+	records records[Token]
+	index   records[tokenRef]
+}
+
+// tokenRef is an entry of the token index, keyed by the user and token ID
+type tokenRef struct {
+	ID string `json:"id"`
+}
+
+func tokenIndexKey(userID string, tokenID string) string {
+	return userID + "." + tokenID
+}
+
+func (s tokenStore) GetToken(ctx context.Context, id string) (*Token, error) {
+	token, _, err := s.records.get(ctx, id)
+	return token, err
+}
+
+func (s tokenStore) PutToken(ctx context.Context, token *Token) error {
+	previous, _, err := s.records.get(ctx, token.ID)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+
+	// The entry is written first, as entries of missing tokens are skipped
+	if err := s.IndexToken(ctx, token); err != nil {
+		return err
+	}
+	if err := s.records.put(ctx, token.ID, token); err != nil {
+		return err
+	}
+	if previous != nil && previous.User != token.User {
+		return s.index.remove(ctx, tokenIndexKey(previous.User, token.ID))
+	}
+	return nil
+}
+
+func (s tokenStore) DeleteToken(ctx context.Context, id string) error {
+	token, _, err := s.records.get(ctx, id)
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if err := s.records.remove(ctx, id); err != nil {
+		return err
+	}
+	if token != nil {
+		return s.index.remove(ctx, tokenIndexKey(token.User, id))
+	}
+	return nil
+}
+
+func (s tokenStore) ListTokens(ctx context.Context) ([]*Token, error) {
+	return s.records.list(ctx, "")
+}
+
+func (s tokenStore) ListUserTokens(ctx context.Context, userID string) ([]*Token, error) {
+	refs, err := s.index.list(ctx, userID+".")
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*Token{}
+	for _, ref := range refs {
+		token, _, err := s.records.get(ctx, ref.ID)
+		if err != nil {
+			// Tokens expire before their index entries
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if token.User == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+func (s tokenStore) IndexToken(ctx context.Context, token *Token) error {
+	return s.index.put(ctx, tokenIndexKey(token.User, token.ID), &tokenRef{ID: token.ID})
+}
+
+type verificationStore struct {
+	records records[PhoneNumberVerification]
+}
+
+func (s verificationStore) GetVerification(ctx context.Context, id string) (*PhoneNumberVerification, error) {
+	verification, _, err := s.records.get(ctx, id)
+	return verification, err
+}
+
+func (s verificationStore) PutVerification(ctx context.Context, verification *PhoneNumberVerification) error {
+	return s.records.put(ctx, verification.ID, verification)
+}
+
+func (s verificationStore) DeleteVerification(ctx context.Context, id string) error {
+	return s.records.remove(ctx, id)
+}
+
+type passkeyStore struct {
+	records records[storedPasskey]
+}
+
+func passkeyKey(userID string, id string) string {
+	return userID + "." + id
+}
+
+func (s passkeyStore) GetPasskey(ctx context.Context, userID string, id string) (*PasskeyCredential, error) {
+	stored, revision, err := s.records.get(ctx, passkeyKey(userID, id))
+	if err != nil {
+		return nil, err
+	}
+	stored.Revision = revision
+	return stored.passkey(), nil
+}
+
+func (s passkeyStore) CreatePasskey(ctx context.Context, passkey *PasskeyCredential) error {
+	revision, err := s.records.create(ctx, passkeyKey(passkey.UserID, passkey.ID), newStoredPasskey(passkey))
+	if err != nil {
+		return err
+	}
+	passkey.Revision = revision
+	return nil
+}
+
+func (s passkeyStore) UpdatePasskey(ctx context.Context, passkey *PasskeyCredential) error {
+	revision, err := s.records.update(ctx, passkeyKey(passkey.UserID, passkey.ID), newStoredPasskey(passkey), passkey.Revision)
+	if err != nil {
+		return err
+	}
+	passkey.Revision = revision
+	return nil
+}
+
+func (s passkeyStore) PutPasskey(ctx context.Context, passkey *PasskeyCredential) error {
+	return s.records.put(ctx, passkeyKey(passkey.UserID, passkey.ID), newStoredPasskey(passkey))
+}
+
+func (s passkeyStore) DeletePasskey(ctx context.Context, userID string, id string) error {
+	return s.records.remove(ctx, passkeyKey(userID, id))
+}
+
+func (s passkeyStore) ListPasskeys(ctx context.Context, userID string) ([]*PasskeyCredential, error) {
+	stored, err := s.records.list(ctx, userID+".")
+	if err != nil {
+		return nil, err
+	}
+	return storedPasskeys(stored), nil
+}
+
+func (s passkeyStore) PagePasskeys(ctx context.Context, userID string, query Query) ([]*PasskeyCredential, string, error) {
+	stored, next, err := s.records.page(ctx, userID+".", query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return storedPasskeys(stored), next, nil
+}
+
+type rateLimitStore struct {
+	records records[RateLimitState]
+}
+
+func (s rateLimitStore) GetRateLimit(ctx context.Context, key string) (*RateLimitState, error) {
+	state, revision, err := s.records.get(ctx, key)
+	if err != nil {
+		if IsNotFound(err) {
+			return &RateLimitState{}, nil
+		}
+		return nil, err
+	}
+	state.Revision = revision
+	return state, nil
+}
+
+func (s rateLimitStore) PutRateLimit(ctx context.Context, key string, state *RateLimitState) error {
+	var revision uint64
+	var err error
+	if state.Revision == 0 {
+		revision, err = s.records.create(ctx, key, state)
+	} else {
+		revision, err = s.records.update(ctx, key, state, state.Revision)
+	}
+	if err != nil {
+		return err
+	}
+	state.Revision = revision
+	return nil
+}
+
+func (s rateLimitStore) DeleteRateLimit(ctx context.Context, key string) error {
+	return s.records.remove(ctx, key)
+}
+
+// kvIndex stores the entries of an index in a JetStream KV bucket, with the
+// ID as the raw value
+type kvIndex struct {
+	bucket string
+}
+
+func kvIndexEntry(entry jetstream.KeyValueEntry) *IndexEntry {
+	return &IndexEntry{Key: entry.Key(), ID: string(entry.Value()), Revision: entry.Revision(), Written: entry.Created()}
+}
+
+func (i kvIndex) GetEntry(ctx context.Context, key string) (*IndexEntry, error) {
+	entry, err := nats.GetKV(ctx, i.bucket, key)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %w", ErrNotFound, err)
+		}
+		return nil, err
+	}
+	return kvIndexEntry(entry), nil
+}
+
+func (i kvIndex) CreateEntry(ctx context.Context, key string, id string) error {
+	_, err := nats.CreateKV(ctx, i.bucket, key, []byte(id))
+	return err
+}
+
+func (i kvIndex) UpdateEntry(ctx context.Context, key string, id string, revision uint64) error {
+	_, err := nats.UpdateKV(ctx, i.bucket, key, []byte(id), revision)
+	return err
+}
+
+func (i kvIndex) PutEntry(ctx context.Context, key string, id string) error {
+	return nats.PutKV(ctx, i.bucket, key, []byte(id))
+}
+
+func (i kvIndex) RemoveEntry(ctx context.Context, key string, revision uint64) error {
+	if revision == 0 {
+		return nats.RemoveKV(ctx, i.bucket, key)
+	}
+	return nats.RemoveKVRevision(ctx, i.bucket, key, revision)
+}
+
+func (i kvIndex) ListEntries(ctx context.Context) ([]*IndexEntry, error) {
+	entries, err := nats.GetKVEntries(ctx, i.bucket, ">")
+	if err != nil {
+		return nil, err
+	}
+
+	indexEntries := make([]*IndexEntry, 0, len(entries))
+	for _, entry := range entries {
+		indexEntries = append(indexEntries, kvIndexEntry(entry))
+	}
+	return indexEntries, nil
+}
+
+// memoryIndex keeps the entries of an index in memory
+type memoryIndex struct {
+	mu       sync.RWMutex
+	entries  map[string]IndexEntry
+	revision uint64
+}
+
+func newMemoryIndex() *memoryIndex {
+	return &memoryIndex{entries: map[string]IndexEntry{}}
+}
+
+func (i *memoryIndex) GetEntry(ctx context.Context, key string) (*IndexEntry, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	entry, ok := i.entries[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return &entry, nil
+}
+
+func (i *memoryIndex) CreateEntry(ctx context.Context, key string, id string) error {
+	return i.write(key, id, func(current IndexEntry, exists bool) bool {
+		return !exists
+	})
+}
+
+func (i *memoryIndex) UpdateEntry(ctx context.Context, key string, id string, revision uint64) error {
+	return i.write(key, id, func(current IndexEntry, exists bool) bool {
+		return exists && current.Revision == revision
+	})
+}
+
+func (i *memoryIndex) PutEntry(ctx context.Context, key string, id string) error {
+	return i.write(key, id, func(IndexEntry, bool) bool { return true })
+}
+
+// write points a key at id under a new revision if allowed accepts the
+// current entry, and fails with nats.ErrConflict otherwise
+func (i *memoryIndex) write(key string, id string, allowed func(current IndexEntry, exists bool) bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	current, exists := i.entries[key]
+	if !allowed(current, exists) {
+		return fmt.Errorf("%w: %s", nats.ErrConflict, key)
+	}
+
+	i.revision++
+	i.entries[key] = IndexEntry{Key: key, ID: id, Revision: i.revision, Written: time.Now()}
+	return nil
+}
+
+func (i *memoryIndex) RemoveEntry(ctx context.Context, key string, revision uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if revision != 0 && i.entries[key].Revision != revision {
+		return fmt.Errorf("%w: %s", nats.ErrConflict, key)
+	}
+	delete(i.entries, key)
+	return nil
+}
+
+func (i *memoryIndex) ListEntries(ctx context.Context) ([]*IndexEntry, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	entries := make([]*IndexEntry, 0, len(i.entries))
+	for _, entry := range i.entries {
+		entries = append(entries, &entry)
+	}
+	// Sort the entries so listings are stable
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].Key < entries[b].Key
+	})
+	return entries, nil
+}
@@ -0,0 +1,339 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+const messageTemplatesBucket = "messageTemplates"
+
+const (
+	// TemplateOTP is the message carrying a one-time code
+	TemplateOTP = "otp"
+	// TemplateLoginURL is the WhatsApp message with a login button
+	TemplateLoginURL = "login_url"
+	// TemplateNotificationDigest batches several notifications into one message
+	TemplateNotificationDigest = "notification_digest"
+)
+
+// DefaultBrand is the brand whose templates are used when a request does
+// not name one, or when its brand has no template for a message
+var DefaultBrand = "infinirewards"
+
+// DefaultLocale is the locale tried after the caller's locales
+const DefaultLocale = "en"
+
+// ErrTemplateNotFound is returned when no brand or locale has a template
+var ErrTemplateNotFound = errors.New("message template not found")
+
+// MessageTemplate is the text of a message for a brand and locale
+type MessageTemplate struct {
+	// Brand is the brand the template belongs to
+	// example: jomfi
+	Brand string `json:"brand"`
+
+	// Name is the message the template is for
+	// example: otp
+	Name string `json:"name"`
+
+	// Locale is the BCP 47 language tag of the template
+	// example: ms-MY
+	Locale string `json:"locale"`
+
+	// Body is a Go text/template rendered with the code, URL and validity of the message
+	// example: JOMFI: Kod OTP anda ialah {{.Code}}. Sah selama {{.ValidMinutes}} minit.
+	Body string `json:"body"`
+
+	// Footer is shown below the body by channels that support it
+	// example: JomFi App
+	Footer string `json:"footer,omitempty"`
+
+	// WhatsAppTemplate is the approved WhatsApp template the message is sent with
+	// example: otp_message
+	WhatsAppTemplate string `json:"whatsAppTemplate,omitempty"`
+
+	// WhatsAppLanguage is the language code of the approved WhatsApp template
+	// example: ms
+	WhatsAppLanguage string `json:"whatsAppLanguage,omitempty"`
+
+	// SMSSender is the name SMS are sent from
+	// example: JomFi
+	SMSSender string `json:"smsSender,omitempty"`
+
+	// UpdatedAt is the time the template was last changed
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// NotificationTemplateName returns the name of the template notifications of an event are rendered with
+func NotificationTemplateName(eventType EventType) string {
+	return strings.ReplaceAll(string(eventType), ".", "_")
+}
+
+// PutMessageTemplateRequest represents the request for creating or replacing a template
+type PutMessageTemplateRequest struct {
+	// Body is a Go text/template with the fields of utils.TemplateData, e.g. Code, URL and ValidMinutes
+	// example: JOMFI: Your OTP is {{.Code}}. Valid for {{.ValidMinutes}} minutes.
+	Body string `json:"body"`
+
+	// Footer is shown below the body by channels that support it
+	// example: JomFi App
+	Footer string `json:"footer,omitempty"`
+
+	// WhatsAppTemplate is the approved WhatsApp template the message is sent with
+	// example: otp_message
+	WhatsAppTemplate string `json:"whatsAppTemplate,omitempty"`
+
+	// WhatsAppLanguage is the language code of the approved WhatsApp template
+	// example: en
+	WhatsAppLanguage string `json:"whatsAppLanguage,omitempty"`
+
+	// SMSSender is the name SMS are sent from, up to 11 characters
+	// example: JomFi
+	SMSSender string `json:"smsSender,omitempty"`
+}
+
+func (r *PutMessageTemplateRequest) Validate() error {
+	if r.Body == "" {
+		return &ValidationError{
+			Field:   "body",
+			Message: "body is required",
+		}
+	}
+	if err := utils.ValidateTemplate(r.Body); err != nil {
+		return &ValidationError{
+			Field:   "body",
+			Message: err.Error(),
+		}
+	}
+	if err := utils.ValidateTemplate(r.Footer); err != nil {
+		return &ValidationError{
+			Field:   "footer",
+			Message: err.Error(),
+		}
+	}
+	if len(r.SMSSender) > 11 {
+		return &ValidationError{
+			Field:   "smsSender",
+			Message: "smsSender must be at most 11 characters",
+		}
+	}
+	return nil
+}
+
+// builtinTemplates are used when no stored template matches, so messages can
+// be sent before any template is configured
+var builtinTemplates = map[string]MessageTemplate{
+	TemplateOTP: {
+		Name:             TemplateOTP,
+		Locale:           DefaultLocale,
+		Body:             "Your InfiniRewards verification code is: {{.Code}}",
+		WhatsAppTemplate: "otp_message",
+		WhatsAppLanguage: "en",
+	},
+	TemplateLoginURL: {
+		Name:   TemplateLoginURL,
+		Locale: DefaultLocale,
+		Body:   "Click the link below to access InfiniRewards",
+		Footer: "InfiniRewards App",
+	},
+	TemplateNotificationDigest: {
+		Name:   TemplateNotificationDigest,
+		Locale: DefaultLocale,
+		Body:   "You have {{.Count}} new InfiniRewards updates:{{range .Items}}\n- {{.}}{{end}}",
+	},
+	NotificationTemplateName(EventPointsMinted): {
+		Name:   NotificationTemplateName(EventPointsMinted),
+		Locale: DefaultLocale,
+		Body:   "You received {{.Amount}} points.",
+	},
+	NotificationTemplateName(EventPointsReceived): {
+		Name:   NotificationTemplateName(EventPointsReceived),
+		Locale: DefaultLocale,
+		Body:   "You received {{.Amount}} points from a transfer.",
+	},
+	NotificationTemplateName(EventCollectibleMinted): {
+		Name:   NotificationTemplateName(EventCollectibleMinted),
+		Locale: DefaultLocale,
+		Body:   "You received {{.Amount}} new collectible(s).",
+	},
+	NotificationTemplateName(EventCollectibleRedeemed): {
+		Name:   NotificationTemplateName(EventCollectibleRedeemed),
+		Locale: DefaultLocale,
+		Body:   "{{.Amount}} of your collectible(s) were redeemed.",
+	},
+	NotificationTemplateName(EventCollectibleExpiring): {
+		Name:   NotificationTemplateName(EventCollectibleExpiring),
+		Locale: DefaultLocale,
+		Body:   "Your collectible expires on {{.ExpiresAt}}. Redeem it before then.",
+	},
+}
+
+var templateKeyRegex = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// MessageTemplateKey returns the KV key of a template, validating its parts
+func MessageTemplateKey(brand string, name string, locale string) (string, error) {
+	if !templateKeyRegex.MatchString(brand) {
+		return "", &ValidationError{Field: "brand", Message: "brand must be 1 to 64 lower case letters, digits, _ or -"}
+	}
+	if !templateKeyRegex.MatchString(name) {
+		return "", &ValidationError{Field: "name", Message: "name must be 1 to 64 lower case letters, digits, _ or -"}
+	}
+	normalized := utils.NormalizeLocale(locale)
+	if normalized == "" || normalized != locale {
+		return "", &ValidationError{Field: "locale", Message: "locale must be a BCP 47 language tag such as en or ms-MY"}
+	}
+	return brand + "." + name + "." + locale, nil
+}
+
+// PutMessageTemplate creates or replaces a template in NATS KV Store
+func (t *MessageTemplate) PutMessageTemplate(ctx context.Context) error {
+	key, err := MessageTemplateKey(t.Brand, t.Name, t.Locale)
+	if err != nil {
+		return err
+	}
+
+	t.UpdatedAt = time.Now()
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message template: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, messageTemplatesBucket, key, data); err != nil {
+		return fmt.Errorf("failed to store message template: %w", err)
+	}
+
+	return nil
+}
+
+// GetMessageTemplate retrieves a stored template from NATS KV Store
+func (t *MessageTemplate) GetMessageTemplate(ctx context.Context, brand string, name string, locale string) error {
+	key, err := MessageTemplateKey(brand, name, locale)
+	if err != nil {
+		return err
+	}
+
+	entry, err := nats.GetKV(ctx, messageTemplatesBucket, key)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return ErrTemplateNotFound
+		}
+		return fmt.Errorf("failed to get message template: %w", err)
+	}
+
+	return json.Unmarshal(entry.Value(), t)
+}
+
+// DeleteMessageTemplate removes a stored template from NATS KV Store
+func DeleteMessageTemplate(ctx context.Context, brand string, name string, locale string) error {
+	key, err := MessageTemplateKey(brand, name, locale)
+	if err != nil {
+		return err
+	}
+
+	if err := nats.RemoveKV(ctx, messageTemplatesBucket, key); err != nil {
+		return fmt.Errorf("failed to delete message template: %w", err)
+	}
+
+	return nil
+}
+
+// ListMessageTemplates returns a page of the stored templates in key order,
+// of one brand if it is set
+func ListMessageTemplates(ctx context.Context, brand string, opts ListOptions) (*Page[MessageTemplate], error) {
+	filter := ""
+	if brand != "" {
+		if !templateKeyRegex.MatchString(brand) {
+			return nil, &ValidationError{Field: "brand", Message: "brand must be 1 to 64 lower case letters, digits, _ or -"}
+		}
+		filter = brand + ".>"
+	}
+
+	page, err := queryPage[MessageTemplate](ctx, messageTemplatesBucket, filter, opts.query(OrderKey, false), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message templates: %w", err)
+	}
+
+	return page, nil
+}
+
+// ResolveMessageTemplate returns the template of a message for the first of
+// the locales that has one, trying each locale's language without its region
+// and then DefaultLocale. The brand's templates are tried before those of
+// DefaultBrand, and the built-in template is used last.
+func ResolveMessageTemplate(ctx context.Context, brand string, name string, locales []string) (*MessageTemplate, error) {
+	candidates := []string{}
+	for _, locale := range append(slices.Clone(locales), DefaultLocale) {
+		locale = utils.NormalizeLocale(locale)
+		if locale == "" {
+			continue
+		}
+		language, _, _ := strings.Cut(locale, "-")
+		for _, candidate := range []string{locale, language} {
+			if !slices.Contains(candidates, candidate) {
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+
+	brands := []string{DefaultBrand}
+	if brand != "" && brand != DefaultBrand {
+		brands = []string{brand, DefaultBrand}
+	}
+
+	for _, brand := range brands {
+		for _, locale := range candidates {
+			template := &MessageTemplate{}
+			err := template.GetMessageTemplate(ctx, brand, name, locale)
+			if err == nil {
+				return template, nil
+			}
+			var validationErr *ValidationError
+			if !errors.Is(err, ErrTemplateNotFound) && !errors.As(err, &validationErr) {
+				return nil, err
+			}
+		}
+	}
+
+	if template, ok := builtinTemplates[name]; ok {
+		template.Brand = DefaultBrand
+		return &template, nil
+	}
+
+	return nil, ErrTemplateNotFound
+}
+
+// NewTemplateMessage renders the template of a message for a brand and the
+// caller's locales into a message to phoneNumber
+func NewTemplateMessage(ctx context.Context, phoneNumber string, name string, brand string, locales []string, data utils.TemplateData) (utils.Message, error) {
+	template, err := ResolveMessageTemplate(ctx, brand, name, locales)
+	if err != nil {
+		return utils.Message{}, err
+	}
+
+	body, err := utils.RenderTemplate(template.Body, data)
+	if err != nil {
+		return utils.Message{}, fmt.Errorf("failed to render %s template for %s/%s: %w", name, template.Brand, template.Locale, err)
+	}
+	footer, err := utils.RenderTemplate(template.Footer, data)
+	if err != nil {
+		return utils.Message{}, fmt.Errorf("failed to render %s template footer for %s/%s: %w", name, template.Brand, template.Locale, err)
+	}
+
+	return utils.Message{
+		To:               phoneNumber,
+		Body:             body,
+		Footer:           footer,
+		Code:             data.Code,
+		WhatsAppTemplate: template.WhatsAppTemplate,
+		WhatsAppLanguage: template.WhatsAppLanguage,
+		Sender:           template.SMSSender,
+	}, nil
+}
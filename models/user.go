@@ -3,10 +3,11 @@ package models
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/json"
 	"fmt"
 	"infinirewards/nats"
+	"infinirewards/utils"
 	"regexp"
+	"strings"
 	"time"
 )
 
@@ -36,6 +37,10 @@ type UpdateUserRequest struct {
 
 	// Avatar is the user's avatar
 	Avatar string `json:"avatar"`
+
+	// Locale is the BCP 47 language tag messages are sent to the user in
+	// example: ms-MY
+	Locale string `json:"locale,omitempty"`
 }
 
 // UpgradeUserContractRequest represents the request for upgrading a user contract
@@ -43,6 +48,10 @@ type UpgradeUserContractRequest struct {
 	// NewClassHash is the class hash of the new implementation contract
 	// example: 0xabcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890
 	NewClassHash string `json:"newClassHash"`
+
+	// UserID is the user whose account contract is upgraded, defaults to the caller
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	UserID string `json:"userId,omitempty"`
 }
 
 // UpgradeUserContractResponse represents the response for upgrading a user contract
@@ -87,88 +96,212 @@ type User struct {
 
 	// AccountAddress is the user's StarkNet account address
 	AccountAddress string `json:"accountAddress"`
+
+	// Roles are the roles granted to the user
+	// example: ["user","merchant"]
+	Roles []Role `json:"roles"`
+
+	// LegacyID is the phone number hash the user was keyed by before moving to a stable ID
+	LegacyID string `json:"legacyId,omitempty"`
+
+	// Locale is the BCP 47 language tag messages are sent to the user in
+	// example: ms-MY
+	Locale string `json:"locale,omitempty"`
+
+	// NotificationPreferences controls how the user is notified of reward events
+	NotificationPreferences NotificationPreferences `json:"notificationPreferences"`
+
+	// SchemaVersion is the version of the stored document's schema
+	SchemaVersion int `json:"schemaVersion"`
+
+	// Revision is the store revision the user was read at, used to detect
+	// concurrent updates
+	Revision uint64 `json:"-"`
 }
 
 const (
 	usersBucket = "users"
 )
 
-// HashPhoneNumber generates a SHA-256 hash of the phone number
-func HashPhoneNumber(phoneNumber string) string {
+// HashPhoneNumber generates a keyed hash of the phone number for indexes and rate limits
+func HashPhoneNumber(phoneNumber string) (string, error) {
+	hash, err := utils.HashPhoneNumber(phoneNumber)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash phone number: %w", err)
+	}
+	return fmt.Sprintf("0x%x", hash), nil
+}
+
+// LegacyPhoneNumberHash generates the unkeyed SHA-256 hash of the phone number
+// that users were keyed by before they had stable IDs
+func LegacyPhoneNumberHash(phoneNumber string) string {
 	hash := sha256.Sum256([]byte(phoneNumber))
 	return fmt.Sprintf("0x%x", hash)
 }
 
-// CreateUser creates a new user in NATS KV Store
+// CreateUser creates a new user in the user store
 func (u *User) CreateUser(ctx context.Context) error {
-	// Generate ID from phone number hash
-	u.ID = HashPhoneNumber(u.PhoneNumber)
+	u.ID = NewUserID()
+	if err := ReservePhoneNumber(ctx, u.PhoneNumber, u.ID); err != nil {
+		return err
+	}
+
+	u.AddRole(RoleUser)
 	u.CreatedAt = time.Now()
 	u.UpdatedAt = time.Now()
 
-	// Store user data
-	userData, err := json.Marshal(u)
-	if err != nil {
-		return fmt.Errorf("failed to marshal user: %w", err)
-	}
-
-	if err := nats.PutKV(ctx, usersBucket, u.ID, userData); err != nil {
+	users := StoresFrom(ctx).Users
+	if err := reindex(ctx, u.ID, nil, userIndexEntries(u), userHolds, func() error {
+		return users.CreateUser(ctx, u)
+	}); err != nil {
+		// Free the number, or it would belong to a user that does not exist
+		if releaseErr := ReleasePhoneNumber(ctx, u.PhoneNumber, u.ID); releaseErr != nil {
+			return fmt.Errorf("failed to store user: %w, and to release the phone number: %w", err, releaseErr)
+		}
 		return fmt.Errorf("failed to store user: %w", err)
 	}
 
 	return nil
 }
 
-// GetUser retrieves a user by ID from NATS KV Store
+// GetUser retrieves a user by ID from the user store
 func (u *User) GetUser(ctx context.Context, id string) error {
-	userKV, err := nats.GetKV(ctx, usersBucket, id)
+	user, err := StoresFrom(ctx).Users.GetUser(ctx, id)
 	if err != nil {
 		return fmt.Errorf("failed to get user: %w", err)
 	}
 
-	return json.Unmarshal(userKV.Value(), u)
+	*u = *user
+	return nil
 }
 
-// GetUserFromPhoneNumber retrieves a user by phone number from NATS KV Store
+// GetUserFromPhoneNumber retrieves a user by phone number from the user store
 func (u *User) GetUserFromPhoneNumber(ctx context.Context, phoneNumber string) error {
-	// Generate ID from phone number hash
-	id := HashPhoneNumber(phoneNumber)
-
-	// Get user data directly using the hashed phone number as ID
-	userKV, err := nats.GetKV(ctx, usersBucket, id)
+	id, err := LookupPhoneNumber(ctx, phoneNumber)
 	if err != nil {
-		return fmt.Errorf("failed to get user: %w", err)
+		return err
 	}
 
-	return json.Unmarshal(userKV.Value(), u)
+	return u.GetUser(ctx, id)
 }
 
-// UpdateUser updates an existing user in NATS KV Store
+// UpdateUser writes the user back if it was not changed since it was read,
+// and fails with a conflict (nats.IsConflict) otherwise. A user that was not
+// read from the user store is created. Its email and account address
+// indexes are updated with it.
 func (u *User) UpdateUser(ctx context.Context) error {
 	u.UpdatedAt = time.Now()
-	userData, err := json.Marshal(u)
-	if err != nil {
-		return fmt.Errorf("failed to marshal user: %w", err)
+
+	users := StoresFrom(ctx).Users
+	previous := []indexEntry{}
+	write := func() error { return users.CreateUser(ctx, u) }
+	if u.Revision != 0 {
+		stored, err := users.GetUser(ctx, u.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update user: %w", err)
+		}
+		if stored.Revision != u.Revision {
+			return fmt.Errorf("failed to update user: %w", nats.ErrConflict)
+		}
+		previous = userIndexEntries(stored)
+		write = func() error { return users.UpdateUser(ctx, u) }
 	}
 
-	if err := nats.PutKV(ctx, usersBucket, u.ID, userData); err != nil {
+	if err := reindex(ctx, u.ID, previous, userIndexEntries(u), userHolds, write); err != nil {
 		return fmt.Errorf("failed to update user: %w", err)
 	}
 
 	return nil
 }
 
-// DeleteUser deletes a user from NATS KV Store
+// ModifyUser reads a user, changes it with fn and writes it back. If the user
+// was updated in between, it is read again and fn is called again.
+func ModifyUser(ctx context.Context, id string, fn func(user *User) error) (*User, error) {
+	user := &User{}
+	err := nats.RetryOnConflict(ctx, func() error {
+		if err := user.GetUser(ctx, id); err != nil {
+			return err
+		}
+		if err := fn(user); err != nil {
+			return err
+		}
+		return user.UpdateUser(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// DeleteUser deletes a user from the user store
 func (u *User) DeleteUser(ctx context.Context) error {
+	// Delete the user's passkeys so they cannot log in to a recreated account
+	if _, err := DeleteUserPasskeys(ctx, u.ID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
 
 	// Delete user data
-	if err := nats.RemoveKV(ctx, usersBucket, u.ID); err != nil {
+	users := StoresFrom(ctx).Users
+	entries := userIndexEntries(u)
+	if stored, err := users.GetUser(ctx, u.ID); err == nil {
+		entries = userIndexEntries(stored)
+	}
+	if err := users.DeleteUser(ctx, u.ID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	for _, entry := range entries {
+		if err := releaseIndexEntry(ctx, entry, u.ID); err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+	}
+
+	// Free the phone number for a new account
+	if err := ReleasePhoneNumber(ctx, u.PhoneNumber, u.ID); err != nil {
 		return fmt.Errorf("failed to delete user: %w", err)
 	}
 
 	return nil
 }
 
+// ListUsers lists all users in the user store
+func ListUsers(ctx context.Context) ([]*User, error) {
+	users, err := StoresFrom(ctx).Users.ListUsers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	return users, nil
+}
+
+// UserFilter selects the users of SearchUsers. Empty fields match all users.
+type UserFilter struct {
+	// Role matches users that have the role
+	Role Role
+	// Name matches users whose name contains it, ignoring case
+	Name string
+}
+
+// SearchUsers returns a page of the users that match filter, newest first
+func SearchUsers(ctx context.Context, filter UserFilter, opts ListOptions) (*Page[User], error) {
+	if _, ok := RolePermissions[filter.Role]; filter.Role != "" && !ok {
+		return nil, &ValidationError{Field: "role", Message: fmt.Sprintf("unknown role %q", filter.Role)}
+	}
+
+	name := strings.ToLower(filter.Name)
+	users, next, err := StoresFrom(ctx).Users.PageUsers(ctx, opts.query(OrderCreated, true), func(user *User) bool {
+		if filter.Role != "" && !user.HasRole(filter.Role) {
+			return false
+		}
+		return strings.Contains(strings.ToLower(user.Name), name)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+
+	return &Page[User]{Items: users, NextCursor: next}, nil
+}
+
 func (r *CreateUserRequest) Validate() error {
 	if r.Name == "" {
 		return &ValidationError{
@@ -202,5 +335,11 @@ func (r *UpdateUserRequest) Validate() error {
 			Message: "name must be less than 100 characters",
 		}
 	}
+	if r.Locale != "" && utils.NormalizeLocale(r.Locale) == "" {
+		return &ValidationError{
+			Field:   "locale",
+			Message: "locale must be a BCP 47 language tag such as en or ms-MY",
+		}
+	}
 	return nil
 }
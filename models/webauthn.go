@@ -0,0 +1,376 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	passkeysBucket         = "passkeys"
+	webauthnSessionsBucket = "webauthnSessions"
+
+	// WebAuthnPurposeRegistration marks a session started to register a passkey
+	WebAuthnPurposeRegistration = "registration"
+	// WebAuthnPurposeLogin marks a session started to log in with a passkey
+	WebAuthnPurposeLogin = "login"
+)
+
+// ErrPasskeyChanged is returned by UpdatePasskey when the passkey was deleted
+// or updated by another login since it was read
+var ErrPasskeyChanged = errors.New("passkey was changed since it was read")
+
+// BeginPasskeyRegistrationRequest represents the request for starting a passkey registration
+type BeginPasskeyRegistrationRequest struct {
+	// Name helps the user recognise the passkey later
+	// example: My Phone
+	Name string `json:"name"`
+}
+
+// BeginWebAuthnResponse represents the response for starting a registration or login ceremony
+type BeginWebAuthnResponse struct {
+	// SessionID must be sent back with the finish request
+	// example: 01HNAJ6640M9JRRJFQSZZVE3HH
+	SessionID string `json:"sessionId"`
+
+	// Options are passed to navigator.credentials.create or navigator.credentials.get
+	Options interface{} `json:"options"`
+}
+
+// FinishWebAuthnRequest represents the request for finishing a registration or login ceremony
+type FinishWebAuthnRequest struct {
+	// SessionID is the session returned by the begin request
+	// example: 01HNAJ6640M9JRRJFQSZZVE3HH
+	SessionID string `json:"sessionId"`
+
+	// Device identifies the device for the issued token (login only)
+	// example: iPhone 15
+	Device string `json:"device"`
+
+	// Credential is the PublicKeyCredential returned by the browser
+	Credential json.RawMessage `json:"credential" swaggertype:"object"`
+}
+
+// PasskeyCredential is a WebAuthn credential registered by a user
+type PasskeyCredential struct {
+	// ID is the base64url encoded credential ID
+	// example: AbCdEf123
+	ID string `json:"id"`
+
+	// UserID is the owner of the credential
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	UserID string `json:"userId"`
+
+	// Name helps the user recognise the passkey
+	// example: My Phone
+	Name string `json:"name"`
+
+	// Credential is the credential record verified on login
+	Credential webauthn.Credential `json:"-"`
+
+	// CreatedAt is the time the passkey was registered
+	CreatedAt time.Time `json:"createdAt"`
+
+	// LastUsedAt is the time the passkey was last used to log in
+	LastUsedAt time.Time `json:"lastUsedAt,omitempty"`
+
+	// Revision is the store revision the passkey was read at, used to detect
+	// concurrent updates and deletions
+	Revision uint64 `json:"-"`
+}
+
+// storedPasskey is the representation of a PasskeyCredential in the passkeys bucket
+type storedPasskey struct {
+	PasskeyCredential
+	Credential webauthn.Credential `json:"credential"`
+}
+
+func newStoredPasskey(p *PasskeyCredential) *storedPasskey {
+	return &storedPasskey{PasskeyCredential: *p, Credential: p.Credential}
+}
+
+// passkey returns the passkey with its credential
+func (s *storedPasskey) passkey() *PasskeyCredential {
+	passkey := s.PasskeyCredential
+	passkey.Credential = s.Credential
+	return &passkey
+}
+
+func (p *PasskeyCredential) setRevision(revision uint64) {
+	p.Revision = revision
+}
+
+func storedPasskeys(stored []*storedPasskey) []*PasskeyCredential {
+	passkeys := make([]*PasskeyCredential, 0, len(stored))
+	for _, s := range stored {
+		passkeys = append(passkeys, s.passkey())
+	}
+	return passkeys
+}
+
+// WebAuthnSession holds the challenge of a ceremony between its begin and finish requests
+type WebAuthnSession struct {
+	ID      string               `json:"id"`
+	Purpose string               `json:"purpose"`
+	UserID  string               `json:"userId,omitempty"`
+	Name    string               `json:"name,omitempty"`
+	Data    webauthn.SessionData `json:"data"`
+}
+
+// WebAuthnUser adapts a User and their passkeys to webauthn.User
+type WebAuthnUser struct {
+	User     *User
+	Passkeys []*PasskeyCredential
+}
+
+// WebAuthnID returns the user handle. Legacy IDs are hex encoded phone number
+// hashes that exceed the 64 byte limit, so their raw hash is used instead, and
+// moved users keep the handle their passkeys were registered with.
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	id := u.User.ID
+	if u.User.LegacyID != "" {
+		id = u.User.LegacyID
+	}
+	if !IsLegacyUserID(id) {
+		return []byte(id)
+	}
+	handle, err := hex.DecodeString(strings.TrimPrefix(id, "0x"))
+	if err != nil {
+		return []byte(id)
+	}
+	return handle
+}
+
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.User.PhoneNumber
+}
+
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	if u.User.Name != "" {
+		return u.User.Name
+	}
+	return u.User.PhoneNumber
+}
+
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.Passkeys))
+	for _, passkey := range u.Passkeys {
+		credentials = append(credentials, passkey.Credential)
+	}
+	return credentials
+}
+
+// Exclusions lists the registered passkeys so the browser does not register an authenticator twice
+func (u *WebAuthnUser) Exclusions() []protocol.CredentialDescriptor {
+	descriptors := make([]protocol.CredentialDescriptor, 0, len(u.Passkeys))
+	for _, passkey := range u.Passkeys {
+		descriptors = append(descriptors, passkey.Credential.Descriptor())
+	}
+	return descriptors
+}
+
+// Passkey returns the passkey with the given raw credential ID
+func (u *WebAuthnUser) Passkey(credentialID []byte) *PasskeyCredential {
+	id := EncodeCredentialID(credentialID)
+	for _, passkey := range u.Passkeys {
+		if passkey.ID == id {
+			return passkey
+		}
+	}
+	return nil
+}
+
+// UserIDFromWebAuthnHandle converts a user handle back to a user ID
+func UserIDFromWebAuthnHandle(handle []byte) string {
+	if len(handle) == sha256.Size {
+		return "0x" + hex.EncodeToString(handle)
+	}
+	return string(handle)
+}
+
+// EncodeCredentialID encodes a raw credential ID for use as a KV key and in the API
+func EncodeCredentialID(credentialID []byte) string {
+	return base64.RawURLEncoding.EncodeToString(credentialID)
+}
+
+// LoadWebAuthnUser loads a user together with their passkeys
+func LoadWebAuthnUser(ctx context.Context, userID string) (*WebAuthnUser, error) {
+	user := &User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	passkeys, err := GetPasskeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebAuthnUser{User: user, Passkeys: passkeys}, nil
+}
+
+// CreatePasskey stores a newly registered passkey
+func (p *PasskeyCredential) CreatePasskey(ctx context.Context) error {
+	p.ID = EncodeCredentialID(p.Credential.ID)
+	p.CreatedAt = time.Now()
+
+	if err := StoresFrom(ctx).Passkeys.CreatePasskey(ctx, p); err != nil {
+		return fmt.Errorf("failed to store passkey: %w", err)
+	}
+
+	return nil
+}
+
+// UpdatePasskey saves the sign count and last use of a passkey after a login.
+// It fails with ErrPasskeyChanged when the passkey was deleted or used by
+// another login since it was read, so a revoked passkey is not stored again.
+func (p *PasskeyCredential) UpdatePasskey(ctx context.Context) error {
+	if err := StoresFrom(ctx).Passkeys.UpdatePasskey(ctx, p); err != nil {
+		if nats.IsConflict(err) {
+			return ErrPasskeyChanged
+		}
+		return fmt.Errorf("failed to update passkey: %w", err)
+	}
+
+	return nil
+}
+
+// putPasskey stores a passkey under its key whatever was stored there, to
+// copy it to a new owner
+func (p *PasskeyCredential) putPasskey(ctx context.Context) error {
+	if err := StoresFrom(ctx).Passkeys.PutPasskey(ctx, p); err != nil {
+		return fmt.Errorf("failed to store passkey: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePasskey removes a passkey of a user
+func DeletePasskey(ctx context.Context, userID string, passkeyID string) error {
+	passkeys := StoresFrom(ctx).Passkeys
+	if _, err := passkeys.GetPasskey(ctx, userID, passkeyID); err != nil {
+		return fmt.Errorf("passkey not found: %w", err)
+	}
+
+	if err := passkeys.DeletePasskey(ctx, userID, passkeyID); err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+
+	return nil
+}
+
+// GetPasskeys lists the passkeys of a user
+func GetPasskeys(ctx context.Context, userID string) ([]*PasskeyCredential, error) {
+	passkeys, err := StoresFrom(ctx).Passkeys.ListPasskeys(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+
+	return passkeys, nil
+}
+
+// DeleteUserPasskeys deletes all passkeys of a user and returns how many were
+// deleted
+func DeleteUserPasskeys(ctx context.Context, userID string) (int, error) {
+	passkeys, err := GetPasskeys(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, passkey := range passkeys {
+		if err := DeletePasskey(ctx, userID, passkey.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(passkeys), nil
+}
+
+// ListPasskeys returns a page of the passkeys of a user in the order they
+// were registered
+func ListPasskeys(ctx context.Context, userID string, opts ListOptions) (*Page[PasskeyCredential], error) {
+	passkeys, next, err := StoresFrom(ctx).Passkeys.PagePasskeys(ctx, userID, opts.query(OrderCreated, false))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list passkeys: %w", err)
+	}
+
+	return &Page[PasskeyCredential]{Items: passkeys, NextCursor: next}, nil
+}
+
+// CreateWebAuthnSession stores the challenge of a ceremony
+func (s *WebAuthnSession) CreateWebAuthnSession(ctx context.Context) error {
+	s.ID = ulid.Make().String()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WebAuthn session: %w", err)
+	}
+
+	if err := nats.PutKV(ctx, webauthnSessionsBucket, s.ID, data); err != nil {
+		return fmt.Errorf("failed to store WebAuthn session: %w", err)
+	}
+
+	return nil
+}
+
+// ConsumeWebAuthnSession loads a session and deletes it so its challenge can only be answered once
+func ConsumeWebAuthnSession(ctx context.Context, id string, purpose string) (*WebAuthnSession, error) {
+	entry, err := nats.GetKV(ctx, webauthnSessionsBucket, id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid or expired session")
+	}
+
+	// Only one of concurrent finish requests may remove the session
+	if err := nats.RemoveKVRevision(ctx, webauthnSessionsBucket, id, entry.Revision()); err != nil {
+		if nats.IsConflict(err) {
+			return nil, fmt.Errorf("invalid or expired session")
+		}
+		return nil, fmt.Errorf("failed to consume WebAuthn session: %w", err)
+	}
+
+	var session WebAuthnSession
+	if err := json.Unmarshal(entry.Value(), &session); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal WebAuthn session: %w", err)
+	}
+
+	if session.Purpose != purpose {
+		return nil, fmt.Errorf("invalid or expired session")
+	}
+
+	return &session, nil
+}
+
+func (r *BeginPasskeyRegistrationRequest) Validate() error {
+	if len(r.Name) > 100 {
+		return &ValidationError{
+			Field:   "name",
+			Message: "name must be less than 100 characters",
+		}
+	}
+	return nil
+}
+
+func (r *FinishWebAuthnRequest) Validate() error {
+	if r.SessionID == "" {
+		return &ValidationError{
+			Field:   "sessionId",
+			Message: "session ID is required",
+		}
+	}
+	if len(r.Credential) == 0 {
+		return &ValidationError{
+			Field:   "credential",
+			Message: "credential is required",
+		}
+	}
+	return nil
+}
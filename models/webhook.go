@@ -1,5 +1,33 @@
 package models
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"infinirewards/nats"
+	"time"
+)
+
+const botMessagesBucket = "botMessages"
+
+// ErrMessageClaimed is returned by ClaimBotMessage for a message that was
+// already claimed
+var ErrMessageClaimed = errors.New("message already claimed")
+
+// ClaimBotMessage records that the bot runs the command of an inbound
+// WhatsApp message, so a redelivered webhook does not run it again. It fails
+// with ErrMessageClaimed when the message was claimed before.
+func ClaimBotMessage(ctx context.Context, messageID string) error {
+	if _, err := nats.CreateKV(ctx, botMessagesBucket, messageID, []byte{}); err != nil {
+		if nats.IsConflict(err) {
+			return ErrMessageClaimed
+		}
+		return fmt.Errorf("failed to claim message: %w", err)
+	}
+
+	return nil
+}
+
 type WebhookResponse struct {
 	Object string  `json:"object,omitempty"`
 	Entry  []Entry `json:"entry,omitempty"`
@@ -50,17 +78,32 @@ type Metadata struct {
 }
 
 type Message struct {
-	From      string `json:"from,omitempty"`
-	ID        string `json:"id,omitempty"`
-	Timestamp string `json:"timestamp,omitempty"`
-	Text      Text   `json:"text,omitempty"`
-	Type      string `json:"type,omitempty"`
+	From        string             `json:"from,omitempty"`
+	ID          string             `json:"id,omitempty"`
+	Timestamp   string             `json:"timestamp,omitempty"`
+	Text        Text               `json:"text,omitempty"`
+	Interactive MessageInteractive `json:"interactive,omitempty"`
+	Type        string             `json:"type,omitempty"`
 }
 
 type Text struct {
 	Body string `json:"body,omitempty"`
 }
 
+// MessageInteractive is the reply of a user to a list or button message
+type MessageInteractive struct {
+	Type        string           `json:"type,omitempty"`
+	ButtonReply InteractiveReply `json:"button_reply,omitempty"`
+	ListReply   InteractiveReply `json:"list_reply,omitempty"`
+}
+
+// InteractiveReply is the button or list row a user picked
+type InteractiveReply struct {
+	ID          string `json:"id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
 type Status struct {
 	ID                    string       `json:"id,omitempty"`
 	BizOpaqueCallbackData string       `json:"biz_opaque_callback_data,omitempty"`
@@ -86,3 +129,10 @@ type Pricing struct {
 	Category     string `json:"category,omitempty"`
 	PricingModel string `json:"pricing_model,omitempty"`
 }
+
+// WhatsAppWebhookEvent is one change of a WhatsApp webhook as queued for the worker
+type WhatsAppWebhookEvent struct {
+	EntryID    string    `json:"entryId"`
+	Change     Change    `json:"change"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
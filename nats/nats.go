@@ -1,14 +1,22 @@
 package nats
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"infinirewards/config"
 	"infinirewards/utils"
+	"math/rand/v2"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/joho/godotenv"
 	"github.com/nats-io/jwt"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/jetstream"
@@ -26,29 +34,26 @@ type Account struct {
 	PublicKey string
 }
 
-func ConnectNats() error {
-	err := godotenv.Load(".env")
-	if err != nil {
-		return fmt.Errorf("failed to load .env file: %w", err)
-	}
+// ConnectNats connects to the NATS server and creates the streams, buckets
+// and object stores the server uses
+func ConnectNats(cfg config.NATSConfig) error {
+	accountPublicKey = cfg.AccountPublicKey
+	accSeed = cfg.AccountSeed
+	natsUrl := cfg.URL
 
-	accountPublicKey = os.Getenv("NATS_ACCOUNT_PUBLIC_KEY")
-	accSeed = os.Getenv("NATS_ACCOUNT_SEED")
-	natsUrl := os.Getenv("NATS_URL")
-
-	// Validate required environment variables
 	if accountPublicKey == "" || accSeed == "" || natsUrl == "" {
-		return fmt.Errorf("missing required NATS environment variables: URL=%v, PublicKey=%v, Seed=%v",
+		return fmt.Errorf("missing required NATS configuration: URL=%v, PublicKey=%v, Seed=%v",
 			natsUrl != "", accountPublicKey != "", accSeed != "")
 	}
 
 	// Check if credentials file exists
-	if _, err := os.Stat("./backend.creds"); err != nil {
-		return fmt.Errorf("NATS credentials file not found at ./backend.creds: %w", err)
+	if _, err := os.Stat(cfg.CredentialsFile); err != nil {
+		return fmt.Errorf("NATS credentials file not found at %s: %w", cfg.CredentialsFile, err)
 	}
 
+	var err error
 	NC, err = nats.Connect(natsUrl,
-		nats.UserCredentials("./backend.creds"),
+		nats.UserCredentials(cfg.CredentialsFile),
 		nats.Name("InfiniRewards Microservice Server (backend)"),
 		nats.RetryOnFailedConnect(true),
 		nats.MaxReconnects(5),
@@ -76,6 +81,44 @@ func ConnectNats() error {
 		return fmt.Errorf("failed to create/update webhooks stream (replicas: 3): %w", err)
 	}
 
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:        WebhooksDLQStream,
+		Description: "Webhook requests that could not be processed",
+		Subjects:    []string{"dlq.webhooks.>"},
+		MaxBytes:    -1,
+		MaxAge:      time.Hour * 24 * 30,
+		Replicas:    3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update webhooks DLQ stream (replicas: 3): %w", err)
+	}
+
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:        EventsStream,
+		Description: "Domain events such as points minted or collectibles redeemed",
+		Subjects:    []string{"events.>"},
+		MaxBytes:    -1,
+		MaxAge:      time.Hour * 24 * 7,
+		Replicas:    3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update events stream (replicas: 3): %w", err)
+	}
+
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:        AuditStream,
+		Description: "Hash chained audit log of mutating requests",
+		Subjects:    []string{"audit.>"},
+		MaxBytes:    -1,
+		MaxAge:      time.Hour * 24 * 365,
+		DenyDelete:  true,
+		DenyPurge:   true,
+		Replicas:    3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update audit stream (replicas: 3): %w", err)
+	}
+
 	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
 		Bucket:      "token",
 		Description: "JWTs",
@@ -86,124 +129,899 @@ func ConnectNats() error {
 		return fmt.Errorf("failed to create/update token KV bucket: %w", err)
 	}
 
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "userTokens",
+		Description: "Tokens issued to each user",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24 * 90,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update user tokens KV bucket: %w", err)
+	}
+
 	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
 		Bucket:      "users",
 		Description: "Users",
 		MaxBytes:    -1,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to create/update users KV bucket: %w", err)
+		return fmt.Errorf("failed to create/update users KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "merchants",
+		Description: "Merchants",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update merchants KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "apikeys",
+		Description: "API keys",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update API keys KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "phoneVerification",
+		Description: "Phone verifications",
+		MaxBytes:    -1,
+		TTL:         time.Minute * 5,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update phone verification KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "rateLimits",
+		Description: "Rate limit counters",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update rate limits KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "passkeys",
+		Description: "WebAuthn passkeys",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update passkeys KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "webauthnSessions",
+		Description: "WebAuthn ceremony sessions",
+		MaxBytes:    -1,
+		TTL:         time.Minute * 5,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update WebAuthn sessions KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "phoneIndex",
+		Description: "Phone number to user index",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update phone index KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "messageDeliveries",
+		Description: "Delivery records of sent messages",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update message deliveries KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "messageTemplates",
+		Description: "Message templates by brand and locale",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update message templates KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "accountIndex",
+		Description: "Account address to user index",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update account index KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "emailIndex",
+		Description: "Email to user index",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update email index KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "merchantIndex",
+		Description: "Merchant account address to merchant index",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update merchant index KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "contractIndex",
+		Description: "Points and collectible contract address to merchant index",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update contract index KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "schemaMigrations",
+		Description: "Schema migrations applied to each bucket",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update schema migrations KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "notifications",
+		Description: "In-app notification inbox",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24 * 90,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update notifications KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "notificationDigests",
+		Description: "Notifications waiting to be sent in a batch",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24 * 7,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update notification digests KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "collectibleExpiries",
+		Description: "Collectibles to remind their holders about before they expire",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update collectible expiries KV bucket: %w", err)
+	}
+
+	// Reachability expires so numbers are tried again on channels they joined
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "reachability",
+		Description: "Whether phone numbers can be reached on a channel",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24 * 30,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update reachability KV bucket: %w", err)
+	}
+
+	// WhatsApp retries webhooks for up to a week
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "botMessages",
+		Description: "Inbound WhatsApp messages claimed by the bot",
+		MaxBytes:    -1,
+		TTL:         time.Hour * 24 * 7,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update bot messages KV bucket: %w", err)
+	}
+
+	// Nonces must outlive the replay window on both sides of the server time
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "requestNonces",
+		Description: "Nonces of signed requests",
+		MaxBytes:    -1,
+		TTL:         time.Minute * 10,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update request nonces KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "phoneChanges",
+		Description: "Pending phone number changes",
+		MaxBytes:    -1,
+		TTL:         time.Minute * 5,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update phone changes KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "movedUsers",
+		Description: "Legacy user IDs moved to stable IDs",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update moved users KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "accountDeletions",
+		Description: "Progress of account deletions",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update account deletions KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "tombstones",
+		Description: "Deleted accounts",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update tombstones KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "media",
+		Description: "Uploaded media",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update media KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "collectibleImages",
+		Description: "Media shown for collectible tokens",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update collectible images KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateObjectStore(context.Background(), jetstream.ObjectStoreConfig{
+		Bucket:      MediaObjectStore,
+		Description: "Uploaded images and their thumbnails",
+		MaxBytes:    -1,
+		Replicas:    3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update media object store (replicas: 3): %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "jwtKeys",
+		Description: "JWT signing keys",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update JWT keys KV bucket: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
+		Bucket:      "jwtLeader",
+		Description: "JWT key rotation leader lease",
+		MaxBytes:    -1,
+		TTL:         time.Second * 30,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create/update JWT leader KV bucket: %w", err)
+	}
+
+	return nil
+}
+
+// KeyValue returns a handle to a KV bucket for callers that need to watch it
+func KeyValue(ctx context.Context, bucket string) (jetstream.KeyValue, error) {
+	if js == nil {
+		return nil, fmt.Errorf("JetStream not initialized")
+	}
+
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	return kv, nil
+}
+
+func PutKV(ctx context.Context, bucket string, key string, value []byte) error {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	_, err = kv.Put(ctx, key, value)
+	if err != nil {
+		return fmt.Errorf("failed to put KV value: %w", err)
+	}
+
+	return nil
+}
+
+// CreateKV stores a value only if the key does not exist yet and returns the new revision
+func CreateKV(ctx context.Context, bucket string, key string, value []byte) (uint64, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	revision, err := kv.Create(ctx, key, value)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create KV value: %w", err)
+	}
+
+	return revision, nil
+}
+
+// UpdateKV stores a value only if the key is still at the given revision and returns the new revision
+func UpdateKV(ctx context.Context, bucket string, key string, value []byte, revision uint64) (uint64, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	revision, err = kv.Update(ctx, key, value, revision)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update KV value: %w", err)
+	}
+
+	return revision, nil
+}
+
+// ErrConflict is returned by stores other than KV buckets when a write lost a
+// race, so IsConflict matches it as well
+var ErrConflict = errors.New("revision conflict")
+
+// ConflictRetries is how many times a read-modify-write is tried before a
+// conflict is returned to the caller
+var ConflictRetries = 5
+
+// IsConflict reports whether err was caused by a CreateKV or UpdateKV losing a race
+func IsConflict(err error) bool {
+	if errors.Is(err, jetstream.ErrKeyExists) || errors.Is(err, ErrConflict) {
+		return true
+	}
+	var apiErr *jetstream.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == jetstream.JSErrCodeStreamWrongLastSequence
+}
+
+// RetryOnConflict runs a read-modify-write until it does not lose a race,
+// up to ConflictRetries times. fn must read the value again on every call.
+func RetryOnConflict(ctx context.Context, fn func() error) error {
+	var err error
+	for attempt := 0; attempt < ConflictRetries; attempt++ {
+		if err = fn(); !IsConflict(err) {
+			return err
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+	}
+	return err
+}
+
+// UpdateKVFunc reads a key, changes its value with fn and stores the result
+// only if the key was not written in between, retrying on conflict. A
+// missing key is passed to fn as nil and created. It returns the new revision.
+func UpdateKVFunc(ctx context.Context, bucket string, key string, fn func(value []byte) ([]byte, error)) (uint64, error) {
+	var revision uint64
+	err := RetryOnConflict(ctx, func() error {
+		var current []byte
+		var currentRevision uint64
+		entry, err := GetKV(ctx, bucket, key)
+		switch {
+		case err == nil:
+			current = entry.Value()
+			currentRevision = entry.Revision()
+		case !IsNotFound(err):
+			return err
+		}
+
+		value, err := fn(current)
+		if err != nil {
+			return err
+		}
+
+		if currentRevision == 0 {
+			revision, err = CreateKV(ctx, bucket, key, value)
+		} else {
+			revision, err = UpdateKV(ctx, bucket, key, value, currentRevision)
+		}
+		return err
+	})
+	return revision, err
+}
+
+// IsNotFound reports whether err was caused by a missing or deleted KV key
+func IsNotFound(err error) bool {
+	return errors.Is(err, jetstream.ErrKeyNotFound) || errors.Is(err, jetstream.ErrKeyDeleted) || errors.Is(err, jetstream.ErrObjectNotFound)
+}
+
+func GetKV(ctx context.Context, bucket string, key string) (jetstream.KeyValueEntry, error) {
+	if js == nil {
+		return nil, fmt.Errorf("JetStream not initialized")
+	}
+
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	data, err := kv.Get(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV value: %w", err)
+	}
+
+	return data, nil
+}
+
+func RemoveKV(ctx context.Context, bucket string, key string) error {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	err = kv.Delete(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to delete KV value: %w", err)
+	}
+
+	return nil
+}
+
+// RemoveKVRevision deletes a key only if it is still at the given revision
+func RemoveKVRevision(ctx context.Context, bucket string, key string, revision uint64) error {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	err = kv.Delete(ctx, key, jetstream.LastRevision(revision))
+	if err != nil {
+		return fmt.Errorf("failed to delete KV value: %w", err)
+	}
+
+	return nil
+}
+
+func GetKVValues[T any](ctx context.Context, bucket string, keyFilter string, transformFunc func(jetstream.KeyValueEntry, *T)) ([]*T, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	watcher, _ := kv.Watch(ctx, keyFilter, jetstream.IgnoreDeletes())
+	defer watcher.Stop()
+
+	result := make([]*T, 0)
+
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var t T
+		if err := json.Unmarshal(entry.Value(), &t); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal KV value: %w", err)
+		}
+		transformFunc(entry, &t)
+		result = append(result, &t)
+	}
+	return result, nil
+}
+
+// GetKVEntries returns the entries of a bucket whose keys match keyFilter,
+// for buckets that do not hold JSON values
+func GetKVEntries(ctx context.Context, bucket string, keyFilter string) ([]jetstream.KeyValueEntry, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	watcher, err := kv.Watch(ctx, keyFilter, jetstream.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch KV bucket: %w", err)
+	}
+	defer watcher.Stop()
+
+	entries := make([]jetstream.KeyValueEntry, 0)
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// GetKVHistory returns the revisions a bucket keeps of a key, oldest first
+func GetKVHistory(ctx context.Context, bucket string, key string) ([]jetstream.KeyValueEntry, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	entries, err := kv.History(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get KV history: %w", err)
+	}
+	return entries, nil
+}
+
+// KVLastRevision returns the latest revision written to a bucket. Revisions
+// of all keys share one sequence, so later writes have higher revisions.
+func KVLastRevision(ctx context.Context, bucket string) (uint64, error) {
+	kv, err := js.KeyValue(ctx, bucket)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get KV bucket: %w", err)
+	}
+
+	status, err := kv.Status(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get KV status: %w", err)
+	}
+	bucketStatus, ok := status.(*jetstream.KeyValueBucketStatus)
+	if !ok {
+		return 0, fmt.Errorf("unexpected KV status %T", status)
+	}
+	return bucketStatus.StreamInfo().State.LastSeq, nil
+}
+
+// KeyValueBuckets returns the names of all KV buckets, sorted
+func KeyValueBuckets(ctx context.Context) ([]string, error) {
+	lister := js.KeyValueStoreNames(ctx)
+	names := []string{}
+	for name := range lister.Name() {
+		names = append(names, name)
+	}
+	if err := lister.Error(); err != nil {
+		return nil, fmt.Errorf("failed to list KV buckets: %w", err)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// StreamNames returns the names of the streams that do not back a KV or
+// object store bucket, sorted
+func StreamNames(ctx context.Context) ([]string, error) {
+	lister := js.StreamNames(ctx)
+	names := []string{}
+	for name := range lister.Name() {
+		if strings.HasPrefix(name, "KV_") || strings.HasPrefix(name, "OBJ_") {
+			continue
+		}
+		names = append(names, name)
+	}
+	if err := lister.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list streams: %w", err)
+	}
+
+	sort.Strings(names)
+	return names, nil
+}
+
+// StreamState returns the message count and sequences of a stream
+func StreamState(ctx context.Context, streamName string) (*jetstream.StreamState, error) {
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream: %w", err)
 	}
 
-	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
-		Bucket:      "merchants",
-		Description: "Merchants",
-		MaxBytes:    -1,
-	})
+	info, err := stream.Info(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create/update merchants KV bucket: %w", err)
+		return nil, fmt.Errorf("failed to get stream info: %w", err)
 	}
+	return &info.State, nil
+}
 
-	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
-		Bucket:      "apikeys",
-		Description: "API keys",
-		MaxBytes:    -1,
-	})
+// ReadStream passes the messages of a stream up to and including lastSeq to
+// fn in sequence order, skipping deleted messages
+func ReadStream(ctx context.Context, streamName string, lastSeq uint64, fn func(msg *jetstream.RawStreamMsg) error) error {
+	stream, err := js.Stream(ctx, streamName)
 	if err != nil {
-		return fmt.Errorf("failed to create/update API keys KV bucket: %w", err)
+		return fmt.Errorf("failed to get stream: %w", err)
 	}
 
-	_, err = js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
-		Bucket:      "phoneVerification",
-		Description: "Phone verifications",
-		MaxBytes:    -1,
-		TTL:         time.Minute * 5,
-	})
+	info, err := stream.Info(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to create/update phone verification KV bucket: %w", err)
+		return fmt.Errorf("failed to get stream info: %w", err)
 	}
 
+	for seq := info.State.FirstSeq; seq > 0 && seq <= lastSeq; seq++ {
+		msg, err := stream.GetMsg(ctx, seq)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get stream message %d: %w", seq, err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func PutKV(ctx context.Context, bucket string, key string, value []byte) error {
+// KVOrder is the order of the entries of a KV query
+type KVOrder string
+
+const (
+	// OrderKey sorts entries by key
+	OrderKey KVOrder = "key"
+	// OrderCreated sorts entries by creation time and then by key
+	OrderCreated KVOrder = "created"
+)
+
+// ErrInvalidCursor is returned for cursors that were not returned by a query
+// in the same order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// KVQuery selects a page of the entries of a bucket
+type KVQuery struct {
+	// Filter matches the keys of the entries, all keys if empty
+	Filter string
+	// Limit is the maximum number of entries of a page, unlimited if zero
+	Limit int
+	// Cursor is the next cursor of the previous page, empty for the first page
+	Cursor string
+	// Order sorts the entries, OrderKey if empty
+	Order      KVOrder
+	Descending bool
+	// CreatedAt returns the creation time of an entry for OrderCreated. When
+	// it is nil the time of the entry's last write is used and no values are
+	// read besides those of the page.
+	CreatedAt func(entry jetstream.KeyValueEntry) time.Time
+}
+
+// KVPosition is where an entry sorts in a KV query
+type KVPosition struct {
+	Key     string
+	Created time.Time
+}
+
+// kvCursor is the position of the last entry of a page
+type kvCursor struct {
+	Order      KVOrder `json:"o"`
+	Descending bool    `json:"d,omitempty"`
+	Key        string  `json:"k"`
+	Created    int64   `json:"c,omitempty"`
+}
+
+// QueryKV passes the entries of a page of a bucket to fn in query order until
+// fn has accepted query.Limit of them, and returns the cursor of the next page,
+// which is empty after the last page. fn rejects entries that do not match
+// the caller's filters. Only the keys of the bucket are read up front, the
+// values are read one at a time for fn.
+func QueryKV(ctx context.Context, bucket string, query KVQuery, fn func(entry jetstream.KeyValueEntry) (bool, error)) (string, error) {
 	kv, err := js.KeyValue(ctx, bucket)
 	if err != nil {
-		return fmt.Errorf("failed to get KV bucket: %w", err)
+		return "", fmt.Errorf("failed to get KV bucket: %w", err)
 	}
 
-	_, err = kv.Put(ctx, key, value)
+	filter := query.Filter
+	if filter == "" {
+		filter = ">"
+	}
+	createdAt := query.Order == OrderCreated && query.CreatedAt != nil
+	opts := []jetstream.WatchOpt{jetstream.IgnoreDeletes()}
+	if !createdAt {
+		opts = append(opts, jetstream.MetaOnly())
+	}
+	watcher, err := kv.Watch(ctx, filter, opts...)
 	if err != nil {
-		return fmt.Errorf("failed to put KV value: %w", err)
+		return "", fmt.Errorf("failed to watch KV bucket: %w", err)
+	}
+	defer watcher.Stop()
+
+	positions := []KVPosition{}
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		position := KVPosition{Key: entry.Key(), Created: entry.Created()}
+		if createdAt {
+			position.Created = query.CreatedAt(entry)
+		}
+		positions = append(positions, position)
 	}
 
-	return nil
+	return PageKV(positions, query, func(position KVPosition) (bool, error) {
+		entry, err := kv.Get(ctx, position.Key)
+		if errors.Is(err, jetstream.ErrKeyNotFound) {
+			// Deleted since the keys were read
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to get KV value: %w", err)
+		}
+		return fn(entry)
+	})
 }
 
-func GetKV(ctx context.Context, bucket string, key string) (jetstream.KeyValueEntry, error) {
-	if js == nil {
-		return nil, fmt.Errorf("JetStream not initialized")
+// PageKV sorts positions in query order and passes those after the cursor to
+// fn the way QueryKV does, for stores that keep entries outside of NATS
+func PageKV(positions []KVPosition, query KVQuery, fn func(position KVPosition) (bool, error)) (string, error) {
+	order := query.Order
+	if order == "" {
+		order = OrderKey
+	}
+	if order != OrderKey && order != OrderCreated {
+		return "", fmt.Errorf("unknown KV order %q", order)
 	}
 
-	kv, err := js.KeyValue(ctx, bucket)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+	compare := func(a KVPosition, b KVPosition) int {
+		c := 0
+		if order == OrderCreated {
+			c = a.Created.Compare(b.Created)
+		}
+		if c == 0 {
+			c = strings.Compare(a.Key, b.Key)
+		}
+		if query.Descending {
+			return -c
+		}
+		return c
 	}
+	sort.SliceStable(positions, func(i, j int) bool {
+		return compare(positions[i], positions[j]) < 0
+	})
 
-	data, err := kv.Get(ctx, key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get KV value: %w", err)
+	start := 0
+	if query.Cursor != "" {
+		after, err := decodeKVCursor(query.Cursor, order, query.Descending)
+		if err != nil {
+			return "", err
+		}
+		start = sort.Search(len(positions), func(i int) bool {
+			return compare(positions[i], *after) > 0
+		})
 	}
 
-	return data, nil
+	accepted := 0
+	for i := start; i < len(positions); i++ {
+		ok, err := fn(positions[i])
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+		accepted++
+		if query.Limit > 0 && accepted == query.Limit {
+			if i+1 == len(positions) {
+				return "", nil
+			}
+			return encodeCursor(kvCursor{
+				Order:      order,
+				Descending: query.Descending,
+				Key:        positions[i].Key,
+				Created:    positions[i].Created.UnixNano(),
+			}), nil
+		}
+	}
+	return "", nil
 }
 
-func RemoveKV(ctx context.Context, bucket string, key string) error {
-	kv, err := js.KeyValue(ctx, bucket)
-	if err != nil {
-		return fmt.Errorf("failed to get KV bucket: %w", err)
+func decodeKVCursor(cursor string, order KVOrder, descending bool) (*KVPosition, error) {
+	var c kvCursor
+	if err := decodeCursor(cursor, &c); err != nil {
+		return nil, err
 	}
-
-	err = kv.Delete(ctx, key)
-	if err != nil {
-		return fmt.Errorf("failed to delete KV value: %w", err)
+	if c.Order != order || c.Descending != descending {
+		return nil, fmt.Errorf("%w: cursor of another order", ErrInvalidCursor)
 	}
+	return &KVPosition{Key: c.Key, Created: time.Unix(0, c.Created)}, nil
+}
 
-	return nil
+// StreamQuery selects a page of the messages of a stream
+type StreamQuery struct {
+	// Subject matches the subjects of the messages, all subjects if empty
+	Subject string
+	// Limit is the maximum number of messages of a page, unlimited if zero
+	Limit int
+	// Cursor is the next cursor of the previous page, empty for the first page
+	Cursor string
 }
 
-func GetKVValues[T any](ctx context.Context, bucket string, keyFilter string, transformFunc func(jetstream.KeyValueEntry, *T)) ([]*T, error) {
-	kv, err := js.KeyValue(ctx, bucket)
+// streamCursor is the sequence of the last message of a page
+type streamCursor struct {
+	Sequence uint64 `json:"s"`
+}
+
+// QueryStream passes the messages of a page of a stream to fn in sequence
+// order until fn has accepted query.Limit of them, and returns the cursor of
+// the next page like QueryKV. Messages are read one at a time.
+func QueryStream(ctx context.Context, streamName string, query StreamQuery, fn func(msg *jetstream.RawStreamMsg) (bool, error)) (string, error) {
+	stream, err := js.Stream(ctx, streamName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get KV bucket: %w", err)
+		return "", fmt.Errorf("failed to get stream: %w", err)
 	}
 
-	watcher, _ := kv.Watch(ctx, keyFilter, jetstream.IgnoreDeletes())
-	defer watcher.Stop()
+	subject := query.Subject
+	if subject == "" {
+		subject = ">"
+	}
+	seq := uint64(1)
+	if query.Cursor != "" {
+		var c streamCursor
+		if err := decodeCursor(query.Cursor, &c); err != nil {
+			return "", err
+		}
+		seq = c.Sequence + 1
+	}
 
-	result := make([]*T, 0)
+	accepted := 0
+	last := uint64(0)
+	for {
+		msg, err := stream.GetMsg(ctx, seq, jetstream.WithGetMsgSubject(subject))
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get stream message %d: %w", seq, err)
+		}
+		if query.Limit > 0 && accepted == query.Limit {
+			// Another message follows the page
+			return encodeCursor(streamCursor{Sequence: last}), nil
+		}
 
-	for entry := range watcher.Updates() {
-		if entry == nil {
-			break
+		ok, err := fn(msg)
+		if err != nil {
+			return "", err
 		}
-		var t T
-		if err := json.Unmarshal(entry.Value(), &t); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal KV value: %w", err)
+		if ok {
+			accepted++
+			last = msg.Sequence
 		}
-		transformFunc(entry, &t)
-		result = append(result, &t)
+		seq = msg.Sequence + 1
 	}
-	return result, nil
 }
 
-func PutObject(ctx context.Context, bucket string, key string, value []byte) (*jetstream.ObjectInfo, error) {
+// encodeCursor returns a cursor as an opaque string
+func encodeCursor(cursor any) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return ErrInvalidCursor
+	}
+	return nil
+}
+
+// PutObject stores value under key in an object store. contentType is kept
+// in the Content-Type header of the object.
+func PutObject(ctx context.Context, bucket string, key string, contentType string, value []byte) (*jetstream.ObjectInfo, error) {
 	os, err := js.ObjectStore(ctx, bucket)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get object store: %w", err)
 	}
-	return os.PutBytes(ctx, key, value)
 
+	meta := jetstream.ObjectMeta{Name: key, Headers: nats.Header{}}
+	meta.Headers.Set("Content-Type", contentType)
+	return os.Put(ctx, meta, bytes.NewReader(value))
 }
 
 func GetObject(ctx context.Context, bucket string, key string) (jetstream.ObjectResult, error) {
@@ -234,6 +1052,107 @@ func PublishStream(ctx context.Context, msg *nats.Msg, opts ...jetstream.Publish
 	return js.PublishMsg(ctx, msg, opts...)
 }
 
+// Publish sends data to the subscribers of a subject without storing it
+func Publish(subject string, data []byte) error {
+	return NC.Publish(subject, data)
+}
+
+// PublishStreamDedup publishes data to a stream subject. Messages with the
+// same ID within the stream's duplicate window are only stored once.
+func PublishStreamDedup(ctx context.Context, subject string, data []byte, msgID string) (*jetstream.PubAck, error) {
+	return js.Publish(ctx, subject, data, jetstream.WithMsgID(msgID))
+}
+
+// AppendMaxBackoff is the longest wait between two attempts of AppendStream
+var AppendMaxBackoff = time.Second
+
+// appendLocks serializes the appends of this process to each stream, so that
+// an append can only lose a race to another replica
+var (
+	appendLocksMu sync.Mutex
+	appendLocks   = map[string]chan struct{}{}
+)
+
+// lockAppend waits until no other append of this process to the stream runs,
+// or until ctx is done. The returned function releases the stream.
+func lockAppend(ctx context.Context, streamName string) (func(), error) {
+	appendLocksMu.Lock()
+	lock, ok := appendLocks[streamName]
+	if !ok {
+		lock = make(chan struct{}, 1)
+		appendLocks[streamName] = lock
+	}
+	appendLocksMu.Unlock()
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AppendStream publishes the message built from the last message of a
+// stream, only if no message was stored in between. last is nil for an empty
+// stream and seq is the sequence the message will be stored at. It is used to
+// chain the messages of a stream.
+//
+// Appends of this process are serialized and a conflict with another process
+// is retried with a jittered backoff until ctx is done, so ctx should have a
+// deadline.
+func AppendStream(ctx context.Context, streamName string, build func(last *jetstream.RawStreamMsg, seq uint64) (*nats.Msg, error)) (*jetstream.PubAck, error) {
+	stream, err := js.Stream(ctx, streamName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream: %w", err)
+	}
+
+	unlock, err := lockAppend(ctx, streamName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	backoff := 10 * time.Millisecond
+	for {
+		ack, err := appendStreamOnce(ctx, stream, build)
+		if !IsConflict(err) {
+			return ack, err
+		}
+
+		// Wait between half and all of the backoff, so that the replicas
+		// that lost the same race do not meet again
+		wait := backoff/2 + rand.N(backoff/2+1)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", ctx.Err(), err)
+		}
+		backoff = min(2*backoff, AppendMaxBackoff)
+	}
+}
+
+// appendStreamOnce makes one attempt of AppendStream
+func appendStreamOnce(ctx context.Context, stream jetstream.Stream, build func(last *jetstream.RawStreamMsg, seq uint64) (*nats.Msg, error)) (*jetstream.PubAck, error) {
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream info: %w", err)
+	}
+
+	var last *jetstream.RawStreamMsg
+	if lastSeq := info.State.LastSeq; lastSeq > 0 {
+		last, err = stream.GetMsg(ctx, lastSeq)
+		if err != nil && !errors.Is(err, jetstream.ErrMsgNotFound) {
+			return nil, fmt.Errorf("failed to get stream message %d: %w", lastSeq, err)
+		}
+	}
+
+	msg, err := build(last, info.State.LastSeq+1)
+	if err != nil {
+		return nil, err
+	}
+	return js.PublishMsg(ctx, msg, jetstream.WithExpectLastSequence(info.State.LastSeq))
+}
+
 func GetStreamMsg(ctx context.Context, streamName string, subjectFilter string) (*jetstream.Msg, error) {
 	randomness, err := utils.GenerateRandomString(5)
 	if err != nil {
@@ -295,6 +1214,35 @@ func LookupStream[T any](ctx context.Context, streamName string, subjectFilters
 	return result, nil
 }
 
+// ConsumeStream creates or updates a durable consumer on a stream and passes
+// its messages to handler until the returned context is stopped
+func ConsumeStream(ctx context.Context, streamName string, config jetstream.ConsumerConfig, handler jetstream.MessageHandler) (jetstream.ConsumeContext, error) {
+	consumer, err := js.CreateOrUpdateConsumer(ctx, streamName, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer %s: %w", config.Durable, err)
+	}
+
+	return consumer.Consume(handler)
+}
+
+// DeadLetter moves a message that cannot be processed to the dead-letter
+// subject of its stream, recording why, and stops its redelivery
+func DeadLetter(ctx context.Context, msg jetstream.Msg, reason error) error {
+	deadLetter := nats.NewMsg(DeadLetterSubject(msg.Subject()))
+	deadLetter.Data = msg.Data()
+	deadLetter.Header.Set("Dead-Letter-Reason", reason.Error())
+	if meta, err := msg.Metadata(); err == nil {
+		deadLetter.Header.Set("Dead-Letter-Delivered", strconv.FormatUint(meta.NumDelivered, 10))
+		deadLetter.Header.Set("Dead-Letter-Sequence", strconv.FormatUint(meta.Sequence.Stream, 10))
+	}
+
+	if _, err := js.PublishMsg(ctx, deadLetter); err != nil {
+		return fmt.Errorf("failed to publish dead letter: %w", err)
+	}
+
+	return msg.Term()
+}
+
 func DeleteStreamMsg(ctx context.Context, streamName string, seq uint64) error {
 	stream, err := js.Stream(ctx, streamName)
 	if err != nil {
@@ -371,6 +1319,136 @@ func GenerateUserJWT(userPublicKey, accountPublicKey string, accountSigningKey n
 	return
 }
 
+// Topics a client may subscribe to under its user subject. Only topics
+// something publishes to are listed.
+const (
+	UserNotificationsTopic = "notifications"
+)
+
+const (
+	// WebhooksStream is the work queue of received webhooks
+	WebhooksStream = "webhooks"
+	// WebhooksDLQStream keeps the webhooks that failed processing too many times
+	WebhooksDLQStream = "webhooksDLQ"
+	// EventsStream keeps the domain events consumed by internal services
+	EventsStream = "events"
+	// AuditStream keeps the audit log of mutating requests
+	AuditStream = "audit"
+)
+
+// MediaObjectStore keeps uploaded images and their thumbnails
+const MediaObjectStore = "media"
+
+// WebhookSubject returns the subject on which webhooks of a kind from a source are queued
+func WebhookSubject(source string, kind string) string {
+	return fmt.Sprintf("webhooks.%s.%s", source, kind)
+}
+
+// EventSubject returns the subject on which domain events of a type are published
+func EventSubject(eventType string) string {
+	return "events." + eventType
+}
+
+// AuditSubject returns the subject on which audit events of an actor are
+// published, under the merchant they concern or "platform"
+func AuditSubject(merchant string, actor string) string {
+	if merchant == "" {
+		merchant = "platform"
+	}
+	if actor == "" {
+		actor = "anonymous"
+	}
+	return fmt.Sprintf("audit.%s.%s", subjectToken(merchant), subjectToken(actor))
+}
+
+// AuditSubjectFilter returns the subject filter of the audit events of a
+// merchant and actor, matching any merchant or actor if it is empty
+func AuditSubjectFilter(merchant string, actor string) string {
+	merchantToken, actorToken := "*", "*"
+	if merchant != "" {
+		merchantToken = subjectToken(merchant)
+	}
+	if actor != "" {
+		actorToken = subjectToken(actor)
+	}
+	return fmt.Sprintf("audit.%s.%s", merchantToken, actorToken)
+}
+
+// subjectToken replaces the characters that cannot appear in a subject token
+func subjectToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// DeadLetterSubject returns the subject a queued message is moved to when it cannot be processed
+func DeadLetterSubject(subject string) string {
+	return "dlq." + subject
+}
+
+// ClientCredsLifetime is how long client credentials stay valid
+const ClientCredsLifetime = 15 * time.Minute
+
+// UserSubject returns the subject on which events of a topic are published for a user
+func UserSubject(userID string, topic string) string {
+	return fmt.Sprintf("users.%s.%s", userID, topic)
+}
+
+// ClientSubjects lists the subjects a client of the user may subscribe to
+func ClientSubjects(userID string) []string {
+	return []string{
+		UserSubject(userID, UserNotificationsTopic),
+	}
+}
+
+// GenerateClientCreds creates an nkey for a device of a user and returns
+// creds that may only subscribe to the user's own subjects
+func GenerateClientCreds(userID string, device string) (creds []byte, expires time.Time, err error) {
+	userPublicKey, userSeed := GenerateUserKey()
+	if userPublicKey == "" {
+		return nil, time.Time{}, fmt.Errorf("failed to generate user key")
+	}
+
+	accountSigningKey, err := nkeys.ParseDecoratedNKey([]byte(accSeed))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse account signing key: %w", err)
+	}
+
+	expires = time.Now().Add(ClientCredsLifetime)
+
+	uc := jwt.NewUserClaims(userPublicKey)
+	uc.Name = device
+	uc.Tags.Add("user:" + userID)
+	uc.Pub.Deny.Add(">")
+	for _, subject := range ClientSubjects(userID) {
+		uc.Sub.Allow.Add(subject)
+		uc.Sub.Allow.Add(subject + ".>")
+	}
+	uc.Expires = expires.Unix()
+	uc.IssuerAccount = accountPublicKey
+	vr := jwt.ValidationResults{}
+	uc.Validate(&vr)
+	if vr.IsBlocking(true) {
+		return nil, time.Time{}, fmt.Errorf("generated user claim is invalid")
+	}
+
+	userJWT, err := uc.Encode(accountSigningKey)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to encode user JWT: %w", err)
+	}
+
+	creds, err = jwt.FormatUserConfig(userJWT, userSeed)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to format user config: %w", err)
+	}
+
+	return creds, expires, nil
+}
+
 // CreateKVBuckets creates all necessary KV buckets for testing
 func CreateKVBuckets() error {
 	js, err := jetstream.New(NC)
@@ -378,7 +1456,7 @@ func CreateKVBuckets() error {
 		return err
 	}
 
-	buckets := []string{"apikeys", "phoneVerification", "token", "users"}
+	buckets := []string{"accountDeletions", "accountIndex", "apikeys", "botMessages", "collectibleExpiries", "collectibleImages", "contractIndex", "emailIndex", "phoneVerification", "jwtKeys", "jwtLeader", "media", "merchantIndex", "messageDeliveries", "messageTemplates", "movedUsers", "notificationDigests", "notifications", "passkeys", "phoneChanges", "phoneIndex", "rateLimits", "reachability", "requestNonces", "schemaMigrations", "token", "tombstones", "userTokens", "users", "webauthnSessions"}
 	for _, bucket := range buckets {
 		_, err := js.CreateOrUpdateKeyValue(context.Background(), jetstream.KeyValueConfig{
 			Bucket: bucket,
@@ -398,7 +1476,7 @@ func CleanupKVBuckets() error {
 		return err
 	}
 
-	buckets := []string{"apikeys", "phoneVerification", "token", "users"}
+	buckets := []string{"accountDeletions", "accountIndex", "apikeys", "botMessages", "collectibleExpiries", "collectibleImages", "contractIndex", "emailIndex", "phoneVerification", "jwtKeys", "jwtLeader", "media", "merchantIndex", "messageDeliveries", "messageTemplates", "movedUsers", "notificationDigests", "notifications", "passkeys", "phoneChanges", "phoneIndex", "rateLimits", "reachability", "requestNonces", "schemaMigrations", "token", "tombstones", "userTokens", "users", "webauthnSessions"}
 	for _, bucket := range buckets {
 		kv, err := js.KeyValue(context.Background(), bucket)
 		if err == nil {
@@ -415,6 +1493,12 @@ func CleanupKVBuckets() error {
 		}
 	}
 
+	// Delete the streams so queued messages do not leak into the next run
+	for _, stream := range []string{WebhooksStream, WebhooksDLQStream, EventsStream, AuditStream} {
+		js.DeleteStream(context.Background(), stream)
+	}
+	js.DeleteObjectStore(context.Background(), MediaObjectStore)
+
 	return nil
 }
 
@@ -428,6 +1512,9 @@ func Close() {
 func ConnectNatsTest() error {
 	var err error
 
+	accountPublicKey = os.Getenv("NATS_ACCOUNT_PUBLIC_KEY")
+	accSeed = os.Getenv("NATS_ACCOUNT_SEED")
+
 	// Connect to NATS
 	NC, err = nats.Connect("nats://127.0.0.1:4222",
 		nats.Name("InfiniRewards Test Server"),
@@ -472,6 +1559,41 @@ func createTestStreams() error {
 		return fmt.Errorf("failed to create webhooks stream: %w", err)
 	}
 
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:        WebhooksDLQStream,
+		Description: "Webhook requests that could not be processed",
+		Subjects:    []string{"dlq.webhooks.>"},
+		MaxBytes:    -1,
+		MaxAge:      time.Hour * 24 * 30,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create webhooks DLQ stream: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:        EventsStream,
+		Description: "Domain events such as points minted or collectibles redeemed",
+		Subjects:    []string{"events.>"},
+		MaxBytes:    -1,
+		MaxAge:      time.Hour * 24 * 7,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create events stream: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateStream(context.Background(), jetstream.StreamConfig{
+		Name:        AuditStream,
+		Description: "Hash chained audit log of mutating requests",
+		Subjects:    []string{"audit.>"},
+		MaxBytes:    -1,
+		MaxAge:      time.Hour * 24 * 365,
+		DenyDelete:  true,
+		DenyPurge:   true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create audit stream: %w", err)
+	}
+
 	return nil
 }
 
@@ -483,10 +1605,36 @@ func createTestBuckets() error {
 		ttl         time.Duration
 	}{
 		{"token", "JWTs", time.Hour * 24 * 90},
+		{"userTokens", "Tokens issued to each user", time.Hour * 24 * 90},
 		{"users", "Users", 0},
 		{"merchants", "Merchants", 0},
 		{"apikeys", "API keys", 0},
 		{"phoneVerification", "Phone verifications", time.Minute * 5},
+		{"rateLimits", "Rate limit counters", time.Hour * 24},
+		{"passkeys", "WebAuthn passkeys", 0},
+		{"webauthnSessions", "WebAuthn ceremony sessions", time.Minute * 5},
+		{"jwtKeys", "JWT signing keys", 0},
+		{"jwtLeader", "JWT key rotation leader lease", time.Second * 30},
+		{"phoneIndex", "Phone number to user index", 0},
+		{"phoneChanges", "Pending phone number changes", time.Minute * 5},
+		{"movedUsers", "Legacy user IDs moved to stable IDs", 0},
+		{"accountDeletions", "Progress of account deletions", 0},
+		{"tombstones", "Deleted accounts", 0},
+		{"requestNonces", "Nonces of signed requests", time.Minute * 10},
+		{"botMessages", "Inbound WhatsApp messages claimed by the bot", time.Hour * 24 * 7},
+		{"messageDeliveries", "Delivery records of sent messages", time.Hour * 24},
+		{"messageTemplates", "Message templates by brand and locale", 0},
+		{"accountIndex", "Account address to user index", 0},
+		{"emailIndex", "Email to user index", 0},
+		{"merchantIndex", "Merchant account address to merchant index", 0},
+		{"contractIndex", "Points and collectible contract address to merchant index", 0},
+		{"schemaMigrations", "Schema migrations applied to each bucket", 0},
+		{"notifications", "In-app notification inbox", time.Hour * 24 * 90},
+		{"notificationDigests", "Notifications waiting to be sent in a batch", time.Hour * 24 * 7},
+		{"collectibleExpiries", "Collectibles to remind their holders about before they expire", 0},
+		{"reachability", "Whether phone numbers can be reached on a channel", time.Hour * 24 * 30},
+		{"media", "Uploaded media", 0},
+		{"collectibleImages", "Media shown for collectible tokens", 0},
 	}
 
 	for _, bucket := range buckets {
@@ -501,5 +1649,14 @@ func createTestBuckets() error {
 		}
 	}
 
+	_, err := js.CreateOrUpdateObjectStore(context.Background(), jetstream.ObjectStoreConfig{
+		Bucket:      MediaObjectStore,
+		Description: "Uploaded images and their thumbnails",
+		MaxBytes:    -1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create media object store: %w", err)
+	}
+
 	return nil
 }
@@ -0,0 +1,363 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// eventsConsumer is the durable consumer shared by all replicas, so each
+// event is notified once
+const eventsConsumer = "notifications"
+
+var (
+	// BatchWindow is how long notifications are collected before they are
+	// sent together in one message
+	BatchWindow = 2 * time.Minute
+	// FlushInterval is how often waiting notifications are checked
+	FlushInterval = 30 * time.Second
+	// ExpiryNotice is how long before a collectible expires its holder is reminded
+	ExpiryNotice = 24 * time.Hour
+	// MaxDeliver is how many times an event is tried before it is dropped
+	MaxDeliver uint64 = 5
+	// RetryDelay is how long a failed event waits before it is redelivered
+	RetryDelay = 30 * time.Second
+	// ProcessTimeout bounds the time spent on one event
+	ProcessTimeout = 30 * time.Second
+)
+
+var (
+	mu         sync.Mutex
+	consumeCtx jetstream.ConsumeContext
+	stopFlush  chan struct{}
+	flushDone  chan struct{}
+)
+
+// Start consumes domain events and sends waiting notifications until Stop is called
+func Start() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if consumeCtx != nil {
+		return nil
+	}
+
+	cc, err := nats.ConsumeStream(context.Background(), nats.EventsStream, jetstream.ConsumerConfig{
+		Durable:       eventsConsumer,
+		Description:   "Notifies users of reward events",
+		FilterSubject: nats.EventSubject(">"),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       ProcessTimeout + 5*time.Second,
+	}, processEvent)
+	if err != nil {
+		return fmt.Errorf("failed to consume events: %w", err)
+	}
+	consumeCtx = cc
+
+	stopFlush = make(chan struct{})
+	flushDone = make(chan struct{})
+	go flushLoop(stopFlush, flushDone)
+
+	logs.Logger.Info("notification service started",
+		slog.String("handler", "notifications"),
+	)
+	return nil
+}
+
+// Stop stops consuming events and sending notifications
+func Stop() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if consumeCtx == nil {
+		return
+	}
+	consumeCtx.Stop()
+	consumeCtx = nil
+
+	close(stopFlush)
+	<-flushDone
+}
+
+func processEvent(msg jetstream.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), ProcessTimeout)
+	defer cancel()
+
+	var event models.Event
+	if err := json.Unmarshal(msg.Data(), &event); err != nil {
+		logs.Logger.Error("dropping malformed event",
+			slog.String("handler", "notifications"),
+			slog.String("subject", msg.Subject()),
+			slog.String("error", err.Error()),
+		)
+		msg.Term()
+		return
+	}
+
+	if err := handleEvent(ctx, &event); err != nil {
+		meta, metaErr := msg.Metadata()
+		if metaErr == nil && meta.NumDelivered >= MaxDeliver {
+			logs.Logger.Error("dropping event after too many attempts",
+				slog.String("handler", "notifications"),
+				slog.String("event_id", event.ID),
+				slog.String("error", err.Error()),
+			)
+			msg.Term()
+			return
+		}
+
+		logs.Logger.Warn("failed to notify event, retrying",
+			slog.String("handler", "notifications"),
+			slog.String("event_id", event.ID),
+			slog.String("error", err.Error()),
+		)
+		msg.NakWithDelay(RetryDelay)
+		return
+	}
+
+	msg.Ack()
+}
+
+// handleEvent adds the notification of an event to the inbox of the
+// account's owner and queues it to be sent by message
+func handleEvent(ctx context.Context, event *models.Event) error {
+	if event.Type == models.EventCollectibleMinted && event.ExpiresAt != nil {
+		expiry := models.CollectibleExpiry{
+			Account:   event.Account,
+			Contract:  event.Contract,
+			TokenID:   event.TokenID,
+			ExpiresAt: *event.ExpiresAt,
+		}
+		if err := expiry.PutCollectibleExpiry(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Accounts that are not ours have no one to notify
+	userID, err := models.LookupAccountAddress(ctx, event.Account)
+	if err != nil {
+		if nats.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	user := &models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		return fmt.Errorf("failed to get user %s: %w", userID, err)
+	}
+
+	message, err := models.NewTemplateMessage(ctx, user.PhoneNumber, models.NotificationTemplateName(event.Type), "", []string{user.Locale}, templateData(event))
+	if err != nil {
+		return err
+	}
+
+	notification := models.Notification{
+		ID:        models.NotificationID(event.ID),
+		UserID:    user.ID,
+		Type:      event.Type,
+		Body:      message.Body,
+		Event:     *event,
+		CreatedAt: time.Now(),
+	}
+	err = notification.CreateNotification(ctx)
+	switch {
+	case errors.Is(err, models.ErrNotificationExists):
+		// The event was redelivered, possibly because it could not be
+		// queued to be sent by message the last time
+		existing, err := models.GetNotification(ctx, user.ID, notification.ID)
+		if err != nil {
+			if errors.Is(err, models.ErrNotificationNotFound) {
+				return nil
+			}
+			return err
+		}
+		if existing.Queued {
+			return nil
+		}
+		notification = *existing
+	case err != nil:
+		return err
+	default:
+		// Clients connected to NATS see new notifications without polling
+		if data, err := json.Marshal(notification); err == nil {
+			if err := nats.Publish(nats.UserSubject(user.ID, nats.UserNotificationsTopic), data); err != nil {
+				logs.Logger.Warn("failed to publish notification",
+					slog.String("handler", "notifications"),
+					slog.String("user_id", user.ID),
+					slog.String("error", err.Error()),
+				)
+			}
+		}
+	}
+
+	preferences := user.NotificationPreferences
+	if preferences.Channel == "" || preferences.Mutes(event.Type) {
+		return nil
+	}
+
+	if err := models.AddToNotificationDigest(ctx, user.ID, notification.ID, notification.Body); err != nil {
+		return err
+	}
+	if err := notification.MarkNotificationQueued(ctx); err != nil && !errors.Is(err, models.ErrNotificationNotFound) {
+		return err
+	}
+	return nil
+}
+
+func templateData(event *models.Event) utils.TemplateData {
+	data := utils.TemplateData{
+		Amount:   event.Amount,
+		Contract: event.Contract,
+		TokenID:  event.TokenID,
+	}
+	if event.ExpiresAt != nil {
+		data.ExpiresAt = event.ExpiresAt.Format(time.DateOnly)
+	}
+	return data
+}
+
+func flushLoop(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), FlushInterval)
+			FlushDigests(ctx, time.Now())
+			RemindExpiringCollectibles(ctx, time.Now())
+			cancel()
+		}
+	}
+}
+
+// FlushDigests sends the notifications that have waited for BatchWindow,
+// unless the user is in quiet hours
+func FlushDigests(ctx context.Context, now time.Time) {
+	digests, err := models.ListNotificationDigests(ctx)
+	if err != nil {
+		logs.Logger.Error("failed to list notification digests",
+			slog.String("handler", "notifications"),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	for _, digest := range digests {
+		if now.Sub(digest.FirstAt) < BatchWindow {
+			continue
+		}
+		if err := sendDigest(ctx, digest, now); err != nil {
+			logs.Logger.Error("failed to send notification digest",
+				slog.String("handler", "notifications"),
+				slog.String("user_id", digest.UserID),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
+
+func sendDigest(ctx context.Context, digest *models.NotificationDigest, now time.Time) error {
+	user := &models.User{}
+	if err := user.GetUser(ctx, digest.UserID); err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	preferences := user.NotificationPreferences
+	if preferences.InQuietHours(now) {
+		return nil
+	}
+
+	// Another replica may be sending the digest, or a notification was just added
+	if err := digest.ClaimNotificationDigest(ctx); err != nil {
+		if nats.IsConflict(err) {
+			return nil
+		}
+		return err
+	}
+
+	// The user may have turned messages off while the notifications waited
+	if preferences.Channel == "" {
+		return nil
+	}
+
+	var message utils.Message
+	if len(digest.Bodies) == 1 {
+		message = utils.Message{To: user.PhoneNumber, Body: digest.Bodies[0]}
+	} else {
+		var err error
+		message, err = models.NewTemplateMessage(ctx, user.PhoneNumber, models.TemplateNotificationDigest, "", []string{user.Locale}, utils.TemplateData{
+			Count: len(digest.Bodies),
+			Items: digest.Bodies,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	message.Reference = "notifications." + user.ID
+	message.Channel = preferences.Channel
+
+	_, err := models.SendMessage(ctx, message)
+	return err
+}
+
+// RemindExpiringCollectibles publishes an expiring event for the collectibles
+// that expire within ExpiryNotice
+func RemindExpiringCollectibles(ctx context.Context, now time.Time) {
+	expiries, err := models.ListCollectibleExpiries(ctx)
+	if err != nil {
+		logs.Logger.Error("failed to list collectible expiries",
+			slog.String("handler", "notifications"),
+			slog.String("error", err.Error()),
+		)
+		return
+	}
+
+	for _, expiry := range expiries {
+		if expiry.ExpiresAt.Sub(now) > ExpiryNotice {
+			continue
+		}
+
+		if expiry.ExpiresAt.After(now) {
+			key, _ := expiry.Key()
+			expiresAt := expiry.ExpiresAt
+			err := models.PublishEvent(ctx, &models.Event{
+				ID:        "expiring." + key,
+				Type:      models.EventCollectibleExpiring,
+				Account:   expiry.Account,
+				Contract:  expiry.Contract,
+				TokenID:   expiry.TokenID,
+				ExpiresAt: &expiresAt,
+			})
+			if err != nil {
+				logs.Logger.Error("failed to publish expiring collectible",
+					slog.String("handler", "notifications"),
+					slog.String("error", err.Error()),
+				)
+				continue
+			}
+		}
+
+		if err := expiry.RemoveCollectibleExpiry(ctx); err != nil && !nats.IsConflict(err) {
+			logs.Logger.Error("failed to remove collectible expiry",
+				slog.String("handler", "notifications"),
+				slog.String("error", err.Error()),
+			)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package privacy
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/infinirewards"
+	"infinirewards/models"
+	"math/big"
+	"sync"
+)
+
+// Chain reads and moves the on-chain assets of accounts
+type Chain interface {
+	// PointsBalance returns the points of a user's account on a points contract
+	PointsBalance(ctx context.Context, user *models.User, contract string) (*big.Int, error)
+	// BurnPoints burns points of a user's account
+	BurnPoints(ctx context.Context, user *models.User, contract string, amount *big.Int) (string, error)
+	// TransferPoints transfers points from a user's account to an address
+	TransferPoints(ctx context.Context, user *models.User, contract string, to string, amount *big.Int) (string, error)
+	// CollectibleTokenIDs returns the token IDs of a collectible contract
+	CollectibleTokenIDs(ctx context.Context, contract string) ([]*big.Int, error)
+	// CollectibleBalance returns how many of a token an address holds
+	CollectibleBalance(ctx context.Context, address string, contract string, tokenID *big.Int) (*big.Int, error)
+	// RedeemCollectible burns tokens held by an address through the account
+	// of the merchant that issued them
+	RedeemCollectible(ctx context.Context, issuer *models.User, merchant *models.Merchant, contract string, holder string, tokenID *big.Int, amount *big.Int) (string, error)
+}
+
+var (
+	chainMu sync.RWMutex
+	chain   Chain = starknetChain{}
+)
+
+// SetChain replaces the chain assets are read from and moved on
+func SetChain(c Chain) {
+	chainMu.Lock()
+	defer chainMu.Unlock()
+	chain = c
+}
+
+func currentChain() Chain {
+	chainMu.RLock()
+	defer chainMu.RUnlock()
+	return chain
+}
+
+// starknetChain is the Chain of the InfiniRewards contracts on StarkNet
+type starknetChain struct{}
+
+func (starknetChain) PointsBalance(ctx context.Context, user *models.User, contract string) (*big.Int, error) {
+	account, err := infinirewards.GetAccount(user.PrivateKey, user.PublicKey, user.AccountAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account: %w", err)
+	}
+	return infinirewards.GetBalance(ctx, account, contract)
+}
+
+func (starknetChain) BurnPoints(ctx context.Context, user *models.User, contract string, amount *big.Int) (string, error) {
+	account, err := infinirewards.GetAccount(user.PrivateKey, user.PublicKey, user.AccountAddress)
+	if err != nil {
+		return "", fmt.Errorf("failed to get account: %w", err)
+	}
+	return infinirewards.BurnPoints(account, contract, amount)
+}
+
+func (starknetChain) TransferPoints(ctx context.Context, user *models.User, contract string, to string, amount *big.Int) (string, error) {
+	account, err := infinirewards.GetAccount(user.PrivateKey, user.PublicKey, user.AccountAddress)
+	if err != nil {
+		return "", fmt.Errorf("failed to get account: %w", err)
+	}
+	return infinirewards.TransferPoints(ctx, account, contract, to, amount)
+}
+
+func (starknetChain) CollectibleTokenIDs(ctx context.Context, contract string) ([]*big.Int, error) {
+	_, _, _, tokenIDs, _, _, _, _, err := infinirewards.GetDetails(ctx, contract)
+	return tokenIDs, err
+}
+
+func (starknetChain) CollectibleBalance(ctx context.Context, address string, contract string, tokenID *big.Int) (*big.Int, error) {
+	return infinirewards.BalanceOf(ctx, address, contract, tokenID)
+}
+
+func (starknetChain) RedeemCollectible(ctx context.Context, issuer *models.User, merchant *models.Merchant, contract string, holder string, tokenID *big.Int, amount *big.Int) (string, error) {
+	account, err := infinirewards.GetAccount(issuer.PrivateKey, issuer.PublicKey, merchant.Address)
+	if err != nil {
+		return "", fmt.Errorf("failed to get account: %w", err)
+	}
+	return infinirewards.Redeem(ctx, account, contract, holder, tokenID, amount)
+}
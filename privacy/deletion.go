@@ -0,0 +1,331 @@
+package privacy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/nats"
+	"log/slog"
+	"time"
+)
+
+// AssetPolicy is what is done with the on-chain assets of a deleted account
+type AssetPolicy string
+
+const (
+	// AssetPolicyBurn burns the points and redeems the collectibles of the account
+	AssetPolicyBurn AssetPolicy = "burn"
+	// AssetPolicySweep transfers the points of the account to SweepAddress
+	// and redeems its collectibles, which cannot be transferred
+	AssetPolicySweep AssetPolicy = "sweep"
+	// AssetPolicyKeep leaves the assets on the account
+	AssetPolicyKeep AssetPolicy = "keep"
+)
+
+// ParseAssetPolicy returns the asset policy named by s
+func ParseAssetPolicy(s string) (AssetPolicy, error) {
+	switch policy := AssetPolicy(s); policy {
+	case AssetPolicyBurn, AssetPolicySweep, AssetPolicyKeep:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown asset policy %q", s)
+}
+
+var (
+	// DefaultAssetPolicy is the asset policy of account deletions
+	DefaultAssetPolicy = AssetPolicyBurn
+
+	// SweepAddress receives the points of deleted accounts under AssetPolicySweep
+	SweepAddress string
+)
+
+// Steps of an account deletion, in the order they run
+const (
+	StepRevokeSessions     = "revokeSessions"
+	StepDisposeAssets      = "disposeAssets"
+	StepAnonymizeMerchant  = "anonymizeMerchant"
+	StepDeletePersonalData = "deletePersonalData"
+	StepDeleteUser         = "deleteUser"
+)
+
+// deletionLease is how long a running deletion is left alone before another
+// request may resume it
+const deletionLease = 5 * time.Minute
+
+// anonymizedMerchantName replaces the name of the merchant of a deleted user
+const anonymizedMerchantName = "Deleted merchant"
+
+// ErrDeletionInProgress is returned when the account is being deleted by
+// another request
+var ErrDeletionInProgress = models.ErrDeletionInProgress
+
+// ErrUserNotFound is returned when deleting or exporting a user that does not
+// exist and was not deleted
+var ErrUserNotFound = errors.New("user not found")
+
+// StepError is returned when a step of an account deletion failed. Deleting
+// the account again resumes at the step.
+type StepError struct {
+	Step string
+	Err  error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("account deletion failed at %s: %v", e.Step, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+type deletionStep struct {
+	name string
+	run  func(ctx context.Context, user *models.User, deletion *models.AccountDeletion, step *models.DeletionStep) error
+}
+
+var deletionSteps = []deletionStep{
+	{StepRevokeSessions, revokeSessions},
+	{StepDisposeAssets, disposeAssets},
+	{StepAnonymizeMerchant, anonymizeMerchant},
+	{StepDeletePersonalData, deletePersonalData},
+	{StepDeleteUser, deleteUser},
+}
+
+// DeleteAccount deletes a user and everything held about them. Sessions and
+// keys are revoked first, then the on-chain assets are disposed of by the
+// asset policy, the merchant is anonymized, personal data is deleted and the
+// user is removed. A tombstone records the deletion.
+//
+// Each step is saved when it completes, so a deletion that failed with a
+// StepError resumes at the failed step when it is run again. Deleting an
+// account that was already deleted returns its tombstone.
+func DeleteAccount(ctx context.Context, userID string) (*models.Tombstone, error) {
+	user := &models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		if !models.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get user: %w", err)
+		}
+		user = nil
+	}
+
+	deletion, err := models.GetAccountDeletion(ctx, userID)
+	switch {
+	case nats.IsNotFound(err) && user == nil:
+		tombstone, err := models.GetTombstone(ctx, userID)
+		if err != nil {
+			if nats.IsNotFound(err) {
+				return nil, ErrUserNotFound
+			}
+			return nil, fmt.Errorf("failed to get tombstone: %w", err)
+		}
+		return tombstone, nil
+	case nats.IsNotFound(err):
+		deletion = &models.AccountDeletion{
+			UserID:         userID,
+			AccountAddress: user.AccountAddress,
+			AssetPolicy:    string(DefaultAssetPolicy),
+			StartedAt:      time.Now(),
+		}
+		for _, step := range deletionSteps {
+			deletion.Steps = append(deletion.Steps, models.DeletionStep{Name: step.name})
+		}
+	case err != nil:
+		return nil, fmt.Errorf("failed to get account deletion: %w", err)
+	case deletion.Running && time.Since(deletion.UpdatedAt) < deletionLease:
+		return nil, ErrDeletionInProgress
+	}
+
+	// Claim the deletion, so a concurrent request fails instead of running
+	// the same steps
+	deletion.Running = true
+	if err := deletion.SaveAccountDeletion(ctx); err != nil {
+		return nil, err
+	}
+
+	for i, step := range deletionSteps {
+		record := &deletion.Steps[i]
+		if record.CompletedAt != nil {
+			continue
+		}
+
+		stepErr := runStep(ctx, step, user, deletion, record)
+		if stepErr != nil {
+			record.Error = stepErr.Error()
+			deletion.Running = false
+		} else {
+			now := time.Now()
+			record.CompletedAt = &now
+			record.Error = ""
+		}
+		if err := deletion.SaveAccountDeletion(ctx); err != nil {
+			return nil, err
+		}
+
+		if stepErr != nil {
+			logs.Logger.Error("account deletion step failed",
+				slog.String("handler", "DeleteAccount"),
+				slog.String("userId", userID),
+				slog.String("step", step.name),
+				slog.String("error", stepErr.Error()),
+			)
+			return nil, &StepError{Step: step.name, Err: stepErr}
+		}
+	}
+
+	tombstone := &models.Tombstone{
+		UserID:         deletion.UserID,
+		AccountAddress: deletion.AccountAddress,
+		AssetPolicy:    deletion.AssetPolicy,
+		Steps:          deletion.Steps,
+		DeletedAt:      time.Now(),
+	}
+	if err := tombstone.PutTombstone(ctx); err != nil {
+		return nil, err
+	}
+	if err := deletion.RemoveAccountDeletion(ctx); err != nil {
+		return nil, err
+	}
+
+	logs.Logger.Info("account deleted",
+		slog.String("handler", "DeleteAccount"),
+		slog.String("userId", userID),
+	)
+	return tombstone, nil
+}
+
+// runStep runs a step of a deletion. Only deleting the user can complete
+// without the user, as every step before it needs them.
+func runStep(ctx context.Context, step deletionStep, user *models.User, deletion *models.AccountDeletion, record *models.DeletionStep) error {
+	if user == nil && step.name != StepDeleteUser {
+		return errors.New("user was deleted before the step completed")
+	}
+	return step.run(ctx, user, deletion, record)
+}
+
+// revokeSessions deletes the refresh tokens, API keys and passkeys of the user
+func revokeSessions(ctx context.Context, user *models.User, deletion *models.AccountDeletion, step *models.DeletionStep) error {
+	tokens, err := models.RevokeUserTokens(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	apiKeys, err := models.DeleteUserAPIKeys(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	passkeys, err := models.DeleteUserPasskeys(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
+	step.Removed += tokens + apiKeys + passkeys
+	return nil
+}
+
+// disposeAssets burns or sweeps the on-chain assets of the user. Balances are
+// read again on every attempt, so assets disposed of by an attempt that
+// failed are not disposed of twice.
+func disposeAssets(ctx context.Context, user *models.User, deletion *models.AccountDeletion, step *models.DeletionStep) error {
+	policy := AssetPolicy(deletion.AssetPolicy)
+	if policy == AssetPolicyKeep {
+		return nil
+	}
+	if policy == AssetPolicySweep && SweepAddress == "" {
+		return errors.New("no sweep address configured")
+	}
+
+	holdings, err := GetHoldings(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	c := currentChain()
+	for _, points := range holdings.Points {
+		var txHash string
+		if policy == AssetPolicySweep {
+			txHash, err = c.TransferPoints(ctx, user, points.Contract, SweepAddress, points.balance)
+		} else {
+			txHash, err = c.BurnPoints(ctx, user, points.Contract, points.balance)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to dispose of points of %s: %w", points.Contract, err)
+		}
+		step.Transactions = append(step.Transactions, txHash)
+	}
+
+	for _, collectible := range holdings.Collectibles {
+		issuer := &models.User{}
+		if err := issuer.GetUser(ctx, collectible.merchant.ID); err != nil {
+			return fmt.Errorf("failed to get issuer of %s: %w", collectible.Contract, err)
+		}
+		txHash, err := c.RedeemCollectible(ctx, issuer, collectible.merchant, collectible.Contract, user.AccountAddress, collectible.tokenID, collectible.balance)
+		if err != nil {
+			return fmt.Errorf("failed to redeem %s token %s: %w", collectible.Contract, collectible.TokenID, err)
+		}
+		step.Transactions = append(step.Transactions, txHash)
+	}
+
+	return nil
+}
+
+// anonymizeMerchant removes the name of the user's merchant. The merchant
+// stays, as its contracts hold the assets of its customers.
+func anonymizeMerchant(ctx context.Context, user *models.User, deletion *models.AccountDeletion, step *models.DeletionStep) error {
+	_, err := models.ModifyMerchant(ctx, user.ID, func(merchant *models.Merchant) error {
+		merchant.Name = anonymizedMerchantName
+		return nil
+	})
+	if err != nil && !models.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// deletePersonalData deletes the notifications, reminders, delivery history
+// and uploaded avatars of the user
+func deletePersonalData(ctx context.Context, user *models.User, deletion *models.AccountDeletion, step *models.DeletionStep) error {
+	notifications, err := models.DeleteUserNotifications(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	step.Removed += notifications
+
+	avatars, err := models.DeleteUserAvatars(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	step.Removed += avatars
+
+	if user.AccountAddress != "" {
+		expiries, err := models.ListAccountCollectibleExpiries(ctx, user.AccountAddress)
+		if err != nil {
+			return err
+		}
+		for _, expiry := range expiries {
+			if err := expiry.RemoveCollectibleExpiry(ctx); err != nil && !nats.IsNotFound(err) && !nats.IsConflict(err) {
+				return err
+			}
+		}
+		step.Removed += len(expiries)
+	}
+
+	if err := models.ForgetReachability(ctx, user.PhoneNumber); err != nil {
+		return err
+	}
+	if user.LegacyID != "" {
+		if err := models.ForgetMovedUser(ctx, user.LegacyID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteUser removes the user, releasing their phone number and email
+func deleteUser(ctx context.Context, user *models.User, deletion *models.AccountDeletion, step *models.DeletionStep) error {
+	if user == nil {
+		// Removed by an attempt that was interrupted before it was saved
+		return nil
+	}
+	return user.DeleteUser(ctx)
+}
@@ -0,0 +1,137 @@
+package privacy
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/models"
+	"time"
+)
+
+// ExportFormatVersion is the version of the layout of Export
+const ExportFormatVersion = 1
+
+// Export is everything held about a user
+type Export struct {
+	// FormatVersion is the version of the layout of the export
+	FormatVersion int       `json:"formatVersion"`
+	ExportedAt    time.Time `json:"exportedAt"`
+
+	User     *models.User     `json:"user"`
+	Merchant *models.Merchant `json:"merchant,omitempty"`
+
+	// APIKeys are the API keys of the user, without their secrets
+	APIKeys []*models.APIKey `json:"apiKeys"`
+	// Sessions are the devices the user is logged in on
+	Sessions []*Session                  `json:"sessions"`
+	Passkeys []*models.PasskeyCredential `json:"passkeys"`
+
+	Notifications       []*models.Notification      `json:"notifications"`
+	NotificationDigest  *models.NotificationDigest  `json:"notificationDigest,omitempty"`
+	CollectibleExpiries []*models.CollectibleExpiry `json:"collectibleExpiries"`
+
+	// Reachability is what is known about reaching the user on each channel
+	Reachability []*models.Reachability `json:"reachability"`
+
+	// Holdings are the on-chain assets of the user's account
+	Holdings *Holdings `json:"holdings"`
+}
+
+// Session is a device a user is logged in on, without its tokens
+type Session struct {
+	Device             string    `json:"device"`
+	Service            string    `json:"service"`
+	CreatedAt          time.Time `json:"createdAt"`
+	RefreshTokenExpiry time.Time `json:"refreshTokenExpiry"`
+}
+
+// ExportAccount collects everything held about a user. Secrets, like the
+// private key and API key secrets, are left out.
+func ExportAccount(ctx context.Context, userID string) (*Export, error) {
+	user := &models.User{}
+	if err := user.GetUser(ctx, userID); err != nil {
+		if models.IsNotFound(err) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	export := &Export{
+		FormatVersion: ExportFormatVersion,
+		ExportedAt:    time.Now(),
+		Sessions:      []*Session{},
+	}
+
+	merchant := &models.Merchant{}
+	if err := merchant.GetMerchant(ctx, userID); err == nil {
+		export.Merchant = merchant
+	} else if !models.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get merchant: %w", err)
+	}
+
+	var err error
+	if export.APIKeys, err = collectPages(func(opts models.ListOptions) (*models.Page[models.APIKey], error) {
+		return models.ListAPIKeys(ctx, userID, opts)
+	}); err != nil {
+		return nil, err
+	}
+	if export.Passkeys, err = collectPages(func(opts models.ListOptions) (*models.Page[models.PasskeyCredential], error) {
+		return models.ListPasskeys(ctx, userID, opts)
+	}); err != nil {
+		return nil, err
+	}
+	if export.Notifications, err = collectPages(func(opts models.ListOptions) (*models.Page[models.Notification], error) {
+		return models.ListNotifications(ctx, userID, false, opts)
+	}); err != nil {
+		return nil, err
+	}
+
+	tokens, err := models.ListUserTokens(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		export.Sessions = append(export.Sessions, &Session{
+			Device:             token.Device,
+			Service:            token.Service,
+			CreatedAt:          token.CreatedAt,
+			RefreshTokenExpiry: token.RefreshTokenExpiry,
+		})
+	}
+
+	if export.NotificationDigest, err = models.GetNotificationDigest(ctx, userID); err != nil {
+		return nil, err
+	}
+	export.CollectibleExpiries = []*models.CollectibleExpiry{}
+	if user.AccountAddress != "" {
+		if export.CollectibleExpiries, err = models.ListAccountCollectibleExpiries(ctx, user.AccountAddress); err != nil {
+			return nil, err
+		}
+	}
+	if export.Reachability, err = models.ListReachability(ctx, user.PhoneNumber); err != nil {
+		return nil, err
+	}
+	if export.Holdings, err = GetHoldings(ctx, user); err != nil {
+		return nil, err
+	}
+
+	user.PrivateKey = ""
+	export.User = user
+	return export, nil
+}
+
+// collectPages reads every page of a list
+func collectPages[T any](list func(opts models.ListOptions) (*models.Page[T], error)) ([]*T, error) {
+	items := []*T{}
+	opts := models.ListOptions{Limit: models.MaxListLimit}
+	for {
+		page, err := list(opts)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		if page.NextCursor == "" {
+			return items, nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,133 @@
+package privacy
+
+import (
+	"context"
+	"fmt"
+	"infinirewards/models"
+	"math/big"
+)
+
+// Holdings are the on-chain assets of an account on the contracts of the
+// platform's merchants
+type Holdings struct {
+	// AccountAddress is the StarkNet account holding the assets
+	// example: 0x1234567890abcdef1234567890abcdef12345678
+	AccountAddress string `json:"accountAddress"`
+
+	Points       []*PointsHolding      `json:"points"`
+	Collectibles []*CollectibleHolding `json:"collectibles"`
+}
+
+// PointsHolding is a balance of points
+type PointsHolding struct {
+	// Contract is the address of the points contract
+	Contract string `json:"contract"`
+	// Merchant is the ID of the merchant that created the contract
+	Merchant string `json:"merchant"`
+	// Balance is the number of points held
+	// example: 100
+	Balance string `json:"balance"`
+
+	balance  *big.Int
+	merchant *models.Merchant
+}
+
+// CollectibleHolding is a balance of a collectible token
+type CollectibleHolding struct {
+	// Contract is the address of the collectible contract
+	Contract string `json:"contract"`
+	// Merchant is the ID of the merchant that created the contract
+	Merchant string `json:"merchant"`
+	// TokenID is the ID of the token
+	// example: 1
+	TokenID string `json:"tokenId"`
+	// Balance is the number of tokens held
+	// example: 1
+	Balance string `json:"balance"`
+
+	tokenID  *big.Int
+	balance  *big.Int
+	merchant *models.Merchant
+}
+
+// GetHoldings reads the non-zero balances of a user's account on every
+// contract created by a merchant
+func GetHoldings(ctx context.Context, user *models.User) (*Holdings, error) {
+	holdings := &Holdings{
+		AccountAddress: user.AccountAddress,
+		Points:         []*PointsHolding{},
+		Collectibles:   []*CollectibleHolding{},
+	}
+	if user.AccountAddress == "" {
+		return holdings, nil
+	}
+
+	c := currentChain()
+	err := eachMerchant(ctx, func(merchant *models.Merchant) error {
+		for _, contract := range merchant.PointsContracts {
+			balance, err := c.PointsBalance(ctx, user, contract)
+			if err != nil {
+				return fmt.Errorf("failed to get balance of %s: %w", contract, err)
+			}
+			if balance.Sign() > 0 {
+				holdings.Points = append(holdings.Points, &PointsHolding{
+					Contract: contract,
+					Merchant: merchant.ID,
+					Balance:  balance.String(),
+					balance:  balance,
+					merchant: merchant,
+				})
+			}
+		}
+
+		for _, contract := range merchant.CollectibleContracts {
+			tokenIDs, err := c.CollectibleTokenIDs(ctx, contract)
+			if err != nil {
+				return fmt.Errorf("failed to get tokens of %s: %w", contract, err)
+			}
+			for _, tokenID := range tokenIDs {
+				balance, err := c.CollectibleBalance(ctx, user.AccountAddress, contract, tokenID)
+				if err != nil {
+					return fmt.Errorf("failed to get balance of %s token %s: %w", contract, tokenID, err)
+				}
+				if balance.Sign() > 0 {
+					holdings.Collectibles = append(holdings.Collectibles, &CollectibleHolding{
+						Contract: contract,
+						Merchant: merchant.ID,
+						TokenID:  tokenID.String(),
+						Balance:  balance.String(),
+						tokenID:  tokenID,
+						balance:  balance,
+						merchant: merchant,
+					})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return holdings, nil
+}
+
+// eachMerchant calls fn with every merchant, page by page
+func eachMerchant(ctx context.Context, fn func(merchant *models.Merchant) error) error {
+	opts := models.ListOptions{Limit: models.MaxListLimit}
+	for {
+		page, err := models.SearchMerchants(ctx, models.MerchantFilter{}, opts)
+		if err != nil {
+			return err
+		}
+		for _, merchant := range page.Items {
+			if err := fn(merchant); err != nil {
+				return err
+			}
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		opts.Cursor = page.NextCursor
+	}
+}
@@ -0,0 +1,177 @@
+package routes
+
+import (
+	"infinirewards/controllers"
+	"net/http"
+)
+
+func SetAdminRoutes(mux *http.ServeMux) {
+	//	@Summary		List users
+	//	@Metadata	List all users, newest first
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			role	query		string	false	"Only users with the role"
+	//	@Param			name	query		string	false	"Only users whose name contains it"
+	//	@Param			limit	query		int		false	"Page size, at most 100"
+	//	@Param			cursor	query		string	false	"nextCursor of the previous page"
+	//	@Success		200		{object}	models.Page[models.User]
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Router			/admin/users [get]
+	handleAuth(mux, "GET /admin/users", controllers.AdminListUsersHandler)
+
+	//	@Summary		Get any user
+	//	@Metadata	Get the details of any user
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			id	path		string	true	"User ID"
+	//	@Success		200	{object}	models.User
+	//	@Failure		401	{string}	string	"Unauthorized"
+	//	@Failure		403	{string}	string	"Forbidden"
+	//	@Failure		404	{string}	string	"User not found"
+	//	@Failure		410	{string}	string	"User deleted"
+	//	@Router			/admin/users/{id} [get]
+	handleAuth(mux, "GET /admin/users/{id}", controllers.AdminGetUserHandler)
+
+	//	@Summary		Set user roles
+	//	@Metadata	Replace the roles of a user
+	//	@Tags			admin
+	//	@Accept			json
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			id		path		string						true	"User ID"
+	//	@Param			request	body		models.SetUserRolesRequest	true	"Roles"
+	//	@Success		200		{object}	models.User
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Failure		404		{string}	string	"User not found"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/admin/users/{id}/roles [put]
+	handleAuth(mux, "PUT /admin/users/{id}/roles", controllers.AdminSetUserRolesHandler)
+
+	//	@Summary		Change user phone number
+	//	@Metadata	Start a support-assisted phone number change for a user who lost their number
+	//	@Tags			admin
+	//	@Accept			json
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			id		path		string						true	"User ID"
+	//	@Param			request	body		models.PhoneChangeRequest	true	"New phone number"
+	//	@Success		200		{object}	models.PhoneChangeResponse
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Failure		404		{string}	string	"User not found"
+	//	@Failure		409		{string}	string	"Phone number already in use"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/admin/users/{id}/phone [post]
+	handleAuth(mux, "POST /admin/users/{id}/phone", controllers.AdminRequestPhoneChangeHandler)
+
+	//	@Summary		List merchants
+	//	@Metadata	List all merchants, newest first
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			name	query		string	false	"Only merchants whose name contains it"
+	//	@Param			limit	query		int		false	"Page size, at most 100"
+	//	@Param			cursor	query		string	false	"nextCursor of the previous page"
+	//	@Success		200		{object}	models.Page[models.Merchant]
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Router			/admin/merchants [get]
+	handleAuth(mux, "GET /admin/merchants", controllers.AdminListMerchantsHandler)
+
+	//	@Summary		Get Audit Log
+	//	@Metadata	List the audit events of all requests, oldest first
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			merchant	query		string	false	"Only events of requests made as this merchant"
+	//	@Param			actor		query		string	false	"Only events of requests sent by this user"
+	//	@Param			limit		query		int		false	"Page size, at most 100"
+	//	@Param			cursor		query		string	false	"nextCursor of the previous page"
+	//	@Success		200			{object}	models.Page[models.AuditEvent]
+	//	@Failure		400			{string}	string	"Bad Request"
+	//	@Failure		401			{string}	string	"Unauthorized"
+	//	@Failure		403			{string}	string	"Forbidden"
+	//	@Router			/admin/audit [get]
+	handleAuth(mux, "GET /admin/audit", controllers.AdminAuditHandler)
+
+	//	@Summary		Verify Audit Log
+	//	@Metadata	Check the hash chain of the audit log
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Success		200	{object}	models.AuditVerification
+	//	@Failure		401	{string}	string	"Unauthorized"
+	//	@Failure		403	{string}	string	"Forbidden"
+	//	@Router			/admin/audit/verify [get]
+	handleAuth(mux, "GET /admin/audit/verify", controllers.AdminVerifyAuditHandler)
+
+	//	@Summary		List message templates
+	//	@Metadata	List the stored message templates, optionally of one brand
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			brand	query		string	false	"Brand"
+	//	@Param			limit	query		int		false	"Page size, at most 100"
+	//	@Param			cursor	query		string	false	"nextCursor of the previous page"
+	//	@Success		200		{object}	models.Page[models.MessageTemplate]
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Router			/admin/templates [get]
+	handleAuth(mux, "GET /admin/templates", controllers.AdminListTemplatesHandler)
+
+	//	@Summary		Get message template
+	//	@Metadata	Get the stored template of a message for a brand and locale
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			brand	path		string	true	"Brand"
+	//	@Param			name	path		string	true	"Message name"
+	//	@Param			locale	path		string	true	"Locale"
+	//	@Success		200		{object}	models.MessageTemplate
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Failure		404		{string}	string	"Template not found"
+	//	@Router			/admin/templates/{brand}/{name}/{locale} [get]
+	handleAuth(mux, "GET /admin/templates/{brand}/{name}/{locale}", controllers.AdminGetTemplateHandler)
+
+	//	@Summary		Create or replace message template
+	//	@Metadata	Store the template of a message for a brand and locale
+	//	@Tags			admin
+	//	@Accept			json
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			brand	path		string								true	"Brand"
+	//	@Param			name	path		string								true	"Message name"
+	//	@Param			locale	path		string								true	"Locale"
+	//	@Param			request	body		models.PutMessageTemplateRequest	true	"Template"
+	//	@Success		200		{object}	models.MessageTemplate
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Router			/admin/templates/{brand}/{name}/{locale} [put]
+	handleAuth(mux, "PUT /admin/templates/{brand}/{name}/{locale}", controllers.AdminPutTemplateHandler)
+
+	//	@Summary		Delete message template
+	//	@Metadata	Delete the stored template of a message for a brand and locale
+	//	@Tags			admin
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			brand	path		string	true	"Brand"
+	//	@Param			name	path		string	true	"Message name"
+	//	@Param			locale	path		string	true	"Locale"
+	//	@Success		200		{object}	models.MessageResponse
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Failure		404		{string}	string	"Template not found"
+	//	@Router			/admin/templates/{brand}/{name}/{locale} [delete]
+	handleAuth(mux, "DELETE /admin/templates/{brand}/{name}/{locale}", controllers.AdminDeleteTemplateHandler)
+}
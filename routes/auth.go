@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"infinirewards/controllers"
 	"infinirewards/jwt"
-	"infinirewards/middleware"
 	"net/http"
 )
 
@@ -26,8 +25,19 @@ import (
 
 func SetAuthRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("POST /auth/request-otp", controllers.RequestOTPHandler)
+	mux.HandleFunc("GET /auth/otp/{id}/status", controllers.OTPStatusHandler)
 	mux.HandleFunc("POST /auth/authenticate", controllers.AuthenticateHandler)
-	mux.HandleFunc("POST /auth/refresh-token", middleware.AuthMiddleware(controllers.RefreshTokenHandler))
+	handleAuth(mux, "POST /auth/refresh-token", controllers.RefreshTokenHandler)
+	handleAuth(mux, "POST /auth/nats-creds", controllers.NATSCredsHandler)
+	mux.HandleFunc("POST /auth/phone-change/verify", controllers.VerifyPhoneChangeHandler)
+
+	// Passkeys
+	handleAuth(mux, "POST /auth/webauthn/register/begin", controllers.BeginPasskeyRegistrationHandler)
+	handleAuth(mux, "POST /auth/webauthn/register/finish", controllers.FinishPasskeyRegistrationHandler)
+	mux.HandleFunc("POST /auth/webauthn/login/begin", controllers.BeginPasskeyLoginHandler)
+	mux.HandleFunc("POST /auth/webauthn/login/finish", controllers.FinishPasskeyLoginHandler)
+	handleAuth(mux, "GET /auth/webauthn/credentials", controllers.ListPasskeysHandler)
+	handleAuth(mux, "DELETE /auth/webauthn/credentials/{id}", controllers.DeletePasskeyHandler)
 
 	// Add JWKS endpoint for future use
 	mux.HandleFunc("GET /.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
@@ -2,7 +2,6 @@ package routes
 
 import (
 	"infinirewards/controllers"
-	"infinirewards/middleware"
 	"net/http"
 )
 
@@ -21,7 +20,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/collectibles/{address}/balance/{tokenId} [get]
-	mux.HandleFunc("GET /collectibles/{address}/balance/{tokenId}", middleware.AuthMiddleware(controllers.GetCollectibleBalanceHandler))
+	handleAuth(mux, "GET /collectibles/{address}/balance/{tokenId}", controllers.GetCollectibleBalanceHandler)
 
 	//	@Summary		Get Collectible URI
 	//	@Metadata	Get URI for collectible token
@@ -62,7 +61,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/collectibles/{address}/token-data/{tokenId} [put]
-	mux.HandleFunc("PUT /collectibles/{address}/token-data/{tokenId}", middleware.AuthMiddleware(controllers.SetTokenDataHandler))
+	handleAuth(mux, "PUT /collectibles/{address}/token-data/{tokenId}", controllers.SetTokenDataHandler)
 
 	//	@Summary		Get Token Data
 	//	@Metadata	Get token data for collectible
@@ -88,7 +87,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		400		{string}	string	"Bad Request"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/collectibles/{address} [get]
-	mux.HandleFunc("GET /collectibles/{address}", middleware.AuthMiddleware(controllers.GetCollectibleDetailsHandler))
+	handleAuth(mux, "GET /collectibles/{address}", controllers.GetCollectibleDetailsHandler)
 
 	//	@Summary		Redeem Collectible
 	//	@Metadata	Redeem collectible tokens
@@ -102,7 +101,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/collectibles/{address}/redeem [post]
-	mux.HandleFunc("POST /collectibles/{address}/redeem", middleware.AuthMiddleware(controllers.RedeemCollectibleHandler))
+	handleAuth(mux, "POST /collectibles/{address}/redeem", controllers.RedeemCollectibleHandler)
 
 	// Points endpoints
 	//	@Summary		Mint Points
@@ -117,7 +116,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/points/mint [post]
-	mux.HandleFunc("POST /points/mint", middleware.AuthMiddleware(controllers.MintPointsHandler))
+	handleAuth(mux, "POST /points/mint", controllers.MintPointsHandler)
 
 	//	@Summary		Burn Points
 	//	@Metadata	Burn points tokens
@@ -131,7 +130,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/points/burn [post]
-	mux.HandleFunc("POST /points/burn", middleware.AuthMiddleware(controllers.BurnPointsHandler))
+	handleAuth(mux, "POST /points/burn", controllers.BurnPointsHandler)
 
 	//	@Summary		Get Points Balance
 	//	@Metadata	Get points balance
@@ -145,7 +144,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/points/{address}/balance [get]
-	mux.HandleFunc("GET /points/{address}/balance", middleware.AuthMiddleware(controllers.GetPointsBalanceHandler))
+	handleAuth(mux, "GET /points/{address}/balance", controllers.GetPointsBalanceHandler)
 
 	//	@Summary		Transfer Points
 	//	@Metadata	Transfer points between accounts
@@ -159,7 +158,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/points/transfer [post]
-	mux.HandleFunc("POST /points/transfer", middleware.AuthMiddleware(controllers.TransferPointsHandler))
+	handleAuth(mux, "POST /points/transfer", controllers.TransferPointsHandler)
 
 	// Merchant endpoints
 	//	@Summary		Get Points Contracts
@@ -172,7 +171,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401	{string}	string	"Unauthorized"
 	//	@Failure		500	{string}	string	"Internal Server Error"
 	//	@Router			/merchant/points-contracts [get]
-	mux.HandleFunc("GET /merchant/points-contracts", middleware.AuthMiddleware(controllers.GetPointsContractsHandler))
+	handleAuth(mux, "GET /merchant/points-contracts", controllers.GetPointsContractsHandler)
 
 	//	@Summary		Mint Collectible
 	//	@Metadata	Mint new collectible tokens
@@ -186,7 +185,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant/collectibles/mint [post]
-	mux.HandleFunc("POST /merchant/collectibles/mint", middleware.AuthMiddleware(controllers.MintCollectibleHandler))
+	handleAuth(mux, "POST /merchant/collectibles/mint", controllers.MintCollectibleHandler)
 
 	//	@Summary		Get Collectible Contracts
 	//	@Metadata	Get merchant's collectible contracts
@@ -198,7 +197,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401	{string}	string	"Unauthorized"
 	//	@Failure		500	{string}	string	"Internal Server Error"
 	//	@Router			/merchant/collectible-contracts [get]
-	mux.HandleFunc("GET /merchant/collectible-contracts", middleware.AuthMiddleware(controllers.GetCollectibleContractsHandler))
+	handleAuth(mux, "GET /merchant/collectible-contracts", controllers.GetCollectibleContractsHandler)
 
 	// Factory endpoints
 	//	@Summary		Create Merchant
@@ -211,7 +210,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		400		{string}	string	"Bad Request"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant [post]
-	mux.HandleFunc("POST /merchant", middleware.AuthMiddleware(controllers.CreateMerchantHandler))
+	handleAuth(mux, "POST /merchant", controllers.CreateMerchantHandler)
 
 	//	@Summary		Create Collectible
 	//	@Metadata	Create a new collectible contract
@@ -225,7 +224,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant/collectibles [post]
-	mux.HandleFunc("POST /merchant/collectibles", middleware.AuthMiddleware(controllers.CreateCollectibleHandler))
+	handleAuth(mux, "POST /merchant/collectibles", controllers.CreateCollectibleHandler)
 
 	//	@Summary		Create Points Contract
 	//	@Metadata	Create a new points contract
@@ -239,7 +238,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant/points-contracts [post]
-	mux.HandleFunc("POST /merchant/points-contracts", middleware.AuthMiddleware(controllers.CreatePointsContractHandler))
+	handleAuth(mux, "POST /merchant/points-contracts", controllers.CreatePointsContractHandler)
 
 	//	@Summary		Upgrade Points Contract
 	//	@Metadata	Upgrade a points contract
@@ -253,7 +252,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant/points/upgrade [post]
-	mux.HandleFunc("POST /merchant/points/upgrade", middleware.AuthMiddleware(controllers.UpgradePointsContractHandler))
+	handleAuth(mux, "POST /merchant/points/upgrade", controllers.UpgradePointsContractHandler)
 
 	//	@Summary		Upgrade Collectible Contract
 	//	@Metadata	Upgrade a collectible contract
@@ -267,7 +266,7 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant/collectible/upgrade [post]
-	mux.HandleFunc("POST /merchant/collectible/upgrade", middleware.AuthMiddleware(controllers.UpgradeCollectibleContractHandler))
+	handleAuth(mux, "POST /merchant/collectible/upgrade", controllers.UpgradeCollectibleContractHandler)
 
 	//	@Summary		Upgrade Merchant Contract
 	//	@Metadata	Upgrade a merchant contract
@@ -281,5 +280,5 @@ func SetInfiniRewardsRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/merchant/upgrade [post]
-	mux.HandleFunc("POST /merchant/upgrade", middleware.AuthMiddleware(controllers.UpgradeMerchantContractHandler))
+	handleAuth(mux, "POST /merchant/upgrade", controllers.UpgradeMerchantContractHandler)
 }
@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"infinirewards/controllers"
+	"net/http"
+)
+
+// SetMediaRoutes registers the endpoint that serves uploaded media. It needs
+// no token, so avatars and collectible images can be shown anywhere.
+func SetMediaRoutes(mux *http.ServeMux) {
+	//	@Summary		Get Media
+	//	@Metadata	Download an uploaded image or its thumbnail
+	//	@Tags			media
+	//	@Produce		image/jpeg
+	//	@Produce		image/png
+	//	@Param			id		path		string	true	"Media ID"
+	//	@Param			size	query		string	false	"thumbnail for the thumbnail of the image"
+	//	@Success		200		{file}		binary
+	//	@Success		304		{string}	string	"Not Modified"
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		404		{string}	string	"Media not found"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/media/{id} [get]
+	mux.HandleFunc("GET /media/{id}", controllers.GetMediaHandler)
+}
@@ -2,11 +2,43 @@ package routes
 
 import (
 	"infinirewards/controllers"
-	"infinirewards/middleware"
 	"net/http"
 )
 
 func SetMerchantRoutes(mux *http.ServeMux) {
 
-	mux.HandleFunc("GET /merchant", middleware.AuthMiddleware(controllers.GetMerchantHandler))
+	handleAuth(mux, "GET /merchant", controllers.GetMerchantHandler)
+
+	//	@Summary		Get Merchant Audit Log
+	//	@Metadata	List the audit events of requests made as the caller's merchant
+	//	@Tags			merchant
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			actor	query		string	false	"Only events of requests sent by this user"
+	//	@Param			limit	query		int		false	"Page size, at most 100"
+	//	@Param			cursor	query		string	false	"nextCursor of the previous page"
+	//	@Success		200		{object}	models.Page[models.AuditEvent]
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Router			/merchant/audit [get]
+	handleAuth(mux, "GET /merchant/audit", controllers.MerchantAuditHandler)
+
+	//	@Summary		Upload Merchant Media
+	//	@Metadata	Upload an image of the caller's merchant, such as the image of a collectible
+	//	@Tags			merchant
+	//	@Accept			multipart/form-data
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			file	formData	file	true	"JPEG, PNG or GIF image"
+	//	@Success		201		{object}	models.Media
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		403		{string}	string	"Forbidden"
+	//	@Failure		404		{string}	string	"Merchant not found"
+	//	@Failure		413		{string}	string	"Request Entity Too Large"
+	//	@Failure		415		{string}	string	"Unsupported Media Type"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/merchant/media [post]
+	handleAuth(mux, "POST /merchant/media", controllers.UploadMerchantMediaHandler)
 }
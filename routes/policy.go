@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"infinirewards/middleware"
+	"infinirewards/models"
+	"net/http"
+	"strings"
+)
+
+// policy is what a route requires on top of a valid token
+type policy struct {
+	Role       models.Role
+	Permission models.Permission
+}
+
+// routePolicies is the policy table for authenticated routes, keyed by the
+// ServeMux pattern. Routes that are not listed only require a valid token.
+var routePolicies = map[string]policy{
+	// Merchant operations
+	"GET /merchant":                                    {Permission: models.PermissionMerchantRead},
+	"GET /merchant/audit":                              {Permission: models.PermissionMerchantRead},
+	"GET /merchant/points-contracts":                   {Permission: models.PermissionMerchantRead},
+	"GET /merchant/collectible-contracts":              {Permission: models.PermissionMerchantRead},
+	"POST /merchant/collectibles":                      {Permission: models.PermissionMerchantManage},
+	"POST /merchant/points-contracts":                  {Permission: models.PermissionMerchantManage},
+	"POST /merchant/collectibles/mint":                 {Permission: models.PermissionMerchantManage},
+	"POST /merchant/media":                             {Permission: models.PermissionMerchantManage},
+	"POST /points/mint":                                {Permission: models.PermissionMerchantManage},
+	"PUT /collectibles/{address}/token-data/{tokenId}": {Permission: models.PermissionMerchantManage},
+	"POST /collectibles/{address}/redeem":              {Permission: models.PermissionMerchantManage},
+
+	// Platform operations
+	"POST /merchant":                     {Permission: models.PermissionMerchantsCreate},
+	"POST /merchant/upgrade":             {Permission: models.PermissionContractsUpgrade},
+	"POST /merchant/points/upgrade":      {Permission: models.PermissionContractsUpgrade},
+	"POST /merchant/collectible/upgrade": {Permission: models.PermissionContractsUpgrade},
+	"POST /user/upgrade":                 {Permission: models.PermissionContractsUpgrade},
+
+	// Administration
+	"GET /admin/users":             {Permission: models.PermissionUsersRead},
+	"GET /admin/users/{id}":        {Permission: models.PermissionUsersRead},
+	"GET /admin/merchants":         {Permission: models.PermissionMerchantsRead},
+	"POST /admin/users/{id}/phone": {Permission: models.PermissionUsersManage},
+	"PUT /admin/users/{id}/roles":  {Role: models.RoleAdmin, Permission: models.PermissionRolesManage},
+	"GET /admin/audit":             {Permission: models.PermissionAuditRead},
+	"GET /admin/audit/verify":      {Permission: models.PermissionAuditRead},
+
+	// Message templates
+	"GET /admin/templates":                            {Permission: models.PermissionTemplatesManage},
+	"GET /admin/templates/{brand}/{name}/{locale}":    {Permission: models.PermissionTemplatesManage},
+	"PUT /admin/templates/{brand}/{name}/{locale}":    {Permission: models.PermissionTemplatesManage},
+	"DELETE /admin/templates/{brand}/{name}/{locale}": {Permission: models.PermissionTemplatesManage},
+}
+
+// handleAuth registers an authenticated route and enforces its policy.
+// Requests to routes that change state are recorded in the audit log,
+// including those the policy rejects.
+func handleAuth(mux *http.ServeMux, pattern string, handler http.HandlerFunc) {
+	p := routePolicies[pattern]
+	if p.Permission != "" {
+		handler = middleware.RequirePermission(p.Permission, handler)
+	}
+	if p.Role != "" {
+		handler = middleware.RequireRole(p.Role, handler)
+	}
+	if method, _, _ := strings.Cut(pattern, " "); method != http.MethodGet {
+		merchantRoute := p.Permission == models.PermissionMerchantRead || p.Permission == models.PermissionMerchantManage
+		handler = middleware.Audit(pattern, merchantRoute, handler)
+	}
+	mux.HandleFunc(pattern, middleware.AuthMiddleware(handler))
+}
@@ -2,7 +2,6 @@ package routes
 
 import (
 	"infinirewards/controllers"
-	"infinirewards/middleware"
 	"net/http"
 )
 
@@ -18,12 +17,13 @@ func SetUserRoutes(mux *http.ServeMux) {
 	//	@Produce		json
 	//	@Security		BearerAuth
 	//	@Success		200	{object}	models.User
+	//	@Header			200	{string}	ETag	"Revision of the user, for If-Match"
 	//	@Failure		400	{string}	string	"Bad Request"
 	//	@Failure		401	{string}	string	"Unauthorized"
 	//	@Failure		404	{string}	string	"User not found"
 	//	@Failure		500	{string}	string	"Internal Server Error"
 	//	@Router			/user [get]
-	mux.HandleFunc("GET /user", middleware.AuthMiddleware(controllers.UserGetUserHandler))
+	handleAuth(mux, "GET /user", controllers.UserGetUserHandler)
 
 	//	@Summary		Create User
 	//	@Metadata	Create a new user
@@ -35,7 +35,7 @@ func SetUserRoutes(mux *http.ServeMux) {
 	//	@Failure		400		{string}	string	"Bad Request"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/user [post]
-	mux.HandleFunc("POST /user", middleware.AuthMiddleware(controllers.UserCreateUserHandler))
+	handleAuth(mux, "POST /user", controllers.UserCreateUserHandler)
 
 	//	@Summary		Update User
 	//	@Metadata	Update authenticated user details
@@ -43,14 +43,18 @@ func SetUserRoutes(mux *http.ServeMux) {
 	//	@Accept			json
 	//	@Produce		json
 	//	@Security		BearerAuth
-	//	@Param			request	body		models.UpdateUserRequest	true	"User Update Request"
-	//	@Success		200		{object}	models.User
-	//	@Failure		400		{string}	string	"Bad Request"
-	//	@Failure		401		{string}	string	"Unauthorized"
-	//	@Failure		404		{string}	string	"User not found"
-	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Param			request		body		models.UpdateUserRequest	true	"User Update Request"
+	//	@Param			If-Match	header		string						false	"ETag of the user the update is based on"
+	//	@Success		200			{object}	models.User
+	//	@Header			200			{string}	ETag	"Revision of the updated user"
+	//	@Failure		400			{string}	string	"Bad Request"
+	//	@Failure		401			{string}	string	"Unauthorized"
+	//	@Failure		404			{string}	string	"User not found"
+	//	@Failure		409			{string}	string	"Email already in use"
+	//	@Failure		412			{string}	string	"Precondition Failed"
+	//	@Failure		500			{string}	string	"Internal Server Error"
 	//	@Router			/user [put]
-	mux.HandleFunc("PUT /user", middleware.AuthMiddleware(controllers.UserUpdateUserHandler))
+	handleAuth(mux, "PUT /user", controllers.UserUpdateUserHandler)
 
 	//	@Summary		Delete User
 	//	@Metadata	Delete authenticated user
@@ -58,12 +62,42 @@ func SetUserRoutes(mux *http.ServeMux) {
 	//	@Accept			json
 	//	@Produce		json
 	//	@Security		BearerAuth
-	//	@Success		200	{object}	models.User
+	//	@Success		200	{object}	models.MessageResponse
 	//	@Failure		401	{string}	string	"Unauthorized"
 	//	@Failure		404	{string}	string	"User not found"
+	//	@Failure		409	{string}	string	"Deletion already in progress"
 	//	@Failure		500	{string}	string	"Internal Server Error"
 	//	@Router			/user [delete]
-	mux.HandleFunc("DELETE /user", middleware.AuthMiddleware(controllers.UserDeleteUserHandler))
+	handleAuth(mux, "DELETE /user", controllers.UserDeleteUserHandler)
+
+	//	@Summary		Export User Data
+	//	@Metadata	Download everything held about the authenticated user
+	//	@Tags			user
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Success		200	{object}	privacy.Export
+	//	@Failure		401	{string}	string	"Unauthorized"
+	//	@Failure		404	{string}	string	"User not found"
+	//	@Failure		500	{string}	string	"Internal Server Error"
+	//	@Router			/user/export [get]
+	handleAuth(mux, "GET /user/export", controllers.UserExportHandler)
+
+	//	@Summary		Upload Avatar
+	//	@Metadata	Upload an image as the authenticated user's avatar
+	//	@Tags			user
+	//	@Accept			multipart/form-data
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			file	formData	file	true	"JPEG, PNG or GIF image"
+	//	@Success		201		{object}	models.Media
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		404		{string}	string	"User not found"
+	//	@Failure		413		{string}	string	"Request Entity Too Large"
+	//	@Failure		415		{string}	string	"Unsupported Media Type"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/user/avatar [post]
+	handleAuth(mux, "POST /user/avatar", controllers.UploadAvatarHandler)
 
 	// API Key routes
 	//	@Summary		Create API Key
@@ -78,19 +112,22 @@ func SetUserRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/user/api-keys [post]
-	mux.HandleFunc("POST /user/api-keys", middleware.AuthMiddleware(controllers.UserCreateAPIKeyHandler))
+	handleAuth(mux, "POST /user/api-keys", controllers.UserCreateAPIKeyHandler)
 
 	//	@Summary		List API Keys
-	//	@Metadata	List all API keys for authenticated user
+	//	@Metadata	List the API keys of the authenticated user, oldest first
 	//	@Tags			api-keys
 	//	@Accept			json
 	//	@Produce		json
 	//	@Security		BearerAuth
-	//	@Success		200	{array}		models.APIKey
-	//	@Failure		401	{string}	string	"Unauthorized"
-	//	@Failure		500	{string}	string	"Internal Server Error"
+	//	@Param			limit	query		int		false	"Page size, at most 100"
+	//	@Param			cursor	query		string	false	"nextCursor of the previous page"
+	//	@Success		200		{object}	models.Page[models.APIKey]
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/user/api-keys [get]
-	mux.HandleFunc("GET /user/api-keys", middleware.AuthMiddleware(controllers.UserListAPIKeysHandler))
+	handleAuth(mux, "GET /user/api-keys", controllers.UserListAPIKeysHandler)
 
 	//	@Summary		Delete API Key
 	//	@Metadata	Delete an API key
@@ -104,7 +141,80 @@ func SetUserRoutes(mux *http.ServeMux) {
 	//	@Failure		401		{string}	string	"Unauthorized"
 	//	@Failure		500		{string}	string	"Internal Server Error"
 	//	@Router			/user/api-keys/{keyId} [delete]
-	mux.HandleFunc("DELETE /user/api-keys/{keyId}", middleware.AuthMiddleware(controllers.UserDeleteAPIKeyHandler))
+	handleAuth(mux, "DELETE /user/api-keys/{keyId}", controllers.UserDeleteAPIKeyHandler)
+
+	//	@Summary		Change phone number
+	//	@Metadata	Send OTPs to the current and new phone numbers to start a phone number change
+	//	@Tags			user
+	//	@Accept			json
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			request	body		models.PhoneChangeRequest	true	"New phone number"
+	//	@Success		200		{object}	models.PhoneChangeResponse
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		409		{string}	string	"Phone number already in use"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/user/phone [post]
+	handleAuth(mux, "POST /user/phone", controllers.RequestPhoneChangeHandler)
+
+	//	@Summary		List notifications
+	//	@Metadata	List the in-app notifications of the authenticated user, newest first
+	//	@Tags			notifications
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			unread	query		bool	false	"Only unread notifications"
+	//	@Param			limit	query		int		false	"Page size, at most 100"
+	//	@Param			cursor	query		string	false	"nextCursor of the previous page"
+	//	@Success		200		{object}	models.Page[models.Notification]
+	//	@Failure		400		{string}	string	"Bad Request"
+	//	@Failure		401		{string}	string	"Unauthorized"
+	//	@Failure		500		{string}	string	"Internal Server Error"
+	//	@Router			/user/notifications [get]
+	handleAuth(mux, "GET /user/notifications", controllers.ListNotificationsHandler)
+
+	//	@Summary		Mark notification read
+	//	@Metadata	Mark a notification of the authenticated user read
+	//	@Tags			notifications
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			id	path		string	true	"Notification ID"
+	//	@Success		200	{object}	models.Notification
+	//	@Failure		401	{string}	string	"Unauthorized"
+	//	@Failure		404	{string}	string	"Notification not found"
+	//	@Failure		500	{string}	string	"Internal Server Error"
+	//	@Router			/user/notifications/{id}/read [post]
+	handleAuth(mux, "POST /user/notifications/{id}/read", controllers.MarkNotificationReadHandler)
+
+	//	@Summary		Get notification preferences
+	//	@Metadata	Get how the authenticated user is notified of reward events
+	//	@Tags			notifications
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Success		200	{object}	models.NotificationPreferences
+	//	@Header			200	{string}	ETag	"Revision of the user, for If-Match"
+	//	@Failure		401	{string}	string	"Unauthorized"
+	//	@Failure		404	{string}	string	"User not found"
+	//	@Router			/user/notification-preferences [get]
+	handleAuth(mux, "GET /user/notification-preferences", controllers.GetNotificationPreferencesHandler)
+
+	//	@Summary		Update notification preferences
+	//	@Metadata	Replace how the authenticated user is notified of reward events
+	//	@Tags			notifications
+	//	@Accept			json
+	//	@Produce		json
+	//	@Security		BearerAuth
+	//	@Param			request		body		models.NotificationPreferences	true	"Notification preferences"
+	//	@Param			If-Match	header		string							false	"ETag of the user the update is based on"
+	//	@Success		200			{object}	models.NotificationPreferences
+	//	@Header			200			{string}	ETag	"Revision of the updated user"
+	//	@Failure		400			{string}	string	"Bad Request"
+	//	@Failure		401			{string}	string	"Unauthorized"
+	//	@Failure		404			{string}	string	"User not found"
+	//	@Failure		412			{string}	string	"Precondition Failed"
+	//	@Failure		500			{string}	string	"Internal Server Error"
+	//	@Router			/user/notification-preferences [put]
+	handleAuth(mux, "PUT /user/notification-preferences", controllers.UpdateNotificationPreferencesHandler)
 
 	// @Summary		Upgrade User Contract
 	// @Metadata	Upgrade a user contract
@@ -117,5 +227,5 @@ func SetUserRoutes(mux *http.ServeMux) {
 	// @Failure		401		{string}	string	"Unauthorized"
 	// @Failure		500		{string}	string	"Internal Server Error"
 	// @Router			/user/upgrade [post]
-	mux.HandleFunc("POST /user/upgrade", middleware.AuthMiddleware(controllers.UpgradeUserContractHandler))
+	handleAuth(mux, "POST /user/upgrade", controllers.UpgradeUserContractHandler)
 }
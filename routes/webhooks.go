@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"infinirewards/controllers"
+	"net/http"
+)
+
+// SetWebhookRoutes registers the endpoints called by messaging platforms.
+// They are authenticated by the platform's signature or a shared token
+// instead of a user token.
+func SetWebhookRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /webhooks/whatsapp", controllers.VerifyWhatsAppWebhookHandler)
+	mux.HandleFunc("POST /webhooks/whatsapp", controllers.ReceiveWhatsAppWebhookHandler)
+
+	// MacroKiosk delivers SMS delivery reports with either method
+	mux.HandleFunc("GET /webhooks/macrokiosk/dlr", controllers.MacroKioskDLRHandler)
+	mux.HandleFunc("POST /webhooks/macrokiosk/dlr", controllers.MacroKioskDLRHandler)
+}
@@ -2,63 +2,92 @@ package utils
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"encoding/json"
 	"fmt"
+	"infinirewards/config"
 	"io"
 	"net/http"
-	"os"
 	"strings"
-
-	"github.com/joho/godotenv"
 )
 
 var BOLD_USER string
 var BOLD_PASS string
 var BOLD_SERVID string
 
-func InitMacroKiosk() error {
-	err := godotenv.Load(".env")
+// BOLD_DLR_TOKEN authenticates the delivery reports MacroKiosk sends back
+var BOLD_DLR_TOKEN string
 
-	if err != nil {
-		return fmt.Errorf("error loading .env file: %v", err)
-	}
-
-	BOLD_USER = os.Getenv("BOLD_USER")
-	BOLD_PASS = os.Getenv("BOLD_PASS")
-	BOLD_SERVID = os.Getenv("BOLD_SERVID")
+func InitMacroKiosk(cfg config.MacroKioskConfig) error {
+	BOLD_USER = cfg.User
+	BOLD_PASS = cfg.Password
+	BOLD_SERVID = cfg.ServiceID
+	BOLD_DLR_TOKEN = cfg.DLRToken
 
 	return nil
 }
 
-func SendSMS(phoneNumber string, code string) error {
+// VerifyMacroKioskDLRToken reports whether a delivery report carries the configured token
+func VerifyMacroKioskDLRToken(token string) bool {
+	return BOLD_DLR_TOKEN != "" && hmac.Equal([]byte(token), []byte(BOLD_DLR_TOKEN))
+}
+
+// SendSMS sends a text message from sender and returns the MacroKiosk
+// message ID. The sender defaults to JomFi.
+func SendSMS(phoneNumber string, sender string, text string) (string, error) {
 	httpposturl := "https://www.etracker.cc/bulksms/send"
 
+	if sender == "" {
+		sender = "JomFi"
+	}
+
+	// The sender and text come from templates, so they are encoded rather than formatted in
+	encodedSender, err := json.Marshal(sender)
+	if err != nil {
+		return "", err
+	}
+	encodedText, err := json.Marshal(text)
+	if err != nil {
+		return "", err
+	}
+
 	var jsonData = []byte(fmt.Sprintf(`{
 		"user":%s,
     "pass":%s,
     "type": "0",
     "to":"%s",
-    "from":"JomFi",
-    "text": "JOMFI: Thanks for registering JomFi. Your OTP is %s. Valid for 15 minutes.",
+    "from":%s,
+    "text": %s,
     "servid": %s,
-    "title":"JomFi",
+    "title":%s,
     "details":"1"
-	}`, BOLD_USER, BOLD_PASS, strings.Split(phoneNumber, "+")[1], code, BOLD_SERVID))
+	}`, BOLD_USER, BOLD_PASS, strings.Split(phoneNumber, "+")[1], encodedSender, encodedText, BOLD_SERVID, encodedSender))
 	request, err := http.NewRequest("POST", httpposturl, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return err
+		return "", err
 	}
 	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
 
 	client := &http.Client{}
 	response, err := client.Do(request)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer response.Body.Close()
 
-	fmt.Println("response Status:", response.Status)
-	fmt.Println("response Headers:", response.Header)
 	body, _ := io.ReadAll(response.Body)
-	fmt.Println("response Body:", string(body))
-	return nil
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("MacroKiosk returned status %d: %s", response.StatusCode, string(body))
+	}
+
+	// The message ID is matched against delivery reports
+	var result struct {
+		MsgID  string `json:"msgid"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("failed to parse MacroKiosk response: %w", err)
+	}
+
+	return result.MsgID, nil
 }
@@ -0,0 +1,142 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// whatsAppProvider sends the code with the approved template of the message.
+// Messages without a code are sent as text or interactive messages. Numbers
+// that WhatsApp rejects as unreachable fail with ErrRecipientUnsupported.
+type whatsAppProvider struct{}
+
+func (p *whatsAppProvider) Name() string { return "whatsapp" }
+
+func (p *whatsAppProvider) Channel() string { return ChannelWhatsApp }
+
+func (p *whatsAppProvider) Send(message Message) (string, error) {
+	var id string
+	var err error
+	switch {
+	case message.Interactive != nil:
+		id, err = SendWhatsAppInteractive(message.To, *message.Interactive)
+	case message.Code == "":
+		id, err = SendWhatsAppText(message.To, message.Body)
+	default:
+		id, err = SendWhatsAppOTP(message.To, message.Code, message.WhatsAppTemplate, message.WhatsAppLanguage)
+	}
+
+	var whatsAppErr *WhatsAppError
+	if errors.As(err, &whatsAppErr) && IsWhatsAppUnreachableCode(whatsAppErr.Code) {
+		return "", fmt.Errorf("%w: %s", ErrRecipientUnsupported, err)
+	}
+	return id, err
+}
+
+// macroKioskProvider sends the message body by SMS
+type macroKioskProvider struct{}
+
+func (p *macroKioskProvider) Name() string { return "macrokiosk" }
+
+func (p *macroKioskProvider) Channel() string { return ChannelSMS }
+
+func (p *macroKioskProvider) Send(message Message) (string, error) {
+	return SendSMS(message.To, message.Sender, message.Body)
+}
+
+// discordProvider posts the message to the Discord webhook, for debug numbers
+type discordProvider struct{}
+
+func (p *discordProvider) Name() string { return "discord" }
+
+func (p *discordProvider) Channel() string { return "" }
+
+func (p *discordProvider) Send(message Message) (string, error) {
+	return "", SendDiscordMessage(message.Body)
+}
+
+// consoleProvider only logs the message, for local development
+type consoleProvider struct{}
+
+func (p *consoleProvider) Name() string { return "console" }
+
+func (p *consoleProvider) Channel() string { return "" }
+
+func (p *consoleProvider) Send(message Message) (string, error) {
+	slog.Info("Message sent to console",
+		slog.String("phone", message.To),
+		slog.String("body", message.Body),
+	)
+	return "", nil
+}
+
+// FileProvider appends messages to a file as JSON lines so tests and local
+// tools can read the codes that were sent
+type FileProvider struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (p *FileProvider) Name() string { return "file" }
+
+func (p *FileProvider) Channel() string { return "" }
+
+// FileSinkMessage is a message written by the file provider
+type FileSinkMessage struct {
+	Message
+	// ID is the provider message ID the file provider returned for the message
+	ID string `json:"id"`
+}
+
+func (p *FileProvider) Send(message Message) (string, error) {
+	id, err := GenerateRandomString(12)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate message ID: %w", err)
+	}
+
+	data, err := json.Marshal(FileSinkMessage{Message: message, ID: id})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", fmt.Errorf("failed to open message sink: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return "", fmt.Errorf("failed to write message sink: %w", err)
+	}
+
+	return id, nil
+}
+
+// ReadFileSink returns the messages written by the file provider, oldest first
+func ReadFileSink(path string) ([]FileSinkMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open message sink: %w", err)
+	}
+	defer f.Close()
+
+	messages := []FileSinkMessage{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var message FileSinkMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, scanner.Err()
+}
@@ -0,0 +1,259 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"infinirewards/config"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Message is a message delivered to a phone number
+type Message struct {
+	// To is the phone number in E.164 format
+	To string `json:"to"`
+	// Body is the full text of the message
+	Body string `json:"body"`
+	// Footer is shown below the body by channels that support it
+	Footer string `json:"footer,omitempty"`
+	// Code is the one-time code in the message, for providers that send it in a template
+	Code string `json:"code,omitempty"`
+	// Reference identifies what the message was sent for, such as a verification ID
+	Reference string `json:"reference,omitempty"`
+	// Channel restricts delivery to providers of one channel, such as ChannelSMS
+	Channel string `json:"channel,omitempty"`
+	// WhatsAppTemplate is the approved WhatsApp template the code is sent with
+	WhatsAppTemplate string `json:"whatsAppTemplate,omitempty"`
+	// WhatsAppLanguage is the language code of the WhatsApp template
+	WhatsAppLanguage string `json:"whatsAppLanguage,omitempty"`
+	// Sender is the name SMS are sent from
+	Sender string `json:"sender,omitempty"`
+	// Interactive is the list or buttons WhatsApp shows instead of the body.
+	// Other channels send the body.
+	Interactive *Interactive `json:"interactive,omitempty"`
+	// Unreachable lists the channels the recipient is known not to be on.
+	// Their providers are skipped unless the message is restricted to them.
+	Unreachable []string `json:"unreachable,omitempty"`
+}
+
+const (
+	// ChannelWhatsApp messages are delivered through WhatsApp
+	ChannelWhatsApp = "whatsapp"
+	// ChannelSMS messages are delivered by SMS
+	ChannelSMS = "sms"
+)
+
+// MessageProvider delivers messages through one channel
+type MessageProvider interface {
+	// Name is the name used for the provider in routes and delivery records
+	Name() string
+	// Channel is the channel the provider delivers through, or empty for
+	// development providers that stand in for any channel
+	Channel() string
+	// Send delivers the message and returns the provider's ID for it, if any
+	Send(message Message) (string, error)
+}
+
+// ErrRecipientUnsupported is returned by providers that cannot reach a phone
+// number, such as WhatsApp for numbers without an account. The next provider
+// of the route is tried without logging an error.
+var ErrRecipientUnsupported = errors.New("recipient not supported by provider")
+
+// DeliveryStatus is the state of a message delivery
+type DeliveryStatus string
+
+const (
+	// DeliveryStatusSent messages were accepted by a provider
+	DeliveryStatusSent DeliveryStatus = "sent"
+	// DeliveryStatusDelivered messages reached the recipient's device
+	DeliveryStatusDelivered DeliveryStatus = "delivered"
+	// DeliveryStatusRead messages were read by the recipient
+	DeliveryStatusRead DeliveryStatus = "read"
+	// DeliveryStatusFailed messages were rejected by every provider of their
+	// route or reported as undeliverable
+	DeliveryStatusFailed DeliveryStatus = "failed"
+)
+
+// DeliveryAttempt is one provider tried for a message
+type DeliveryAttempt struct {
+	Provider string `json:"provider"`
+	Channel  string `json:"channel,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Unreachable is set when the provider cannot reach the recipient at all
+	Unreachable bool `json:"unreachable,omitempty"`
+}
+
+// Delivery is the outcome of sending a message through its route
+type Delivery struct {
+	// Provider is the provider that accepted the message
+	Provider string `json:"provider,omitempty"`
+	// Channel is the channel of the provider that accepted the message
+	Channel string `json:"channel,omitempty"`
+	// ProviderMessageID is the provider's ID for the message
+	ProviderMessageID string         `json:"providerMessageId,omitempty"`
+	Status            DeliveryStatus `json:"status"`
+	// Attempts lists the providers tried in order
+	Attempts []DeliveryAttempt `json:"attempts"`
+}
+
+// defaultMessageRoutes is used when no routes are configured. The profiles of
+// local development and tests route to the console or a file instead.
+const defaultMessageRoutes = "*=whatsapp,macrokiosk"
+
+// messageRoute sends messages to phone numbers starting with Prefix through
+// Providers, falling back to the next provider when one fails
+type messageRoute struct {
+	Prefix    string
+	Providers []MessageProvider
+}
+
+var (
+	messageProviders = map[string]MessageProvider{}
+	messageRoutes    []messageRoute
+)
+
+// InitMessageProviders registers the message providers and parses the
+// routing chain. Routes are separated by semicolons and map a phone number
+// prefix, or * for every other number, to a comma separated list of
+// providers, e.g. "+60=whatsapp,macrokiosk;*=macrokiosk". The file provider
+// is available when a file sink path is set.
+func InitMessageProviders(cfg config.OTPConfig) error {
+	providers := []MessageProvider{
+		&whatsAppProvider{},
+		&macroKioskProvider{},
+		&discordProvider{},
+		&consoleProvider{},
+	}
+	if cfg.FileSinkPath != "" {
+		providers = append(providers, &FileProvider{Path: cfg.FileSinkPath})
+	}
+	discordWebhookURL = cfg.DiscordWebhookURL
+
+	messageProviders = map[string]MessageProvider{}
+	for _, provider := range providers {
+		messageProviders[provider.Name()] = provider
+	}
+
+	routing := cfg.Routes
+	if routing == "" {
+		routing = defaultMessageRoutes
+	}
+
+	routes, err := parseMessageRoutes(routing)
+	if err != nil {
+		return fmt.Errorf("invalid OTP routes: %w", err)
+	}
+	messageRoutes = routes
+
+	return nil
+}
+
+func parseMessageRoutes(config string) ([]messageRoute, error) {
+	routes := []messageRoute{}
+	for _, entry := range strings.Split(config, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		prefix, names, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("route %q must be in the format prefix=provider,...", entry)
+		}
+
+		route := messageRoute{Prefix: strings.TrimSpace(prefix)}
+		if route.Prefix == "*" {
+			route.Prefix = ""
+		}
+		for _, name := range strings.Split(names, ",") {
+			provider, ok := messageProviders[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown provider %q in route %q", name, entry)
+			}
+			route.Providers = append(route.Providers, provider)
+		}
+		routes = append(routes, route)
+	}
+
+	// The longest matching prefix wins
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].Prefix) > len(routes[j].Prefix)
+	})
+
+	return routes, nil
+}
+
+// SendMessage sends a message through the providers of the route matching
+// its phone number until one accepts it
+func SendMessage(message Message) (*Delivery, error) {
+	delivery := &Delivery{
+		Status:   DeliveryStatusFailed,
+		Attempts: []DeliveryAttempt{},
+	}
+
+	var route *messageRoute
+	for i := range messageRoutes {
+		if strings.HasPrefix(message.To, messageRoutes[i].Prefix) {
+			route = &messageRoutes[i]
+			break
+		}
+	}
+	if route == nil {
+		return delivery, fmt.Errorf("no message route for %s", message.To)
+	}
+
+	providers := route.Providers
+	if message.Channel == "" && len(message.Unreachable) > 0 {
+		reachable := []MessageProvider{}
+		for _, provider := range providers {
+			if !slices.Contains(message.Unreachable, provider.Channel()) {
+				reachable = append(reachable, provider)
+			}
+		}
+		// Numbers that are unreachable on every channel of the route are still tried
+		if len(reachable) > 0 {
+			providers = reachable
+		}
+	}
+
+	errs := []error{}
+	for _, provider := range providers {
+		if message.Channel != "" && provider.Channel() != "" && provider.Channel() != message.Channel {
+			continue
+		}
+
+		providerMessageID, err := provider.Send(message)
+		if err != nil {
+			delivery.Attempts = append(delivery.Attempts, DeliveryAttempt{
+				Provider:    provider.Name(),
+				Channel:     provider.Channel(),
+				Error:       err.Error(),
+				Unreachable: errors.Is(err, ErrRecipientUnsupported),
+			})
+			errs = append(errs, fmt.Errorf("%s: %w", provider.Name(), err))
+
+			if !errors.Is(err, ErrRecipientUnsupported) {
+				slog.Warn("Message provider failed, trying next provider",
+					slog.String("provider", provider.Name()),
+					slog.String("error", err.Error()),
+				)
+			}
+			continue
+		}
+
+		delivery.Attempts = append(delivery.Attempts, DeliveryAttempt{Provider: provider.Name(), Channel: provider.Channel()})
+		delivery.Provider = provider.Name()
+		delivery.Channel = provider.Channel()
+		delivery.ProviderMessageID = providerMessageID
+		delivery.Status = DeliveryStatusSent
+		return delivery, nil
+	}
+
+	if len(delivery.Attempts) == 0 {
+		return delivery, fmt.Errorf("no %s provider in the message route for %s", message.Channel, message.To)
+	}
+
+	return delivery, fmt.Errorf("all providers failed: %w", errors.Join(errs...))
+}
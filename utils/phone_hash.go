@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// ErrPhoneNumberPepperNotSet is returned by HashPhoneNumber before
+// InitPhoneNumberPepper succeeded
+var ErrPhoneNumberPepperNotSet = errors.New("phone number pepper is not initialized")
+
+// phoneNumberPepper keys the phone number hashes so they cannot be brute-forced
+// by anyone who does not hold the server secret
+var phoneNumberPepper []byte
+
+// InitPhoneNumberPepper loads the base64 encoded phone number pepper
+func InitPhoneNumberPepper(encoded string) error {
+	if encoded == "" {
+		return fmt.Errorf("phone number pepper is not set")
+	}
+
+	pepper, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("phone number pepper must be base64 encoded: %w", err)
+	}
+	if len(pepper) < 32 {
+		return fmt.Errorf("phone number pepper must decode to at least 32 bytes, got %d", len(pepper))
+	}
+
+	phoneNumberPepper = pepper
+	return nil
+}
+
+// HashPhoneNumber returns the HMAC-SHA256 of a phone number keyed with the server pepper
+func HashPhoneNumber(phoneNumber string) ([]byte, error) {
+	if phoneNumberPepper == nil {
+		return nil, ErrPhoneNumberPepperNotSet
+	}
+
+	mac := hmac.New(sha256.New, phoneNumberPepper)
+	mac.Write([]byte(phoneNumber))
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RequestSigningAlgorithm is the Authorization scheme of signed requests
+	RequestSigningAlgorithm = "IR1-HMAC-SHA256"
+	// RequestTimestampHeader carries the Unix time at which a request was signed
+	RequestTimestampHeader = "X-IR-Timestamp"
+	// RequestNonceHeader carries a value that is never reused with the same API key
+	RequestNonceHeader = "X-IR-Nonce"
+	// RequestSigningWindow is how far the timestamp of a signed request may be
+	// from the server time
+	RequestSigningWindow = 5 * time.Minute
+	// MaxSignedBodySize is the largest body of a signed request that is read
+	// to verify its signature, the size of the largest JSON body accepted
+	MaxSignedBodySize = 1 << 20
+)
+
+var requestNonceRegex = regexp.MustCompile(`^[A-Za-z0-9_=-]{16,128}$`)
+
+// SignedRequest holds the parts of a signed request that are covered by the signature
+type SignedRequest struct {
+	KeyID     string
+	Signature string
+	Timestamp time.Time
+	Nonce     string
+	Method    string
+	Path      string
+	Query     string
+	BodyHash  string
+}
+
+// StringToSign returns the canonical form of the request that is signed
+func (s *SignedRequest) StringToSign() string {
+	return strings.Join([]string{
+		RequestSigningAlgorithm,
+		strconv.FormatInt(s.Timestamp.Unix(), 10),
+		s.Nonce,
+		s.Method,
+		s.Path,
+		s.Query,
+		s.BodyHash,
+	}, "\n")
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the string to sign keyed with secret
+func (s *SignedRequest) Sign(secret string) string {
+	return hex.EncodeToString(s.mac(secret))
+}
+
+// Verify reports whether the request was signed with secret
+func (s *SignedRequest) Verify(secret string) bool {
+	signature, err := hex.DecodeString(s.Signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(s.mac(secret), signature)
+}
+
+func (s *SignedRequest) mac(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(s.StringToSign()))
+	return mac.Sum(nil)
+}
+
+// SignRequest signs r with an API key by setting its Authorization,
+// timestamp and nonce headers
+func SignRequest(r *http.Request, keyID string, secret string) error {
+	nonce, err := GenerateRandomString(16)
+	if err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	signed := newSignedRequest(r, time.Now(), nonce)
+	if err := signed.hashBody(r, r.Body); err != nil {
+		return err
+	}
+
+	r.Header.Set(RequestTimestampHeader, strconv.FormatInt(signed.Timestamp.Unix(), 10))
+	r.Header.Set(RequestNonceHeader, nonce)
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Signature=%s", RequestSigningAlgorithm, keyID, signed.Sign(secret)))
+	return nil
+}
+
+// IsSignedRequest reports whether r uses request signing instead of a bearer token
+func IsSignedRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), RequestSigningAlgorithm+" ")
+}
+
+// ParseSignedRequest reads the signature, timestamp and nonce of a signed
+// request. The body is not read, so that requests which are too old or name
+// an unknown key are rejected first, see HashBody.
+func ParseSignedRequest(r *http.Request) (*SignedRequest, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), RequestSigningAlgorithm+" "), ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed authorization parameter %q", param)
+		}
+		params[key] = value
+	}
+	if params["Credential"] == "" || params["Signature"] == "" {
+		return nil, fmt.Errorf("authorization must have a Credential and a Signature")
+	}
+
+	unix, err := strconv.ParseInt(r.Header.Get(RequestTimestampHeader), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s header", RequestTimestampHeader)
+	}
+
+	nonce := r.Header.Get(RequestNonceHeader)
+	if !requestNonceRegex.MatchString(nonce) {
+		return nil, fmt.Errorf("%s must be 16 to 128 URL safe characters", RequestNonceHeader)
+	}
+
+	signed := newSignedRequest(r, time.Unix(unix, 0), nonce)
+	signed.KeyID = params["Credential"]
+	signed.Signature = params["Signature"]
+
+	return signed, nil
+}
+
+// HashBody reads the body of a signed request, up to MaxSignedBodySize, to
+// hash it. The body is replaced so handlers can still read it. A larger body
+// returns an *http.MaxBytesError.
+func (s *SignedRequest) HashBody(w http.ResponseWriter, r *http.Request) error {
+	if r.Body == nil {
+		return s.hashBody(r, nil)
+	}
+	return s.hashBody(r, http.MaxBytesReader(w, r.Body, MaxSignedBodySize))
+}
+
+func (s *SignedRequest) hashBody(r *http.Request, reader io.Reader) error {
+	body := []byte{}
+	if reader != nil {
+		var err error
+		body, err = io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read body: %w", err)
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	bodyHash := sha256.Sum256(body)
+	s.BodyHash = hex.EncodeToString(bodyHash[:])
+
+	return nil
+}
+
+func newSignedRequest(r *http.Request, timestamp time.Time, nonce string) *SignedRequest {
+	return &SignedRequest{
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Method:    r.Method,
+		Path:      r.URL.EscapedPath(),
+		Query:     r.URL.Query().Encode(),
+	}
+}
@@ -0,0 +1,128 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is the data message templates are rendered with
+type TemplateData struct {
+	// Code is the one-time code of an OTP message
+	Code string
+	// URL is the link of a login message
+	URL string
+	// ValidMinutes is how long the code or link can be used
+	ValidMinutes int
+	// Amount is the number of points or collectibles of a notification
+	Amount string
+	// Contract is the points or collectible contract of a notification
+	Contract string
+	// TokenID is the collectible of a notification
+	TokenID string
+	// ExpiresAt is the date a collectible expires on
+	ExpiresAt string
+	// Count is the number of notifications in a digest
+	Count int
+	// Items are the notifications in a digest
+	Items []string
+}
+
+// sampleTemplateData is used to check that a template renders before it is stored
+var sampleTemplateData = TemplateData{
+	Code:         "123456",
+	URL:          "https://example.com/login",
+	ValidMinutes: 5,
+	Amount:       "100",
+	Contract:     "0x1234",
+	TokenID:      "1",
+	ExpiresAt:    "2025-01-01",
+	Count:        2,
+	Items:        []string{"You received 100 points.", "You received 1 collectible."},
+}
+
+// RenderTemplate renders a message template body with text/template
+func RenderTemplate(body string, data TemplateData) (string, error) {
+	tmpl, err := template.New("message").Option("missingkey=error").Parse(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// ValidateTemplate reports whether a template body parses and only uses
+// fields of TemplateData
+func ValidateTemplate(body string) error {
+	_, err := RenderTemplate(body, sampleTemplateData)
+	return err
+}
+
+var localeRegex = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// NormalizeLocale returns a BCP 47 language tag with a lower case language
+// and upper case region, e.g. "ms-MY", or an empty string if it is invalid
+func NormalizeLocale(locale string) string {
+	locale = strings.ReplaceAll(strings.TrimSpace(locale), "_", "-")
+	if !localeRegex.MatchString(locale) {
+		return ""
+	}
+
+	parts := strings.Split(locale, "-")
+	parts[0] = strings.ToLower(parts[0])
+	for i := 1; i < len(parts); i++ {
+		if len(parts[i]) == 2 {
+			parts[i] = strings.ToUpper(parts[i])
+		} else {
+			parts[i] = strings.ToLower(parts[i])
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// ParseAcceptLanguage returns the locales of an Accept-Language header in
+// order of preference. Wildcards and invalid tags are skipped.
+func ParseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+
+	tags := []weighted{}
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		locale := NormalizeLocale(tag)
+		if locale == "" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed <= 0 {
+				continue
+			}
+			q = parsed
+		}
+		tags = append(tags, weighted{locale: locale, q: q})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	locales := make([]string, len(tags))
+	for i, tag := range tags {
+		locales[i] = tag.locale
+	}
+	return locales
+}
@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"fmt"
+	"infinirewards/config"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthn is the relying party used for passkey registration and login
+var WebAuthn *webauthn.WebAuthn
+
+// InitWebAuthn configures the relying party
+func InitWebAuthn(cfg config.WebAuthnConfig) error {
+	if cfg.RPID == "" {
+		return fmt.Errorf("WebAuthn relying party ID is not set")
+	}
+
+	displayName := cfg.RPDisplayName
+	if displayName == "" {
+		displayName = "InfiniRewards"
+	}
+
+	var err error
+	WebAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: displayName,
+		RPOrigins:     cfg.RPOrigins,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure WebAuthn: %w", err)
+	}
+
+	return nil
+}
@@ -2,20 +2,26 @@ package utils
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"infinirewards/config"
 	"io"
 	"net/http"
-	"os"
 	"strings"
-
-	"github.com/joho/godotenv"
 )
 
 var token string
 var phoneId string
 
+// webhookVerifyToken is the token Meta echoes when subscribing the webhook
+var webhookVerifyToken string
+
+// appSecret signs the webhook payloads sent by Meta
+var appSecret string
+
 type SendWithTemplateRequest struct {
 	MessagingProduct string   `json:"messaging_product,omitempty"`
 	To               string   `json:"to,omitempty"`
@@ -42,6 +48,17 @@ type Template struct {
 	Components []Components     `json:"components,omitempty"`
 }
 
+type SendWithTextRequest struct {
+	MessagingProduct string `json:"messaging_product,omitempty"`
+	To               string `json:"to,omitempty"`
+	Type             string `json:"type,omitempty"`
+	Text             Text   `json:"text,omitempty"`
+}
+
+type Text struct {
+	Body string `json:"body,omitempty"`
+}
+
 type SendWithInteractiveRequest struct {
 	MessagingProduct string      `json:"messaging_product,omitempty"`
 	To               string      `json:"to,omitempty"`
@@ -104,19 +121,18 @@ type Row struct {
 	Metadata string `json:"description,omitempty"`
 }
 
-func InitWhatsApp() error {
-	err := godotenv.Load(".env")
-
-	if err != nil {
-		return fmt.Errorf("error loading .env file: %v", err)
-	}
-	phoneId = os.Getenv("WHATSAPP_PHONE_ID")
-	token = os.Getenv("WHATSAPP_TOKEN")
+func InitWhatsApp(cfg config.WhatsAppConfig) error {
+	phoneId = cfg.PhoneID
+	token = cfg.Token
+	webhookVerifyToken = cfg.WebhookVerifyToken
+	appSecret = cfg.AppSecret
 
 	return nil
 }
 
-func SendWhatsappLoginURL(to string, token string) (res map[string]interface{}, err error) {
+// SendWhatsappLoginURL sends a button that opens loginURL, with the body and
+// footer text of the brand's login template
+func SendWhatsappLoginURL(to string, loginURL string, body string, footer string) (res map[string]interface{}, err error) {
 	return sendMessage(SendWithInteractiveRequest{
 		MessagingProduct: "whatsapp",
 		To:               to,
@@ -124,19 +140,52 @@ func SendWhatsappLoginURL(to string, token string) (res map[string]interface{},
 		Interactive: Interactive{
 			Type:   "cta_url",
 			Header: InteractiveHeader{Type: "text", Text: "Login"},
-			Body:   InteractiveBody{Text: "Click the link below to access Beautifood"},
-			Footer: InteractiveFooter{Text: "Beautifood App"},
+			Body:   InteractiveBody{Text: body},
+			Footer: InteractiveFooter{Text: footer},
 			Action: InteractiveAction{
 				Name: "cta_url",
 				Parameters: CTAParameters{
 					DisplayText: "Login",
-					Url:         "https://beautifood.io",
+					Url:         loginURL,
 				},
 			},
 		},
 	})
 }
 
+// SendWhatsAppText sends a text message and returns the WhatsApp message ID.
+// It is only delivered within 24 hours of the last message of the user.
+func SendWhatsAppText(to string, body string) (string, error) {
+	res, err := sendMessage(SendWithTextRequest{
+		MessagingProduct: "whatsapp",
+		To:               to,
+		Type:             "text",
+		Text:             Text{Body: body},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return whatsAppMessageID(res), nil
+}
+
+// SendWhatsAppInteractive sends a list or button message and returns the
+// WhatsApp message ID. Like text, it is only delivered within 24 hours of
+// the last message of the user.
+func SendWhatsAppInteractive(to string, interactive Interactive) (string, error) {
+	res, err := sendMessage(SendWithInteractiveRequest{
+		MessagingProduct: "whatsapp",
+		To:               to,
+		Type:             "interactive",
+		Interactive:      interactive,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return whatsAppMessageID(res), nil
+}
+
 func sendMessage(request any) (res map[string]interface{}, err error) {
 
 	jsonRequest, err := json.Marshal(request)
@@ -188,78 +237,57 @@ func sendMessage(request any) (res map[string]interface{}, err error) {
 	return res, err
 }
 
-func parseHTTPError(body io.Reader) (err error) {
-	var errRes map[string]map[string]interface{}
-	err = json.NewDecoder(body).Decode(&errRes)
-	if err != nil {
-		return fmt.Errorf("unparsed error message")
-	}
-	msg := fmt.Sprintf("%s", errRes["error"]["message"])
-	return errors.New(msg)
+// WhatsAppError is an error returned by the WhatsApp Cloud API
+type WhatsAppError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
 }
 
-func IsWhatsAppUser(phoneNumber string) (bool, error) {
-	endpoint := fmt.Sprintf("https://graph.facebook.com/%s/%s/messages", "v20.0", phoneId)
-
-	// Create a test message request
-	request := SendWithTemplateRequest{
-		MessagingProduct: "whatsapp",
-		To:               phoneNumber,
-		Type:             "template",
-		Template: Template{
-			Name:     "hello_world", // Use a simple template that exists in your WhatsApp Business account
-			Language: TemplateLanguage{Code: "en"},
-		},
-	}
+func (e *WhatsAppError) Error() string {
+	return fmt.Sprintf("%d: %s", e.Code, e.Message)
+}
 
-	jsonRequest, err := json.Marshal(request)
-	if err != nil {
-		return false, err
+func parseHTTPError(body io.Reader) (err error) {
+	var errRes struct {
+		Error WhatsAppError `json:"error"`
 	}
-
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(jsonRequest))
+	err = json.NewDecoder(body).Decode(&errRes)
 	if err != nil {
-		return false, err
+		return fmt.Errorf("unparsed error message")
 	}
+	return &errRes.Error
+}
 
-	req.Header.Set("Authorization", "Bearer "+token)
-	req.Header.Set("Content-Type", "application/json")
+// whatsAppUnreachableCodes are the error codes WhatsApp returns, or reports
+// in status webhooks, for numbers that cannot receive WhatsApp messages
+var whatsAppUnreachableCodes = map[int]bool{
+	131026: true, // Message undeliverable, e.g. the number has no WhatsApp account
+	131030: true, // Recipient not in the allowed list of a test business number
+}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
+// IsWhatsAppUnreachableCode reports whether a WhatsApp error code means the
+// recipient cannot be reached on WhatsApp
+func IsWhatsAppUnreachableCode(code int) bool {
+	return whatsAppUnreachableCodes[code]
+}
 
-	// If status is 200, the number exists on WhatsApp
-	// If we get an error about the number not being registered, the user is not on WhatsApp
-	if resp.StatusCode == 200 {
-		return true, nil
+// SendWhatsAppOTP sends the code with an approved template and returns the
+// WhatsApp message ID. The template defaults to otp_message in English.
+func SendWhatsAppOTP(to string, code string, templateName string, language string) (string, error) {
+	if templateName == "" {
+		templateName = "otp_message"
 	}
-
-	var errRes map[string]map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&errRes); err != nil {
-		return false, err
+	if language == "" {
+		language = "en"
 	}
 
-	// Check if error is specifically about number not being registered on WhatsApp
-	if errMsg, ok := errRes["error"]["message"].(string); ok {
-		if strings.Contains(strings.ToLower(errMsg), "not a whatsapp user") {
-			return false, nil
-		}
-	}
-
-	return false, fmt.Errorf("failed to check WhatsApp status: %v", errRes["error"]["message"])
-}
-
-func SendWhatsAppOTP(to string, code string) error {
-	_, err := sendMessage(SendWithTemplateRequest{
+	res, err := sendMessage(SendWithTemplateRequest{
 		MessagingProduct: "whatsapp",
 		To:               to,
 		Type:             "template",
 		Template: Template{
-			Name:     "otp_message", // Make sure this template is approved in your WhatsApp Business account
-			Language: TemplateLanguage{Code: "en"},
+			Name:     templateName, // Make sure this template is approved in your WhatsApp Business account
+			Language: TemplateLanguage{Code: language},
 			Components: []Components{
 				{
 					Type: "body",
@@ -273,5 +301,46 @@ func SendWhatsAppOTP(to string, code string) error {
 			},
 		},
 	})
-	return err
+	if err != nil {
+		return "", err
+	}
+
+	return whatsAppMessageID(res), nil
+}
+
+// whatsAppMessageID returns the ID of the first message in a send response
+func whatsAppMessageID(res map[string]interface{}) string {
+	messages, ok := res["messages"].([]interface{})
+	if !ok || len(messages) == 0 {
+		return ""
+	}
+	message, ok := messages[0].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	id, _ := message["id"].(string)
+	return id
+}
+
+// VerifyWhatsAppWebhookToken reports whether the verify token of a webhook
+// subscription request matches the configured one
+func VerifyWhatsAppWebhookToken(verifyToken string) bool {
+	return webhookVerifyToken != "" && hmac.Equal([]byte(verifyToken), []byte(webhookVerifyToken))
+}
+
+// VerifyWhatsAppSignature reports whether the X-Hub-Signature-256 header is
+// the HMAC-SHA256 of the payload keyed with the app secret
+func VerifyWhatsAppSignature(payload []byte, signatureHeader string) bool {
+	if appSecret == "" {
+		return false
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(signatureHeader, "sha256="))
+	if err != nil || !strings.HasPrefix(signatureHeader, "sha256=") {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(appSecret))
+	mac.Write(payload)
+	return hmac.Equal(mac.Sum(nil), signature)
 }
@@ -0,0 +1,220 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"infinirewards/bot"
+	"infinirewards/logs"
+	"infinirewards/models"
+	"infinirewards/nats"
+	"infinirewards/utils"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// whatsAppConsumer is the durable consumer shared by all replicas, so each
+// webhook is processed once
+const whatsAppConsumer = "whatsapp-webhooks"
+
+var (
+	// MaxDeliver is how many times a webhook is tried before it is moved to the dead-letter queue
+	MaxDeliver uint64 = 5
+	// RetryDelay is how long a failed webhook waits before it is redelivered
+	RetryDelay = 30 * time.Second
+	// ProcessTimeout bounds the time a handler may take for one webhook
+	ProcessTimeout = 30 * time.Second
+)
+
+// WhatsAppHandler processes one change of a WhatsApp webhook
+type WhatsAppHandler func(ctx context.Context, event *models.WhatsAppWebhookEvent) error
+
+var (
+	handlersMu       sync.RWMutex
+	whatsAppHandlers = map[string]WhatsAppHandler{
+		"messages": handleWhatsAppMessages,
+	}
+	consumeCtx jetstream.ConsumeContext
+)
+
+// HandleWhatsApp registers the handler for the changes of a webhook field,
+// replacing the previous one
+func HandleWhatsApp(field string, handler WhatsAppHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+	whatsAppHandlers[field] = handler
+}
+
+// Start consumes the queued webhooks until Stop is called
+func Start() error {
+	if consumeCtx != nil {
+		return nil
+	}
+
+	cc, err := nats.ConsumeStream(context.Background(), nats.WebhooksStream, jetstream.ConsumerConfig{
+		Durable:       whatsAppConsumer,
+		Description:   "Processes WhatsApp webhooks",
+		FilterSubject: nats.WebhookSubject("whatsapp", ">"),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       ProcessTimeout + 5*time.Second,
+	}, processWhatsAppWebhook)
+	if err != nil {
+		return fmt.Errorf("failed to consume WhatsApp webhooks: %w", err)
+	}
+	consumeCtx = cc
+
+	logs.Logger.Info("webhook worker started",
+		slog.String("handler", "worker"),
+	)
+	return nil
+}
+
+// Stop stops consuming webhooks. Webhooks being processed are redelivered
+// to another replica if they are not acknowledged in time.
+func Stop() {
+	if consumeCtx == nil {
+		return
+	}
+	consumeCtx.Stop()
+	consumeCtx = nil
+}
+
+func processWhatsAppWebhook(msg jetstream.Msg) {
+	ctx, cancel := context.WithTimeout(context.Background(), ProcessTimeout)
+	defer cancel()
+
+	var event models.WhatsAppWebhookEvent
+	if err := json.Unmarshal(msg.Data(), &event); err != nil {
+		// Redelivering a malformed message cannot succeed
+		deadLetter(ctx, msg, fmt.Errorf("failed to unmarshal webhook: %w", err))
+		return
+	}
+
+	handlersMu.RLock()
+	handler, ok := whatsAppHandlers[event.Change.Field]
+	handlersMu.RUnlock()
+	if !ok {
+		logs.Logger.Warn("no handler for webhook",
+			slog.String("handler", "worker"),
+			slog.String("field", event.Change.Field),
+		)
+		msg.Ack()
+		return
+	}
+
+	if err := handler(ctx, &event); err != nil {
+		meta, metaErr := msg.Metadata()
+		if metaErr == nil && meta.NumDelivered >= MaxDeliver {
+			deadLetter(ctx, msg, err)
+			return
+		}
+
+		logs.Logger.Warn("failed to process webhook, retrying",
+			slog.String("handler", "worker"),
+			slog.String("subject", msg.Subject()),
+			slog.String("error", err.Error()),
+		)
+		msg.NakWithDelay(RetryDelay)
+		return
+	}
+
+	msg.Ack()
+}
+
+func deadLetter(ctx context.Context, msg jetstream.Msg, reason error) {
+	logs.Logger.Error("moving webhook to dead-letter queue",
+		slog.String("handler", "worker"),
+		slog.String("subject", msg.Subject()),
+		slog.String("error", reason.Error()),
+	)
+
+	if err := nats.DeadLetter(ctx, msg, reason); err != nil {
+		logs.Logger.Error("failed to dead-letter webhook",
+			slog.String("handler", "worker"),
+			slog.String("subject", msg.Subject()),
+			slog.String("error", err.Error()),
+		)
+		msg.NakWithDelay(RetryDelay)
+	}
+}
+
+// whatsAppStatuses maps WhatsApp message statuses to delivery statuses
+var whatsAppStatuses = map[string]utils.DeliveryStatus{
+	"sent":      utils.DeliveryStatusSent,
+	"delivered": utils.DeliveryStatusDelivered,
+	"read":      utils.DeliveryStatusRead,
+	"failed":    utils.DeliveryStatusFailed,
+}
+
+// handleWhatsAppMessages answers inbound messages with the bot and applies
+// delivery statuses to the records of the messages sent by this service
+func handleWhatsAppMessages(ctx context.Context, event *models.WhatsAppWebhookEvent) error {
+	for _, message := range event.Change.Value.Messages {
+		logs.Logger.Info("received WhatsApp message",
+			slog.String("handler", "worker"),
+			slog.String("message_id", message.ID),
+			slog.String("type", message.Type),
+		)
+
+		// Numbers that message the business are on WhatsApp
+		if err := models.RecordReachability(ctx, utils.ChannelWhatsApp, "+"+message.From, true); err != nil {
+			return err
+		}
+
+		if err := bot.HandleMessage(ctx, message); err != nil {
+			return fmt.Errorf("failed to answer message %s: %w", message.ID, err)
+		}
+	}
+
+	for _, status := range event.Change.Value.Statuses {
+		deliveryStatus, ok := whatsAppStatuses[status.Status]
+		if !ok {
+			continue
+		}
+
+		reason := ""
+		if len(status.Errors) > 0 {
+			reason = fmt.Sprintf("%d: %s", status.Errors[0].Code, status.Errors[0].Title)
+		}
+
+		if err := recordStatusReachability(ctx, status); err != nil {
+			return err
+		}
+
+		_, err := models.UpdateMessageDeliveryStatus(ctx, "whatsapp", status.ID, deliveryStatus, reason)
+		if errors.Is(err, models.ErrMessageDeliveryNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update status of %s: %w", status.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// recordStatusReachability learns whether the recipient of a message is on
+// WhatsApp from its status. Other failures, such as an expired conversation
+// window, say nothing about the number.
+func recordStatusReachability(ctx context.Context, status models.Status) error {
+	if status.RecipientID == "" {
+		return nil
+	}
+	phoneNumber := "+" + status.RecipientID
+
+	switch status.Status {
+	case "delivered", "read":
+		return models.RecordReachability(ctx, utils.ChannelWhatsApp, phoneNumber, true)
+	case "failed":
+		for _, statusErr := range status.Errors {
+			if utils.IsWhatsAppUnreachableCode(statusErr.Code) {
+				return models.RecordReachability(ctx, utils.ChannelWhatsApp, phoneNumber, false)
+			}
+		}
+	}
+	return nil
+}